@@ -2,42 +2,54 @@ package client
 
 import (
 	"context"
-	"time"
 
 	"github.com/thewalkers2012/grpc-example/pb"
 	"google.golang.org/grpc"
 )
 
-// AuthClient is a client to call authentication RPC
+// AuthClient is a client to call authentication RPC.
+// It is a CredentialSource that logs in with a static username and password.
 type AuthClient struct {
 	service  pb.AuthServiceClient
+	tenantID string
 	username string
 	password string
 }
 
-// NewAuthClient returns a new auth client
-func NewAuthClient(cc *grpc.ClientConn, username string, password string) *AuthClient {
+// NewAuthClient returns a new auth client for a user of the default tenant
+func NewAuthClient(cc grpc.ClientConnInterface, username string, password string) *AuthClient {
+	return NewTenantAuthClient(cc, "", username, password)
+}
+
+// NewTenantAuthClient returns a new auth client for a user of the tenant
+func NewTenantAuthClient(cc grpc.ClientConnInterface, tenantID string, username string, password string) *AuthClient {
 	service := pb.NewAuthServiceClient(cc)
 	return &AuthClient{
 		service:  service,
+		tenantID: tenantID,
 		username: username,
 		password: password,
 	}
 }
 
 // Login login user and returns the access token
-func (client *AuthClient) Login() (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (client *AuthClient) Login(ctx context.Context) (string, error) {
+	return login(ctx, client.service, client.tenantID, client.username, client.password)
+}
+
+func login(ctx context.Context, service pb.AuthServiceClient, tenantID string, username string, password string) (string, error) {
+	ctx, cancel := withTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	req := &pb.LoginRequest{
-		Username: client.username,
-		Password: client.password,
+		Username: username,
+		Password: password,
+		TenantId: tenantID,
 	}
 
-	res, err := client.service.Login(ctx, req)
+	res, err := service.Login(ctx, req)
 	if err != nil {
-		return "", err
+		return "", wrapError("login", err)
 	}
 
 	return res.AccessToken, nil
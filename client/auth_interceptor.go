@@ -3,39 +3,59 @@ package client
 import (
 	"context"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
-// AuthInterceptor is a client interceptor for authorization
+const loginMethod = "/pb.AuthService/Login"
+
+// AuthInterceptor is a client interceptor for authorization.
+// It gets a token from its credential source on the first call that needs one,
+// refreshes the token shortly before it expires and gets a new one when the server rejects it.
+//
+// It can be installed with grpc.WithUnaryInterceptor and grpc.WithStreamInterceptor,
+// or with grpc.WithPerRPCCredentials, which attaches the token but cannot retry rejected calls.
 type AuthInterceptor struct {
-	authClient  *AuthClient
-	authMethods map[string]bool
-	accessToken string
+	source        CredentialSource
+	authMethods   map[string]bool
+	refreshBefore time.Duration
+
+	// refreshMutex makes concurrent callers share a single refresh
+	refreshMutex sync.Mutex
+
+	mutex        sync.Mutex
+	accessToken  string
+	refreshAt    time.Time
+	refreshTimer *time.Timer
+	closed       bool
 }
 
-// NewAuthInterceptor returns a new auth interceptor
+// NewAuthInterceptor returns a new auth interceptor.
+// A token is attached to the methods in authMethods, or to every method but Login if authMethods is nil.
+// Tokens are refreshed refreshBefore their expiry time, or halfway through
+// their lifetime if that is shorter. No RPC is made until a token is needed.
 func NewAuthInterceptor(
-	authClient *AuthClient,
+	source CredentialSource,
 	authMethods map[string]bool,
-	refreshDuration time.Duration,
-) (*AuthInterceptor, error) {
-	interceptor := &AuthInterceptor{
-		authClient:  authClient,
-		authMethods: authMethods,
+	refreshBefore time.Duration,
+) *AuthInterceptor {
+	return &AuthInterceptor{
+		source:        source,
+		authMethods:   authMethods,
+		refreshBefore: refreshBefore,
 	}
-
-	err := interceptor.scheduleRefreshToken(refreshDuration)
-	if err != nil {
-		return nil, err
-	}
-
-	return interceptor, nil
 }
 
-// Unary returns a client interceptor to authenticate unary RPC
+// Unary returns a client interceptor to authenticate unary RPC.
+// A call rejected with Unauthenticated is retried once with a new token,
+// unless the source gave no token, since it would not give one on retry either.
 func (interceptor *AuthInterceptor) Unary() grpc.UnaryClientInterceptor {
 	return func(ctx context.Context,
 		method string,
@@ -47,15 +67,32 @@ func (interceptor *AuthInterceptor) Unary() grpc.UnaryClientInterceptor {
 	) error {
 		log.Printf("--> unary interceptor: %s", method)
 
-		if interceptor.authMethods[method] {
-			return invoker(interceptor.attachToken(ctx), method, req, reply, cc, opts...)
+		if !interceptor.needsToken(method) {
+			return invoker(ctx, method, req, reply, cc, opts...)
 		}
 
-		return invoker(ctx, method, req, reply, cc, opts...)
+		accessToken, err := interceptor.token(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = invoker(attachToken(ctx, accessToken), method, req, reply, cc, opts...)
+		if accessToken == "" || status.Code(err) != codes.Unauthenticated {
+			return err
+		}
+
+		accessToken, err = interceptor.refreshToken(ctx, accessToken)
+		if err != nil {
+			return err
+		}
+
+		return invoker(attachToken(ctx, accessToken), method, req, reply, cc, opts...)
 	}
 }
 
-// Stream returns a client interceptor to authenticate stream RPC
+// Stream returns a client interceptor to authenticate stream RPC.
+// Messages may already be sent when a stream is rejected, so the stream is not retried,
+// but the rejected token is dropped and the next call gets a new token.
 func (interceptor *AuthInterceptor) Stream() grpc.StreamClientInterceptor {
 	return func(ctx context.Context,
 		desc *grpc.StreamDesc,
@@ -66,48 +103,185 @@ func (interceptor *AuthInterceptor) Stream() grpc.StreamClientInterceptor {
 	) (grpc.ClientStream, error) {
 		log.Printf("--> stream interceptor: %s", method)
 
-		if interceptor.authMethods[method] {
-			return streamer(interceptor.attachToken(ctx), desc, cc, method, opts...)
+		if !interceptor.needsToken(method) {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+
+		accessToken, err := interceptor.token(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		stream, err := streamer(attachToken(ctx, accessToken), desc, cc, method, opts...)
+		if err != nil {
+			if accessToken != "" && status.Code(err) == codes.Unauthenticated {
+				interceptor.invalidate(accessToken)
+			}
+			return nil, err
 		}
 
-		return streamer(ctx, desc, cc, method, opts...)
+		return &authClientStream{ClientStream: stream, interceptor: interceptor, accessToken: accessToken}, nil
 	}
 }
 
-func (interceptor *AuthInterceptor) attachToken(ctx context.Context) context.Context {
-	return metadata.AppendToOutgoingContext(ctx, "authorization", interceptor.accessToken)
+// Close stops refreshing the token in the background
+func (interceptor *AuthInterceptor) Close() {
+	interceptor.mutex.Lock()
+	defer interceptor.mutex.Unlock()
+
+	interceptor.closed = true
+	if interceptor.refreshTimer != nil {
+		interceptor.refreshTimer.Stop()
+		interceptor.refreshTimer = nil
+	}
 }
 
-func (interceptor *AuthInterceptor) scheduleRefreshToken(refreshDuration time.Duration) error {
-	err := interceptor.refreshToken()
-	if err != nil {
-		return err
-	}
-
-	go func() {
-		wait := refreshDuration
-		for {
-			time.Sleep(wait)
-			err := interceptor.refreshToken()
-			if err != nil {
-				wait = time.Second
-			} else {
-				wait = refreshDuration
-			}
-		}
-	}()
+// authClientStream drops the access token when the server rejects it
+type authClientStream struct {
+	grpc.ClientStream
+	interceptor *AuthInterceptor
+	accessToken string
+}
 
-	return nil
+func (stream *authClientStream) RecvMsg(m interface{}) error {
+	err := stream.ClientStream.RecvMsg(m)
+	if status.Code(err) == codes.Unauthenticated {
+		stream.interceptor.invalidate(stream.accessToken)
+	}
+	return err
 }
 
-func (interceptor *AuthInterceptor) refreshToken() error {
-	accessToken, err := interceptor.authClient.Login()
+// GetRequestMetadata returns the access token as the authorization metadata,
+// so that the interceptor can be used as grpc.PerRPCCredentials
+func (interceptor *AuthInterceptor) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	info, ok := credentials.RequestInfoFromContext(ctx)
+	if ok && !interceptor.needsToken(info.Method) {
+		return nil, nil
+	}
+
+	accessToken, err := interceptor.token(ctx)
+	if err != nil || accessToken == "" {
+		return nil, err
+	}
+
+	return map[string]string{"authorization": accessToken}, nil
+}
+
+// RequireTransportSecurity returns false, so that tokens can be used without TLS in development
+func (interceptor *AuthInterceptor) RequireTransportSecurity() bool {
+	return false
+}
+
+func (interceptor *AuthInterceptor) needsToken(method string) bool {
+	if interceptor.authMethods == nil {
+		return method != loginMethod
+	}
+	return interceptor.authMethods[method]
+}
+
+func attachToken(ctx context.Context, accessToken string) context.Context {
+	if accessToken == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", accessToken)
+}
+
+// token returns the current access token, getting a new one if there is none or it is about to expire
+func (interceptor *AuthInterceptor) token(ctx context.Context) (string, error) {
+	interceptor.mutex.Lock()
+	accessToken := interceptor.accessToken
+	fresh := accessToken != "" && (interceptor.refreshAt.IsZero() || time.Now().Before(interceptor.refreshAt))
+	interceptor.mutex.Unlock()
+
+	if fresh {
+		return accessToken, nil
+	}
+
+	return interceptor.refreshToken(ctx, accessToken)
+}
+
+// refreshToken gets a new token from the source, unless another caller has already replaced the stale token
+func (interceptor *AuthInterceptor) refreshToken(ctx context.Context, staleToken string) (string, error) {
+	interceptor.refreshMutex.Lock()
+	defer interceptor.refreshMutex.Unlock()
+
+	interceptor.mutex.Lock()
+	current := interceptor.accessToken
+	interceptor.mutex.Unlock()
+
+	if current != "" && current != staleToken {
+		return current, nil
+	}
+
+	accessToken, err := interceptor.source.Token(ctx)
 	if err != nil {
-		return err
+		return "", err
 	}
 
+	issuedAt := time.Now()
+	refreshAt := time.Time{}
+	if expiresAt, ok := TokenExpiry(accessToken); ok {
+		margin := interceptor.refreshBefore
+		if lifetime := expiresAt.Sub(issuedAt); margin > lifetime/2 {
+			margin = lifetime / 2
+		}
+		refreshAt = expiresAt.Add(-margin)
+	}
+
+	interceptor.mutex.Lock()
+	defer interceptor.mutex.Unlock()
+
 	interceptor.accessToken = accessToken
-	log.Printf("token refresh: %s", accessToken)
+	interceptor.refreshAt = refreshAt
+	interceptor.scheduleRefresh(accessToken, refreshAt)
+	log.Printf("token refresh, next refresh at %v", refreshAt)
+
+	return accessToken, nil
+}
+
+// scheduleRefresh refreshes the token in the background at refreshAt.
+// It must be called with the mutex held.
+func (interceptor *AuthInterceptor) scheduleRefresh(accessToken string, refreshAt time.Time) {
+	if interceptor.refreshTimer != nil {
+		interceptor.refreshTimer.Stop()
+		interceptor.refreshTimer = nil
+	}
+	// a token that is already due, such as an expired static token, is only refreshed by calls
+	if interceptor.closed || refreshAt.IsZero() || !refreshAt.After(time.Now()) {
+		return
+	}
+
+	interceptor.refreshTimer = time.AfterFunc(time.Until(refreshAt), func() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+		defer cancel()
+
+		_, err := interceptor.refreshToken(ctx, accessToken)
+		if err != nil {
+			// the next call that needs the token tries again
+			log.Printf("cannot refresh token: %v", err)
+		}
+	})
+}
+
+// invalidate drops the access token if it is still the current one
+func (interceptor *AuthInterceptor) invalidate(accessToken string) {
+	interceptor.mutex.Lock()
+	defer interceptor.mutex.Unlock()
+
+	if interceptor.accessToken == accessToken {
+		interceptor.accessToken = ""
+		interceptor.refreshAt = time.Time{}
+	}
+}
+
+// TokenExpiry reads the expiry time of a JWT without verifying its signature,
+// which only the server can do
+func TokenExpiry(accessToken string) (time.Time, bool) {
+	claims := &jwt.StandardClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(accessToken, claims)
+	if err != nil || claims.ExpiresAt == 0 {
+		return time.Time{}, false
+	}
 
-	return nil
+	return time.Unix(claims.ExpiresAt, 0), true
 }
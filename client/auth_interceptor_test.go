@@ -0,0 +1,183 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/client"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const createLaptopMethod = "/pb.LaptopService/CreateLaptop"
+
+func TestAuthInterceptorConcurrentCalls(t *testing.T) {
+	t.Parallel()
+
+	listener, logins := startAuthTestServer(t, time.Minute)
+	conn, interceptor := dialWithAuth(t, listener.Addr().String(), time.Second)
+	defer interceptor.Close()
+
+	laptopClient := client.NewLaptopClient(conn)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := laptopClient.CreateLaptop(context.Background(), sample.NewLaptop())
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	require.EqualValues(t, 1, atomic.LoadInt32(logins))
+}
+
+func TestAuthInterceptorLoginIsLazy(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	// the server is down, but creating the interceptor doesn't need it
+	conn, interceptor := dialWithAuth(t, address, time.Second)
+	defer interceptor.Close()
+
+	_, err = client.NewLaptopClient(conn).CreateLaptop(context.Background(), sample.NewLaptop())
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestAuthInterceptorRetriesUnauthenticated(t *testing.T) {
+	t.Parallel()
+
+	listener, logins := startAuthTestServer(t, time.Minute)
+	conn, interceptor := dialWithAuth(t, listener.Addr().String(), time.Second)
+	defer interceptor.Close()
+
+	calls := 0
+	rejectFirstCall := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		calls++
+		if calls == 1 {
+			return status.Error(codes.Unauthenticated, "access token is invalid")
+		}
+		return cc.Invoke(ctx, method, req, reply, opts...)
+	}
+
+	req := &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()}
+	err := interceptor.Unary()(context.Background(), createLaptopMethod, req, &pb.CreateLaptopResponse{}, conn, rejectFirstCall)
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+	require.EqualValues(t, 2, atomic.LoadInt32(logins))
+
+	// the call is retried only once
+	alwaysReject := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return status.Error(codes.Unauthenticated, "access token is invalid")
+	}
+	err = interceptor.Unary()(context.Background(), createLaptopMethod, req, &pb.CreateLaptopResponse{}, conn, alwaysReject)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.EqualValues(t, 3, atomic.LoadInt32(logins))
+}
+
+func TestAuthInterceptorDoesNotRetryWithoutToken(t *testing.T) {
+	t.Parallel()
+
+	interceptor := client.NewAuthInterceptor(client.MTLSSource{}, nil, time.Second)
+	defer interceptor.Close()
+
+	calls := 0
+	reject := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		calls++
+		return status.Error(codes.Unauthenticated, "authorization token is not provided")
+	}
+
+	req := &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()}
+	err := interceptor.Unary()(context.Background(), createLaptopMethod, req, &pb.CreateLaptopResponse{}, nil, reject)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.Equal(t, 1, calls)
+}
+
+func TestAuthInterceptorRefreshesBeforeExpiry(t *testing.T) {
+	t.Parallel()
+
+	listener, logins := startAuthTestServer(t, 2*time.Second)
+	conn, interceptor := dialWithAuth(t, listener.Addr().String(), time.Second)
+
+	_, err := client.NewLaptopClient(conn).CreateLaptop(context.Background(), sample.NewLaptop())
+	require.NoError(t, err)
+	require.EqualValues(t, 1, atomic.LoadInt32(logins))
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(logins) >= 2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	interceptor.Close()
+	stopped := atomic.LoadInt32(logins)
+	time.Sleep(2 * time.Second)
+	require.Equal(t, stopped, atomic.LoadInt32(logins))
+}
+
+// startAuthTestServer starts a server that requires a token to create laptops.
+// It returns the number of logins made to the server so far.
+func startAuthTestServer(t *testing.T, tokenDuration time.Duration) (net.Listener, *int32) {
+	userStore := service.NewInMemoryUserStore()
+	user, err := service.NewUser("admin1", "secret", "admin")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(context.Background(), user))
+
+	jwtManager := service.NewJWTManager("secret", tokenDuration)
+	interceptor := service.NewAuthInterceptor(jwtManager, map[string][]string{
+		createLaptopMethod: {"admin"},
+	})
+
+	var logins int32
+	countLogins := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == "/pb.AuthService/Login" {
+			atomic.AddInt32(&logins, 1)
+		}
+		return handler(ctx, req)
+	}
+
+	grpcServer := grpc.NewServer(grpc.ChainUnaryInterceptor(countLogins, interceptor.Unary()))
+	pb.RegisterAuthServiceServer(grpcServer, service.NewAuthServer(userStore, jwtManager))
+	pb.RegisterLaptopServiceServer(grpcServer, service.NewLaptopService(service.NewInMemoryLaptopStore(), nil, nil))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	return listener, &logins
+}
+
+func dialWithAuth(t *testing.T, address string, refreshBefore time.Duration) (*grpc.ClientConn, *client.AuthInterceptor) {
+	authConn, err := grpc.Dial(address, grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { authConn.Close() })
+
+	authClient := client.NewAuthClient(authConn, "admin1", "secret")
+	interceptor := client.NewAuthInterceptor(authClient, map[string]bool{createLaptopMethod: true}, refreshBefore)
+
+	conn, err := grpc.Dial(
+		address,
+		grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(interceptor.Unary()),
+		grpc.WithStreamInterceptor(interceptor.Stream()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return conn, interceptor
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/resolver"
+)
+
+// staticScheme is the resolver scheme for a fixed, comma-separated list of server addresses
+const staticScheme = "static"
+
+// serviceConfig balances RPCs over all resolved servers in round-robin
+// and retries idempotent RPCs when a server is unavailable
+const serviceConfig = `{
+	"loadBalancingConfig": [{"round_robin": {}}],
+	"methodConfig": [{
+		"name": [
+			{"service": "pb.LaptopService", "method": "SearchLaptop"},
+			{"service": "pb.LaptopService", "method": "GetLaptop"}
+		],
+		"retryPolicy": {
+			"maxAttempts": 4,
+			"initialBackoff": "0.1s",
+			"maxBackoff": "1s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE"]
+		}
+	}]
+}`
+
+// Target returns the dial target for the server address.
+// A comma-separated list of addresses uses the static resolver,
+// and targets with a scheme such as "dns:///host:port" are returned as is.
+func Target(address string) string {
+	if strings.Contains(address, "://") || !strings.Contains(address, ",") {
+		return address
+	}
+	return staticScheme + ":///" + address
+}
+
+// Dial creates a client connection to the servers of the target
+// with round-robin load balancing, retries of idempotent RPCs
+// and safe retries of CreateLaptop
+func Dial(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithResolvers(&staticResolverBuilder{}),
+		grpc.WithDefaultServiceConfig(serviceConfig),
+		grpc.WithChainUnaryInterceptor(CreateLaptopRetryInterceptor(defaultCreateAttempts, defaultCreateBackoff)),
+	}, opts...)
+
+	return grpc.Dial(Target(target), opts...)
+}
+
+// staticResolverBuilder builds resolvers for the static scheme
+type staticResolverBuilder struct{}
+
+func (*staticResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	var addresses []resolver.Address
+	for _, address := range strings.Split(target.Endpoint, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+
+		addresses = append(addresses, resolver.Address{Addr: address, ServerName: host})
+	}
+
+	err := cc.UpdateState(resolver.State{Addresses: addresses})
+	if err != nil {
+		return nil, err
+	}
+
+	return &staticResolver{}, nil
+}
+
+func (*staticResolverBuilder) Scheme() string {
+	return staticScheme
+}
+
+// staticResolver never changes its addresses
+type staticResolver struct{}
+
+func (*staticResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (*staticResolver) Close() {}
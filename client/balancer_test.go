@@ -0,0 +1,152 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/client"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTarget(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "0.0.0.0:50051", client.Target("0.0.0.0:50051"))
+	require.Equal(t, "static:///0.0.0.0:50051,0.0.0.0:50052", client.Target("0.0.0.0:50051,0.0.0.0:50052"))
+	require.Equal(t, "dns:///localhost:50051", client.Target("dns:///localhost:50051"))
+}
+
+func TestDialBalancesAcrossServers(t *testing.T) {
+	t.Parallel()
+
+	laptopFolder := t.TempDir()
+	server1, address1 := startTestServer(t, laptopFolder)
+	_, address2 := startTestServer(t, laptopFolder)
+
+	conn, err := client.Dial(address1+","+address2, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	laptopClient := pb.NewLaptopServiceClient(conn)
+
+	laptop := sample.NewLaptop()
+	laptop.Id = ""
+	res, err := laptopClient.CreateLaptop(context.Background(), &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+	require.NotEmpty(t, res.GetId())
+	require.Empty(t, laptop.GetId())
+
+	// both servers see the laptop through the shared store
+	laptop.Id = res.GetId()
+	for i := 0; i < 4; i++ {
+		got, err := laptopClient.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: res.GetId()})
+		require.NoError(t, err)
+		require.True(t, proto.Equal(laptop, got.GetLaptop()))
+	}
+
+	// the remaining server keeps serving when the other one is down
+	server1.Stop()
+	for i := 0; i < 4; i++ {
+		_, err := laptopClient.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: res.GetId()})
+		require.NoError(t, err)
+	}
+}
+
+func TestCreateLaptopRetryInterceptor(t *testing.T) {
+	t.Parallel()
+
+	_, address := startTestServer(t, t.TempDir())
+	conn, err := grpc.Dial(address, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// a server that doesn't remember idempotency keys
+	_, otherAddress := startTestServer(t, t.TempDir(), service.WithIdempotencyStore(nil))
+	otherConn, err := grpc.Dial(otherAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer otherConn.Close()
+
+	laptopClient := pb.NewLaptopServiceClient(conn)
+	interceptor := client.CreateLaptopRetryInterceptor(3, 0)
+
+	// the first attempt is saved, but its response is lost
+	attempts := 0
+	lostResponse := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		attempts++
+		err := cc.Invoke(ctx, method, req, reply, opts...)
+		if attempts == 1 {
+			require.NoError(t, err)
+			return status.Error(codes.Unavailable, "connection lost")
+		}
+		return err
+	}
+
+	laptop := sample.NewLaptop()
+	laptop.Id = ""
+	for _, cc := range []*grpc.ClientConn{conn, otherConn} {
+		attempts = 0
+		req := &pb.CreateLaptopRequest{Laptop: laptop}
+		res := &pb.CreateLaptopResponse{}
+
+		err = interceptor(context.Background(), "/pb.LaptopService/CreateLaptop", req, res, cc, lostResponse)
+		require.NoError(t, err)
+		require.Equal(t, 2, attempts)
+		require.NotEmpty(t, res.GetId())
+
+		// the request of the caller is not changed
+		require.Empty(t, req.GetLaptop().GetId())
+
+		found, err := pb.NewLaptopServiceClient(cc).GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: res.GetId()})
+		require.NoError(t, err)
+		require.Equal(t, laptop.GetCpu().GetBrand(), found.GetLaptop().GetCpu().GetBrand())
+	}
+
+	// a different laptop with the ID of a saved laptop is still a conflict
+	saved := sample.NewLaptop()
+	_, err = laptopClient.CreateLaptop(context.Background(), &pb.CreateLaptopRequest{Laptop: saved})
+	require.NoError(t, err)
+
+	attempts = 0
+	unavailableOnce := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		attempts++
+		if attempts == 1 {
+			return status.Error(codes.Unavailable, "connection refused")
+		}
+		return cc.Invoke(ctx, method, req, reply, opts...)
+	}
+
+	other := sample.NewLaptop()
+	other.Id = saved.Id
+	err = interceptor(context.Background(), "/pb.LaptopService/CreateLaptop",
+		&pb.CreateLaptopRequest{Laptop: other}, &pb.CreateLaptopResponse{}, conn, unavailableOnce)
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	require.Equal(t, 2, attempts)
+
+	found, err := laptopClient.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: saved.GetId()})
+	require.NoError(t, err)
+	require.True(t, proto.Equal(saved, found.GetLaptop()))
+}
+
+func startTestServer(t *testing.T, laptopFolder string, options ...service.LaptopServerOption) (*grpc.Server, string) {
+	laptopStore, err := service.NewDiskLaptopStore(laptopFolder)
+	require.NoError(t, err)
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterLaptopServiceServer(grpcServer, service.NewLaptopService(laptopStore, nil, nil, options...))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	return grpcServer, listener.Addr().String()
+}
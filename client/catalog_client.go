@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/thewalkers2012/grpc-example/pb"
+	"google.golang.org/grpc"
+)
+
+// CatalogClient is a client to back up and restore the laptop catalog.
+// Archives can be large, so its calls are only bounded by the context.
+type CatalogClient struct {
+	service   pb.CatalogServiceClient
+	chunkSize int
+}
+
+// NewCatalogClient returns a new catalog client
+func NewCatalogClient(cc grpc.ClientConnInterface) *CatalogClient {
+	return &CatalogClient{
+		service:   pb.NewCatalogServiceClient(cc),
+		chunkSize: 64 << 10,
+	}
+}
+
+// ExportCatalog calls export catalog RPC and writes the catalog archive to writer
+func (catalogClient *CatalogClient) ExportCatalog(ctx context.Context, writer io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := catalogClient.service.ExportCatalog(ctx, &pb.ExportCatalogRequest{})
+	if err != nil {
+		return wrapError("export catalog", err)
+	}
+
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return wrapError("export catalog", err)
+		}
+
+		_, err = writer.Write(res.GetChunkData())
+		if err != nil {
+			return fmt.Errorf("export catalog: cannot write archive: %w", err)
+		}
+	}
+}
+
+// ImportCatalog calls import catalog RPC with the catalog archive read from reader
+func (catalogClient *CatalogClient) ImportCatalog(ctx context.Context, reader io.Reader) (*pb.ImportCatalogResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := catalogClient.service.ImportCatalog(ctx)
+	if err != nil {
+		return nil, wrapError("import catalog", err)
+	}
+
+	buffer := make([]byte, catalogClient.chunkSize)
+	for {
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			err := stream.Send(&pb.ImportCatalogRequest{ChunkData: buffer[:n]})
+			if err != nil {
+				return nil, wrapError("import catalog", sendError(stream, err))
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("import catalog: cannot read archive: %w", err)
+		}
+	}
+
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, wrapError("import catalog", err)
+	}
+
+	return res, nil
+}
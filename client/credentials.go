@@ -0,0 +1,129 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/thewalkers2012/grpc-example/pb"
+	"google.golang.org/grpc"
+)
+
+// Environment variables read by EnvSource with the default prefix
+const (
+	DefaultEnvPrefix = "LAPTOP_"
+	envTenant        = "TENANT"
+	envUsername      = "USERNAME"
+	envPassword      = "PASSWORD"
+	envAccessToken   = "ACCESS_TOKEN"
+)
+
+// CredentialSource provides the access token that authenticates a client
+type CredentialSource interface {
+	// Token returns an access token, or an empty string if no token is attached to requests,
+	// which then only reach the public RPCs of the server
+	Token(ctx context.Context) (string, error)
+}
+
+// Credentials are either a username and password to log in with, or a pre-issued access token.
+// The user is of the default tenant if the credentials have no tenant ID.
+type Credentials struct {
+	TenantID    string `json:"tenant_id"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	AccessToken string `json:"access_token"`
+}
+
+// token returns the access token, logging in if the credentials don't have one
+func (creds *Credentials) token(ctx context.Context, service pb.AuthServiceClient) (string, error) {
+	if creds.AccessToken != "" {
+		return creds.AccessToken, nil
+	}
+	if creds.Username == "" {
+		return "", fmt.Errorf("credentials have neither a username nor an access token")
+	}
+
+	return login(ctx, service, creds.TenantID, creds.Username, creds.Password)
+}
+
+// Token logs in with the username and password of the auth client
+func (client *AuthClient) Token(ctx context.Context) (string, error) {
+	return client.Login(ctx)
+}
+
+// StaticTokenSource always returns the same pre-issued access token
+type StaticTokenSource string
+
+// Token returns the static access token
+func (source StaticTokenSource) Token(ctx context.Context) (string, error) {
+	return string(source), nil
+}
+
+// MTLSSource attaches no access token to requests. The server only authenticates users by token,
+// not by the TLS certificate of the client, so the client can only call public RPCs such as Login.
+type MTLSSource struct{}
+
+// Token returns an empty token
+func (MTLSSource) Token(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+// EnvSource reads the credentials from environment variables every time a token is needed:
+// <prefix>ACCESS_TOKEN, or <prefix>USERNAME and <prefix>PASSWORD with an optional <prefix>TENANT
+type EnvSource struct {
+	service pb.AuthServiceClient
+	prefix  string
+}
+
+// NewEnvSource returns a new EnvSource that logs in through cc
+func NewEnvSource(cc grpc.ClientConnInterface, prefix string) *EnvSource {
+	return &EnvSource{
+		service: pb.NewAuthServiceClient(cc),
+		prefix:  prefix,
+	}
+}
+
+// Token returns the access token from the environment, or logs in with the username and password
+func (source *EnvSource) Token(ctx context.Context) (string, error) {
+	creds := &Credentials{
+		TenantID:    os.Getenv(source.prefix + envTenant),
+		Username:    os.Getenv(source.prefix + envUsername),
+		Password:    os.Getenv(source.prefix + envPassword),
+		AccessToken: os.Getenv(source.prefix + envAccessToken),
+	}
+
+	return creds.token(ctx, source.service)
+}
+
+// FileSource reads the credentials from a JSON file every time a token is needed,
+// so that the file can be rotated while the client is running
+type FileSource struct {
+	service pb.AuthServiceClient
+	path    string
+}
+
+// NewFileSource returns a new FileSource that logs in through cc
+func NewFileSource(cc grpc.ClientConnInterface, path string) *FileSource {
+	return &FileSource{
+		service: pb.NewAuthServiceClient(cc),
+		path:    path,
+	}
+}
+
+// Token returns the access token from the file, or logs in with the username and password
+func (source *FileSource) Token(ctx context.Context) (string, error) {
+	data, err := ioutil.ReadFile(source.path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read credentials file: %w", err)
+	}
+
+	creds := &Credentials{}
+	err = json.Unmarshal(data, creds)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse credentials file: %w", err)
+	}
+
+	return creds.token(ctx, source.service)
+}
@@ -0,0 +1,119 @@
+package client_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/client"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCredentialSourcesAsPerRPCCredentials(t *testing.T) {
+	t.Parallel()
+
+	listener, _ := startAuthTestServer(t, time.Minute)
+	address := listener.Addr().String()
+
+	authConn, err := grpc.Dial(address, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer authConn.Close()
+
+	accessToken, err := client.NewAuthClient(authConn, "admin1", "secret").Login(context.Background())
+	require.NoError(t, err)
+
+	credentialsFolder := t.TempDir()
+	passwordFile := filepath.Join(credentialsFolder, "password.json")
+	require.NoError(t, ioutil.WriteFile(passwordFile, []byte(`{"username": "admin1", "password": "secret"}`), 0600))
+	tokenFile := filepath.Join(credentialsFolder, "token.json")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte(`{"access_token": "`+accessToken+`"}`), 0600))
+
+	testCases := []struct {
+		name   string
+		source client.CredentialSource
+		code   codes.Code
+	}{
+		{
+			name:   "password",
+			source: client.NewAuthClient(authConn, "admin1", "secret"),
+			code:   codes.OK,
+		},
+		{
+			name:   "static token",
+			source: client.StaticTokenSource(accessToken),
+			code:   codes.OK,
+		},
+		{
+			name:   "password file",
+			source: client.NewFileSource(authConn, passwordFile),
+			code:   codes.OK,
+		},
+		{
+			name:   "token file",
+			source: client.NewFileSource(authConn, tokenFile),
+			code:   codes.OK,
+		},
+		{
+			name:   "wrong password",
+			source: client.NewAuthClient(authConn, "admin1", "wrong"),
+			code:   codes.NotFound,
+		},
+		{
+			name:   "missing file",
+			source: client.NewFileSource(authConn, filepath.Join(credentialsFolder, "missing.json")),
+			code:   codes.Unauthenticated,
+		},
+		{
+			name:   "mtls",
+			source: client.MTLSSource{},
+			code:   codes.Unauthenticated,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			interceptor := client.NewAuthInterceptor(tc.source, nil, time.Second)
+			defer interceptor.Close()
+
+			conn, err := grpc.Dial(address, grpc.WithInsecure(), grpc.WithPerRPCCredentials(interceptor))
+			require.NoError(t, err)
+			defer conn.Close()
+
+			_, err = client.NewLaptopClient(conn).CreateLaptop(context.Background(), sample.NewLaptop())
+			require.Equal(t, tc.code, status.Code(err))
+		})
+	}
+}
+
+func TestEnvSource(t *testing.T) {
+	listener, _ := startAuthTestServer(t, time.Minute)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	source := client.NewEnvSource(conn, client.DefaultEnvPrefix)
+
+	t.Setenv("LAPTOP_ACCESS_TOKEN", "pre-issued")
+	accessToken, err := source.Token(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "pre-issued", accessToken)
+
+	t.Setenv("LAPTOP_ACCESS_TOKEN", "")
+	_, err = source.Token(context.Background())
+	require.Error(t, err)
+
+	t.Setenv("LAPTOP_USERNAME", "admin1")
+	t.Setenv("LAPTOP_PASSWORD", "secret")
+	accessToken, err = source.Token(context.Background())
+	require.NoError(t, err)
+	require.NotEmpty(t, accessToken)
+}
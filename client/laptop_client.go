@@ -1,187 +1,651 @@
 package client
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/thewalkers2012/grpc-example/pb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultTimeout   = 5 * time.Second
+	defaultChunkSize = 1024
 )
 
 // LaptopClient is a client to call laptop service RPCs
 type LaptopClient struct {
-	service pb.LaptopServiceClient
+	service       pb.LaptopServiceClient
+	timeout       time.Duration
+	streamTimeout time.Duration
+	chunkSize     int
+}
+
+// LaptopClientOption configures a LaptopClient
+type LaptopClientOption func(client *LaptopClient)
+
+// WithTimeout sets the timeout of unary RPCs, 0 means no timeout other than the context's
+func WithTimeout(timeout time.Duration) LaptopClientOption {
+	return func(client *LaptopClient) {
+		client.timeout = timeout
+	}
+}
+
+// WithStreamTimeout sets the timeout of a whole streaming RPC, 0 means no timeout other than the context's
+func WithStreamTimeout(timeout time.Duration) LaptopClientOption {
+	return func(client *LaptopClient) {
+		client.streamTimeout = timeout
+	}
+}
+
+// WithChunkSize sets the size of the image chunks sent by UploadImage
+func WithChunkSize(size int) LaptopClientOption {
+	return func(client *LaptopClient) {
+		if size > 0 {
+			client.chunkSize = size
+		}
+	}
 }
 
 // NewLaptopClient returns a new laptop client
-func NewLaptopClient(cc *grpc.ClientConn) *LaptopClient {
-	service := pb.NewLaptopServiceClient(cc)
-	return &LaptopClient{
-		service: service,
+func NewLaptopClient(cc grpc.ClientConnInterface, options ...LaptopClientOption) *LaptopClient {
+	client := &LaptopClient{
+		service:       pb.NewLaptopServiceClient(cc),
+		timeout:       defaultTimeout,
+		streamTimeout: defaultTimeout,
+		chunkSize:     defaultChunkSize,
 	}
+
+	for _, option := range options {
+		option(client)
+	}
+
+	return client
+}
+
+// Error is an error returned by a LaptopClient, AuthClient or CatalogClient RPC.
+// It keeps the gRPC status of the failure, so status.Code and status.FromError work on it,
+// and the details the server sent with the status.
+type Error struct {
+	Op  string
+	Err error
+	// Reason is the stable reason of the error, like LAPTOP_NOT_FOUND, empty if the server sent none
+	Reason string
+	// Metadata is the context of the reason, like the ID of the missing laptop
+	Metadata map[string]string
+	// Resource is the resource that is missing or in a wrong state, nil if the error isn't about one
+	Resource *ResourceInfo
+	// Violations are the invalid fields of the request
+	Violations []FieldViolation
+	// RetryDelay is how long to wait before retrying the request, 0 if it shouldn't be retried as is
+	RetryDelay time.Duration
+}
+
+// ResourceInfo is the resource an error is about
+type ResourceInfo struct {
+	Type        string
+	Name        string
+	Description string
+}
+
+// FieldViolation is an invalid field of a request
+type FieldViolation struct {
+	Field       string
+	Description string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%s: %v", err.Op, err.Err)
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
 }
 
-// CreateLaptop calls create laptop RPCs
-func (laptopClient *LaptopClient) CreateLaptop(laptop *pb.Laptop) {
+// Code returns the gRPC code of the error
+func (err *Error) Code() codes.Code {
+	return status.Code(err.Err)
+}
+
+// GRPCStatus returns the gRPC status of the error
+func (err *Error) GRPCStatus() *status.Status {
+	return status.Convert(err.Err)
+}
+
+func wrapError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	clientErr := &Error{Op: op, Err: err}
+	if st, ok := status.FromError(err); ok {
+		clientErr.decodeDetails(st)
+	}
+	return clientErr
+}
+
+// decodeDetails sets the fields of the error from the details of its status
+func (err *Error) decodeDetails(st *status.Status) {
+	for _, detail := range st.Details() {
+		switch detail := detail.(type) {
+		case *errdetails.ErrorInfo:
+			err.Reason = detail.GetReason()
+			err.Metadata = detail.GetMetadata()
+		case *errdetails.ResourceInfo:
+			err.Resource = &ResourceInfo{
+				Type:        detail.GetResourceType(),
+				Name:        detail.GetResourceName(),
+				Description: detail.GetDescription(),
+			}
+		case *errdetails.BadRequest:
+			for _, violation := range detail.GetFieldViolations() {
+				err.Violations = append(err.Violations, FieldViolation{
+					Field:       violation.GetField(),
+					Description: violation.GetDescription(),
+				})
+			}
+		case *errdetails.RetryInfo:
+			err.RetryDelay = detail.GetRetryDelay().AsDuration()
+		}
+	}
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// CreateLaptop calls create laptop RPC and returns the ID of the new laptop
+func (laptopClient *LaptopClient) CreateLaptop(ctx context.Context, laptop *pb.Laptop) (string, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.timeout)
+	defer cancel()
+
 	req := &pb.CreateLaptopRequest{
 		Laptop: laptop,
 	}
 
-	// set timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	res, err := laptopClient.service.CreateLaptop(ctx, req)
+	if err != nil {
+		return "", wrapError("create laptop", err)
+	}
+
+	return res.GetId(), nil
+}
+
+// GetLaptop calls get laptop RPC
+func (laptopClient *LaptopClient) GetLaptop(ctx context.Context, id string) (*pb.Laptop, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.timeout)
+	defer cancel()
+
+	res, err := laptopClient.service.GetLaptop(ctx, &pb.GetLaptopRequest{Id: id})
+	if err != nil {
+		return nil, wrapError("get laptop", err)
+	}
+
+	return res.GetLaptop(), nil
+}
+
+// GetLaptopAsOf calls get laptop RPC for the version of the laptop at the time
+func (laptopClient *LaptopClient) GetLaptopAsOf(ctx context.Context, id string, asOf time.Time) (*pb.Laptop, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.timeout)
 	defer cancel()
 
-	res, err := laptopClient.service.CreateLaptop(ctx, req)
+	res, err := laptopClient.service.GetLaptop(ctx, &pb.GetLaptopRequest{Id: id, AsOf: timestamppb.New(asOf)})
 	if err != nil {
-		st, ok := status.FromError(err)
-		if ok && st.Code() == codes.AlreadyExists {
-			// not a big deal
-			log.Print("laptop already exists")
-		} else {
-			log.Fatal("cannot create laptop: ", err)
-		}
-		return
+		return nil, wrapError("get laptop", err)
 	}
 
-	log.Printf("create laptop with id: %s", res.Id)
+	return res.GetLaptop(), nil
 }
 
-// SearchLaptop calls search laptop RPC
-func (laptopClient *LaptopClient) SearchLaptop(filter *pb.Filter) {
-	log.Print("search filter: ", filter)
+// GetLaptopHistory calls get laptop history RPC and returns the versions from the oldest to the newest
+func (laptopClient *LaptopClient) GetLaptopHistory(ctx context.Context, id string) ([]*pb.LaptopVersion, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.timeout)
+	defer cancel()
+
+	res, err := laptopClient.service.GetLaptopHistory(ctx, &pb.GetLaptopHistoryRequest{Id: id})
+	if err != nil {
+		return nil, wrapError("get laptop history", err)
+	}
+
+	return res.GetVersions(), nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// UpdateLaptop calls update laptop RPC and returns the updated laptop
+func (laptopClient *LaptopClient) UpdateLaptop(ctx context.Context, laptop *pb.Laptop) (*pb.Laptop, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.timeout)
 	defer cancel()
 
-	req := &pb.SearchLaptopRequest{
-		Filter: filter,
+	res, err := laptopClient.service.UpdateLaptop(ctx, &pb.UpdateLaptopRequest{Laptop: laptop})
+	if err != nil {
+		return nil, wrapError("update laptop", err)
 	}
-	stream, err := laptopClient.service.SearchLaptop(ctx, req)
+
+	return res.GetLaptop(), nil
+}
+
+// DeleteLaptop calls delete laptop RPC
+func (laptopClient *LaptopClient) DeleteLaptop(ctx context.Context, id string) error {
+	ctx, cancel := withTimeout(ctx, laptopClient.timeout)
+	defer cancel()
+
+	_, err := laptopClient.service.DeleteLaptop(ctx, &pb.DeleteLaptopRequest{Id: id})
+	return wrapError("delete laptop", err)
+}
+
+// RestoreLaptop calls restore laptop RPC and returns the restored laptop
+func (laptopClient *LaptopClient) RestoreLaptop(ctx context.Context, id string) (*pb.Laptop, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.timeout)
+	defer cancel()
+
+	res, err := laptopClient.service.RestoreLaptop(ctx, &pb.RestoreLaptopRequest{Id: id})
 	if err != nil {
-		log.Fatal("can not search laptop: ", err)
+		return nil, wrapError("restore laptop", err)
+	}
+
+	return res.GetLaptop(), nil
+}
+
+// DeleteImage calls delete image RPC and returns the remaining images of the laptop
+func (laptopClient *LaptopClient) DeleteImage(ctx context.Context, laptopID string, imageID string) ([]*pb.LaptopImage, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.timeout)
+	defer cancel()
+
+	res, err := laptopClient.service.DeleteImage(ctx, &pb.DeleteImageRequest{LaptopId: laptopID, ImageId: imageID})
+	if err != nil {
+		return nil, wrapError("delete image", err)
+	}
+
+	return res.GetImages(), nil
+}
+
+// SetPrimaryImage calls set primary image RPC and returns the images of the laptop in their new order
+func (laptopClient *LaptopClient) SetPrimaryImage(ctx context.Context, laptopID string, imageID string) ([]*pb.LaptopImage, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.timeout)
+	defer cancel()
+
+	res, err := laptopClient.service.SetPrimaryImage(ctx, &pb.SetPrimaryImageRequest{LaptopId: laptopID, ImageId: imageID})
+	if err != nil {
+		return nil, wrapError("set primary image", err)
+	}
+
+	return res.GetImages(), nil
+}
+
+// ReorderImages calls reorder images RPC to put the images first, in this order,
+// and returns the images of the laptop in their new order
+func (laptopClient *LaptopClient) ReorderImages(ctx context.Context, laptopID string, imageIDs []string) ([]*pb.LaptopImage, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.timeout)
+	defer cancel()
+
+	res, err := laptopClient.service.ReorderImages(ctx, &pb.ReorderImagesRequest{LaptopId: laptopID, ImageIds: imageIDs})
+	if err != nil {
+		return nil, wrapError("reorder images", err)
+	}
+
+	return res.GetImages(), nil
+}
+
+// BulkCreateLaptops calls bulk create laptops RPC with the laptops returned by next,
+// until next returns io.EOF
+func (laptopClient *LaptopClient) BulkCreateLaptops(
+	ctx context.Context,
+	next func() (*pb.Laptop, error),
+) (*pb.BulkCreateLaptopsResponse, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.streamTimeout)
+	defer cancel()
+
+	stream, err := laptopClient.service.BulkCreateLaptops(ctx)
+	if err != nil {
+		return nil, wrapError("bulk create laptops", err)
 	}
 
 	for {
-		res, err := stream.Recv()
-		if err == io.EOF {
-			return
+		laptop, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bulk create laptops: cannot read laptop: %w", err)
 		}
 
+		err = stream.Send(&pb.BulkCreateLaptopsRequest{Laptop: laptop})
 		if err != nil {
-			log.Fatal("cannot receive response: ", err)
+			return nil, wrapError("bulk create laptops", sendError(stream, err))
 		}
+	}
 
-		laptop := res.GetLaptop()
-		log.Print("- found: ", laptop.GetId())
-		log.Print(" + brand: ", laptop.GetBrand())
-		log.Print(" + name: ", laptop.GetName())
-		log.Print(" + cpu cores: ", laptop.GetCpu().GetNumberCores())
-		log.Print(" + ram: ", laptop.GetRam().GetValue(), laptop.GetRam().GetUnit())
-		log.Print(" + price: ", laptop.GetPriceUsd())
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, wrapError("bulk create laptops", err)
 	}
+
+	return res, nil
 }
 
-// UploadImage calls upload image rpc
-func (laptopClient *LaptopClient) UploadImage(laptopID string, imagePath string) {
-	file, err := os.Open(imagePath)
+// LaptopIterator iterates over the laptops found by SearchLaptop
+//
+//	it, err := laptopClient.SearchLaptop(ctx, filter)
+//	...
+//	defer it.Close()
+//	for it.Next() {
+//		laptop := it.Laptop()
+//	}
+//	err = it.Err()
+type LaptopIterator struct {
+	stream pb.LaptopService_SearchLaptopClient
+	cancel context.CancelFunc
+	res    *pb.SearchLaptopResponse
+	err    error
+}
+
+// Next receives the next laptop, it returns false when there are no more laptops or an error occurs
+func (it *LaptopIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	res, err := it.stream.Recv()
 	if err != nil {
-		log.Fatal("cannot open image file: ", err)
+		if err != io.EOF {
+			it.err = wrapError("search laptop", err)
+		}
+		it.res = nil
+		it.Close()
+		return false
 	}
-	defer file.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	it.res = res
+	return true
+}
+
+// Laptop returns the current laptop
+func (it *LaptopIterator) Laptop() *pb.Laptop {
+	return it.res.GetLaptop()
+}
+
+// ConvertedPrice returns the price of the current laptop in the currency of SearchLaptopInCurrency
+func (it *LaptopIterator) ConvertedPrice() *pb.Money {
+	return it.res.GetConvertedPrice()
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *LaptopIterator) Err() error {
+	return it.err
+}
+
+// Close stops the search, it is safe to call Close more than once
+func (it *LaptopIterator) Close() {
+	it.cancel()
+}
+
+// SearchLaptop calls search laptop RPC and returns an iterator over the found laptops
+func (laptopClient *LaptopClient) SearchLaptop(ctx context.Context, filter *pb.Filter) (*LaptopIterator, error) {
+	return laptopClient.SearchLaptopInCurrency(ctx, filter, "")
+}
+
+// SearchLaptopInCurrency calls search laptop RPC with the prices converted to the currency
+func (laptopClient *LaptopClient) SearchLaptopInCurrency(
+	ctx context.Context,
+	filter *pb.Filter,
+	currencyCode string,
+) (*LaptopIterator, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.streamTimeout)
+
+	req := &pb.SearchLaptopRequest{
+		Filter:       filter,
+		CurrencyCode: currencyCode,
+	}
+
+	stream, err := laptopClient.service.SearchLaptop(ctx, req)
+	if err != nil {
+		cancel()
+		return nil, wrapError("search laptop", err)
+	}
+
+	return &LaptopIterator{stream: stream, cancel: cancel}, nil
+}
+
+// LaptopWatcher iterates over the responses of WatchLaptops:
+// the laptops of the initial snapshot, its end, then the live events
+//
+//	watcher, err := laptopClient.WatchLaptops(ctx, filter, true)
+//	...
+//	defer watcher.Close()
+//	for watcher.Next() {
+//		res := watcher.Response()
+//	}
+//	err = watcher.Err()
+type LaptopWatcher struct {
+	stream pb.LaptopService_WatchLaptopsClient
+	cancel context.CancelFunc
+	res    *pb.WatchLaptopsResponse
+	err    error
+}
+
+// Next receives the next response, it returns false when the watch ends
+func (watcher *LaptopWatcher) Next() bool {
+	if watcher.err != nil {
+		return false
+	}
+
+	res, err := watcher.stream.Recv()
+	if err != nil {
+		if err != io.EOF {
+			watcher.err = wrapError("watch laptops", err)
+		}
+		watcher.res = nil
+		watcher.Close()
+		return false
+	}
+
+	watcher.res = res
+	return true
+}
+
+// Response returns the current response
+func (watcher *LaptopWatcher) Response() *pb.WatchLaptopsResponse {
+	return watcher.res
+}
+
+// Err returns the error that ended the watch, if any
+func (watcher *LaptopWatcher) Err() error {
+	return watcher.err
+}
+
+// Close stops watching, it is safe to call Close more than once
+func (watcher *LaptopWatcher) Close() {
+	watcher.cancel()
+}
+
+// WatchLaptops calls watch laptops RPC. The watch is not limited by the stream timeout,
+// it lasts until the context is done or the watcher is closed.
+func (laptopClient *LaptopClient) WatchLaptops(
+	ctx context.Context,
+	filter *pb.Filter,
+	initialSnapshot bool,
+) (*LaptopWatcher, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	req := &pb.WatchLaptopsRequest{
+		Filter:          filter,
+		InitialSnapshot: initialSnapshot,
+	}
+
+	stream, err := laptopClient.service.WatchLaptops(ctx, req)
+	if err != nil {
+		cancel()
+		return nil, wrapError("watch laptops", err)
+	}
+
+	return &LaptopWatcher{stream: stream, cancel: cancel}, nil
+}
+
+// SearchFacets calls search facets RPC. Empty boundaries use the server defaults.
+func (laptopClient *LaptopClient) SearchFacets(
+	ctx context.Context,
+	filter *pb.Filter,
+	priceBoundariesUSD []float64,
+	ramBoundariesGB []uint64,
+) (*pb.SearchFacetsResponse, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.timeout)
+	defer cancel()
+
+	req := &pb.SearchFacetsRequest{
+		Filter:             filter,
+		PriceBoundariesUsd: priceBoundariesUSD,
+		RamBoundariesGb:    ramBoundariesGB,
+	}
+
+	res, err := laptopClient.service.SearchFacets(ctx, req)
+	if err != nil {
+		return nil, wrapError("search facets", err)
+	}
+
+	return res, nil
+}
+
+// UploadProgress is called after every chunk sent by UploadImage with the total number of bytes sent so far
+type UploadProgress func(sent int64)
+
+// UploadImage calls upload image RPC with the image read from reader.
+// The progress callback is optional.
+func (laptopClient *LaptopClient) UploadImage(
+	ctx context.Context,
+	laptopID string,
+	imageType string,
+	reader io.Reader,
+	progress UploadProgress,
+) (*pb.UploadImageResponse, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.streamTimeout)
 	defer cancel()
 
 	stream, err := laptopClient.service.UploadImage(ctx)
 	if err != nil {
-		log.Fatal("cannot upload image: ", err)
+		return nil, wrapError("upload image", err)
 	}
 
 	req := &pb.UploadmageRequest{
 		Data: &pb.UploadmageRequest_Info{
 			Info: &pb.ImageInfo{
 				LaptopId:   laptopID,
-				ImageTypes: filepath.Ext(imagePath),
+				ImageTypes: imageType,
 			},
 		},
 	}
 
 	err = stream.Send(req)
 	if err != nil {
-		log.Fatal("cannot send image info to server: ", err, stream.RecvMsg(nil))
+		return nil, wrapError("upload image", sendError(stream, err))
 	}
 
-	reader := bufio.NewReader(file)
-	buffer := make([]byte, 1024)
+	buffer := make([]byte, laptopClient.chunkSize)
+	var sent int64
 
 	for {
 		n, err := reader.Read(buffer)
-		if err == io.EOF {
-			break
-		}
+		if n > 0 {
+			req := &pb.UploadmageRequest{
+				Data: &pb.UploadmageRequest_ChunkData{
+					ChunkData: buffer[:n],
+				},
+			}
 
-		if err != nil {
-			log.Fatal("cannot read chunk to buffer: ", err)
-		}
+			if err := stream.Send(req); err != nil {
+				return nil, wrapError("upload image", sendError(stream, err))
+			}
 
-		req := &pb.UploadmageRequest{
-			Data: &pb.UploadmageRequest_ChunkData{
-				ChunkData: buffer[:n],
-			},
+			sent += int64(n)
+			if progress != nil {
+				progress(sent)
+			}
 		}
 
-		err = stream.Send(req)
+		if errors.Is(err, io.EOF) {
+			break
+		}
 		if err != nil {
-			log.Fatal("cannot send chunk to server", err)
+			return nil, fmt.Errorf("upload image: cannot read image data: %w", err)
 		}
 	}
 
 	res, err := stream.CloseAndRecv()
 	if err != nil {
-		log.Fatal("cannot receive response：", err)
+		return nil, wrapError("upload image", err)
 	}
 
-	log.Printf("image uploaded with id: %s, size %d", res.GetId(), res.GetSize())
+	return res, nil
 }
 
-// RateLaptop calls rate laptop RPC
-func (laptopClient *LaptopClient) RateLaptop(laptopIDs []string, scores []float64) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// UploadImageFile calls upload image RPC with the image file at imagePath
+func (laptopClient *LaptopClient) UploadImageFile(
+	ctx context.Context,
+	laptopID string,
+	imagePath string,
+	progress UploadProgress,
+) (*pb.UploadImageResponse, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("upload image: cannot open image file: %w", err)
+	}
+	defer file.Close()
+
+	return laptopClient.UploadImage(ctx, laptopID, filepath.Ext(imagePath), file, progress)
+}
+
+// RateLaptop calls rate laptop RPC and returns the rating of every laptop after its score
+func (laptopClient *LaptopClient) RateLaptop(
+	ctx context.Context,
+	laptopIDs []string,
+	scores []float64,
+) ([]*pb.RateLaptopResponse, error) {
+	if len(laptopIDs) != len(scores) {
+		return nil, fmt.Errorf("rate laptop: got %d laptop IDs but %d scores", len(laptopIDs), len(scores))
+	}
+
+	ctx, cancel := withTimeout(ctx, laptopClient.streamTimeout)
 	defer cancel()
 
 	stream, err := laptopClient.service.RateLaptop(ctx)
 	if err != nil {
-		return fmt.Errorf("cannot rate laptop: %v", err)
+		return nil, wrapError("rate laptop", err)
 	}
 
-	waitResponse := make(chan error)
+	type result struct {
+		responses []*pb.RateLaptopResponse
+		err       error
+	}
+	waitResponse := make(chan result, 1)
+
 	// go routine to receive responses
 	go func() {
+		var responses []*pb.RateLaptopResponse
 		for {
 			res, err := stream.Recv()
 			if err == io.EOF {
-				log.Printf("no more response")
-				waitResponse <- nil
+				waitResponse <- result{responses: responses}
 				return
 			}
 			if err != nil {
-				waitResponse <- fmt.Errorf("cannot receive stream response: %v", err)
+				waitResponse <- result{err: wrapError("rate laptop", err)}
 				return
 			}
 
-			log.Print("receive response: ", res)
+			responses = append(responses, res)
 		}
 	}()
 
-	// second request
 	for i, laptopID := range laptopIDs {
 		req := &pb.RateLaptopRequest{
 			LaptopId: laptopID,
@@ -190,17 +654,34 @@ func (laptopClient *LaptopClient) RateLaptop(laptopIDs []string, scores []float6
 
 		err := stream.Send(req)
 		if err != nil {
-			return fmt.Errorf("cannot send stream request: %v - %v", err, stream.RecvMsg(nil))
+			// the receiving go routine gets the status of the closed stream
+			res := <-waitResponse
+			if res.err != nil {
+				return nil, res.err
+			}
+			return nil, wrapError("rate laptop", err)
 		}
-
-		log.Print("send request: ", req)
 	}
 
 	err = stream.CloseSend()
 	if err != nil {
-		return fmt.Errorf("cannot close send: %v", err)
+		return nil, wrapError("rate laptop", err)
+	}
+
+	res := <-waitResponse
+	return res.responses, res.err
+}
+
+// sendError returns the real error of a failed send: when the server has closed the stream,
+// Send returns io.EOF and the status is only available from RecvMsg
+func sendError(stream grpc.ClientStream, err error) error {
+	if err != io.EOF {
+		return err
 	}
 
-	err = <-waitResponse
-	return err
+	recvErr := stream.RecvMsg(nil)
+	if recvErr == nil || recvErr == io.EOF {
+		return err
+	}
+	return recvErr
 }
@@ -0,0 +1,283 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/client"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestLaptopClientCreateAndGet(t *testing.T) {
+	t.Parallel()
+
+	laptopClient := newTestLaptopClient(t)
+
+	laptop := sample.NewLaptop()
+	id, err := laptopClient.CreateLaptop(context.Background(), laptop)
+	require.NoError(t, err)
+	require.Equal(t, laptop.GetId(), id)
+
+	got, err := laptopClient.GetLaptop(context.Background(), id)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(laptop, got))
+
+	// errors keep the gRPC status of the failure
+	_, err = laptopClient.CreateLaptop(context.Background(), laptop)
+	require.Error(t, err)
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	var clientErr *client.Error
+	require.True(t, errors.As(err, &clientErr))
+	require.Equal(t, "create laptop", clientErr.Op)
+	require.Equal(t, codes.AlreadyExists, clientErr.Code())
+
+	_, err = laptopClient.GetLaptop(context.Background(), "unknown")
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestLaptopClientSearchLaptop(t *testing.T) {
+	t.Parallel()
+
+	laptopClient := newTestLaptopClient(t)
+
+	expectedIDs := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		laptop := sample.NewLaptop()
+		laptop.PriceUsd = 1000
+		id, err := laptopClient.CreateLaptop(context.Background(), laptop)
+		require.NoError(t, err)
+		expectedIDs[id] = true
+	}
+
+	filter := &pb.Filter{
+		MaxPriceUsd: 2000,
+		MinRam:      &pb.Memory{Value: 0, Unit: pb.Memory_BIT},
+	}
+
+	it, err := laptopClient.SearchLaptop(context.Background(), filter)
+	require.NoError(t, err)
+	defer it.Close()
+
+	found := 0
+	for it.Next() {
+		require.True(t, expectedIDs[it.Laptop().GetId()])
+		found++
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, len(expectedIDs), found)
+	require.False(t, it.Next())
+}
+
+func TestLaptopClientSearchLaptopTimeout(t *testing.T) {
+	t.Parallel()
+
+	laptopClient := newTestLaptopClient(t, client.WithStreamTimeout(time.Nanosecond))
+
+	it, err := laptopClient.SearchLaptop(context.Background(), &pb.Filter{})
+	if err == nil {
+		defer it.Close()
+		for it.Next() {
+		}
+		err = it.Err()
+	}
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
+
+func TestLaptopClientBulkCreateLaptops(t *testing.T) {
+	t.Parallel()
+
+	laptopClient := newTestLaptopClient(t)
+
+	laptops := []*pb.Laptop{sample.NewLaptop(), sample.NewLaptop()}
+	i := 0
+	next := func() (*pb.Laptop, error) {
+		if i == len(laptops) {
+			return nil, io.EOF
+		}
+		i++
+		return laptops[i-1], nil
+	}
+
+	res, err := laptopClient.BulkCreateLaptops(context.Background(), next)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, res.GetCreatedCount())
+
+	// an error of next stops the import
+	_, err = laptopClient.BulkCreateLaptops(context.Background(), func() (*pb.Laptop, error) {
+		return nil, errors.New("cannot parse laptop")
+	})
+	require.Error(t, err)
+}
+
+func TestLaptopClientUploadImage(t *testing.T) {
+	t.Parallel()
+
+	laptopClient := newTestLaptopClient(t, client.WithChunkSize(10))
+
+	laptop := sample.NewLaptop()
+	_, err := laptopClient.CreateLaptop(context.Background(), laptop)
+	require.NoError(t, err)
+
+	image := bytes.Repeat([]byte("a"), 25)
+	var progress []int64
+	res, err := laptopClient.UploadImage(context.Background(), laptop.GetId(), ".jpg", bytes.NewReader(image), func(sent int64) {
+		progress = append(progress, sent)
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, res.GetId())
+	require.EqualValues(t, len(image), res.GetSize())
+	require.Equal(t, []int64{10, 20, 25}, progress)
+
+	_, err = laptopClient.UploadImage(context.Background(), "unknown", ".jpg", bytes.NewReader(image), nil)
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestLaptopClientErrorDetails(t *testing.T) {
+	t.Parallel()
+
+	laptopClient := newTestLaptopClient(t)
+
+	_, err := laptopClient.GetLaptop(context.Background(), "unknown")
+	var clientErr *client.Error
+	require.True(t, errors.As(err, &clientErr))
+	require.Equal(t, service.ReasonLaptopNotFound, clientErr.Reason)
+	require.Equal(t, "unknown", clientErr.Metadata["laptop_id"])
+	require.Equal(t, &client.ResourceInfo{
+		Type:        service.ResourceTypeLaptop,
+		Name:        "unknown",
+		Description: "laptop doesn't exist",
+	}, clientErr.Resource)
+
+	laptop := sample.NewLaptop()
+	laptop.Cpu.NumberThreads = 0
+	_, err = laptopClient.CreateLaptop(context.Background(), laptop)
+	require.True(t, errors.As(err, &clientErr))
+	require.Equal(t, codes.InvalidArgument, clientErr.Code())
+	require.Equal(t, service.ReasonInvalidArgument, clientErr.Reason)
+	require.Equal(t, "laptop.cpu.number_threads", clientErr.Violations[0].Field)
+	require.Nil(t, clientErr.Resource)
+
+	laptop = sample.NewLaptop()
+	_, err = laptopClient.CreateLaptop(context.Background(), laptop)
+	require.NoError(t, err)
+	_, err = laptopClient.CreateLaptop(context.Background(), laptop)
+	require.True(t, errors.As(err, &clientErr))
+	require.Equal(t, service.ReasonLaptopAlreadyExists, clientErr.Reason)
+	require.Equal(t, laptop.GetId(), clientErr.Resource.Name)
+
+	_, err = laptopClient.RestoreLaptop(context.Background(), laptop.GetId())
+	require.True(t, errors.As(err, &clientErr))
+	require.Equal(t, codes.FailedPrecondition, clientErr.Code())
+	require.Equal(t, service.ReasonLaptopNotDeleted, clientErr.Reason)
+
+	image := bytes.Repeat([]byte("a"), 1<<20+1)
+	_, err = laptopClient.UploadImage(context.Background(), laptop.GetId(), ".jpg", bytes.NewReader(image), nil)
+	require.True(t, errors.As(err, &clientErr))
+	require.Equal(t, service.ReasonImageTooLarge, clientErr.Reason)
+	require.Equal(t, "chunk_data", clientErr.Violations[0].Field)
+}
+
+func TestLaptopClientRateLaptop(t *testing.T) {
+	t.Parallel()
+
+	laptopClient := newTestLaptopClient(t)
+
+	laptop := sample.NewLaptop()
+	_, err := laptopClient.CreateLaptop(context.Background(), laptop)
+	require.NoError(t, err)
+
+	ids := []string{laptop.GetId(), laptop.GetId()}
+	responses, err := laptopClient.RateLaptop(context.Background(), ids, []float64{8, 10})
+	require.NoError(t, err)
+	require.Len(t, responses, 2)
+	require.EqualValues(t, 2, responses[1].GetRatedCount())
+	require.Equal(t, 9.0, responses[1].GetAverageScore())
+
+	_, err = laptopClient.RateLaptop(context.Background(), ids, []float64{8})
+	require.Error(t, err)
+
+	_, err = laptopClient.RateLaptop(context.Background(), []string{"unknown"}, []float64{8})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestLaptopClientUpdateDeleteAndWatch(t *testing.T) {
+	t.Parallel()
+
+	laptopClient := newTestLaptopClient(t)
+
+	laptop := sample.NewLaptop()
+	_, err := laptopClient.CreateLaptop(context.Background(), laptop)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watcher, err := laptopClient.WatchLaptops(ctx, nil, true)
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	require.True(t, watcher.Next())
+	require.Equal(t, laptop.GetId(), watcher.Response().GetSnapshotLaptop().GetId())
+	require.True(t, watcher.Next())
+	require.True(t, watcher.Response().GetSnapshotComplete())
+
+	laptop.Name = "updated"
+	updated, err := laptopClient.UpdateLaptop(context.Background(), laptop)
+	require.NoError(t, err)
+	require.Equal(t, "updated", updated.GetName())
+	require.NotNil(t, updated.GetUpdatedAt())
+
+	require.NoError(t, laptopClient.DeleteLaptop(context.Background(), laptop.GetId()))
+
+	require.True(t, watcher.Next())
+	require.Equal(t, pb.LaptopEvent_UPDATED, watcher.Response().GetEvent().GetType())
+	require.True(t, watcher.Next())
+	require.Equal(t, pb.LaptopEvent_DELETED, watcher.Response().GetEvent().GetType())
+
+	err = laptopClient.DeleteLaptop(context.Background(), laptop.GetId())
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// closing the watcher ends the iteration
+	watcher.Close()
+	require.False(t, watcher.Next())
+	require.Equal(t, codes.Canceled, status.Code(watcher.Err()))
+}
+
+func newTestLaptopClient(t *testing.T, options ...client.LaptopClientOption) *client.LaptopClient {
+	imageStore, err := service.NewDiskImageStore(t.TempDir())
+	require.NoError(t, err)
+
+	laptopServer := service.NewLaptopService(
+		service.NewInMemoryLaptopStore(),
+		imageStore,
+		service.NewInMemoryRatingStore(),
+	)
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return client.NewLaptopClient(conn, options...)
+}
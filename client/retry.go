@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	createLaptopMethod    = "/pb.LaptopService/CreateLaptop"
+	idempotencyKeyHeader  = "idempotency-key"
+	defaultCreateAttempts = 4
+	defaultCreateBackoff  = 100 * time.Millisecond
+)
+
+// CreateLaptopRetryInterceptor returns a client interceptor that retries CreateLaptop
+// when the server is unavailable, or busy with an earlier attempt. Every attempt has the same
+// idempotency key, chosen by the interceptor unless the caller set one, so that a retry gets
+// the response of an earlier attempt that was saved, even by another server sharing its store.
+// A laptop without an ID is sent with an ID chosen by the interceptor, in a copy of the request:
+// if a server doesn't remember the key, a retry that fails with AlreadyExists can only conflict
+// with an earlier attempt, and is reported as a success.
+func CreateLaptopRetryInterceptor(maxAttempts int, backoff time.Duration) grpc.UnaryClientInterceptor {
+	return func(
+		ctx context.Context,
+		method string,
+		req, reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		createReq, ok := req.(*pb.CreateLaptopRequest)
+		if method != createLaptopMethod || !ok || createReq.GetLaptop() == nil {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		md, _ := metadata.FromOutgoingContext(ctx)
+		if len(md.Get(idempotencyKeyHeader)) == 0 {
+			ctx = metadata.AppendToOutgoingContext(ctx, idempotencyKeyHeader, uuid.New().String())
+		}
+
+		// the request of the caller is not changed
+		generatedID := createReq.GetLaptop().GetId() == ""
+		if generatedID {
+			createReq = proto.Clone(createReq).(*pb.CreateLaptopRequest)
+			createReq.Laptop.Id = uuid.New().String()
+		}
+		laptopID := createReq.GetLaptop().GetId()
+
+		wait := backoff
+		for attempt := 1; ; attempt++ {
+			err := invoker(ctx, method, createReq, reply, cc, opts...)
+			code := status.Code(err)
+
+			if code == codes.AlreadyExists && attempt > 1 && generatedID {
+				log.Printf("laptop %s was saved by an earlier attempt", laptopID)
+				reply.(*pb.CreateLaptopResponse).Id = laptopID
+				return nil
+			}
+
+			if (code != codes.Unavailable && code != codes.Aborted) || attempt >= maxAttempts {
+				return err
+			}
+
+			log.Printf("retry create-laptop %s after error: %v", laptopID, err)
+			select {
+			case <-ctx.Done():
+				return status.FromContextError(ctx.Err()).Err()
+			case <-time.After(wait):
+			}
+			wait *= 2
+		}
+	}
+}
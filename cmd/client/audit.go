@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func runAudit(a *app, args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected a subcommand: list or verify")
+	}
+
+	switch args[0] {
+	case "list":
+		return runListAuditEntries(a, args[1:])
+	case "verify":
+		return runVerifyAuditLog(a, args[1:])
+	default:
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+}
+
+func runListAuditEntries(a *app, args []string) error {
+	flags := flag.NewFlagSet("audit list", flag.ExitOnError)
+	username := flags.String("user", "", "only the entries of this user")
+	method := flags.String("method", "", "only the entries of this full gRPC method, like /pb.LaptopService/CreateLaptop")
+	tenantID := flags.String("tenant", "", "only the entries of this tenant")
+	since := flags.String("since", "", "only the entries at or after this RFC 3339 time")
+	until := flags.String("until", "", "only the entries at or before this RFC 3339 time")
+	limit := flags.Uint("limit", 0, "the maximum number of entries, the most recent ones are printed (server default if 0)")
+	flags.Parse(args)
+
+	req := &pb.ListAuditEntriesRequest{
+		Username: *username,
+		Method:   *method,
+		TenantId: *tenantID,
+		Limit:    uint32(*limit),
+	}
+
+	var err error
+	req.StartTime, err = parseTimeFlag("since", *since)
+	if err != nil {
+		return err
+	}
+	req.EndTime, err = parseTimeFlag("until", *until)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := a.context()
+	defer cancel()
+
+	res, err := a.authService().ListAuditEntries(ctx, req)
+	if err != nil {
+		return fmt.Errorf("cannot list audit entries: %w", err)
+	}
+
+	var messages []proto.Message
+	var rows [][]string
+	for _, entry := range res.GetEntries() {
+		messages = append(messages, entry)
+		rows = append(rows, []string{
+			entry.GetTime().AsTime().Format(time.RFC3339),
+			entry.GetAction(),
+			entry.GetTenantId(),
+			entry.GetUsername(),
+			entry.GetMethod(),
+			entry.GetPeer(),
+			entry.GetCode(),
+			entry.GetDetails(),
+		})
+	}
+
+	header := []string{"TIME", "ACTION", "TENANT", "USER", "METHOD", "PEER", "CODE", "DETAILS"}
+	return a.printer.List(messages, header, rows)
+}
+
+// runVerifyAuditLog checks the hash chain of an audit log file of the server with its key
+func runVerifyAuditLog(a *app, args []string) error {
+	flags := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	file := flags.String("file", "", "audit log file to verify")
+	keyFile := flags.String("key-file", "", "file of the secret key of the audit log, the -audit-key-file of the server")
+	flags.Parse(args)
+
+	key, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read audit log key: %w", err)
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return fmt.Errorf("cannot open audit log: %w", err)
+	}
+	defer f.Close()
+
+	count, err := service.VerifyAuditLog(f, bytes.TrimSpace(key))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("audit log %s is valid: %d entries\n", *file, count)
+	return nil
+}
+
+// parseTimeFlag parses an optional RFC 3339 time
+func parseTimeFlag(name string, value string) (*timestamppb.Timestamp, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -%s time: %w", name, err)
+	}
+	return timestamppb.New(t), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/thewalkers2012/grpc-example/client"
+)
+
+func runCatalog(a *app, args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected a subcommand: export or import")
+	}
+
+	switch args[0] {
+	case "export":
+		return runExportCatalog(a, args[1:])
+	case "import":
+		return runImportCatalog(a, args[1:])
+	default:
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+}
+
+func runExportCatalog(a *app, args []string) error {
+	flags := flag.NewFlagSet("catalog export", flag.ExitOnError)
+	file := flags.String("file", "catalog.tar.gz", "file to write the catalog archive to")
+	flags.Parse(args)
+
+	f, err := os.Create(*file)
+	if err != nil {
+		return fmt.Errorf("cannot create archive file: %w", err)
+	}
+
+	err = client.NewCatalogClient(a.conn).ExportCatalog(context.Background(), f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*file)
+		return err
+	}
+
+	fmt.Printf("exported catalog to %s\n", *file)
+	return nil
+}
+
+func runImportCatalog(a *app, args []string) error {
+	flags := flag.NewFlagSet("catalog import", flag.ExitOnError)
+	file := flags.String("file", "catalog.tar.gz", "catalog archive to import")
+	flags.Parse(args)
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return fmt.Errorf("cannot open archive file: %w", err)
+	}
+	defer f.Close()
+
+	res, err := client.NewCatalogClient(a.conn).ImportCatalog(context.Background(), f)
+	if err != nil {
+		return err
+	}
+
+	header := []string{"LAPTOPS", "SKIPPED", "IMAGES", "RATINGS"}
+	row := []string{
+		fmt.Sprint(res.GetLaptopCount()),
+		fmt.Sprint(res.GetSkippedLaptopCount()),
+		fmt.Sprint(res.GetImageCount()),
+		fmt.Sprint(res.GetRatingCount()),
+	}
+	return a.printer.One(res, header, row)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/thewalkers2012/grpc-example/client"
+)
+
+const tokenFileName = "tokens.json"
+
+func defaultConfigDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".grpc-example"
+	}
+	return filepath.Join(dir, "grpc-example")
+}
+
+// tokenCache keeps access tokens per server address in the config directory
+type tokenCache struct {
+	mutex  sync.RWMutex
+	path   string
+	Tokens map[string]string `json:"tokens"`
+}
+
+func loadTokenCache(configDir string) (*tokenCache, error) {
+	cache := &tokenCache{
+		path:   filepath.Join(configDir, tokenFileName),
+		Tokens: make(map[string]string),
+	}
+
+	data, err := ioutil.ReadFile(cache.path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read token file: %w", err)
+	}
+
+	err = json.Unmarshal(data, cache)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse token file: %w", err)
+	}
+
+	if cache.Tokens == nil {
+		cache.Tokens = make(map[string]string)
+	}
+
+	return cache, nil
+}
+
+// Token returns the cached token of the server address
+func (cache *tokenCache) Token(address string) string {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+
+	return cache.Tokens[address]
+}
+
+// Save caches the token of the server address and writes it to disk
+func (cache *tokenCache) Save(address string, token string) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.Tokens[address] = token
+
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot marshal tokens: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(cache.path), 0700)
+	if err != nil {
+		return fmt.Errorf("cannot create config directory: %w", err)
+	}
+
+	err = ioutil.WriteFile(cache.path, data, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot write token file: %w", err)
+	}
+
+	return nil
+}
+
+// cachedTokenSource is the credential source of the token saved by the login command
+type cachedTokenSource struct {
+	tokens  *tokenCache
+	address string
+}
+
+// Token returns the cached token of the server address, or no token once it has expired,
+// so that the calls of public methods are anonymous until the next login
+func (source *cachedTokenSource) Token(ctx context.Context) (string, error) {
+	accessToken := source.tokens.Token(source.address)
+	if expiresAt, ok := client.TokenExpiry(accessToken); ok && !time.Now().Before(expiresAt) {
+		return "", nil
+	}
+	return accessToken, nil
+}
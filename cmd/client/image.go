@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/thewalkers2012/grpc-example/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+func runImages(a *app, args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected a subcommand: list, delete, set-primary or reorder")
+	}
+
+	switch args[0] {
+	case "list":
+		return runListImages(a, args[1:])
+	case "delete":
+		return runDeleteImage(a, args[1:])
+	case "set-primary":
+		return runSetPrimaryImage(a, args[1:])
+	case "reorder":
+		return runReorderImages(a, args[1:])
+	default:
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+}
+
+func runListImages(a *app, args []string) error {
+	flags := flag.NewFlagSet("images list", flag.ExitOnError)
+	id := flags.String("id", "", "laptop ID")
+	flags.Parse(args)
+
+	laptop, err := a.laptopClient().GetLaptop(context.Background(), *id)
+	if err != nil {
+		return err
+	}
+
+	return a.printImages(laptop.GetImages())
+}
+
+func runDeleteImage(a *app, args []string) error {
+	flags := flag.NewFlagSet("images delete", flag.ExitOnError)
+	id := flags.String("id", "", "laptop ID")
+	imageID := flags.String("image", "", "image ID")
+	flags.Parse(args)
+
+	images, err := a.laptopClient().DeleteImage(context.Background(), *id, *imageID)
+	if err != nil {
+		return err
+	}
+
+	return a.printImages(images)
+}
+
+func runSetPrimaryImage(a *app, args []string) error {
+	flags := flag.NewFlagSet("images set-primary", flag.ExitOnError)
+	id := flags.String("id", "", "laptop ID")
+	imageID := flags.String("image", "", "image ID")
+	flags.Parse(args)
+
+	images, err := a.laptopClient().SetPrimaryImage(context.Background(), *id, *imageID)
+	if err != nil {
+		return err
+	}
+
+	return a.printImages(images)
+}
+
+func runReorderImages(a *app, args []string) error {
+	flags := flag.NewFlagSet("images reorder", flag.ExitOnError)
+	id := flags.String("id", "", "laptop ID")
+	imageIDs := flags.String("images", "", "comma-separated image IDs to put first, the other images keep their order after them")
+	flags.Parse(args)
+
+	images, err := a.laptopClient().ReorderImages(context.Background(), *id, strings.Split(*imageIDs, ","))
+	if err != nil {
+		return err
+	}
+
+	return a.printImages(images)
+}
+
+// printImages prints the images of a laptop gallery, the primary image first
+func (a *app) printImages(images []*pb.LaptopImage) error {
+	var messages []proto.Message
+	var rows [][]string
+	for _, image := range images {
+		messages = append(messages, image)
+		rows = append(rows, []string{
+			fmt.Sprint(image.GetOrder()),
+			image.GetId(),
+			image.GetType(),
+			fmt.Sprint(image.GetSize()),
+		})
+	}
+
+	return a.printer.List(messages, []string{"ORDER", "ID", "TYPE", "SIZE"}, rows)
+}
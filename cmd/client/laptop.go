@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/thewalkers2012/grpc-example/client"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/serializer"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+func (a *app) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), a.timeout)
+}
+
+func (a *app) laptopClient() *client.LaptopClient {
+	return client.NewLaptopClient(
+		a.conn,
+		client.WithTimeout(a.timeout),
+		client.WithStreamTimeout(a.timeout),
+	)
+}
+
+// readLaptopsFromJSONFile reads a single laptop or an array of laptops from a JSON file
+func readLaptopsFromJSONFile(filename string) ([]*pb.Laptop, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read laptop file: %w", err)
+	}
+
+	data = bytes.TrimSpace(data)
+	if !bytes.HasPrefix(data, []byte("[")) {
+		laptop := &pb.Laptop{}
+		err = serializer.JSONToProtobuf(data, laptop)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse laptop: %w", err)
+		}
+		return []*pb.Laptop{laptop}, nil
+	}
+
+	var items []json.RawMessage
+	err = json.Unmarshal(data, &items)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse laptop list: %w", err)
+	}
+
+	laptops := make([]*pb.Laptop, len(items))
+	for i, item := range items {
+		laptops[i] = &pb.Laptop{}
+		err = serializer.JSONToProtobuf(item, laptops[i])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse laptop %d: %w", i, err)
+		}
+	}
+
+	return laptops, nil
+}
+
+func runCreate(a *app, args []string) error {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	file := flags.String("file", "", "JSON file with a laptop or an array of laptops")
+	samples := flags.Int("sample", 0, "number of random sample laptops to create")
+	idempotencyKey := flags.String("idempotency-key", "", "key to safely retry the request; suffixed with the laptop index when creating many")
+	flags.Parse(args)
+
+	var laptops []*pb.Laptop
+	if *file != "" {
+		var err error
+		laptops, err = readLaptopsFromJSONFile(*file)
+		if err != nil {
+			return err
+		}
+	}
+	for i := 0; i < *samples; i++ {
+		laptops = append(laptops, sample.NewLaptop())
+	}
+	if len(laptops) == 0 {
+		return errors.New("either -file or -sample is required")
+	}
+
+	var messages []proto.Message
+	var rows [][]string
+	laptopClient := a.laptopClient()
+	for i, laptop := range laptops {
+		ctx := context.Background()
+		if *idempotencyKey != "" {
+			key := *idempotencyKey
+			if len(laptops) > 1 {
+				key = fmt.Sprintf("%s-%d", key, i)
+			}
+			ctx = metadata.AppendToOutgoingContext(ctx, service.IdempotencyKeyHeader, key)
+		}
+
+		id, err := laptopClient.CreateLaptop(ctx, laptop)
+		if err != nil {
+			return err
+		}
+
+		messages = append(messages, &pb.CreateLaptopResponse{Id: id})
+		rows = append(rows, []string{id})
+	}
+
+	return a.printer.List(messages, []string{"ID"}, rows)
+}
+
+// filterFlags defines the search filter flags, the returned function builds the filter after parsing.
+// The max price is in the currency of the returned flag.
+func filterFlags(flags *flag.FlagSet) (func() *pb.Filter, *string) {
+	maxPrice := flags.Float64("max-price", 0, "maximum price (0 means no limit)")
+	currency := flags.String("currency", service.USD, "currency of the prices")
+	minCores := flags.Uint("min-cores", 0, "minimum number of CPU cores")
+	minGhz := flags.Float64("min-ghz", 0, "minimum CPU frequency in GHz")
+	minRAM := flags.Uint64("min-ram", 0, "minimum RAM in GB")
+	query := flags.String("query", "", "words of the brand, name, CPU or GPU, like \"thinkpad i7 rtx\"")
+	sortOrder := flags.String("sort", "", "sort by \"price\" or \"-price\", by relevance of the query by default")
+
+	filter := func() *pb.Filter {
+		filter := &pb.Filter{
+			MaxPriceUsd: math.MaxFloat64,
+			MinCpuCores: uint32(*minCores),
+			MinCpuGhz:   *minGhz,
+			MinRam:      &pb.Memory{Value: *minRAM, Unit: pb.Memory_GIGABYTE},
+			Query:       *query,
+		}
+
+		switch {
+		case *maxPrice == 0:
+		case *currency == service.USD:
+			filter.MaxPriceUsd = *maxPrice
+		default:
+			filter.MaxPrice = service.NewMoney(*currency, *maxPrice)
+		}
+
+		switch *sortOrder {
+		case "price":
+			filter.SortOrder = pb.Filter_PRICE_ASCENDING
+		case "-price":
+			filter.SortOrder = pb.Filter_PRICE_DESCENDING
+		}
+
+		return filter
+	}
+
+	return filter, currency
+}
+
+func runSearch(a *app, args []string) error {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	filter, currency := filterFlags(flags)
+	flags.Parse(args)
+
+	it, err := a.laptopClient().SearchLaptopInCurrency(context.Background(), filter(), *currency)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	header := append(append([]string{}, laptopHeader...), "PRICE")
+	var messages []proto.Message
+	var rows [][]string
+	for it.Next() {
+		price := it.ConvertedPrice()
+		priceText := fmt.Sprintf("%g %s", service.MoneyAmount(price), price.GetCurrencyCode())
+
+		messages = append(messages, it.Laptop())
+		rows = append(rows, append(laptopRow(it.Laptop()), priceText))
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+
+	return a.printer.List(messages, header, rows)
+}
+
+func runFacets(a *app, args []string) error {
+	flags := flag.NewFlagSet("facets", flag.ExitOnError)
+	filter, _ := filterFlags(flags)
+	flags.Parse(args)
+
+	res, err := a.laptopClient().SearchFacets(context.Background(), filter(), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	facets := []struct {
+		name   string
+		values []*pb.FacetValue
+	}{
+		{"brand", res.GetBrands()},
+		{"cpu brand", res.GetCpuBrands()},
+		{"ram (GB)", res.GetRamBuckets()},
+		{"price (USD)", res.GetPriceBuckets()},
+		{"screen panel", res.GetScreenPanels()},
+		{"release year", res.GetReleaseYears()},
+	}
+
+	rows := [][]string{{"total", "", fmt.Sprint(res.GetTotalCount())}}
+	for _, facet := range facets {
+		for _, value := range facet.values {
+			rows = append(rows, []string{facet.name, value.GetValue(), fmt.Sprint(value.GetCount())})
+		}
+	}
+
+	return a.printer.Rows(res, []string{"FACET", "VALUE", "COUNT"}, rows)
+}
+
+func runGet(a *app, args []string) error {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	id := flags.String("id", "", "laptop ID")
+	asOf := flags.String("as-of", "", "get the laptop as it was at this RFC 3339 time")
+	flags.Parse(args)
+
+	var laptop *pb.Laptop
+	var err error
+	if *asOf != "" {
+		var at time.Time
+		at, err = time.Parse(time.RFC3339, *asOf)
+		if err != nil {
+			return fmt.Errorf("invalid -as-of time: %w", err)
+		}
+		laptop, err = a.laptopClient().GetLaptopAsOf(context.Background(), *id, at)
+	} else {
+		laptop, err = a.laptopClient().GetLaptop(context.Background(), *id)
+	}
+	if err != nil {
+		return err
+	}
+
+	return a.printer.One(laptop, laptopHeader, laptopRow(laptop))
+}
+
+func runHistory(a *app, args []string) error {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	id := flags.String("id", "", "laptop ID")
+	flags.Parse(args)
+
+	versions, err := a.laptopClient().GetLaptopHistory(context.Background(), *id)
+	if err != nil {
+		return err
+	}
+
+	var messages []proto.Message
+	var rows [][]string
+	for _, version := range versions {
+		messages = append(messages, version)
+
+		row := []string{
+			fmt.Sprint(version.GetVersion()),
+			version.GetChange().String(),
+			version.GetActor(),
+			version.GetTime().AsTime().Format(time.RFC3339),
+		}
+		if len(version.GetDiffs()) == 0 {
+			rows = append(rows, append(row, "", "", ""))
+		}
+		for _, diff := range version.GetDiffs() {
+			rows = append(rows, append(row[:4:4], diff.GetField(), diff.GetOldValue(), diff.GetNewValue()))
+		}
+	}
+
+	return a.printer.List(messages, []string{"VERSION", "CHANGE", "ACTOR", "TIME", "FIELD", "OLD", "NEW"}, rows)
+}
+
+func runRestore(a *app, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	id := flags.String("id", "", "laptop ID")
+	flags.Parse(args)
+
+	laptop, err := a.laptopClient().RestoreLaptop(context.Background(), *id)
+	if err != nil {
+		return err
+	}
+
+	return a.printer.One(laptop, laptopHeader, laptopRow(laptop))
+}
+
+func runUpdate(a *app, args []string) error {
+	flags := flag.NewFlagSet("update", flag.ExitOnError)
+	file := flags.String("file", "", "JSON file with the laptop to save, it replaces the laptop with the same ID")
+	flags.Parse(args)
+
+	laptops, err := readLaptopsFromJSONFile(*file)
+	if err != nil {
+		return err
+	}
+	if len(laptops) != 1 {
+		return fmt.Errorf("expect a single laptop, got %d", len(laptops))
+	}
+
+	laptop, err := a.laptopClient().UpdateLaptop(context.Background(), laptops[0])
+	if err != nil {
+		return err
+	}
+
+	return a.printer.One(laptop, laptopHeader, laptopRow(laptop))
+}
+
+func runDelete(a *app, args []string) error {
+	flags := flag.NewFlagSet("delete", flag.ExitOnError)
+	id := flags.String("id", "", "laptop ID")
+	flags.Parse(args)
+
+	err := a.laptopClient().DeleteLaptop(context.Background(), *id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "deleted laptop %s\n", *id)
+	return nil
+}
+
+func runWatch(a *app, args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	filter, _ := filterFlags(flags)
+	snapshot := flags.Bool("snapshot", false, "print the laptops that match the filter before the live events")
+	flags.Parse(args)
+
+	// watch until interrupted
+	watcher, err := a.laptopClient().WatchLaptops(context.Background(), filter(), *snapshot)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for watcher.Next() {
+		res := watcher.Response()
+
+		var row []string
+		switch data := res.GetData().(type) {
+		case *pb.WatchLaptopsResponse_SnapshotLaptop:
+			row = append([]string{"SNAPSHOT"}, laptopRow(data.SnapshotLaptop)...)
+		case *pb.WatchLaptopsResponse_SnapshotComplete:
+			row = []string{"SNAPSHOT_COMPLETE"}
+		case *pb.WatchLaptopsResponse_Event:
+			row = append([]string{data.Event.GetType().String()}, laptopRow(data.Event.GetLaptop())...)
+		}
+
+		err := a.printer.Line(res, row)
+		if err != nil {
+			return err
+		}
+	}
+
+	return watcher.Err()
+}
+
+func runUploadImage(a *app, args []string) error {
+	flags := flag.NewFlagSet("upload-image", flag.ExitOnError)
+	id := flags.String("id", "", "laptop ID")
+	imagePath := flags.String("file", "", "path of the image file")
+	idempotencyKey := flags.String("idempotency-key", "", "key to safely retry the request")
+	flags.Parse(args)
+
+	ctx := context.Background()
+	if *idempotencyKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, service.IdempotencyKeyHeader, *idempotencyKey)
+	}
+
+	var total int64
+	if info, err := os.Stat(*imagePath); err == nil {
+		total = info.Size()
+	}
+
+	progress := func(sent int64) {
+		fmt.Fprintf(os.Stderr, "\ruploaded %d/%d bytes", sent, total)
+		if sent == total {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+
+	res, err := a.laptopClient().UploadImageFile(ctx, *id, *imagePath, progress)
+	if err != nil {
+		return err
+	}
+
+	row := []string{res.GetId(), fmt.Sprint(res.GetSize()), fmt.Sprint(res.GetDeduplicated())}
+	return a.printer.One(res, []string{"ID", "SIZE", "DEDUPLICATED"}, row)
+}
+
+func runRate(a *app, args []string) error {
+	flags := flag.NewFlagSet("rate", flag.ExitOnError)
+	id := flags.String("id", "", "laptop ID")
+	score := flags.Float64("score", 0, "score between 1 and 10")
+	flags.Parse(args)
+
+	responses, err := a.laptopClient().RateLaptop(context.Background(), []string{*id}, []float64{*score})
+	if err != nil {
+		return err
+	}
+	if len(responses) == 0 {
+		return errors.New("no rating is returned")
+	}
+	res := responses[0]
+
+	row := []string{
+		res.GetLaptopId(),
+		fmt.Sprint(res.GetRatedCount()),
+		fmt.Sprintf("%.2f", res.GetAverageScore()),
+	}
+
+	return a.printer.One(res, []string{"LAPTOP ID", "RATED COUNT", "AVERAGE SCORE"}, row)
+}
+
+func runImport(a *app, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	file := flags.String("file", "", "file of laptops, as JSON Lines or length-delimited binary protobuf")
+	format := flags.String("format", "auto", "file format: jsonl, binary or auto to detect it from the file extension")
+	flags.Parse(args)
+
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return fmt.Errorf("cannot open laptop file: %w", err)
+	}
+	defer f.Close()
+
+	if *format == "auto" {
+		*format = "binary"
+		switch filepath.Ext(*file) {
+		case ".jsonl", ".ndjson", ".json":
+			*format = "jsonl"
+		}
+	}
+
+	var next func() (*pb.Laptop, error)
+	switch *format {
+	case "jsonl":
+		next = jsonLinesReader(f)
+	case "binary":
+		next = delimitedReader(f)
+	default:
+		return fmt.Errorf("unknown file format %q", *format)
+	}
+
+	res, err := a.laptopClient().BulkCreateLaptops(context.Background(), next)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range res.GetResults() {
+		if codes.Code(result.GetCode()) != codes.OK {
+			fmt.Fprintf(os.Stderr, "laptop %d: %s: %s\n", result.GetIndex(), codes.Code(result.GetCode()), result.GetMessage())
+		}
+	}
+
+	row := []string{fmt.Sprint(res.GetCreatedCount()), fmt.Sprint(res.GetFailedCount())}
+	return a.printer.One(res, []string{"CREATED", "FAILED"}, row)
+}
+
+// jsonLinesReader returns the laptops of a JSON Lines file one by one, skipping blank lines
+func jsonLinesReader(reader io.Reader) func() (*pb.Laptop, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 1<<20)
+	line := 0
+
+	return func() (*pb.Laptop, error) {
+		for scanner.Scan() {
+			line++
+			data := bytes.TrimSpace(scanner.Bytes())
+			if len(data) == 0 {
+				continue
+			}
+
+			laptop := &pb.Laptop{}
+			err := serializer.JSONToProtobuf(data, laptop)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse laptop on line %d: %w", line, err)
+			}
+			return laptop, nil
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+// delimitedReader returns the laptops of a length-delimited binary protobuf file one by one
+func delimitedReader(reader io.Reader) func() (*pb.Laptop, error) {
+	buffered := bufio.NewReader(reader)
+
+	return func() (*pb.Laptop, error) {
+		laptop := &pb.Laptop{}
+		err := serializer.ReadDelimited(buffered, laptop)
+		if err != nil {
+			return nil, err
+		}
+		return laptop, nil
+	}
+}
@@ -7,84 +7,62 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"strings"
+	"os"
 	"time"
 
 	"github.com/thewalkers2012/grpc-example/client"
-	"github.com/thewalkers2012/grpc-example/pb"
-	"github.com/thewalkers2012/grpc-example/sample"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 )
 
-func testCreateLaptop(laptopClient *client.LaptopClient) {
-	laptopClient.CreateLaptop(sample.NewLaptop())
+// app holds everything a subcommand needs to talk to the server
+type app struct {
+	conn    *grpc.ClientConn
+	address string
+	timeout time.Duration
+	tokens  *tokenCache
+	printer *printer
 }
 
-func testSearchLaptop(laptopClient *client.LaptopClient) {
-	for i := 0; i < 10; i++ {
-		laptopClient.CreateLaptop(sample.NewLaptop())
-	}
-
-	filter := &pb.Filter{
-		MaxPriceUsd: 3000,
-		MinCpuCores: 4,
-		MinCpuGhz:   2.5,
-		MinRam:      &pb.Memory{Value: 8, Unit: pb.Memory_GIGABYTE},
-	}
-
-	laptopClient.SearchLaptop(filter)
+// command is a CLI subcommand
+type command struct {
+	name  string
+	usage string
+	run   func(app *app, args []string) error
 }
 
-func testRateLaptop(laptopClient *client.LaptopClient) {
-	n := 3
-	laptopIDs := make([]string, n)
-
-	for i := 0; i < n; i++ {
-		laptop := sample.NewLaptop()
-		laptopIDs[i] = laptop.GetId()
-		laptopClient.CreateLaptop(laptop)
-	}
-
-	scores := make([]float64, n)
-	for {
-		fmt.Print("rate laptop (y/n)?")
-		var answer string
-		fmt.Scan(&answer)
-
-		if strings.ToLower(answer) != "y" {
-			break
-		}
-		for i := 0; i < n; i++ {
-			scores[i] = sample.RandomLaptopScore()
-		}
-
-		err := laptopClient.RateLaptop(laptopIDs, scores)
-		if err != nil {
-			log.Fatal(err)
-		}
+func commands() []*command {
+	return []*command{
+		{name: "login", usage: "log in and cache the access token", run: runLogin},
+		{name: "refresh", usage: "replace the cached access token with a new one", run: runRefresh},
+		{name: "create", usage: "create laptops from a JSON file or random samples", run: runCreate},
+		{name: "import", usage: "import laptops from a JSON Lines or length-delimited protobuf file", run: runImport},
+		{name: "search", usage: "search laptops with a filter", run: runSearch},
+		{name: "facets", usage: "count the laptops that match a filter by brand, CPU, RAM, price, panel and year", run: runFacets},
+		{name: "get", usage: "get a laptop by ID", run: runGet},
+		{name: "update", usage: "replace a laptop with the one of a JSON file (admin)", run: runUpdate},
+		{name: "delete", usage: "delete a laptop by ID (admin)", run: runDelete},
+		{name: "restore", usage: "restore a deleted laptop by ID (admin)", run: runRestore},
+		{name: "history", usage: "print the versions of a laptop with the changed fields (admin)", run: runHistory},
+		{name: "watch", usage: "print the events of the laptops that match a filter", run: runWatch},
+		{name: "upload-image", usage: "upload an image for a laptop", run: runUploadImage},
+		{name: "images", usage: "manage the image gallery of a laptop (list, delete, set-primary, reorder)", run: runImages},
+		{name: "rate", usage: "rate a laptop", run: runRate},
+		{name: "catalog", usage: "export or import the catalog archive (admin)", run: runCatalog},
+		{name: "users", usage: "manage users (list, create, set-role)", run: runUsers},
+		{name: "tenants", usage: "manage tenants (list, create) as an admin of the default tenant", run: runTenants},
+		{name: "audit", usage: "list the audit log entries (admin) or verify the hash chain of an audit log file", run: runAudit},
 	}
 }
 
-func testUploadImage(laptopClient *client.LaptopClient) {
-	laptop := sample.NewLaptop()
-	laptopClient.CreateLaptop(laptop)
-	laptopClient.UploadImage(laptop.GetId(), "tmp/laptop.jpeg")
-}
-
-const (
-	username        = "admin1"
-	password        = "secret"
-	refreshDuration = 30 * time.Second
-)
-
-func authMethods() map[string]bool {
-	const laptopServicePath = "/pb.LaptopService/"
-	return map[string]bool{
-		laptopServicePath + "CreateLaptop": true,
-		laptopServicePath + "UploadImage":  true,
-		laptopServicePath + "RateLaptop":   true,
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] <command> [command flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands() {
+		fmt.Fprintf(out, "  %-14s %s\n", cmd.name, cmd.usage)
 	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
 }
 
 func loadTLSCredentials() (credentials.TransportCredentials, error) {
@@ -115,10 +93,41 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
 }
 
 func main() {
-	serverAddress := flag.String("address", "", "the server address")
+	serverAddress := flag.String("address", "0.0.0.0:8080", "the server address, a comma-separated list of addresses or a target such as dns:///host:port")
 	enableTLS := flag.Bool("tls", false, "enable SSL/TLS")
+	output := flag.String("output", "table", "output format: table or json")
+	configDir := flag.String("config-dir", defaultConfigDir(), "directory to cache access tokens")
+	timeout := flag.Duration("timeout", 5*time.Second, "timeout of each RPC")
+	credentialsFile := flag.String("credentials", "", "JSON file with a username and password or an access token, instead of the cached login")
+	flag.Usage = usage
 	flag.Parse()
-	log.Printf("dial server %s, TLS = %t", *serverAddress, *enableTLS)
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var cmd *command
+	for _, c := range commands() {
+		if c.name == flag.Arg(0) {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	printer, err := newPrinter(*output, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tokens, err := loadTokenCache(*configDir)
+	if err != nil {
+		log.Fatal("cannot load token cache: ", err)
+	}
 
 	transportOption := grpc.WithInsecure()
 
@@ -131,27 +140,39 @@ func main() {
 		transportOption = grpc.WithTransportCredentials(tlsCredentials)
 	}
 
-	cc1, err := grpc.Dial(*serverAddress, transportOption)
+	authConn, err := client.Dial(*serverAddress, transportOption)
 	if err != nil {
 		log.Fatal("cannot dial server: ", err)
 	}
+	defer authConn.Close()
 
-	authClient := client.NewAuthClient(cc1, username, password)
-	interceptor, err := client.NewAuthInterceptor(authClient, authMethods(), refreshDuration)
-	if err != nil {
-		log.Fatal("cannot create auth interceptor: ", err)
+	var source client.CredentialSource = &cachedTokenSource{tokens: tokens, address: *serverAddress}
+	if *credentialsFile != "" {
+		source = client.NewFileSource(authConn, *credentialsFile)
+	} else if os.Getenv(client.DefaultEnvPrefix+"USERNAME") != "" || os.Getenv(client.DefaultEnvPrefix+"ACCESS_TOKEN") != "" {
+		source = client.NewEnvSource(authConn, client.DefaultEnvPrefix)
 	}
 
-	cc2, err := grpc.Dial(
-		*serverAddress,
-		grpc.WithUnaryInterceptor(interceptor.Unary()),
-		grpc.WithStreamInterceptor(interceptor.Stream()),
-		transportOption,
-	)
+	authInterceptor := client.NewAuthInterceptor(source, nil, time.Minute)
+	defer authInterceptor.Close()
+
+	conn, err := client.Dial(*serverAddress, transportOption, grpc.WithPerRPCCredentials(authInterceptor))
 	if err != nil {
 		log.Fatal("cannot dial server: ", err)
 	}
+	defer conn.Close()
+
+	a := &app{
+		conn:    conn,
+		address: *serverAddress,
+		timeout: *timeout,
+		tokens:  tokens,
+		printer: printer,
+	}
 
-	laptopClient := client.NewLaptopClient(cc2)
-	testRateLaptop(laptopClient)
+	err = cmd.run(a, flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/serializer"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// printer prints RPC results as a table or as JSON
+type printer struct {
+	format string
+	out    io.Writer
+}
+
+func newPrinter(format string, out io.Writer) (*printer, error) {
+	if format != "table" && format != "json" {
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+
+	return &printer{format: format, out: out}, nil
+}
+
+// One prints a single message
+func (p *printer) One(message proto.Message, header []string, row []string) error {
+	if p.format == "json" {
+		data, err := serializer.ProtobufToJSON(message)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(p.out, data)
+		return err
+	}
+
+	return p.table(header, [][]string{row})
+}
+
+// Rows prints a single message that is shown as several rows of a table
+func (p *printer) Rows(message proto.Message, header []string, rows [][]string) error {
+	if p.format == "json" {
+		return p.One(message, header, nil)
+	}
+
+	return p.table(header, rows)
+}
+
+// List prints a list of messages
+func (p *printer) List(messages []proto.Message, header []string, rows [][]string) error {
+	if p.format == "json" {
+		items := make([]string, len(messages))
+		for i, message := range messages {
+			data, err := serializer.ProtobufToJSON(message)
+			if err != nil {
+				return err
+			}
+			items[i] = data
+		}
+		_, err := fmt.Fprintf(p.out, "[%s]\n", strings.Join(items, ",\n"))
+		return err
+	}
+
+	return p.table(header, rows)
+}
+
+// Line prints a message of a stream as soon as it is received, on a single line
+func (p *printer) Line(message proto.Message, row []string) error {
+	if p.format == "json" {
+		data, err := protojson.Marshal(message)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(p.out, string(data))
+		return err
+	}
+
+	_, err := fmt.Fprintln(p.out, strings.Join(row, "\t"))
+	return err
+}
+
+func (p *printer) table(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(p.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+var laptopHeader = []string{"ID", "BRAND", "NAME", "CPU", "CORES", "RAM", "PRICE (USD)"}
+
+func laptopRow(laptop *pb.Laptop) []string {
+	return []string{
+		laptop.GetId(),
+		laptop.GetBrand(),
+		laptop.GetName(),
+		laptop.GetCpu().GetName(),
+		fmt.Sprint(laptop.GetCpu().GetNumberCores()),
+		fmt.Sprintf("%d %s", laptop.GetRam().GetValue(), laptop.GetRam().GetUnit()),
+		fmt.Sprintf("%.2f", laptop.GetPriceUsd()),
+	}
+}
+
+var userHeader = []string{"USERNAME", "ROLE", "TENANT"}
+
+func userRow(user *pb.User) []string {
+	return []string{user.GetUsername(), user.GetRole(), user.GetTenantId()}
+}
+
+var tenantHeader = []string{"ID"}
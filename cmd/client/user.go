@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/thewalkers2012/grpc-example/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+func (a *app) authService() pb.AuthServiceClient {
+	return pb.NewAuthServiceClient(a.conn)
+}
+
+func runLogin(a *app, args []string) error {
+	flags := flag.NewFlagSet("login", flag.ExitOnError)
+	username := flags.String("username", "", "username")
+	password := flags.String("password", "", "password")
+	tenantID := flags.String("tenant", "", "tenant of the user (the default tenant if empty)")
+	flags.Parse(args)
+
+	ctx, cancel := a.context()
+	defer cancel()
+
+	req := &pb.LoginRequest{
+		Username: *username,
+		Password: *password,
+		TenantId: *tenantID,
+	}
+
+	res, err := a.authService().Login(ctx, req)
+	if err != nil {
+		return fmt.Errorf("cannot login: %w", err)
+	}
+
+	err = a.tokens.Save(a.address, res.GetAccessToken())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("logged in to %s as %s\n", a.address, *username)
+	return nil
+}
+
+func runRefresh(a *app, args []string) error {
+	ctx, cancel := a.context()
+	defer cancel()
+
+	res, err := a.authService().RefreshToken(ctx, &pb.RefreshTokenRequest{})
+	if err != nil {
+		return fmt.Errorf("cannot refresh token: %w", err)
+	}
+
+	err = a.tokens.Save(a.address, res.GetAccessToken())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("refreshed the access token of %s\n", a.address)
+	return nil
+}
+
+func runUsers(a *app, args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected a subcommand: list, create or set-role")
+	}
+
+	switch args[0] {
+	case "list":
+		return runListUsers(a, args[1:])
+	case "create":
+		return runCreateUser(a, args[1:])
+	case "set-role":
+		return runSetUserRole(a, args[1:])
+	default:
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+}
+
+func runListUsers(a *app, args []string) error {
+	ctx, cancel := a.context()
+	defer cancel()
+
+	res, err := a.authService().ListUsers(ctx, &pb.ListUsersRequest{})
+	if err != nil {
+		return fmt.Errorf("cannot list users: %w", err)
+	}
+
+	var messages []proto.Message
+	var rows [][]string
+	for _, user := range res.GetUsers() {
+		messages = append(messages, user)
+		rows = append(rows, userRow(user))
+	}
+
+	return a.printer.List(messages, userHeader, rows)
+}
+
+func runCreateUser(a *app, args []string) error {
+	flags := flag.NewFlagSet("users create", flag.ExitOnError)
+	username := flags.String("username", "", "username")
+	password := flags.String("password", "", "password")
+	role := flags.String("role", "user", "role of the user")
+	flags.Parse(args)
+
+	ctx, cancel := a.context()
+	defer cancel()
+
+	req := &pb.CreateUserRequest{
+		Username: *username,
+		Password: *password,
+		Role:     *role,
+	}
+
+	res, err := a.authService().CreateUser(ctx, req)
+	if err != nil {
+		return fmt.Errorf("cannot create user: %w", err)
+	}
+
+	return a.printer.One(res.GetUser(), userHeader, userRow(res.GetUser()))
+}
+
+func runSetUserRole(a *app, args []string) error {
+	flags := flag.NewFlagSet("users set-role", flag.ExitOnError)
+	username := flags.String("username", "", "username")
+	role := flags.String("role", "", "new role of the user")
+	flags.Parse(args)
+
+	ctx, cancel := a.context()
+	defer cancel()
+
+	req := &pb.UpdateUserRoleRequest{
+		Username: *username,
+		Role:     *role,
+	}
+
+	res, err := a.authService().UpdateUserRole(ctx, req)
+	if err != nil {
+		return fmt.Errorf("cannot update user role: %w", err)
+	}
+
+	return a.printer.One(res.GetUser(), userHeader, userRow(res.GetUser()))
+}
+
+func runTenants(a *app, args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected a subcommand: list or create")
+	}
+
+	switch args[0] {
+	case "list":
+		return runListTenants(a, args[1:])
+	case "create":
+		return runCreateTenant(a, args[1:])
+	default:
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+}
+
+func runListTenants(a *app, args []string) error {
+	ctx, cancel := a.context()
+	defer cancel()
+
+	res, err := a.authService().ListTenants(ctx, &pb.ListTenantsRequest{})
+	if err != nil {
+		return fmt.Errorf("cannot list tenants: %w", err)
+	}
+
+	var messages []proto.Message
+	var rows [][]string
+	for _, tenant := range res.GetTenants() {
+		messages = append(messages, tenant)
+		rows = append(rows, []string{tenant.GetId()})
+	}
+
+	return a.printer.List(messages, tenantHeader, rows)
+}
+
+func runCreateTenant(a *app, args []string) error {
+	flags := flag.NewFlagSet("tenants create", flag.ExitOnError)
+	tenantID := flags.String("id", "", "ID of the tenant")
+	adminUsername := flags.String("admin-username", "", "username of the first admin of the tenant")
+	adminPassword := flags.String("admin-password", "", "password of the first admin of the tenant")
+	flags.Parse(args)
+
+	ctx, cancel := a.context()
+	defer cancel()
+
+	req := &pb.CreateTenantRequest{
+		TenantId:      *tenantID,
+		AdminUsername: *adminUsername,
+		AdminPassword: *adminPassword,
+	}
+
+	res, err := a.authService().CreateTenant(ctx, req)
+	if err != nil {
+		return fmt.Errorf("cannot create tenant: %w", err)
+	}
+
+	return a.printer.One(res, userHeader, userRow(res.GetAdmin()))
+}
@@ -1,19 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/thewalkers2012/grpc-example/gateway"
 	"github.com/thewalkers2012/grpc-example/pb"
 	"github.com/thewalkers2012/grpc-example/service"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection"
 )
 
 func seedUsers(userStore service.UserStore) error {
@@ -24,12 +34,18 @@ func seedUsers(userStore service.UserStore) error {
 	return createUser(userStore, "user1", "secret", "user")
 }
 
+// createUser saves a new user, unless a user with the same name was saved before the server restarted
 func createUser(userStore service.UserStore, username, password, role string) error {
 	user, err := service.NewUser(username, password, role)
 	if err != nil {
 		return err
 	}
-	return userStore.Save(user)
+
+	err = userStore.Save(context.Background(), user)
+	if errors.Is(err, service.ErrAlreadyExists) {
+		return nil
+	}
+	return err
 }
 
 const (
@@ -39,10 +55,48 @@ const (
 
 func accessibleRoles() map[string][]string {
 	const laptopServicePath = "/pb.LaptopService/"
+	const authServicePath = "/pb.AuthService/"
+	const catalogServicePath = "/pb.CatalogService/"
 	return map[string][]string{
-		laptopServicePath + "CreateLaptop": {"admin"},
-		laptopServicePath + "UploadImage":  {"admin"},
-		laptopServicePath + "RateLaptop":   {"admin", "user"},
+		laptopServicePath + "CreateLaptop":      {"admin"},
+		laptopServicePath + "BulkCreateLaptops": {"admin"},
+		laptopServicePath + "UpdateLaptop":      {"admin"},
+		laptopServicePath + "DeleteLaptop":      {"admin"},
+		laptopServicePath + "RestoreLaptop":     {"admin"},
+		laptopServicePath + "GetLaptopHistory":  {"admin"},
+		laptopServicePath + "UploadImage":       {"admin"},
+		laptopServicePath + "DeleteImage":       {"admin"},
+		laptopServicePath + "SetPrimaryImage":   {"admin"},
+		laptopServicePath + "ReorderImages":     {"admin"},
+		laptopServicePath + "RateLaptop":        {"admin", "user"},
+		authServicePath + "RefreshToken":        {"admin", "user"},
+		authServicePath + "CreateUser":          {"admin"},
+		authServicePath + "ListUsers":           {"admin"},
+		authServicePath + "UpdateUserRole":      {"admin"},
+		authServicePath + "CreateTenant":        {"admin"},
+		authServicePath + "ListTenants":         {"admin"},
+		authServicePath + "ListAuditEntries":    {"admin"},
+		catalogServicePath + "ExportCatalog":    {"admin"},
+		catalogServicePath + "ImportCatalog":    {"admin"},
+	}
+}
+
+// auditedMethods are the admin mutations recorded in the audit log.
+// Logins, token refreshes and role changes are recorded by the auth server.
+func auditedMethods() []string {
+	return []string{
+		"/pb.LaptopService/CreateLaptop",
+		"/pb.LaptopService/BulkCreateLaptops",
+		"/pb.LaptopService/UpdateLaptop",
+		"/pb.LaptopService/DeleteLaptop",
+		"/pb.LaptopService/RestoreLaptop",
+		"/pb.LaptopService/UploadImage",
+		"/pb.LaptopService/DeleteImage",
+		"/pb.LaptopService/SetPrimaryImage",
+		"/pb.LaptopService/ReorderImages",
+		"/pb.AuthService/CreateUser",
+		"/pb.AuthService/CreateTenant",
+		"/pb.CatalogService/ImportCatalog",
 	}
 }
 
@@ -77,24 +131,90 @@ func loadTLSCredential() (credentials.TransportCredentials, error) {
 func main() {
 	port := flag.Int("port", 0, "the server port")
 	enableTLS := flag.Bool("tls", false, "enable SSL/TLS")
+	enableReflection := flag.Bool("reflection", false, "enable gRPC server reflection")
+	restPort := flag.Int("rest-port", 0, "the REST gateway port (0 to disable)")
+	webPort := flag.Int("web-port", 0, "the gRPC-Web port for browser clients (0 to disable)")
+	corsOrigins := flag.String("cors-origins", "*", "comma-separated origins allowed to call gRPC-Web")
+	idempotencyTTL := flag.Duration("idempotency-ttl", service.DefaultIdempotencyTTL, "how long responses are remembered by idempotency key")
+	laptopFolder := flag.String("laptop-folder", "", "folder to store the tenants and their laptops, history and users in a subfolder per tenant, shared by all servers using it (in memory if empty)")
+	auditLogFile := flag.String("audit-log", "", "file of the hash-chained audit log of logins, permission denials and admin mutations (disabled if empty)")
+	auditKeyFile := flag.String("audit-key-file", "", "file of the secret key of the audit log hash chain, required with -audit-log")
+	imageCollectInterval := flag.Duration("image-gc-interval", service.DefaultImageCollectInterval, "how often the images of deleted laptops are removed (0 to disable)")
+	imageRetention := flag.Duration("image-retention", service.DefaultImageRetention, "how long the images of a deleted laptop are kept, so that restoring it brings them back")
+	exchangeRateFile := flag.String("exchange-rates", "", "JSON file of the exchange rates of the supported currencies, reloaded on SIGHUP (USD only if empty)")
 	flag.Parse()
 	log.Printf("start server on post %d, TLS = %t", *port, *enableTLS)
 
-	userStore := service.NewInMemoryUserStore()
-	err := seedUsers(userStore)
+	// every tenant has its own stores, the default tenant is the one of the seeded users
+	tenantStore, err := newTenantStore(*laptopFolder)
+	if err != nil {
+		log.Fatal("cannot load tenants: ", err)
+	}
+
+	defaultTenant, err := findDefaultTenant(tenantStore)
+	if err != nil {
+		log.Fatal("cannot create default tenant: ", err)
+	}
+
+	if *imageCollectInterval > 0 {
+		go service.RunImageCollector(context.Background(), tenantStore, *imageCollectInterval, *imageRetention)
+	}
+
+	userStore := defaultTenant.UserStore
+	err = seedUsers(userStore)
 	if err != nil {
-		log.Fatal("cannot seed users")
+		log.Fatal("cannot seed users: ", err)
+	}
+
+	authServerOptions := []service.AuthServerOption{service.WithAuthTenants(tenantStore)}
+	var interceptorOptions []service.AuthInterceptorOption
+	var auditLog *service.FileAuditLog
+	if *auditLogFile != "" {
+		auditKey, err := loadAuditKey(*auditKeyFile)
+		if err != nil {
+			log.Fatal("cannot load audit log key: ", err)
+		}
+
+		auditLog, err = service.NewFileAuditLog(*auditLogFile, auditKey)
+		if err != nil {
+			log.Fatal("cannot open audit log: ", err)
+		}
+
+		authServerOptions = append(authServerOptions, service.WithAuthAuditLog(auditLog))
+		interceptorOptions = append(interceptorOptions, service.WithAuditLog(auditLog, auditedMethods()))
 	}
 
 	jwtManager := service.NewJWTManager(secretKey, tokenDuration)
-	authServer := service.NewAuthServer(userStore, jwtManager)
+	authServer := service.NewAuthServer(userStore, jwtManager, authServerOptions...)
 
-	laptopStore := service.NewInMemoryLaptopStore()
-	imageStore := service.NewDiskImageStore("img")
-	ratingStore := service.NewInMemoryRatingStore()
-	laptopServer := service.NewLaptopService(laptopStore, imageStore, ratingStore)
+	laptopStore := defaultTenant.LaptopStore
+	imageStore := defaultTenant.ImageStore
+	ratingStore := defaultTenant.RatingStore
+	idempotencyStore, err := newIdempotencyStore(*laptopFolder, *idempotencyTTL)
+	if err != nil {
+		log.Fatal("cannot load idempotency keys: ", err)
+	}
+	laptopServerOptions := []service.LaptopServerOption{
+		service.WithIdempotencyStore(idempotencyStore),
+		service.WithHistoryStore(defaultTenant.HistoryStore),
+		service.WithEventBus(defaultTenant.EventBus),
+		service.WithTenants(tenantStore),
+	}
+
+	if *exchangeRateFile != "" {
+		exchangeRates, err := service.NewFileExchangeRates(*exchangeRateFile)
+		if err != nil {
+			log.Fatal("cannot load exchange rates: ", err)
+		}
+		go reloadOnHangup(exchangeRates)
+		laptopServerOptions = append(laptopServerOptions, service.WithExchangeRates(exchangeRates))
+	}
 
-	interceptor := service.NewAuthInterceptor(jwtManager, accessibleRoles())
+	laptopServer := service.NewLaptopService(laptopStore, imageStore, ratingStore, laptopServerOptions...)
+
+	catalogServer := service.NewCatalogServer(laptopStore, imageStore, ratingStore, service.WithCatalogTenants(tenantStore))
+
+	interceptor := service.NewAuthInterceptor(jwtManager, accessibleRoles(), interceptorOptions...)
 	serverOptions := []grpc.ServerOption{
 		grpc.UnaryInterceptor(interceptor.Unary()),
 		grpc.StreamInterceptor(interceptor.Stream()),
@@ -111,7 +231,11 @@ func main() {
 	grpcServer := grpc.NewServer(serverOptions...)
 	pb.RegisterAuthServiceServer(grpcServer, authServer)
 	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
-	// reflection.Register(grpcServer)
+	pb.RegisterCatalogServiceServer(grpcServer, catalogServer)
+
+	if *enableReflection {
+		reflection.Register(grpcServer)
+	}
 
 	address := fmt.Sprintf("0.0.0.0:%d", *port)
 	listen, err := net.Listen("tcp", address)
@@ -119,8 +243,137 @@ func main() {
 		log.Fatal("can not start server: ", err)
 	}
 
+	if *restPort > 0 {
+		go runRESTServer(address, *restPort, *enableTLS)
+	}
+
+	if *webPort > 0 {
+		go runWebServer(grpcServer, *webPort, strings.Split(*corsOrigins, ","), *enableTLS)
+	}
+
+	go stopOnSignal(grpcServer)
+
 	err = grpcServer.Serve(listen)
 	if err != nil {
 		log.Fatal("cannot start server: ", err)
 	}
+
+	// the server is stopped, so nothing is recorded anymore
+	if auditLog != nil {
+		err = auditLog.Close()
+		if err != nil {
+			log.Print("cannot close audit log: ", err)
+		}
+	}
+}
+
+// newTenantStore returns the store of the tenants, kept in the laptop folder if there is one
+func newTenantStore(laptopFolder string) (service.TenantStore, error) {
+	newTenant := service.NewTenantFactory("img", laptopFolder)
+	if laptopFolder == "" {
+		return service.NewInMemoryTenantStore(newTenant), nil
+	}
+	return service.NewDiskTenantStore(laptopFolder, newTenant)
+}
+
+// findDefaultTenant returns the default tenant, created by the first server that starts
+func findDefaultTenant(tenantStore service.TenantStore) (*service.Tenant, error) {
+	tenant, err := tenantStore.Create(context.Background(), service.DefaultTenant)
+	if errors.Is(err, service.ErrAlreadyExists) {
+		return tenantStore.Find(context.Background(), service.DefaultTenant)
+	}
+	return tenant, err
+}
+
+// newIdempotencyStore returns the store of the idempotency keys, kept in the laptop folder if there is one,
+// so that a request retried on another server is not run twice
+func newIdempotencyStore(laptopFolder string, ttl time.Duration) (service.IdempotencyStore, error) {
+	if laptopFolder == "" {
+		return service.NewInMemoryIdempotencyStore(ttl), nil
+	}
+	return service.NewDiskIdempotencyStore(laptopFolder, ttl)
+}
+
+// shutdownTimeout is how long the server waits for the running requests when it is stopped
+const shutdownTimeout = 10 * time.Second
+
+// stopOnSignal stops the server gracefully when it receives SIGINT or SIGTERM,
+// or forcefully if the running requests are not done after shutdownTimeout
+func stopOnSignal(grpcServer *grpc.Server) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Print("stop server")
+
+	timer := time.AfterFunc(shutdownTimeout, grpcServer.Stop)
+	defer timer.Stop()
+	grpcServer.GracefulStop()
+}
+
+// loadAuditKey reads the secret key of the audit log from a file
+func loadAuditKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, service.ErrAuditKeyMissing
+	}
+
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(key), nil
+}
+
+// reloadOnHangup reloads the exchange rates every time the server receives SIGHUP
+func reloadOnHangup(exchangeRates *service.FileExchangeRates) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for range hangup {
+		err := exchangeRates.Reload()
+		if err != nil {
+			log.Print("cannot reload exchange rates: ", err)
+			continue
+		}
+		log.Print("reloaded exchange rates")
+	}
+}
+
+func runRESTServer(grpcAddress string, port int, enableTLS bool) {
+	transportOption := grpc.WithInsecure()
+	if enableTLS {
+		tlsCredentials, err := credentials.NewClientTLSFromFile("cert/ca-cert.pem", "")
+		if err != nil {
+			log.Fatal("cannot load gateway TLS credentials: ", err)
+		}
+		transportOption = grpc.WithTransportCredentials(tlsCredentials)
+	}
+
+	handler, err := gateway.NewHandler(context.Background(), grpcAddress, transportOption)
+	if err != nil {
+		log.Fatal("cannot create REST gateway: ", err)
+	}
+
+	log.Printf("start REST gateway on port %d", port)
+	err = listenAndServe(port, handler, enableTLS)
+	if err != nil {
+		log.Fatal("cannot start REST gateway: ", err)
+	}
+}
+
+func runWebServer(grpcServer *grpc.Server, port int, allowedOrigins []string, enableTLS bool) {
+	handler := gateway.NewWebHandler(grpcServer, allowedOrigins)
+
+	log.Printf("start gRPC-Web server on port %d, allowed origins = %v", port, allowedOrigins)
+	err := listenAndServe(port, handler, enableTLS)
+	if err != nil {
+		log.Fatal("cannot start gRPC-Web server: ", err)
+	}
+}
+
+func listenAndServe(port int, handler http.Handler, enableTLS bool) error {
+	address := fmt.Sprintf("0.0.0.0:%d", port)
+	if enableTLS {
+		return http.ListenAndServeTLS(address, "cert/server-cert.pem", "cert/server-key.pem", handler)
+	}
+	return http.ListenAndServe(address, handler)
 }
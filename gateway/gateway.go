@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/thewalkers2012/grpc-example/client"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// NewHandler returns an HTTP handler that serves the REST/JSON API
+// by proxying every request to the gRPC server at grpcAddress.
+// The connection to the gRPC server is closed when ctx is done.
+func NewHandler(ctx context.Context, grpcAddress string, dialOptions ...grpc.DialOption) (http.Handler, error) {
+	conn, err := grpc.DialContext(ctx, grpcAddress, dialOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot dial gRPC server: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := conn.Close(); err != nil {
+			log.Printf("cannot close gateway connection: %v", err)
+		}
+	}()
+
+	mux := runtime.NewServeMux(
+		runtime.WithIncomingHeaderMatcher(headerMatcher),
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
+			MarshalOptions: protojson.MarshalOptions{
+				UseProtoNames:   true,
+				EmitUnpopulated: true,
+			},
+			UnmarshalOptions: protojson.UnmarshalOptions{
+				DiscardUnknown: true,
+			},
+		}),
+	)
+
+	err = pb.RegisterAuthServiceHandler(ctx, mux, conn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot register auth service handler: %w", err)
+	}
+
+	err = pb.RegisterLaptopServiceHandler(ctx, mux, conn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot register laptop service handler: %w", err)
+	}
+
+	uploader := &imageUploader{
+		mux:    mux,
+		client: client.NewLaptopClient(conn, client.WithStreamTimeout(0)),
+	}
+	err = mux.HandlePath(http.MethodPost, "/v1/laptops/{laptop_id}/images", uploader.handle)
+	if err != nil {
+		return nil, fmt.Errorf("cannot register upload image handler: %w", err)
+	}
+
+	return ForwardBearerToken(mux), nil
+}
+
+// headerMatcher forwards the Idempotency-Key header as metadata,
+// in addition to the headers forwarded by default
+func headerMatcher(key string) (string, bool) {
+	if textproto.CanonicalMIMEHeaderKey(key) == "Idempotency-Key" {
+		return service.IdempotencyKeyHeader, true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// ForwardBearerToken strips the "Bearer " scheme from the Authorization header,
+// so that the raw access token is forwarded as the "authorization" metadata
+// that the server's AuthInterceptor reads.
+func ForwardBearerToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get("Authorization")
+		if len(value) > len("bearer ") && strings.EqualFold(value[:len("bearer ")], "bearer ") {
+			r.Header.Set("Authorization", strings.TrimSpace(value[len("bearer "):]))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
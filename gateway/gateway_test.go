@@ -0,0 +1,162 @@
+package gateway_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/gateway"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/serializer"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/grpc"
+)
+
+func TestGatewayCreateLaptopAndUploadImage(t *testing.T) {
+	t.Parallel()
+
+	testImageFolder := "../tmp"
+	imageFolder := t.TempDir()
+	_, grpcAddress := startTestServer(t, service.NewInMemoryLaptopStore(), imageFolder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler, err := gateway.NewHandler(ctx, grpcAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// login
+	res, err := http.Post(server.URL+"/v1/auth/login", "application/json",
+		bytes.NewBufferString(`{"username": "admin1", "password": "secret"}`))
+	require.NoError(t, err)
+	loginRes := decodeJSON(t, res)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	token := loginRes["access_token"].(string)
+
+	// create laptop without token
+	laptop := sample.NewLaptop()
+	laptopJSON, err := serializer.ProtobufToJSON(laptop)
+	require.NoError(t, err)
+	body := fmt.Sprintf(`{"laptop": %s}`, laptopJSON)
+
+	res, err = http.Post(server.URL+"/v1/laptops", "application/json", bytes.NewBufferString(body))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	// create laptop with bearer token
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/laptops", bytes.NewBufferString(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	created := decodeJSON(t, res)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, laptop.GetId(), created["id"])
+
+	// upload image as multipart form
+	image, err := os.ReadFile(testImageFolder + "/laptop.jpeg")
+	require.NoError(t, err)
+
+	form := &bytes.Buffer{}
+	writer := multipart.NewWriter(form)
+	part, err := writer.CreateFormFile("image", "laptop.jpeg")
+	require.NoError(t, err)
+	_, err = part.Write(image)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	req, err = http.NewRequest(http.MethodPost, server.URL+"/v1/laptops/"+laptop.GetId()+"/images", form)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	uploaded := decodeJSON(t, res)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.EqualValues(t, len(image), uploaded["size"])
+
+	require.NotEmpty(t, uploaded["id"])
+
+	checksum := sha256.Sum256(image)
+	savedImagePath := filepath.Join(imageFolder, hex.EncodeToString(checksum[:]))
+	require.FileExists(t, savedImagePath)
+}
+
+func startTestServer(t *testing.T, laptopStore service.LaptopStore, imageFolder string) (*grpc.Server, string) {
+	userStore := service.NewInMemoryUserStore()
+	user, err := service.NewUser("admin1", "secret", "admin")
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(context.Background(), user))
+
+	imageStore, err := service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	interceptor := service.NewAuthInterceptor(jwtManager, map[string][]string{
+		"/pb.LaptopService/CreateLaptop": {"admin"},
+		"/pb.LaptopService/UploadImage":  {"admin"},
+	})
+
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()),
+	)
+	pb.RegisterAuthServiceServer(grpcServer, service.NewAuthServer(userStore, jwtManager))
+	pb.RegisterLaptopServiceServer(grpcServer, service.NewLaptopService(
+		laptopStore,
+		imageStore,
+		service.NewInMemoryRatingStore(),
+	))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	return grpcServer, listener.Addr().String()
+}
+
+func login(t *testing.T, grpcAddress string) string {
+	conn, err := grpc.Dial(grpcAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	res, err := pb.NewAuthServiceClient(conn).Login(context.Background(), &pb.LoginRequest{
+		Username: "admin1",
+		Password: "secret",
+	})
+	require.NoError(t, err)
+	return res.GetAccessToken()
+}
+
+func decodeJSON(t *testing.T, res *http.Response) map[string]interface{} {
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	result := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(data, &result), string(data))
+	return result
+}
@@ -0,0 +1,88 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/thewalkers2012/grpc-example/client"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const imageFormField = "image"
+
+// imageUploader maps a multipart POST onto the UploadImage client stream
+type imageUploader struct {
+	mux    *runtime.ServeMux
+	client *client.LaptopClient
+}
+
+func (uploader *imageUploader) handle(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	_, outbound := runtime.MarshalerForRequest(uploader.mux, r)
+
+	ctx, err := runtime.AnnotateContext(r.Context(), uploader.mux, r, "/pb.LaptopService/UploadImage")
+	if err != nil {
+		runtime.HTTPError(r.Context(), uploader.mux, outbound, w, r, err)
+		return
+	}
+
+	res, err := uploader.upload(ctx, r, pathParams["laptop_id"])
+	if err != nil {
+		runtime.HTTPError(ctx, uploader.mux, outbound, w, r, err)
+		return
+	}
+
+	data, err := outbound.Marshal(res)
+	if err != nil {
+		runtime.HTTPError(ctx, uploader.mux, outbound, w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", outbound.ContentType(res))
+	_, _ = w.Write(data)
+}
+
+func (uploader *imageUploader) upload(ctx context.Context, r *http.Request, laptopID string) (*pb.UploadImageResponse, error) {
+	part, err := imagePart(r)
+	if err != nil {
+		return nil, err
+	}
+	defer part.Close()
+
+	res, err := uploader.client.UploadImage(ctx, laptopID, filepath.Ext(part.FileName()), part, nil)
+	if _, ok := status.FromError(err); !ok {
+		// the only errors without a gRPC status come from reading the request body
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return res, err
+}
+
+// imagePart returns the multipart part that holds the image file
+func imagePart(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "request is not multipart: %v", err)
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, status.Errorf(codes.InvalidArgument, "form field %q is not provided", imageFormField)
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot read multipart form: %v", err)
+		}
+
+		if part.FormName() == imageFormField {
+			return part, nil
+		}
+		part.Close()
+	}
+}
@@ -0,0 +1,41 @@
+package gateway
+
+import (
+	"net/http"
+
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
+	"google.golang.org/grpc"
+)
+
+// NewWebHandler returns an HTTP handler that serves gRPC-Web requests from browsers.
+// Requests are handled in-process by grpcServer, so they go through the same
+// interceptor chain as native gRPC calls. Cross-origin requests are accepted
+// only from allowedOrigins, where "*" allows any origin.
+func NewWebHandler(grpcServer *grpc.Server, allowedOrigins []string) http.Handler {
+	wrapped := grpcweb.WrapServer(
+		grpcServer,
+		grpcweb.WithOriginFunc(originMatcher(allowedOrigins)),
+	)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wrapped.IsGrpcWebRequest(r) || wrapped.IsAcceptableGrpcCorsRequest(r) {
+			wrapped.ServeHTTP(w, r)
+			return
+		}
+
+		http.NotFound(w, r)
+	})
+
+	return ForwardBearerToken(handler)
+}
+
+func originMatcher(allowedOrigins []string) func(origin string) bool {
+	allowed := make(map[string]bool)
+	for _, origin := range allowedOrigins {
+		allowed[origin] = true
+	}
+
+	return func(origin string) bool {
+		return allowed["*"] || allowed[origin]
+	}
+}
@@ -0,0 +1,149 @@
+package gateway_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/gateway"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWebSearchLaptop(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, laptopStore.Save(context.Background(), sample.NewLaptop()))
+	}
+
+	grpcServer, _ := startTestServer(t, laptopStore, t.TempDir())
+	server := httptest.NewServer(gateway.NewWebHandler(grpcServer, []string{"http://localhost:3000"}))
+	defer server.Close()
+
+	req := &pb.SearchLaptopRequest{Filter: &pb.Filter{MaxPriceUsd: 1e6}}
+	res := postWeb(t, server.URL+"/pb.LaptopService/SearchLaptop", "", req)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	messages, trailer := readWebFrames(t, res)
+	require.Len(t, messages, 3)
+	require.Contains(t, trailer, "grpc-status:0")
+
+	for _, message := range messages {
+		laptopRes := &pb.SearchLaptopResponse{}
+		require.NoError(t, proto.Unmarshal(message, laptopRes))
+		require.NotEmpty(t, laptopRes.GetLaptop().GetId())
+	}
+}
+
+func TestWebAuthorization(t *testing.T) {
+	t.Parallel()
+
+	grpcServer, grpcAddress := startTestServer(t, service.NewInMemoryLaptopStore(), t.TempDir())
+	server := httptest.NewServer(gateway.NewWebHandler(grpcServer, []string{"*"}))
+	defer server.Close()
+
+	req := &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()}
+
+	res := postWeb(t, server.URL+"/pb.LaptopService/CreateLaptop", "", req)
+	_, trailer := readWebFrames(t, res)
+	require.Contains(t, trailer, "grpc-status:16")
+
+	res = postWeb(t, server.URL+"/pb.LaptopService/CreateLaptop", "Bearer "+login(t, grpcAddress), req)
+	messages, trailer := readWebFrames(t, res)
+	require.Contains(t, trailer, "grpc-status:0")
+	require.Len(t, messages, 1)
+}
+
+func TestWebCORS(t *testing.T) {
+	t.Parallel()
+
+	grpcServer, _ := startTestServer(t, service.NewInMemoryLaptopStore(), t.TempDir())
+	server := httptest.NewServer(gateway.NewWebHandler(grpcServer, []string{"http://localhost:3000"}))
+	defer server.Close()
+
+	preflight := func(origin string) *http.Response {
+		req, err := http.NewRequest(http.MethodOptions, server.URL+"/pb.LaptopService/SearchLaptop", nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		req.Header.Set("Access-Control-Request-Headers", "authorization,content-type,x-grpc-web")
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	res := preflight("http://localhost:3000")
+	require.Equal(t, "http://localhost:3000", res.Header.Get("Access-Control-Allow-Origin"))
+
+	res = preflight("http://evil.example.com")
+	require.Empty(t, res.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func postWeb(t *testing.T, url string, authorization string, message proto.Message) *http.Response {
+	data, err := proto.Marshal(message)
+	require.NoError(t, err)
+
+	body := &bytes.Buffer{}
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	body.Write(header)
+	body.Write(data)
+
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc-web+proto")
+	req.Header.Set("X-Grpc-Web", "1")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return res
+}
+
+// readWebFrames returns the data frames and the trailer frame of a gRPC-Web response
+func readWebFrames(t *testing.T, res *http.Response) ([][]byte, string) {
+	defer res.Body.Close()
+
+	var messages [][]byte
+	var trailer string
+
+	header := make([]byte, 5)
+	for {
+		_, err := io.ReadFull(res.Body, header)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		data := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		_, err = io.ReadFull(res.Body, data)
+		require.NoError(t, err)
+
+		if header[0]&0x80 != 0 {
+			trailer += strings.ReplaceAll(string(data), " ", "")
+		} else {
+			messages = append(messages, data)
+		}
+	}
+
+	// grpc-status may also be sent as an HTTP header when there is no data
+	if status := res.Header.Get("Grpc-Status"); status != "" {
+		trailer += "grpc-status:" + status
+	}
+
+	return messages, trailer
+}
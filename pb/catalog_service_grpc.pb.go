@@ -0,0 +1,198 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// CatalogServiceClient is the client API for CatalogService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type CatalogServiceClient interface {
+	ExportCatalog(ctx context.Context, in *ExportCatalogRequest, opts ...grpc.CallOption) (CatalogService_ExportCatalogClient, error)
+	ImportCatalog(ctx context.Context, opts ...grpc.CallOption) (CatalogService_ImportCatalogClient, error)
+}
+
+type catalogServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCatalogServiceClient(cc grpc.ClientConnInterface) CatalogServiceClient {
+	return &catalogServiceClient{cc}
+}
+
+func (c *catalogServiceClient) ExportCatalog(ctx context.Context, in *ExportCatalogRequest, opts ...grpc.CallOption) (CatalogService_ExportCatalogClient, error) {
+	stream, err := c.cc.NewStream(ctx, &CatalogService_ServiceDesc.Streams[0], "/pb.CatalogService/ExportCatalog", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &catalogServiceExportCatalogClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type CatalogService_ExportCatalogClient interface {
+	Recv() (*ExportCatalogResponse, error)
+	grpc.ClientStream
+}
+
+type catalogServiceExportCatalogClient struct {
+	grpc.ClientStream
+}
+
+func (x *catalogServiceExportCatalogClient) Recv() (*ExportCatalogResponse, error) {
+	m := new(ExportCatalogResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *catalogServiceClient) ImportCatalog(ctx context.Context, opts ...grpc.CallOption) (CatalogService_ImportCatalogClient, error) {
+	stream, err := c.cc.NewStream(ctx, &CatalogService_ServiceDesc.Streams[1], "/pb.CatalogService/ImportCatalog", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &catalogServiceImportCatalogClient{stream}
+	return x, nil
+}
+
+type CatalogService_ImportCatalogClient interface {
+	Send(*ImportCatalogRequest) error
+	CloseAndRecv() (*ImportCatalogResponse, error)
+	grpc.ClientStream
+}
+
+type catalogServiceImportCatalogClient struct {
+	grpc.ClientStream
+}
+
+func (x *catalogServiceImportCatalogClient) Send(m *ImportCatalogRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *catalogServiceImportCatalogClient) CloseAndRecv() (*ImportCatalogResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(ImportCatalogResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CatalogServiceServer is the server API for CatalogService service.
+// All implementations must embed UnimplementedCatalogServiceServer
+// for forward compatibility
+type CatalogServiceServer interface {
+	ExportCatalog(*ExportCatalogRequest, CatalogService_ExportCatalogServer) error
+	ImportCatalog(CatalogService_ImportCatalogServer) error
+	mustEmbedUnimplementedCatalogServiceServer()
+}
+
+// UnimplementedCatalogServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedCatalogServiceServer struct {
+}
+
+func (UnimplementedCatalogServiceServer) ExportCatalog(*ExportCatalogRequest, CatalogService_ExportCatalogServer) error {
+	return status.Errorf(codes.Unimplemented, "method ExportCatalog not implemented")
+}
+func (UnimplementedCatalogServiceServer) ImportCatalog(CatalogService_ImportCatalogServer) error {
+	return status.Errorf(codes.Unimplemented, "method ImportCatalog not implemented")
+}
+func (UnimplementedCatalogServiceServer) mustEmbedUnimplementedCatalogServiceServer() {}
+
+// UnsafeCatalogServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CatalogServiceServer will
+// result in compilation errors.
+type UnsafeCatalogServiceServer interface {
+	mustEmbedUnimplementedCatalogServiceServer()
+}
+
+func RegisterCatalogServiceServer(s grpc.ServiceRegistrar, srv CatalogServiceServer) {
+	s.RegisterService(&CatalogService_ServiceDesc, srv)
+}
+
+func _CatalogService_ExportCatalog_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExportCatalogRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CatalogServiceServer).ExportCatalog(m, &catalogServiceExportCatalogServer{stream})
+}
+
+type CatalogService_ExportCatalogServer interface {
+	Send(*ExportCatalogResponse) error
+	grpc.ServerStream
+}
+
+type catalogServiceExportCatalogServer struct {
+	grpc.ServerStream
+}
+
+func (x *catalogServiceExportCatalogServer) Send(m *ExportCatalogResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _CatalogService_ImportCatalog_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(CatalogServiceServer).ImportCatalog(&catalogServiceImportCatalogServer{stream})
+}
+
+type CatalogService_ImportCatalogServer interface {
+	SendAndClose(*ImportCatalogResponse) error
+	Recv() (*ImportCatalogRequest, error)
+	grpc.ServerStream
+}
+
+type catalogServiceImportCatalogServer struct {
+	grpc.ServerStream
+}
+
+func (x *catalogServiceImportCatalogServer) SendAndClose(m *ImportCatalogResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *catalogServiceImportCatalogServer) Recv() (*ImportCatalogRequest, error) {
+	m := new(ImportCatalogRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CatalogService_ServiceDesc is the grpc.ServiceDesc for CatalogService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var CatalogService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pb.CatalogService",
+	HandlerType: (*CatalogServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ExportCatalog",
+			Handler:       _CatalogService_ExportCatalog_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ImportCatalog",
+			Handler:       _CatalogService_ImportCatalog_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "catalog_service.proto",
+}
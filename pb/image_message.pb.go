@@ -0,0 +1,173 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.26.0
+// 	protoc        v3.6.1
+// source: image_message.proto
+
+package pb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// LaptopImage is a reference to an uploaded image of a laptop
+type LaptopImage struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id   string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Type string `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	Size uint64 `protobuf:"varint,3,opt,name=size,proto3" json:"size,omitempty"`
+	// the position of the image in the gallery of the laptop, the primary image is at 0
+	Order uint32 `protobuf:"varint,4,opt,name=order,proto3" json:"order,omitempty"`
+}
+
+func (x *LaptopImage) Reset() {
+	*x = LaptopImage{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_image_message_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *LaptopImage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LaptopImage) ProtoMessage() {}
+
+func (x *LaptopImage) ProtoReflect() protoreflect.Message {
+	mi := &file_image_message_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LaptopImage.ProtoReflect.Descriptor instead.
+func (*LaptopImage) Descriptor() ([]byte, []int) {
+	return file_image_message_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *LaptopImage) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *LaptopImage) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *LaptopImage) GetSize() uint64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *LaptopImage) GetOrder() uint32 {
+	if x != nil {
+		return x.Order
+	}
+	return 0
+}
+
+var File_image_message_proto protoreflect.FileDescriptor
+
+var file_image_message_proto_rawDesc = []byte{
+	0x0a, 0x13, 0x69, 0x6d, 0x61, 0x67, 0x65, 0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x02, 0x70, 0x62, 0x22, 0x5b, 0x0a, 0x0b, 0x4c, 0x61, 0x70,
+	0x74, 0x6f, 0x70, 0x49, 0x6d, 0x61, 0x67, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x12, 0x0a, 0x04,
+	0x73, 0x69, 0x7a, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04, 0x52, 0x04, 0x73, 0x69, 0x7a, 0x65,
+	0x12, 0x14, 0x0a, 0x05, 0x6f, 0x72, 0x64, 0x65, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0d, 0x52,
+	0x05, 0x6f, 0x72, 0x64, 0x65, 0x72, 0x42, 0x2b, 0x5a, 0x29, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62,
+	0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x74, 0x68, 0x65, 0x77, 0x61, 0x6c, 0x6b, 0x65, 0x72, 0x73, 0x32,
+	0x30, 0x31, 0x32, 0x2f, 0x67, 0x72, 0x70, 0x63, 0x2d, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65,
+	0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_image_message_proto_rawDescOnce sync.Once
+	file_image_message_proto_rawDescData = file_image_message_proto_rawDesc
+)
+
+func file_image_message_proto_rawDescGZIP() []byte {
+	file_image_message_proto_rawDescOnce.Do(func() {
+		file_image_message_proto_rawDescData = protoimpl.X.CompressGZIP(file_image_message_proto_rawDescData)
+	})
+	return file_image_message_proto_rawDescData
+}
+
+var file_image_message_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_image_message_proto_goTypes = []interface{}{
+	(*LaptopImage)(nil), // 0: pb.LaptopImage
+}
+var file_image_message_proto_depIdxs = []int32{
+	0, // [0:0] is the sub-list for method output_type
+	0, // [0:0] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_image_message_proto_init() }
+func file_image_message_proto_init() {
+	if File_image_message_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_image_message_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*LaptopImage); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_image_message_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_image_message_proto_goTypes,
+		DependencyIndexes: file_image_message_proto_depIdxs,
+		MessageInfos:      file_image_message_proto_msgTypes,
+	}.Build()
+	File_image_message_proto = out.File
+	file_image_message_proto_rawDesc = nil
+	file_image_message_proto_goTypes = nil
+	file_image_message_proto_depIdxs = nil
+}
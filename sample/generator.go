@@ -113,6 +113,7 @@ func NewLaptop() *pb.Laptop {
 	name := randomLaptopName(brand)
 	laptop := &pb.Laptop{
 		Id:       randomID(),
+		Brand:    brand,
 		Name:     name,
 		Cpu:      NewCPU(),
 		Ram:      NewRAM(),
@@ -0,0 +1,72 @@
+package serializer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// maxDelimitedSize limits the size of a length-delimited message, so that a corrupted length
+// doesn't allocate an arbitrary amount of memory
+const maxDelimitedSize = 64 << 20
+
+// WriteDelimited writes protocol buffer message prefixed with its varint-encoded size
+func WriteDelimited(writer io.Writer, message proto.Message) error {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("cannot marshal proto message to binary: %w", err)
+	}
+
+	size := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(size, uint64(len(data)))
+
+	_, err = writer.Write(size[:n])
+	if err == nil {
+		_, err = writer.Write(data)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write delimited message: %w", err)
+	}
+
+	return nil
+}
+
+// DelimitedReader is a reader of size-prefixed protocol buffer messages written by WriteDelimited
+type DelimitedReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// ReadDelimited reads the next size-prefixed protocol buffer message.
+// It returns io.EOF if there are no more messages.
+func ReadDelimited(reader DelimitedReader, message proto.Message) error {
+	size, err := binary.ReadUvarint(reader)
+	if err == io.EOF {
+		return io.EOF
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read delimited message size: %w", err)
+	}
+	if size > maxDelimitedSize {
+		return fmt.Errorf("delimited message is too large: %d > %d", size, maxDelimitedSize)
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(reader, data)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read delimited message: %w", err)
+	}
+
+	err = proto.Unmarshal(data, message)
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal binary to proto message: %w", err)
+	}
+
+	return nil
+}
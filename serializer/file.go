@@ -51,3 +51,18 @@ func WriteProtobufToJSONFile(message proto.Message, filename string) error {
 
 	return nil
 }
+
+// ReadProtobufFromJSONFile reads protocol buffer message from JSON file
+func ReadProtobufFromJSONFile(message proto.Message, filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("cannot read JSON data from file: %w", err)
+	}
+
+	err = JSONToProtobuf(data, message)
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal JSON to proto message: %w", err)
+	}
+
+	return nil
+}
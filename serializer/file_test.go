@@ -1,6 +1,9 @@
 package serializer_test
 
 import (
+	"bufio"
+	"bytes"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -27,4 +30,38 @@ func TestFileSerializer(t *testing.T) {
 
 	err = serializer.WriteProtobufToJSONFile(labtop1, jsonFile)
 	assert.NoError(t, err)
+
+	laptop3 := &pb.Laptop{}
+	err = serializer.ReadProtobufFromJSONFile(laptop3, jsonFile)
+	assert.NoError(t, err)
+	assert.True(t, proto.Equal(labtop1, laptop3))
+}
+
+func TestDelimitedSerializer(t *testing.T) {
+	t.Parallel()
+
+	buffer := &bytes.Buffer{}
+	laptops := []*pb.Laptop{sample.NewLaptop(), sample.NewLaptop(), {}}
+	for _, laptop := range laptops {
+		err := serializer.WriteDelimited(buffer, laptop)
+		assert.NoError(t, err)
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(buffer.Bytes()))
+	for _, laptop := range laptops {
+		other := &pb.Laptop{}
+		err := serializer.ReadDelimited(reader, other)
+		assert.NoError(t, err)
+		assert.True(t, proto.Equal(laptop, other))
+	}
+
+	err := serializer.ReadDelimited(reader, &pb.Laptop{})
+	assert.Equal(t, io.EOF, err)
+
+	// cut the last byte of the second laptop and the empty laptop
+	truncated := bufio.NewReader(bytes.NewReader(buffer.Bytes()[:buffer.Len()-2]))
+	err = serializer.ReadDelimited(truncated, &pb.Laptop{})
+	assert.NoError(t, err)
+	err = serializer.ReadDelimited(truncated, &pb.Laptop{})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
 }
@@ -15,3 +15,8 @@ func ProtobufToJSON(message proto.Message) (string, error) {
 	data, err := b.Marshal(message)
 	return string(data), err
 }
+
+// JSONToProtobuf converts JSON data to protocol buffer message
+func JSONToProtobuf(data []byte, message proto.Message) error {
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, message)
+}
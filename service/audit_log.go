@@ -0,0 +1,325 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+// Actions of the audit entries
+const (
+	AuditLogin            = "login"
+	AuditLoginFailed      = "login_failed"
+	AuditTokenRefresh     = "token_refresh"
+	AuditRoleChange       = "role_change"
+	AuditPermissionDenied = "permission_denied"
+	AuditMutation         = "admin_mutation"
+)
+
+// DefaultAuditQueryLimit is the number of entries returned by a query without a limit
+const DefaultAuditQueryLimit = 100
+
+// ErrAuditChainBroken is returned when an audit log entry doesn't match the hash chain
+var ErrAuditChainBroken = errors.New("audit log hash chain is broken")
+
+// ErrAuditKeyMissing is returned when an audit log is opened or verified without a key
+var ErrAuditKeyMissing = errors.New("audit log key is required")
+
+// AuditEntry is a security event of the audit log.
+// Its hash is an HMAC of the entry and the hash of the previous entry, keyed by a server secret,
+// so that no entry can be changed, removed or inserted without breaking the chain,
+// and the chain cannot be computed again without the key.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	TenantID string    `json:"tenant_id,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Method   string    `json:"method,omitempty"`
+	Peer     string    `json:"peer,omitempty"`
+	// Code is the name of the gRPC status code of the request
+	Code     string `json:"code"`
+	Details  string `json:"details,omitempty"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// computeHash returns the HMAC-SHA256 of the entry with the key, with its previous hash but without its own hash
+func (entry *AuditEntry) computeHash(key []byte) (string, error) {
+	other := *entry
+	other.Hash = ""
+
+	data, err := json.Marshal(&other)
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal audit entry: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// AuditFilter selects entries of the audit log, every empty field matches all entries
+type AuditFilter struct {
+	TenantID string
+	Username string
+	Method   string
+	// Since and Until are the inclusive time range of the entries
+	Since time.Time
+	Until time.Time
+	// Limit is the maximum number of entries, the most recent ones are kept
+	Limit int
+}
+
+func (filter *AuditFilter) matches(entry *AuditEntry) bool {
+	return (filter.TenantID == "" || entry.TenantID == filter.TenantID) &&
+		(filter.Username == "" || entry.Username == filter.Username) &&
+		(filter.Method == "" || entry.Method == filter.Method) &&
+		(filter.Since.IsZero() || !entry.Time.Before(filter.Since)) &&
+		(filter.Until.IsZero() || !entry.Time.After(filter.Until))
+}
+
+// AuditLog is an append-only log of security events
+type AuditLog interface {
+	// Record appends the entry to the log, setting its time and hashes
+	Record(entry *AuditEntry) error
+	// Query returns the entries that match the filter, from the oldest to the newest
+	Query(filter *AuditFilter) ([]*AuditEntry, error)
+}
+
+// FileAuditLog is an audit log written to a file, one JSON entry per line
+type FileAuditLog struct {
+	mutex    sync.Mutex
+	path     string
+	key      []byte
+	file     *os.File
+	writer   io.Writer
+	lastHash string
+	// size is the size of the complete entries written to the file
+	size int64
+	// err is set when a partial entry could not be removed from the file,
+	// since the entries recorded after it would not be read
+	err error
+}
+
+// FileAuditLogOption configures a FileAuditLog
+type FileAuditLogOption func(auditLog *FileAuditLog)
+
+// WithAuditWriter makes the log write its entries through the writer returned by wrap for the log file
+func WithAuditWriter(wrap func(file io.Writer) io.Writer) FileAuditLogOption {
+	return func(auditLog *FileAuditLog) {
+		auditLog.writer = wrap(auditLog.file)
+	}
+}
+
+// NewFileAuditLog opens the audit log file, creating it if needed, with the key of its hash chain.
+// It returns an error if the hash chain of the existing entries is broken.
+func NewFileAuditLog(path string, key []byte, options ...FileAuditLogOption) (*FileAuditLog, error) {
+	if len(key) == 0 {
+		return nil, ErrAuditKeyMissing
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log: %w", err)
+	}
+
+	lastHash := ""
+	_, err = readAuditLog(file, key, func(entry *AuditEntry) error {
+		lastHash = entry.Hash
+		return nil
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot get audit log size: %w", err)
+	}
+
+	auditLog := &FileAuditLog{
+		path:     path,
+		key:      key,
+		file:     file,
+		writer:   file,
+		lastHash: lastHash,
+		size:     info.Size(),
+	}
+	for _, option := range options {
+		option(auditLog)
+	}
+	return auditLog, nil
+}
+
+// Record appends the entry to the log file.
+// If the entry cannot be written, the file is truncated to the entries written before it.
+func (auditLog *FileAuditLog) Record(entry *AuditEntry) error {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	if auditLog.err != nil {
+		return auditLog.err
+	}
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Time = entry.Time.UTC()
+	entry.PrevHash = auditLog.lastHash
+
+	hash, err := entry.computeHash(auditLog.key)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("cannot marshal audit entry: %w", err)
+	}
+
+	data = append(data, '\n')
+	_, err = auditLog.writer.Write(data)
+	if err != nil {
+		return auditLog.truncate(fmt.Errorf("cannot write audit entry: %w", err))
+	}
+
+	err = auditLog.file.Sync()
+	if err != nil {
+		return auditLog.truncate(fmt.Errorf("cannot sync audit log: %w", err))
+	}
+
+	auditLog.lastHash = hash
+	auditLog.size += int64(len(data))
+	return nil
+}
+
+// truncate removes the entry that failed with err from the file, so that the next entry follows
+// the last complete one and the hash chain stays valid. It must be called with the mutex held.
+func (auditLog *FileAuditLog) truncate(err error) error {
+	truncateErr := auditLog.file.Truncate(auditLog.size)
+	if truncateErr != nil {
+		auditLog.err = fmt.Errorf("audit log has a partial entry: %v", truncateErr)
+		return fmt.Errorf("%w, and %v", err, auditLog.err)
+	}
+	return err
+}
+
+// Query reads the log file and returns the entries that match the filter.
+// The file is read without holding the lock, so entries are recorded while it is scanned.
+func (auditLog *FileAuditLog) Query(filter *AuditFilter) ([]*AuditEntry, error) {
+	// only the entries written so far are read, so the scan never sees a partial line
+	auditLog.mutex.Lock()
+	size := auditLog.size
+	auditLog.mutex.Unlock()
+
+	file, err := os.Open(auditLog.path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log: %w", err)
+	}
+	defer file.Close()
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultAuditQueryLimit
+	}
+
+	var entries []*AuditEntry
+	_, err = readAuditLog(io.LimitReader(file, size), auditLog.key, func(entry *AuditEntry) error {
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+			if len(entries) > limit {
+				entries = entries[1:]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Close closes the log file
+func (auditLog *FileAuditLog) Close() error {
+	return auditLog.file.Close()
+}
+
+// VerifyAuditLog checks the hash chain of an audit log with its key and returns its number of entries
+func VerifyAuditLog(reader io.Reader, key []byte) (int, error) {
+	if len(key) == 0 {
+		return 0, ErrAuditKeyMissing
+	}
+	return readAuditLog(reader, key, func(entry *AuditEntry) error { return nil })
+}
+
+// readAuditLog calls fn with every entry of the log after checking its hash, and returns the number of entries
+func readAuditLog(reader io.Reader, key []byte, fn func(entry *AuditEntry) error) (int, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+
+	prevHash := ""
+	count := 0
+	for scanner.Scan() {
+		count++
+
+		entry := &AuditEntry{}
+		err := json.Unmarshal(scanner.Bytes(), entry)
+		if err != nil {
+			return count, fmt.Errorf("%w: cannot parse entry %d: %v", ErrAuditChainBroken, count, err)
+		}
+
+		hash, err := entry.computeHash(key)
+		if err != nil {
+			return count, err
+		}
+
+		if entry.PrevHash != prevHash || !hmac.Equal([]byte(entry.Hash), []byte(hash)) {
+			return count, fmt.Errorf("%w at entry %d", ErrAuditChainBroken, count)
+		}
+		prevHash = entry.Hash
+
+		err = fn(entry)
+		if err != nil {
+			return count, err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return count, fmt.Errorf("cannot read audit log: %w", err)
+	}
+
+	return count, nil
+}
+
+// recordAudit records the entry if there is an audit log, with the peer address of the request.
+// A failure is logged, it doesn't fail the request.
+func recordAudit(ctx context.Context, auditLog AuditLog, entry *AuditEntry) {
+	if auditLog == nil {
+		return
+	}
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		entry.Peer = p.Addr.String()
+	}
+
+	err := auditLog.Record(entry)
+	if err != nil {
+		log.Printf("cannot record %s audit entry: %v", entry.Action, err)
+	}
+}
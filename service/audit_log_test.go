@@ -0,0 +1,288 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var auditKey = []byte("audit secret")
+
+func TestFileAuditLog(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := service.NewFileAuditLog(path, auditKey)
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, auditLog.Record(&service.AuditEntry{Action: service.AuditLogin, Username: "alice", Code: "OK"}))
+	require.NoError(t, auditLog.Record(&service.AuditEntry{Action: service.AuditLogin, Username: "bob", Code: "OK"}))
+	require.NoError(t, auditLog.Close())
+
+	// the chain goes on after the log is opened again
+	auditLog, err = service.NewFileAuditLog(path, auditKey)
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	entry := &service.AuditEntry{Action: service.AuditMutation, Username: "alice", Method: "/pb.LaptopService/CreateLaptop", Code: "OK"}
+	require.NoError(t, auditLog.Record(entry))
+	require.NotEmpty(t, entry.PrevHash)
+
+	entries, err := auditLog.Query(&service.AuditFilter{Username: "alice"})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, entry.Hash, entries[1].Hash)
+	require.NotEqual(t, entries[0].Hash, entries[1].PrevHash, "alice's entries are not consecutive")
+
+	entries, err = auditLog.Query(&service.AuditFilter{Since: start, Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, service.AuditMutation, entries[0].Action)
+
+	entries, err = auditLog.Query(&service.AuditFilter{Until: start.Add(-time.Minute)})
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	count, err := service.VerifyAuditLog(bytes.NewReader(data), auditKey)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	// changing an entry breaks the chain
+	tampered := bytes.Replace(data, []byte(`"username":"bob"`), []byte(`"username":"eve"`), 1)
+	_, err = service.VerifyAuditLog(bytes.NewReader(tampered), auditKey)
+	require.ErrorIs(t, err, service.ErrAuditChainBroken)
+
+	// the chain cannot be computed again without the key
+	_, err = service.VerifyAuditLog(bytes.NewReader(data), []byte("other key"))
+	require.ErrorIs(t, err, service.ErrAuditChainBroken)
+	_, err = service.NewFileAuditLog(path, nil)
+	require.ErrorIs(t, err, service.ErrAuditKeyMissing)
+
+	// removing an entry too
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	_, err = service.VerifyAuditLog(bytes.NewReader(append(lines[0], lines[2]...)), auditKey)
+	require.ErrorIs(t, err, service.ErrAuditChainBroken)
+
+	tamperedPath := filepath.Join(t.TempDir(), "audit.log")
+	require.NoError(t, ioutil.WriteFile(tamperedPath, tampered, 0600))
+	_, err = service.NewFileAuditLog(tamperedPath, auditKey)
+	require.ErrorIs(t, err, service.ErrAuditChainBroken)
+}
+
+func TestFileAuditLogFailedWrite(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writer := &failingWriter{}
+	auditLog, err := service.NewFileAuditLog(path, auditKey, service.WithAuditWriter(func(file io.Writer) io.Writer {
+		writer.Writer = file
+		return writer
+	}))
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	require.NoError(t, auditLog.Record(&service.AuditEntry{Action: service.AuditLogin, Username: "alice", Code: "OK"}))
+
+	// half of the entry is written before the write fails
+	writer.fail = true
+	require.Error(t, auditLog.Record(&service.AuditEntry{Action: service.AuditLogin, Username: "bob", Code: "OK"}))
+
+	writer.fail = false
+	require.NoError(t, auditLog.Record(&service.AuditEntry{Action: service.AuditLogin, Username: "carol", Code: "OK"}))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	count, err := service.VerifyAuditLog(bytes.NewReader(data), auditKey)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	entries, err := auditLog.Query(&service.AuditFilter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "carol", entries[1].Username)
+}
+
+// failingWriter writes half of the data and fails when fail is set
+type failingWriter struct {
+	io.Writer
+	fail bool
+}
+
+func (writer *failingWriter) Write(data []byte) (int, error) {
+	if !writer.fail {
+		return writer.Writer.Write(data)
+	}
+
+	n, _ := writer.Writer.Write(data[:len(data)/2])
+	return n, errors.New("disk is full")
+}
+
+func TestFileAuditLogQueryWhileRecording(t *testing.T) {
+	t.Parallel()
+
+	auditLog, err := service.NewFileAuditLog(filepath.Join(t.TempDir(), "audit.log"), auditKey)
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	const count = 100
+	done := make(chan error)
+	go func() {
+		for i := 0; i < count; i++ {
+			err := auditLog.Record(&service.AuditEntry{Action: service.AuditLogin, Username: "alice", Code: "OK"})
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	// every query sees complete entries, whatever is being written
+	for recording := true; recording; {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+			recording = false
+		default:
+		}
+
+		_, err := auditLog.Query(&service.AuditFilter{Limit: count})
+		require.NoError(t, err)
+	}
+
+	entries, err := auditLog.Query(&service.AuditFilter{Limit: count})
+	require.NoError(t, err)
+	require.Len(t, entries, count)
+}
+
+func TestClientAuditLog(t *testing.T) {
+	t.Parallel()
+
+	auditLog, err := service.NewFileAuditLog(filepath.Join(t.TempDir(), "audit.log"), auditKey)
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	userStore := service.NewInMemoryUserStore()
+	for _, role := range []string{"admin", "user"} {
+		user, err := service.NewUser(role+"1", "secret", role)
+		require.NoError(t, err)
+		require.NoError(t, userStore.Save(context.Background(), user))
+	}
+
+	conn, err := grpc.Dial(startTestAuditServer(t, userStore, auditLog), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	authClient := pb.NewAuthServiceClient(conn)
+	laptopClient := pb.NewLaptopServiceClient(conn)
+	ctx := context.Background()
+
+	login := func(username string, password string) (context.Context, error) {
+		res, err := authClient.Login(ctx, &pb.LoginRequest{Username: username, Password: password})
+		if err != nil {
+			return nil, err
+		}
+		return metadata.AppendToOutgoingContext(ctx, "authorization", res.GetAccessToken()), nil
+	}
+
+	_, err = login("admin1", "wrong")
+	require.Equal(t, codes.NotFound, status.Code(err))
+	admin, err := login("admin1", "secret")
+	require.NoError(t, err)
+	user, err := login("user1", "secret")
+	require.NoError(t, err)
+
+	_, err = laptopClient.CreateLaptop(user, &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = laptopClient.CreateLaptop(admin, &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+	require.NoError(t, err)
+
+	refreshed, err := authClient.RefreshToken(user, &pb.RefreshTokenRequest{})
+	require.NoError(t, err)
+	require.NotEmpty(t, refreshed.GetAccessToken())
+
+	// a typo in the role is rejected instead of locking the user out
+	_, err = authClient.UpdateUserRole(admin, &pb.UpdateUserRoleRequest{Username: "user1", Role: "admn"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = authClient.UpdateUserRole(admin, &pb.UpdateUserRoleRequest{Username: "user1", Role: "admin"})
+	require.NoError(t, err)
+
+	res, err := authClient.ListAuditEntries(admin, &pb.ListAuditEntriesRequest{})
+	require.NoError(t, err)
+
+	var actions []string
+	for _, entry := range res.GetEntries() {
+		actions = append(actions, entry.GetAction()+" "+entry.GetUsername()+" "+entry.GetCode())
+		require.NotEmpty(t, entry.GetPeer())
+	}
+	require.Equal(t, []string{
+		"login_failed admin1 NotFound",
+		"login admin1 OK",
+		"login user1 OK",
+		"permission_denied user1 PermissionDenied",
+		"admin_mutation admin1 OK",
+		"token_refresh user1 OK",
+		"role_change admin1 OK",
+	}, actions)
+	require.Contains(t, res.GetEntries()[6].GetDetails(), "from user to admin")
+
+	res, err = authClient.ListAuditEntries(admin, &pb.ListAuditEntriesRequest{
+		Username: "admin1",
+		Method:   "/pb.LaptopService/CreateLaptop",
+	})
+	require.NoError(t, err)
+	require.Len(t, res.GetEntries(), 1)
+	require.Equal(t, service.AuditMutation, res.GetEntries()[0].GetAction())
+
+	_, err = authClient.ListAuditEntries(user, &pb.ListAuditEntriesRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func startTestAuditServer(t *testing.T, userStore service.UserStore, auditLog service.AuditLog) string {
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	interceptor := service.NewAuthInterceptor(
+		jwtManager,
+		map[string][]string{
+			"/pb.AuthService/RefreshToken":     {"admin", "user"},
+			"/pb.AuthService/UpdateUserRole":   {"admin"},
+			"/pb.AuthService/ListAuditEntries": {"admin"},
+			"/pb.LaptopService/CreateLaptop":   {"admin"},
+		},
+		service.WithAuditLog(auditLog, []string{"/pb.LaptopService/CreateLaptop"}),
+	)
+
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()),
+	)
+	pb.RegisterAuthServiceServer(grpcServer, service.NewAuthServer(userStore, jwtManager, service.WithAuthAuditLog(auditLog)))
+	pb.RegisterLaptopServiceServer(grpcServer, service.NewLaptopService(service.NewInMemoryLaptopStore(), nil, nil))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	return listener.Addr().String()
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"log"
 
 	"google.golang.org/grpc"
@@ -14,14 +15,40 @@ import (
 type AuthInterceptor struct {
 	jwtManager      *JWTManager
 	accessibleRoles map[string][]string
+	auditLog        AuditLog
+	auditedMethods  map[string]bool
+}
+
+// AuthInterceptorOption configures optional dependencies of an AuthInterceptor
+type AuthInterceptorOption func(interceptor *AuthInterceptor)
+
+// WithAuditLog records the denied requests and the calls of the audited methods, such as admin mutations
+func WithAuditLog(auditLog AuditLog, auditedMethods []string) AuthInterceptorOption {
+	return func(interceptor *AuthInterceptor) {
+		interceptor.auditLog = auditLog
+		interceptor.auditedMethods = make(map[string]bool, len(auditedMethods))
+		for _, method := range auditedMethods {
+			interceptor.auditedMethods[method] = true
+		}
+	}
 }
 
 // NewAuthInterceptor returns a new auth interceptor
-func NewAuthInterceptor(jwtManager *JWTManager, accessibleRoles map[string][]string) *AuthInterceptor {
-	return &AuthInterceptor{
+func NewAuthInterceptor(
+	jwtManager *JWTManager,
+	accessibleRoles map[string][]string,
+	options ...AuthInterceptorOption,
+) *AuthInterceptor {
+	interceptor := &AuthInterceptor{
 		jwtManager:      jwtManager,
 		accessibleRoles: accessibleRoles,
 	}
+
+	for _, option := range options {
+		option(interceptor)
+	}
+
+	return interceptor
 }
 
 // Unary returns a server interceptor function to authenticate and authorize unary RPC
@@ -33,12 +60,15 @@ func (interceptor *AuthInterceptor) Unary() grpc.UnaryServerInterceptor {
 	) (interface{}, error) {
 		log.Println("--> unary interceptor: ", info.FullMethod)
 
-		err := interceptor.authorize(ctx, info.FullMethod)
+		claims, err := interceptor.authorize(ctx, info.FullMethod)
 		if err != nil {
 			return nil, err
 		}
 
-		return handler(ctx, req)
+		ctx = contextWithClaims(ctx, claims)
+		res, err := handler(ctx, req)
+		interceptor.audit(ctx, info.FullMethod, err)
+		return res, err
 	}
 }
 
@@ -52,45 +82,157 @@ func (interceptor *AuthInterceptor) Stream() grpc.StreamServerInterceptor {
 	) error {
 		log.Println("--> stream interceptor: ", info.FullMethod)
 
-		err := interceptor.authorize(stream.Context(), info.FullMethod)
+		claims, err := interceptor.authorize(stream.Context(), info.FullMethod)
 		if err != nil {
 			return err
 		}
 
-		return handler(srv, stream)
+		ctx := contextWithClaims(stream.Context(), claims)
+		err = handler(srv, &claimsServerStream{
+			ServerStream: stream,
+			ctx:          ctx,
+		})
+		interceptor.audit(ctx, info.FullMethod, err)
+		return err
 	}
 }
 
-func (interceptor *AuthInterceptor) authorize(ctx context.Context, method string) error {
-	// log.Println("------------------<<<<<<<<<<", method) for debug
-	accessibleRoles, ok := interceptor.accessibleRoles[method]
-	// log.Println("------------------>>>>>>>>>>", accessibleRoles) for debug
-	if !ok {
-		// everyone can access
-		return nil
+// TenantHeader is the metadata key of the tenant a request is meant for.
+// It is optional, but the request is denied if it isn't the tenant of the access token.
+const TenantHeader = "tenant-id"
+
+// audit records the call of an audited method with its result
+func (interceptor *AuthInterceptor) audit(ctx context.Context, method string, err error) {
+	if !interceptor.auditedMethods[method] {
+		return
+	}
+
+	entry := &AuditEntry{
+		Action:   AuditMutation,
+		TenantID: TenantFromContext(ctx),
+		Method:   method,
+		Code:     status.Code(err).String(),
+	}
+	if claims := ClaimsFromContext(ctx); claims != nil {
+		entry.Username = claims.Username
+	}
+	if err != nil {
+		entry.Details = status.Convert(err).Message()
 	}
 
-	md, ok := metadata.FromIncomingContext(ctx)
-	if !ok {
-		return status.Errorf(codes.Unauthenticated, "metadata is not provided")
+	recordAudit(ctx, interceptor.auditLog, entry)
+}
+
+// authorize returns the claims of the access token, or nil if everyone can access the method
+// and the request has no access token. Denied requests are recorded in the audit log.
+func (interceptor *AuthInterceptor) authorize(ctx context.Context, method string) (*UserClaims, error) {
+	claims, err := interceptor.checkAccess(ctx, method)
+	if status.Code(err) == codes.PermissionDenied {
+		entry := &AuditEntry{
+			Action:   AuditPermissionDenied,
+			TenantID: tenantOf(claims),
+			Username: claims.GetUsername(),
+			Method:   method,
+			Code:     codes.PermissionDenied.String(),
+			Details:  status.Convert(err).Message(),
+		}
+		recordAudit(ctx, interceptor.auditLog, entry)
 	}
+	return claims, err
+}
+
+// checkAccess returns the claims of the access token, or nil if everyone can access the method
+// and the request has no valid access token. Requests of a public method with an access token are
+// authorized too, so that they see the data of the tenant of the token, but a token that cannot
+// be verified, such as an expired one, only makes them anonymous.
+// The claims are returned with a PermissionDenied error if the token is valid.
+func (interceptor *AuthInterceptor) checkAccess(ctx context.Context, method string) (*UserClaims, error) {
+	accessibleRoles, restricted := interceptor.accessibleRoles[method]
 
+	md, _ := metadata.FromIncomingContext(ctx)
 	values := md["authorization"]
 	if len(values) == 0 {
-		return status.Errorf(codes.Unauthenticated, "authorization token is not provided")
+		if restricted {
+			return nil, detailedError(codes.Unauthenticated, ReasonTokenMissing, nil, "authorization token is not provided")
+		}
+		return nil, checkTenant(md, nil)
 	}
 
 	accessToken := values[0]
 	claims, err := interceptor.jwtManager.Verify(accessToken)
 	if err != nil {
-		return status.Errorf(codes.Unauthenticated, "access token is invalid: %v", err)
+		if !restricted {
+			return nil, checkTenant(md, nil)
+		}
+		return nil, detailedError(codes.Unauthenticated, ReasonTokenInvalid, nil, fmt.Sprintf("access token is invalid: %v", err))
+	}
+
+	err = checkTenant(md, claims)
+	if err != nil {
+		return claims, err
+	}
+
+	if !restricted {
+		// everyone can access
+		return claims, nil
 	}
 
 	for _, role := range accessibleRoles {
 		if role == claims.Role {
-			return nil
+			return claims, nil
 		}
 	}
 
-	return status.Errorf(codes.PermissionDenied, "no permission to access this RPC")
+	return claims, detailedError(
+		codes.PermissionDenied,
+		ReasonPermissionDenied,
+		map[string]string{"method": method, "role": claims.Role},
+		"no permission to access this RPC",
+	)
+}
+
+// checkTenant denies the request if its tenant header is not the tenant of the claims
+func checkTenant(md metadata.MD, claims *UserClaims) error {
+	values := md.Get(TenantHeader)
+	if len(values) == 0 {
+		return nil
+	}
+
+	tenantID := tenantOf(claims)
+	if values[0] != tenantID {
+		return detailedError(
+			codes.PermissionDenied,
+			ReasonTenantMismatch,
+			map[string]string{"tenant_id": values[0]},
+			fmt.Sprintf("cannot access tenant %s from tenant %s", values[0], tenantID),
+			resourceInfo(ResourceTypeTenant, values[0], "tenant of the request is not the tenant of the user"),
+		)
+	}
+
+	return nil
+}
+
+type claimsContextKey struct{}
+
+// ClaimsFromContext returns the claims of the authorized user, or nil if the RPC is not authenticated
+func ClaimsFromContext(ctx context.Context) *UserClaims {
+	claims, _ := ctx.Value(claimsContextKey{}).(*UserClaims)
+	return claims
+}
+
+func contextWithClaims(ctx context.Context, claims *UserClaims) context.Context {
+	if claims == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, claimsContextKey{}, claims)
+}
+
+// claimsServerStream is a server stream whose context carries the user claims
+type claimsServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *claimsServerStream) Context() context.Context {
+	return stream.ctx
 }
@@ -2,46 +2,499 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
 	"github.com/thewalkers2012/grpc-example/pb"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// full method names of the audited auth RPCs
+const (
+	loginMethod          = "/pb.AuthService/Login"
+	refreshTokenMethod   = "/pb.AuthService/RefreshToken"
+	updateUserRoleMethod = "/pb.AuthService/UpdateUserRole"
 )
 
 // AuthServer is the server for authentication
 type AuthServer struct {
 	userStore  UserStore
 	jwtManager *JWTManager
+	tenants    TenantStore
+	auditLog   AuditLog
 	pb.UnimplementedAuthServiceServer
 }
 
+// AuthServerOption configures optional dependencies of an AuthServer
+type AuthServerOption func(server *AuthServer)
+
+// WithAuthTenants makes the server manage the users of the tenant of each request and the tenants themselves,
+// instead of the users of the store it was created with
+func WithAuthTenants(tenants TenantStore) AuthServerOption {
+	return func(server *AuthServer) {
+		server.tenants = tenants
+	}
+}
+
+// WithAuthAuditLog records the logins, token refreshes and role changes in the audit log,
+// and lets admins query it
+func WithAuthAuditLog(auditLog AuditLog) AuthServerOption {
+	return func(server *AuthServer) {
+		server.auditLog = auditLog
+	}
+}
+
 // NewAuthServer returns a new auth server
-func NewAuthServer(userStore UserStore, jwtManager *JWTManager) *AuthServer {
-	return &AuthServer{
+func NewAuthServer(userStore UserStore, jwtManager *JWTManager, options ...AuthServerOption) *AuthServer {
+	server := &AuthServer{
 		userStore:  userStore,
 		jwtManager: jwtManager,
 	}
+
+	for _, option := range options {
+		option(server)
+	}
+
+	return server
+}
+
+// tenantUserStore returns the user store of the tenant, or nil if the tenant doesn't exist
+func (server *AuthServer) tenantUserStore(ctx context.Context, tenantID string) (UserStore, error) {
+	if server.tenants == nil {
+		if tenantID != DefaultTenant {
+			return nil, nil
+		}
+		return server.userStore, nil
+	}
+
+	tenant, err := server.tenants.Find(ctx, tenantID)
+	if err != nil || tenant == nil {
+		return nil, err
+	}
+	return tenant.UserStore, nil
+}
+
+// requestUserStore returns the user store of the tenant of the request
+func (server *AuthServer) requestUserStore(ctx context.Context) (UserStore, error) {
+	tenantID := TenantFromContext(ctx)
+	userStore, err := server.tenantUserStore(ctx, tenantID)
+	if err != nil {
+		return nil, storeError(ctx, "cannot find tenant", err)
+	}
+	if userStore == nil {
+		return nil, tenantNotFoundError(tenantID)
+	}
+	return userStore, nil
 }
 
 // Login is a unary RPC to login user
 func (server *AuthServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
-	user, err := server.userStore.Find(req.GetUsername())
+	tenantID := req.GetTenantId()
+	if tenantID == "" {
+		tenantID = DefaultTenant
+	}
+
+	userStore, err := server.tenantUserStore(ctx, tenantID)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+		return nil, storeError(ctx, "cannot find tenant", err)
+	}
+
+	audit := &AuditEntry{
+		Action:   AuditLogin,
+		TenantID: tenantID,
+		Username: req.GetUsername(),
+		Method:   loginMethod,
+	}
+	failLogin := func(err error) error {
+		audit.Action = AuditLoginFailed
+		audit.Code = status.Code(err).String()
+		audit.Details = status.Convert(err).Message()
+		recordAudit(ctx, server.auditLog, audit)
+		return err
+	}
+
+	// an unknown tenant or user fails like a wrong password, so that they cannot be told apart
+	if userStore == nil {
+		return nil, failLogin(invalidCredentialsError())
+	}
+
+	user, err := userStore.Find(ctx, req.GetUsername())
+	if err != nil {
+		return nil, failLogin(storeError(ctx, "cannot find user", err))
 	}
 
 	if user == nil || !user.IsCorrectPassword(req.GetPassword()) {
-		return nil, status.Errorf(codes.NotFound, "incorrect username/password")
+		return nil, failLogin(invalidCredentialsError())
+	}
+
+	if tenantID != DefaultTenant {
+		user.TenantID = tenantID
 	}
 
 	token, err := server.jwtManager.Generate(user)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot generate access token")
+		return nil, failLogin(internalError("cannot generate access token", err))
 	}
 
+	audit.Code = codes.OK.String()
+	recordAudit(ctx, server.auditLog, audit)
+
 	res := &pb.LoginResponse{
 		AccessToken: token,
 	}
 
 	return res, nil
 }
+
+// RefreshToken is a unary RPC to get a new access token for the user of the request
+func (server *AuthServer) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	claims := ClaimsFromContext(ctx)
+	if claims == nil {
+		return nil, detailedError(codes.Unauthenticated, ReasonTokenMissing, nil, "access token is not provided")
+	}
+
+	userStore, err := server.requestUserStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := userStore.Find(ctx, claims.Username)
+	if err != nil {
+		return nil, storeError(ctx, "cannot find user", err)
+	}
+
+	if user == nil {
+		return nil, detailedError(
+			codes.Unauthenticated,
+			ReasonTokenInvalid,
+			map[string]string{"username": claims.Username},
+			fmt.Sprintf("user %s doesn't exist anymore", claims.Username),
+		)
+	}
+
+	user.TenantID = claims.TenantID
+	token, err := server.jwtManager.Generate(user)
+	if err != nil {
+		return nil, internalError("cannot generate access token", err)
+	}
+
+	recordAudit(ctx, server.auditLog, &AuditEntry{
+		Action:   AuditTokenRefresh,
+		TenantID: TenantFromContext(ctx),
+		Username: user.Username,
+		Method:   refreshTokenMethod,
+		Code:     codes.OK.String(),
+	})
+
+	return &pb.RefreshTokenResponse{AccessToken: token}, nil
+}
+
+// CreateUser is a unary RPC to create a new user
+func (server *AuthServer) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
+	var violations FieldViolations
+	if req.GetUsername() == "" {
+		violations.Add("username", "is required")
+	}
+	if req.GetPassword() == "" {
+		violations.Add("password", "is required")
+	}
+	validateRole(&violations, req.GetRole())
+	if err := violations.Err(); err != nil {
+		return nil, err
+	}
+
+	userStore, err := server.requestUserStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := newTenantUser(ctx, req.GetUsername(), req.GetPassword(), req.GetRole())
+	if err != nil {
+		return nil, internalError("cannot create user", err)
+	}
+
+	err = userStore.Save(ctx, user)
+	if errors.Is(err, ErrAlreadyExists) {
+		return nil, detailedError(
+			codes.AlreadyExists,
+			ReasonUserAlreadyExists,
+			map[string]string{"username": user.Username},
+			fmt.Sprintf("cannot save user to the store: %v", err),
+			resourceInfo(ResourceTypeUser, user.Username, "user already exists"),
+		)
+	}
+	if err != nil {
+		return nil, storeError(ctx, "cannot save user to the store", err)
+	}
+
+	res := &pb.CreateUserResponse{
+		User: toPbUser(user),
+	}
+
+	return res, nil
+}
+
+// ListUsers is a unary RPC to list all users
+func (server *AuthServer) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	userStore, err := server.requestUserStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := userStore.List(ctx)
+	if err != nil {
+		return nil, storeError(ctx, "cannot list users", err)
+	}
+
+	res := &pb.ListUsersResponse{}
+	for _, user := range users {
+		res.Users = append(res.Users, toPbUser(user))
+	}
+
+	return res, nil
+}
+
+// UpdateUserRole is a unary RPC to change the role of a user
+func (server *AuthServer) UpdateUserRole(ctx context.Context, req *pb.UpdateUserRoleRequest) (*pb.UpdateUserRoleResponse, error) {
+	var violations FieldViolations
+	validateRole(&violations, req.GetRole())
+	if err := violations.Err(); err != nil {
+		return nil, err
+	}
+
+	userStore, err := server.requestUserStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := userStore.Find(ctx, req.GetUsername())
+	if err != nil {
+		return nil, storeError(ctx, "cannot find user", err)
+	}
+
+	if user == nil {
+		return nil, userNotFoundError(req.GetUsername())
+	}
+
+	previousRole := user.Role
+	user.Role = req.GetRole()
+	err = userStore.Update(ctx, user)
+	if err != nil {
+		return nil, storeError(ctx, "cannot update user", err)
+	}
+
+	recordAudit(ctx, server.auditLog, &AuditEntry{
+		Action:   AuditRoleChange,
+		TenantID: TenantFromContext(ctx),
+		Username: ClaimsFromContext(ctx).GetUsername(),
+		Method:   updateUserRoleMethod,
+		Code:     codes.OK.String(),
+		Details:  fmt.Sprintf("role of %s changed from %s to %s", user.Username, previousRole, user.Role),
+	})
+
+	res := &pb.UpdateUserRoleResponse{
+		User: toPbUser(user),
+	}
+
+	return res, nil
+}
+
+// CreateTenant is a unary RPC to create a new tenant with its first admin
+func (server *AuthServer) CreateTenant(ctx context.Context, req *pb.CreateTenantRequest) (*pb.CreateTenantResponse, error) {
+	err := server.checkTenantAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var violations FieldViolations
+	if !tenantIDPattern.MatchString(req.GetTenantId()) {
+		violations.Add("tenant_id", ErrInvalidTenantID.Error())
+	}
+	if req.GetAdminUsername() == "" {
+		violations.Add("admin_username", "is required")
+	}
+	if req.GetAdminPassword() == "" {
+		violations.Add("admin_password", "is required")
+	}
+	if err := violations.Err(); err != nil {
+		return nil, err
+	}
+
+	admin, err := NewUser(req.GetAdminUsername(), req.GetAdminPassword(), RoleAdmin)
+	if err != nil {
+		return nil, internalError("cannot create user", err)
+	}
+	admin.TenantID = req.GetTenantId()
+
+	// the tenant is created with its admin, so that it is never left without one
+	tenant, err := server.tenants.Create(ctx, req.GetTenantId(), admin)
+	if errors.Is(err, ErrAlreadyExists) {
+		return nil, detailedError(
+			codes.AlreadyExists,
+			ReasonTenantAlreadyExists,
+			map[string]string{"tenant_id": req.GetTenantId()},
+			fmt.Sprintf("cannot create tenant: %v", err),
+			resourceInfo(ResourceTypeTenant, req.GetTenantId(), "tenant already exists"),
+		)
+	}
+	if err != nil {
+		return nil, storeError(ctx, "cannot create tenant", err)
+	}
+
+	res := &pb.CreateTenantResponse{
+		Tenant: &pb.Tenant{Id: tenant.ID},
+		Admin:  toPbUser(admin),
+	}
+
+	return res, nil
+}
+
+// ListTenants is a unary RPC to list all tenants
+func (server *AuthServer) ListTenants(ctx context.Context, req *pb.ListTenantsRequest) (*pb.ListTenantsResponse, error) {
+	err := server.checkTenantAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants, err := server.tenants.List(ctx)
+	if err != nil {
+		return nil, storeError(ctx, "cannot list tenants", err)
+	}
+
+	res := &pb.ListTenantsResponse{}
+	for _, tenant := range tenants {
+		res.Tenants = append(res.Tenants, &pb.Tenant{Id: tenant.ID})
+	}
+
+	return res, nil
+}
+
+// ListAuditEntries is a unary RPC to query the audit log.
+// Admins of a tenant other than the default one only see the entries of their tenant.
+func (server *AuthServer) ListAuditEntries(ctx context.Context, req *pb.ListAuditEntriesRequest) (*pb.ListAuditEntriesResponse, error) {
+	if server.auditLog == nil {
+		return nil, detailedError(codes.Unimplemented, ReasonAuditLogDisabled, nil, "audit log is not enabled")
+	}
+
+	var violations FieldViolations
+	filter := &AuditFilter{
+		TenantID: req.GetTenantId(),
+		Username: req.GetUsername(),
+		Method:   req.GetMethod(),
+		Limit:    int(req.GetLimit()),
+	}
+	if req.GetStartTime() != nil {
+		if err := req.GetStartTime().CheckValid(); err != nil {
+			violations.Add("start_time", err.Error())
+		}
+		filter.Since = req.GetStartTime().AsTime()
+	}
+	if req.GetEndTime() != nil {
+		if err := req.GetEndTime().CheckValid(); err != nil {
+			violations.Add("end_time", err.Error())
+		}
+		filter.Until = req.GetEndTime().AsTime()
+	}
+	if err := violations.Err(); err != nil {
+		return nil, err
+	}
+
+	if tenantID := TenantFromContext(ctx); tenantID != DefaultTenant {
+		if filter.TenantID != "" && filter.TenantID != tenantID {
+			return nil, detailedError(
+				codes.PermissionDenied,
+				ReasonPermissionDenied,
+				map[string]string{"tenant_id": tenantID, "audit_tenant_id": filter.TenantID},
+				fmt.Sprintf("users of tenant %s cannot see the audit log of tenant %s", tenantID, filter.TenantID),
+			)
+		}
+		filter.TenantID = tenantID
+	}
+
+	entries, err := server.auditLog.Query(filter)
+	if err != nil {
+		return nil, internalError("cannot query audit log", err)
+	}
+
+	res := &pb.ListAuditEntriesResponse{}
+	for _, entry := range entries {
+		res.Entries = append(res.Entries, toPbAuditEntry(entry))
+	}
+
+	return res, nil
+}
+
+// checkTenantAdmin denies the request if the server has no tenants or the user is not of the default tenant.
+// The role of the user is checked by the auth interceptor.
+func (server *AuthServer) checkTenantAdmin(ctx context.Context) error {
+	if server.tenants == nil {
+		return detailedError(codes.Unimplemented, ReasonTenantsDisabled, nil, "tenants are not enabled")
+	}
+	if tenantID := TenantFromContext(ctx); tenantID != DefaultTenant {
+		return detailedError(
+			codes.PermissionDenied,
+			ReasonPermissionDenied,
+			map[string]string{"tenant_id": tenantID},
+			fmt.Sprintf("users of tenant %s cannot manage tenants", tenantID),
+		)
+	}
+	return nil
+}
+
+// invalidCredentialsError returns the error of a login with a wrong username or password
+func invalidCredentialsError() error {
+	return detailedError(codes.NotFound, ReasonInvalidCredentials, nil, "incorrect username/password")
+}
+
+// validateRole adds a violation of the role field unless it is a known role
+func validateRole(violations *FieldViolations, role string) {
+	switch {
+	case role == "":
+		violations.Add("role", "is required")
+	case !isValidRole(role):
+		violations.Add("role", ErrInvalidRole.Error())
+	}
+}
+
+// newTenantUser returns a new user of the tenant of the request
+func newTenantUser(ctx context.Context, username string, password string, role string) (*User, error) {
+	user, err := NewUser(username, password, role)
+	if err != nil {
+		return nil, err
+	}
+
+	if tenantID := TenantFromContext(ctx); tenantID != DefaultTenant {
+		user.TenantID = tenantID
+	}
+	return user, nil
+}
+
+func toPbAuditEntry(entry *AuditEntry) *pb.AuditEntry {
+	return &pb.AuditEntry{
+		Time:     timestamppb.New(entry.Time),
+		Action:   entry.Action,
+		TenantId: entry.TenantID,
+		Username: entry.Username,
+		Method:   entry.Method,
+		Peer:     entry.Peer,
+		Code:     entry.Code,
+		Details:  entry.Details,
+		PrevHash: entry.PrevHash,
+		Hash:     entry.Hash,
+	}
+}
+
+func toPbUser(user *User) *pb.User {
+	tenantID := user.TenantID
+	if tenantID == "" {
+		tenantID = DefaultTenant
+	}
+
+	return &pb.User{
+		Username: user.Username,
+		Role:     user.Role,
+		TenantId: tenantID,
+	}
+}
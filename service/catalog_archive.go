@@ -0,0 +1,589 @@
+package service
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/serializer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// CatalogArchiveVersion is the version of the catalog archives written by WriteCatalogArchive
+const CatalogArchiveVersion = 1
+
+// A catalog archive is a gzipped tar file with these entries.
+// The manifest is written last, so that images are read only once when the archive is written.
+const (
+	catalogLaptopsFile  = "laptops.pb"
+	catalogImagesFile   = "images.pb"
+	catalogRatingsFile  = "ratings.pb"
+	catalogImageFolder  = "images/"
+	catalogManifestFile = "manifest.json"
+)
+
+// CatalogImportLimits are the limits of the archives read by ImportCatalogArchive,
+// so that an archive cannot fill the memory or the staging folder
+type CatalogImportLimits struct {
+	// ArchiveSize is the max size of the gzipped archive
+	ArchiveSize int64
+	// ContentSize is the max size of the tar file of the archive once decompressed
+	ContentSize int64
+	// RecordsSize is the max size of each file of records and of the manifest, which are read in memory
+	RecordsSize int64
+	// ImageSize is the max size of each image
+	ImageSize int64
+}
+
+// DefaultCatalogImportLimits are the limits of the imported archives unless they are configured
+var DefaultCatalogImportLimits = CatalogImportLimits{
+	ArchiveSize: 1 << 30,
+	ContentSize: 2 << 30,
+	RecordsSize: 64 << 20,
+	ImageSize:   maxImageSize,
+}
+
+// ErrInvalidCatalogArchive is returned when a catalog archive is malformed or doesn't match its manifest
+var ErrInvalidCatalogArchive = errors.New("invalid catalog archive")
+
+// catalogManifest lists the files of a catalog archive with their checksums
+type catalogManifest struct {
+	Version   int           `json:"version"`
+	CreatedAt time.Time     `json:"created_at"`
+	Files     []catalogFile `json:"files"`
+}
+
+type catalogFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// WriteCatalogArchive writes all laptops, images and ratings of the stores to a catalog archive.
+// The records are spooled to temporary files and the images are copied from their files,
+// so that the catalog is never held in memory.
+func WriteCatalogArchive(
+	ctx context.Context,
+	writer io.Writer,
+	laptopStore LaptopStore,
+	imageStore ImageStore,
+	ratingStore RatingStore,
+) error {
+	gzipWriter := gzip.NewWriter(writer)
+	archive := &catalogWriter{
+		tar:      tar.NewWriter(gzipWriter),
+		manifest: &catalogManifest{Version: CatalogArchiveVersion, CreatedAt: time.Now().UTC()},
+	}
+
+	err := archive.writeSpooled(catalogLaptopsFile, func(records io.Writer) error {
+		filter := &pb.Filter{MaxPriceUsd: math.MaxFloat64}
+		err := laptopStore.Search(ctx, filter, func(laptop *pb.Laptop) error {
+			return serializer.WriteDelimited(records, laptop)
+		})
+		if err != nil {
+			return fmt.Errorf("cannot read laptops: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ratings, err := ratingStore.List(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot read ratings: %w", err)
+	}
+
+	err = archive.writeSpooled(catalogRatingsFile, func(records io.Writer) error {
+		for laptopID, rating := range ratings {
+			record := &pb.CatalogRating{
+				LaptopId: laptopID,
+				Count:    rating.Count,
+				Sum:      rating.Sum,
+			}
+
+			err := serializer.WriteDelimited(records, record)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	images, err := imageStore.List(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot read images: %w", err)
+	}
+
+	err = archive.writeSpooled(catalogImagesFile, func(records io.Writer) error {
+		for _, info := range images {
+			record := &pb.CatalogImage{
+				Id:        info.ID,
+				LaptopId:  info.LaptopID,
+				ImageType: info.Type,
+			}
+
+			err := serializer.WriteDelimited(records, record)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, info := range images {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := archive.writeImage(ctx, imageStore, info)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = archive.writeManifest()
+	if err != nil {
+		return err
+	}
+
+	err = archive.tar.Close()
+	if err != nil {
+		return fmt.Errorf("cannot close archive: %w", err)
+	}
+
+	return gzipWriter.Close()
+}
+
+// catalogWriter writes the files of a catalog archive and records them in its manifest
+type catalogWriter struct {
+	tar      *tar.Writer
+	manifest *catalogManifest
+}
+
+// writeFile copies a file of the given size to the archive
+func (archive *catalogWriter) writeFile(name string, size int64, reader io.Reader) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: archive.manifest.CreatedAt,
+	}
+
+	err := archive.tar.WriteHeader(header)
+	if err != nil {
+		return fmt.Errorf("cannot write archive header of %s: %w", name, err)
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(archive.tar, hash), reader)
+	if err != nil {
+		return fmt.Errorf("cannot write %s to archive: %w", name, err)
+	}
+	if n != size {
+		return fmt.Errorf("cannot write %s to archive: read %d bytes, expected %d", name, n, size)
+	}
+
+	if name != catalogManifestFile {
+		archive.manifest.Files = append(archive.manifest.Files, catalogFile{
+			Name:   name,
+			Size:   size,
+			SHA256: hex.EncodeToString(hash.Sum(nil)),
+		})
+	}
+
+	return nil
+}
+
+// writeSpooled writes the records written by write to the archive.
+// They are spooled to a temporary file first, since the size of a file is written before its content.
+func (archive *catalogWriter) writeSpooled(name string, write func(records io.Writer) error) error {
+	spool, err := ioutil.TempFile("", "catalog-export-")
+	if err != nil {
+		return fmt.Errorf("cannot create spool file of %s: %w", name, err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	records := bufio.NewWriter(spool)
+	err = write(records)
+	if err != nil {
+		return err
+	}
+
+	err = records.Flush()
+	if err != nil {
+		return fmt.Errorf("cannot spool %s: %w", name, err)
+	}
+
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot rewind spool file of %s: %w", name, err)
+	}
+
+	return archive.writeFile(name, size, spool)
+}
+
+func (archive *catalogWriter) writeImage(ctx context.Context, imageStore ImageStore, info *ImageInfo) error {
+	file, err := imageStore.Open(ctx, info.ID)
+	if err != nil {
+		return fmt.Errorf("cannot open image %s: %w", info.ID, err)
+	}
+	defer file.Close()
+
+	return archive.writeFile(catalogImageFolder+info.ID, info.Size, file)
+}
+
+func (archive *catalogWriter) writeManifest() error {
+	data, err := json.MarshalIndent(archive.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot marshal manifest: %w", err)
+	}
+
+	return archive.writeFile(catalogManifestFile, int64(len(data)), bytes.NewReader(data))
+}
+
+// ImportCatalogArchive adds the laptops of a catalog archive to the stores of the tenant, with their images and ratings.
+// The laptops are validated and saved like the laptops created by CreateLaptop, and laptops that already exist are skipped.
+// Nothing is saved unless the whole archive is valid and matches its manifest.
+func ImportCatalogArchive(
+	ctx context.Context,
+	reader io.Reader,
+	tenant *Tenant,
+	limits CatalogImportLimits,
+) (*pb.ImportCatalogResponse, error) {
+	stagingFolder, err := ioutil.TempDir("", "catalog-import-")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create staging folder: %w", err)
+	}
+	defer os.RemoveAll(stagingFolder)
+
+	archive, err := readCatalogArchive(ctx, reader, stagingFolder, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	return archive.apply(ctx, tenant)
+}
+
+// stagedCatalog is a verified catalog archive whose images are staged in a folder
+type stagedCatalog struct {
+	stagingFolder string
+	laptops       []*pb.Laptop
+	images        []*pb.CatalogImage
+	ratings       []*pb.CatalogRating
+}
+
+func readCatalogArchive(
+	ctx context.Context,
+	reader io.Reader,
+	stagingFolder string,
+	limits CatalogImportLimits,
+) (*stagedCatalog, error) {
+	gzipReader, err := gzip.NewReader(&sizeLimitedReader{
+		reader:    reader,
+		remaining: limits.ArchiveSize,
+		err:       fmt.Errorf("archive is larger than %d bytes", limits.ArchiveSize),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCatalogArchive, err)
+	}
+
+	tarReader := tar.NewReader(&sizeLimitedReader{
+		reader:    gzipReader,
+		remaining: limits.ContentSize,
+		err:       fmt.Errorf("archive is larger than %d bytes once decompressed", limits.ContentSize),
+	})
+	files := make(map[string]catalogFile)
+	data := make(map[string][]byte)
+	var manifest *catalogManifest
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCatalogArchive, err)
+		}
+
+		name := header.Name
+		if manifest != nil {
+			return nil, fmt.Errorf("%w: unexpected file %s after the manifest", ErrInvalidCatalogArchive, name)
+		}
+		if _, ok := files[name]; ok {
+			return nil, fmt.Errorf("%w: duplicate file %s", ErrInvalidCatalogArchive, name)
+		}
+
+		isRecords := name == catalogManifestFile ||
+			name == catalogLaptopsFile || name == catalogImagesFile || name == catalogRatingsFile
+		if isRecords && header.Size > limits.RecordsSize {
+			return nil, fmt.Errorf("%w: %s is larger than %d bytes", ErrInvalidCatalogArchive, name, limits.RecordsSize)
+		}
+		if !isRecords && header.Size > limits.ImageSize {
+			return nil, fmt.Errorf("%w: %s is larger than %d bytes", ErrInvalidCatalogArchive, name, limits.ImageSize)
+		}
+
+		switch {
+		case name == catalogManifestFile:
+			manifest = &catalogManifest{}
+			err = json.NewDecoder(tarReader).Decode(manifest)
+			if err != nil {
+				return nil, fmt.Errorf("%w: cannot parse manifest: %v", ErrInvalidCatalogArchive, err)
+			}
+			continue
+
+		case name == catalogLaptopsFile || name == catalogImagesFile || name == catalogRatingsFile:
+			content := &bytes.Buffer{}
+			files[name], err = copyWithChecksum(content, tarReader, name)
+			data[name] = content.Bytes()
+
+		case strings.HasPrefix(name, catalogImageFolder) && isUUID(strings.TrimPrefix(name, catalogImageFolder)):
+			var file *os.File
+			file, err = os.Create(filepath.Join(stagingFolder, strings.TrimPrefix(name, catalogImageFolder)))
+			if err != nil {
+				return nil, fmt.Errorf("cannot create staged image: %w", err)
+			}
+			files[name], err = copyWithChecksum(file, tarReader, name)
+			file.Close()
+
+		default:
+			return nil, fmt.Errorf("%w: unexpected file %s", ErrInvalidCatalogArchive, name)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = verifyCatalogManifest(manifest, files)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := &stagedCatalog{stagingFolder: stagingFolder}
+
+	err = readRecords(data[catalogLaptopsFile], func() proto.Message {
+		laptop := &pb.Laptop{}
+		archive.laptops = append(archive.laptops, laptop)
+		return laptop
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = readRecords(data[catalogImagesFile], func() proto.Message {
+		image := &pb.CatalogImage{}
+		archive.images = append(archive.images, image)
+		return image
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = readRecords(data[catalogRatingsFile], func() proto.Message {
+		rating := &pb.CatalogRating{}
+		archive.ratings = append(archive.ratings, rating)
+		return rating
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the laptops are checked like the laptops of a create request, but their price is already converted
+	for i, laptop := range archive.laptops {
+		err := prepareLaptop(laptop)
+		if err != nil {
+			return nil, fmt.Errorf("%w: laptop %d is invalid: %s", ErrInvalidCatalogArchive, i, status.Convert(err).Message())
+		}
+	}
+
+	for _, image := range archive.images {
+		if _, ok := files[catalogImageFolder+image.GetId()]; !ok {
+			return nil, fmt.Errorf("%w: image %s is missing", ErrInvalidCatalogArchive, image.GetId())
+		}
+	}
+
+	return archive, nil
+}
+
+// sizeLimitedReader reads at most a number of bytes of a reader, and then returns its error
+type sizeLimitedReader struct {
+	reader    io.Reader
+	remaining int64
+	err       error
+}
+
+func (reader *sizeLimitedReader) Read(data []byte) (int, error) {
+	if reader.remaining <= 0 {
+		return 0, reader.err
+	}
+	if int64(len(data)) > reader.remaining {
+		data = data[:reader.remaining]
+	}
+
+	n, err := reader.reader.Read(data)
+	reader.remaining -= int64(n)
+	return n, err
+}
+
+func isUUID(value string) bool {
+	_, err := uuid.Parse(value)
+	return err == nil
+}
+
+func copyWithChecksum(writer io.Writer, reader io.Reader, name string) (catalogFile, error) {
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(writer, hash), reader)
+	if err != nil {
+		return catalogFile{}, fmt.Errorf("%w: cannot read %s: %v", ErrInvalidCatalogArchive, name, err)
+	}
+
+	return catalogFile{Name: name, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// verifyCatalogManifest checks that the archive has exactly the files of the manifest, with the same checksums
+func verifyCatalogManifest(manifest *catalogManifest, files map[string]catalogFile) error {
+	if manifest == nil {
+		return fmt.Errorf("%w: manifest is missing", ErrInvalidCatalogArchive)
+	}
+	if manifest.Version != CatalogArchiveVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidCatalogArchive, manifest.Version)
+	}
+	if len(manifest.Files) != len(files) {
+		return fmt.Errorf("%w: manifest lists %d files, archive has %d", ErrInvalidCatalogArchive, len(manifest.Files), len(files))
+	}
+
+	for _, expected := range manifest.Files {
+		file, ok := files[expected.Name]
+		if !ok {
+			return fmt.Errorf("%w: file %s is missing", ErrInvalidCatalogArchive, expected.Name)
+		}
+		if file != expected {
+			return fmt.Errorf("%w: checksum of %s doesn't match", ErrInvalidCatalogArchive, expected.Name)
+		}
+	}
+
+	for _, name := range []string{catalogLaptopsFile, catalogImagesFile, catalogRatingsFile} {
+		if _, ok := files[name]; !ok {
+			return fmt.Errorf("%w: file %s is missing", ErrInvalidCatalogArchive, name)
+		}
+	}
+
+	return nil
+}
+
+// readRecords reads the length-delimited records of data into the messages returned by next
+func readRecords(data []byte, next func() proto.Message) error {
+	reader := bytes.NewReader(data)
+	for reader.Len() > 0 {
+		err := serializer.ReadDelimited(reader, next())
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidCatalogArchive, err)
+		}
+	}
+
+	return nil
+}
+
+// apply saves the laptops that don't exist yet to the stores of the tenant, with their images and ratings
+func (archive *stagedCatalog) apply(ctx context.Context, tenant *Tenant) (*pb.ImportCatalogResponse, error) {
+	res := &pb.ImportCatalogResponse{}
+	created := make(map[string]bool)
+
+	for start := 0; start < len(archive.laptops); start += bulkCreateBatchSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		end := start + bulkCreateBatchSize
+		if end > len(archive.laptops) {
+			end = len(archive.laptops)
+		}
+
+		batch := archive.laptops[start:end]
+		for i, err := range tenant.saveLaptops(ctx, batch) {
+			switch {
+			case err == nil:
+				created[batch[i].GetId()] = true
+				res.LaptopCount++
+			case errors.Is(err, ErrAlreadyExists):
+				res.SkippedLaptopCount++
+			default:
+				return nil, fmt.Errorf("cannot save laptop %s: %w", batch[i].GetId(), err)
+			}
+		}
+	}
+
+	for _, rating := range archive.ratings {
+		if !created[rating.GetLaptopId()] {
+			continue
+		}
+
+		err := tenant.RatingStore.Set(ctx, rating.GetLaptopId(), &Rating{Count: rating.GetCount(), Sum: rating.GetSum()})
+		if err != nil {
+			return nil, fmt.Errorf("cannot save rating of laptop %s: %w", rating.GetLaptopId(), err)
+		}
+		res.RatingCount++
+	}
+
+	// the images are archived in gallery order, so restoring them in turn keeps the galleries
+	for _, image := range archive.images {
+		if !created[image.GetLaptopId()] {
+			continue
+		}
+
+		err := archive.restoreImage(ctx, tenant.ImageStore, image)
+		if err != nil {
+			return nil, err
+		}
+		res.ImageCount++
+	}
+
+	return res, nil
+}
+
+func (archive *stagedCatalog) restoreImage(ctx context.Context, imageStore ImageStore, image *pb.CatalogImage) error {
+	file, err := os.Open(filepath.Join(archive.stagingFolder, image.GetId()))
+	if err != nil {
+		return fmt.Errorf("cannot open staged image %s: %w", image.GetId(), err)
+	}
+	defer file.Close()
+
+	err = imageStore.Restore(ctx, image.GetId(), image.GetLaptopId(), image.GetImageType(), file)
+	if err != nil {
+		return fmt.Errorf("cannot save image %s: %w", image.GetId(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+
+	"github.com/thewalkers2012/grpc-example/pb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+)
+
+// catalogChunkSize is the size of the archive chunks sent by ExportCatalog
+const catalogChunkSize = 64 << 10
+
+// CatalogServer is the server to back up and restore the laptop catalog
+type CatalogServer struct {
+	laptopStore  LaptopStore
+	imageStore   ImageStore
+	ratingStore  RatingStore
+	historyStore LaptopHistoryStore
+	eventBus     *LaptopEventBus
+	tenants      TenantStore
+	limits       CatalogImportLimits
+	pb.UnimplementedCatalogServiceServer
+}
+
+// CatalogServerOption configures optional dependencies of a CatalogServer
+type CatalogServerOption func(server *CatalogServer)
+
+// WithCatalogTenants makes the server export and import the catalog of the tenant of each request,
+// instead of the stores it was created with
+func WithCatalogTenants(tenants TenantStore) CatalogServerOption {
+	return func(server *CatalogServer) {
+		server.tenants = tenants
+	}
+}
+
+// WithCatalogHistoryStore sets the store where the versions of the imported laptops are recorded
+func WithCatalogHistoryStore(store LaptopHistoryStore) CatalogServerOption {
+	return func(server *CatalogServer) {
+		server.historyStore = store
+	}
+}
+
+// WithCatalogEventBus sets the bus the creation of the imported laptops is published to
+func WithCatalogEventBus(bus *LaptopEventBus) CatalogServerOption {
+	return func(server *CatalogServer) {
+		server.eventBus = bus
+	}
+}
+
+// WithCatalogImportLimits sets the limits of the imported archives, DefaultCatalogImportLimits by default
+func WithCatalogImportLimits(limits CatalogImportLimits) CatalogServerOption {
+	return func(server *CatalogServer) {
+		server.limits = limits
+	}
+}
+
+// NewCatalogServer returns a new catalog server
+func NewCatalogServer(
+	laptopStore LaptopStore,
+	imageStore ImageStore,
+	ratingStore RatingStore,
+	options ...CatalogServerOption,
+) *CatalogServer {
+	server := &CatalogServer{
+		laptopStore: laptopStore,
+		imageStore:  imageStore,
+		ratingStore: ratingStore,
+		limits:      DefaultCatalogImportLimits,
+	}
+
+	for _, option := range options {
+		option(server)
+	}
+
+	return server
+}
+
+// tenant returns the stores of the tenant of the request
+func (server *CatalogServer) tenant(ctx context.Context) (*Tenant, error) {
+	return findTenant(ctx, server.tenants, &Tenant{
+		ID:           DefaultTenant,
+		LaptopStore:  server.laptopStore,
+		ImageStore:   server.imageStore,
+		RatingStore:  server.ratingStore,
+		HistoryStore: server.historyStore,
+		EventBus:     server.eventBus,
+	})
+}
+
+// ExportCatalog is a server-streaming RPC to export the catalog as an archive
+func (server *CatalogServer) ExportCatalog(req *pb.ExportCatalogRequest, stream pb.CatalogService_ExportCatalogServer) error {
+	log.Print("receive an export-catalog request")
+
+	tenant, err := server.tenant(stream.Context())
+	if err != nil {
+		return logError(err)
+	}
+
+	chunks := &exportWriter{stream: stream}
+	writer := bufio.NewWriterSize(chunks, catalogChunkSize)
+
+	err = WriteCatalogArchive(stream.Context(), writer, tenant.LaptopStore, tenant.ImageStore, tenant.RatingStore)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if chunks.err != nil {
+		return logError(streamError(stream.Context(), "cannot send archive chunk", chunks.err))
+	}
+	if err != nil {
+		return logError(storeError(stream.Context(), "cannot export catalog", err))
+	}
+
+	return nil
+}
+
+// ImportCatalog is a client-streaming RPC to import a catalog archive
+func (server *CatalogServer) ImportCatalog(stream pb.CatalogService_ImportCatalogServer) error {
+	log.Print("receive an import-catalog request")
+
+	tenant, err := server.tenant(stream.Context())
+	if err != nil {
+		return logError(err)
+	}
+
+	reader := &importReader{stream: stream}
+
+	res, err := ImportCatalogArchive(stream.Context(), reader, tenant, server.limits)
+	if err != nil {
+		if reader.err != nil {
+			return logError(streamError(stream.Context(), "cannot receive archive chunk", reader.err))
+		}
+		if errors.Is(err, ErrInvalidCatalogArchive) {
+			return logError(invalidCatalogArchiveError(err))
+		}
+		return logError(storeError(stream.Context(), "cannot import catalog", err))
+	}
+
+	log.Printf("imported %d laptops, %d images and %d ratings, skipped %d laptops",
+		res.GetLaptopCount(), res.GetImageCount(), res.GetRatingCount(), res.GetSkippedLaptopCount())
+
+	err = stream.SendAndClose(res)
+	if err != nil {
+		return logError(streamError(stream.Context(), "cannot send response", err))
+	}
+
+	return nil
+}
+
+// invalidCatalogArchiveError returns an InvalidArgument error of an archive that cannot be imported
+func invalidCatalogArchiveError(err error) error {
+	return detailedError(
+		codes.InvalidArgument,
+		ReasonInvalidCatalogArchive,
+		nil,
+		err.Error(),
+		&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+			Field:       "chunk_data",
+			Description: err.Error(),
+		}}},
+	)
+}
+
+// exportWriter sends every write as an archive chunk
+type exportWriter struct {
+	stream pb.CatalogService_ExportCatalogServer
+	// err is the error of the stream, as opposed to errors of the stores
+	err error
+}
+
+func (writer *exportWriter) Write(data []byte) (int, error) {
+	err := writer.stream.Send(&pb.ExportCatalogResponse{ChunkData: data})
+	if err != nil {
+		writer.err = err
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// importReader reads the archive chunks of the request stream
+type importReader struct {
+	stream pb.CatalogService_ImportCatalogServer
+	chunk  []byte
+	// err is the error of the stream, as opposed to errors of the archive
+	err error
+}
+
+func (reader *importReader) Read(data []byte) (int, error) {
+	for len(reader.chunk) == 0 {
+		req, err := reader.stream.Recv()
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			reader.err = err
+			return 0, err
+		}
+		reader.chunk = req.GetChunkData()
+	}
+
+	n := copy(data, reader.chunk)
+	reader.chunk = reader.chunk[n:]
+	return n, nil
+}
@@ -0,0 +1,299 @@
+package service_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/client"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCatalogExportImport(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := newTestImageStore(t, t.TempDir())
+	ratingStore := service.NewInMemoryRatingStore()
+
+	laptops := []*pb.Laptop{sample.NewLaptop(), sample.NewLaptop(), sample.NewLaptop()}
+	for _, laptop := range laptops {
+		require.NoError(t, laptopStore.Save(context.Background(), laptop))
+	}
+
+	image := bytes.Repeat([]byte("image"), 100)
+	imageID, _, err := imageStore.Save(context.Background(), laptops[0].Id, ".jpg", *bytes.NewBuffer(image))
+	require.NoError(t, err)
+
+	_, err = ratingStore.Add(context.Background(), laptops[1].Id, 8)
+	require.NoError(t, err)
+	_, err = ratingStore.Add(context.Background(), laptops[1].Id, 10)
+	require.NoError(t, err)
+
+	catalogClient := newTestCatalogClient(t, laptopStore, imageStore, ratingStore)
+
+	archive := &bytes.Buffer{}
+	err = catalogClient.ExportCatalog(context.Background(), archive)
+	require.NoError(t, err)
+
+	// restore the archive to empty stores
+	laptopStore2 := service.NewInMemoryLaptopStore()
+	imageStore2 := newTestImageStore(t, t.TempDir())
+	ratingStore2 := service.NewInMemoryRatingStore()
+	historyStore2 := service.NewInMemoryLaptopHistoryStore()
+	eventBus2 := service.NewLaptopEventBus(10)
+	catalogClient2 := newTestCatalogClient(t, laptopStore2, imageStore2, ratingStore2,
+		service.WithCatalogHistoryStore(historyStore2),
+		service.WithCatalogEventBus(eventBus2),
+	)
+
+	subscription := eventBus2.Subscribe()
+	defer subscription.Close()
+
+	res, err := catalogClient2.ImportCatalog(context.Background(), bytes.NewReader(archive.Bytes()))
+	require.NoError(t, err)
+	require.EqualValues(t, 3, res.GetLaptopCount())
+	require.EqualValues(t, 0, res.GetSkippedLaptopCount())
+	require.EqualValues(t, 1, res.GetImageCount())
+	require.EqualValues(t, 1, res.GetRatingCount())
+
+	// the imported laptops are created like the laptops of CreateLaptop
+	var created []string
+	for _, laptop := range laptops {
+		other, err := laptopStore2.Find(context.Background(), laptop.Id)
+		require.NoError(t, err)
+		requireSameLaptop(t, laptop, other)
+
+		versions, err := historyStore2.List(context.Background(), laptop.Id)
+		require.NoError(t, err)
+		require.Len(t, versions, 1)
+		require.Equal(t, pb.LaptopVersion_CREATED, versions[0].GetChange())
+
+		event := <-subscription.Events()
+		require.Equal(t, pb.LaptopEvent_CREATED, event.GetType())
+		created = append(created, event.GetLaptopId())
+	}
+	require.ElementsMatch(t, []string{laptops[0].Id, laptops[1].Id, laptops[2].Id}, created)
+
+	file, err := imageStore2.Open(context.Background(), imageID)
+	require.NoError(t, err)
+	restored, err := ioutil.ReadAll(file)
+	file.Close()
+	require.NoError(t, err)
+	require.Equal(t, image, restored)
+
+	ratings, err := ratingStore2.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, map[string]*service.Rating{laptops[1].Id: {Count: 2, Sum: 18}}, ratings)
+
+	// importing again skips the existing laptops
+	res, err = catalogClient2.ImportCatalog(context.Background(), bytes.NewReader(archive.Bytes()))
+	require.NoError(t, err)
+	require.EqualValues(t, 0, res.GetLaptopCount())
+	require.EqualValues(t, 3, res.GetSkippedLaptopCount())
+	require.EqualValues(t, 0, res.GetImageCount())
+}
+
+func TestCatalogImportRejectsTamperedArchive(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	require.NoError(t, laptopStore.Save(context.Background(), sample.NewLaptop()))
+
+	archive := &bytes.Buffer{}
+	err := service.WriteCatalogArchive(
+		context.Background(),
+		archive,
+		laptopStore,
+		newTestImageStore(t, t.TempDir()),
+		service.NewInMemoryRatingStore(),
+	)
+	require.NoError(t, err)
+
+	tampered := rewriteArchive(t, archive.Bytes(), func(name string, data []byte) []byte {
+		if name == "laptops.pb" {
+			return append(data, 0)
+		}
+		return data
+	})
+
+	laptopStore2 := service.NewInMemoryLaptopStore()
+	catalogClient := newTestCatalogClient(t, laptopStore2, newTestImageStore(t, t.TempDir()), service.NewInMemoryRatingStore())
+
+	_, err = catalogClient.ImportCatalog(context.Background(), bytes.NewReader(tampered))
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = catalogClient.ImportCatalog(context.Background(), bytes.NewReader([]byte("not an archive")))
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	var clientErr *client.Error
+	require.ErrorAs(t, err, &clientErr)
+	require.Equal(t, service.ReasonInvalidCatalogArchive, clientErr.Reason)
+	require.Len(t, clientErr.Violations, 1)
+	require.Equal(t, "chunk_data", clientErr.Violations[0].Field)
+
+	// nothing is imported from an invalid archive
+	err = laptopStore2.Search(context.Background(), &pb.Filter{MaxPriceUsd: 1e9}, func(laptop *pb.Laptop) error {
+		t.Errorf("unexpected laptop %s", laptop.Id)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCatalogImportRejectsInvalidLaptop(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	laptop.Cpu.NumberCores = 0
+	require.NoError(t, laptopStore.Save(context.Background(), laptop))
+	require.NoError(t, laptopStore.Save(context.Background(), sample.NewLaptop()))
+
+	archive := &bytes.Buffer{}
+	err := service.WriteCatalogArchive(
+		context.Background(),
+		archive,
+		laptopStore,
+		newTestImageStore(t, t.TempDir()),
+		service.NewInMemoryRatingStore(),
+	)
+	require.NoError(t, err)
+
+	laptopStore2 := service.NewInMemoryLaptopStore()
+	catalogClient := newTestCatalogClient(t, laptopStore2, newTestImageStore(t, t.TempDir()), service.NewInMemoryRatingStore())
+
+	_, err = catalogClient.ImportCatalog(context.Background(), bytes.NewReader(archive.Bytes()))
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "cpu.number_cores")
+
+	// none of the laptops is imported
+	err = laptopStore2.Search(context.Background(), &pb.Filter{MaxPriceUsd: 1e9}, func(laptop *pb.Laptop) error {
+		t.Errorf("unexpected laptop %s", laptop.Id)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCatalogImportLimits(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := newTestImageStore(t, t.TempDir())
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(context.Background(), laptop))
+	_, _, err := imageStore.Save(context.Background(), laptop.Id, ".jpg", *bytes.NewBuffer(make([]byte, 4096)))
+	require.NoError(t, err)
+
+	archive := &bytes.Buffer{}
+	err = service.WriteCatalogArchive(context.Background(), archive, laptopStore, imageStore, service.NewInMemoryRatingStore())
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		limits service.CatalogImportLimits
+	}{
+		{
+			name:   "archive",
+			limits: service.CatalogImportLimits{ArchiveSize: 100, ContentSize: 1 << 20, RecordsSize: 1 << 20, ImageSize: 1 << 20},
+		},
+		{
+			// the zeroed image compresses well, but not once decompressed
+			name:   "content",
+			limits: service.CatalogImportLimits{ArchiveSize: 1 << 20, ContentSize: 4096, RecordsSize: 1 << 20, ImageSize: 1 << 20},
+		},
+		{
+			name:   "records",
+			limits: service.CatalogImportLimits{ArchiveSize: 1 << 20, ContentSize: 1 << 20, RecordsSize: 10, ImageSize: 1 << 20},
+		},
+		{
+			name:   "image",
+			limits: service.CatalogImportLimits{ArchiveSize: 1 << 20, ContentSize: 1 << 20, RecordsSize: 1 << 20, ImageSize: 1024},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			laptopStore2 := service.NewInMemoryLaptopStore()
+			catalogClient := newTestCatalogClient(t, laptopStore2, newTestImageStore(t, t.TempDir()), service.NewInMemoryRatingStore(),
+				service.WithCatalogImportLimits(tc.limits),
+			)
+
+			_, err := catalogClient.ImportCatalog(context.Background(), bytes.NewReader(archive.Bytes()))
+			require.Equal(t, codes.InvalidArgument, status.Code(err))
+			require.Contains(t, status.Convert(err).Message(), "larger than")
+
+			other, err := laptopStore2.Find(context.Background(), laptop.Id)
+			require.NoError(t, err)
+			require.Nil(t, other)
+		})
+	}
+}
+
+// rewriteArchive returns a copy of a catalog archive with the files changed by rewrite
+func rewriteArchive(t *testing.T, archive []byte, rewrite func(name string, data []byte) []byte) []byte {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(archive))
+	require.NoError(t, err)
+	tarReader := tar.NewReader(gzipReader)
+
+	output := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(output)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadAll(tarReader)
+		require.NoError(t, err)
+
+		data = rewrite(header.Name, data)
+		header.Size = int64(len(data))
+		require.NoError(t, tarWriter.WriteHeader(header))
+		_, err = tarWriter.Write(data)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tarWriter.Close())
+	require.NoError(t, gzipWriter.Close())
+	return output.Bytes()
+}
+
+func newTestCatalogClient(
+	t *testing.T,
+	laptopStore service.LaptopStore,
+	imageStore service.ImageStore,
+	ratingStore service.RatingStore,
+	options ...service.CatalogServerOption,
+) *client.CatalogClient {
+	grpcServer := grpc.NewServer()
+	pb.RegisterCatalogServiceServer(grpcServer, service.NewCatalogServer(laptopStore, imageStore, ratingStore, options...))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return client.NewCatalogClient(conn)
+}
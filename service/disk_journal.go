@@ -0,0 +1,220 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// folderLockName is the file locked by a server while it changes a folder shared with other servers
+const folderLockName = ".lock"
+
+// diskJournal is a file of JSON records, one per line, in a folder shared by several servers.
+// A server appends records while it holds the lock of the folder, after it has read the records
+// appended by the other servers, so that every server applies the same records in the same order.
+// The journal is compacted by replacing it with a new file, which the servers read from its start.
+type diskJournal struct {
+	path     string
+	lockFile *os.File
+	// info is the journal file read, nil if there was none, and offset the size read
+	info   os.FileInfo
+	offset int64
+	// records is the number of records read or appended since the journal was created
+	records int
+}
+
+// openDiskJournal returns the journal of the folder with the name, the file is created by the first record
+func openDiskJournal(folder string, name string) (*diskJournal, error) {
+	lockFile, err := os.OpenFile(filepath.Join(folder, folderLockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open folder lock: %w", err)
+	}
+
+	return &diskJournal{path: filepath.Join(folder, name), lockFile: lockFile}, nil
+}
+
+// Close closes the lock of the folder
+func (journal *diskJournal) Close() error {
+	return journal.lockFile.Close()
+}
+
+// changed tells whether the journal was appended to or replaced since it was read.
+// It only costs a stat, so it is checked before reading the journal with the lock held.
+func (journal *diskJournal) changed() (bool, error) {
+	info, err := os.Stat(journal.path)
+	if os.IsNotExist(err) {
+		return journal.info != nil, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot read journal: %w", err)
+	}
+
+	return journal.info == nil || !os.SameFile(info, journal.info) || info.Size() != journal.offset, nil
+}
+
+// withLock calls fn while it holds the lock of the folder, shared by all servers using it.
+// The lock is not exclusive between the goroutines of a server, so they must hold a mutex too.
+func (journal *diskJournal) withLock(fn func() error) error {
+	err := lockFile(journal.lockFile)
+	if err != nil {
+		return fmt.Errorf("cannot lock folder: %w", err)
+	}
+	defer unlockFile(journal.lockFile)
+
+	return fn()
+}
+
+// read calls apply with every record appended since the journal was last read,
+// after calling reset if the journal was replaced. A partial last record, left by a server
+// that stopped while it was writing it, is removed. It must be called with the lock held.
+func (journal *diskJournal) read(reset func() error, apply func(record []byte) error) error {
+	file, err := os.OpenFile(journal.path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		if journal.info == nil {
+			return nil
+		}
+		journal.info, journal.offset, journal.records = nil, 0, 0
+		return reset()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot open journal: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot read journal: %w", err)
+	}
+
+	if journal.info != nil && (!os.SameFile(info, journal.info) || info.Size() < journal.offset) {
+		journal.info, journal.offset, journal.records = nil, 0, 0
+		err := reset()
+		if err != nil {
+			return err
+		}
+	}
+	journal.info = info
+
+	if info.Size() == journal.offset {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(io.NewSectionReader(file, journal.offset, info.Size()-journal.offset))
+	if err != nil {
+		return fmt.Errorf("cannot read journal: %w", err)
+	}
+
+	// nobody writes the journal while the lock is held, so a partial record is never completed
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if end < len(data) {
+		err := file.Truncate(journal.offset + int64(end))
+		if err != nil {
+			return fmt.Errorf("cannot remove partial record of journal: %w", err)
+		}
+		log.Printf("removed partial last record of journal %s", journal.path)
+	}
+
+	for _, line := range bytes.SplitAfter(data[:end], []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		record := bytes.TrimSpace(line)
+		if len(record) > 0 {
+			err := apply(record)
+			if err != nil {
+				return fmt.Errorf("cannot apply record of journal %s: %w", journal.path, err)
+			}
+			journal.records++
+		}
+		journal.offset += int64(len(line))
+	}
+
+	return nil
+}
+
+// append appends the records to the journal in a single write.
+// It must be called with the lock held, after read, so that the journal stays read up to its end.
+func (journal *diskJournal) append(records ...interface{}) error {
+	data, err := marshalRecords(records)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(journal.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open journal: %w", err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(data)
+	if err != nil {
+		// a partial record would be followed by the next one
+		file.Truncate(journal.offset)
+		return fmt.Errorf("cannot write journal: %w", err)
+	}
+
+	journal.offset += int64(len(data))
+	journal.records += len(records)
+	if info, err := file.Stat(); err == nil {
+		journal.info = info
+	}
+
+	return nil
+}
+
+// replace replaces the journal with a new one of the records, such as a snapshot of the state
+// of the journal. It must be called with the lock held, after read.
+func (journal *diskJournal) replace(records ...interface{}) error {
+	data, err := marshalRecords(records)
+	if err != nil {
+		return err
+	}
+
+	// the temporary file starts with a dot, like the lock, so that it is not taken for data of the folder
+	tmpFile, err := ioutil.TempFile(filepath.Dir(journal.path), "."+filepath.Base(journal.path)+"-*")
+	if err != nil {
+		return fmt.Errorf("cannot create journal: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, journal.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("cannot replace journal: %w", err)
+	}
+
+	info, err := os.Stat(journal.path)
+	if err != nil {
+		return fmt.Errorf("cannot read journal: %w", err)
+	}
+
+	journal.info = info
+	journal.offset = int64(len(data))
+	journal.records = len(records)
+	return nil
+}
+
+// marshalRecords returns the JSON lines of the records
+func marshalRecords(records []interface{}) ([]byte, error) {
+	var data []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("cannot marshal journal record: %w", err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+	return data, nil
+}
@@ -0,0 +1,473 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/serializer"
+)
+
+const (
+	laptopFileExt = ".pb"
+	// laptopJournalName is the file of the IDs of the laptops changed by the servers, one per line
+	laptopJournalName = ".changes"
+	// maxLaptopJournalSize is the size of the journal over which it is replaced by an empty one
+	maxLaptopJournalSize = 1 << 20
+)
+
+// ErrInvalidLaptopID is returned when a laptop ID cannot be the name of its file
+var ErrInvalidLaptopID = errors.New("laptop ID must be a file name, without path separators or leading dot")
+
+// DiskLaptopStore stores laptops as binary protobuf files in a folder.
+// Several servers can share the same folder: every laptop saved, updated or deleted
+// by one of them is visible to the others. Laptops are cached in memory after they are read.
+//
+// The servers change the laptop files while they hold the lock of the folder, and append the ID of
+// every changed laptop to the journal of the folder. The cache is synced by reading the new lines
+// of the journal, so that it costs a single stat when no laptop has changed.
+type DiskLaptopStore struct {
+	mutex        sync.Mutex
+	laptopFolder string
+	cache        *InMemoryLaptopStore
+	lockFile     *os.File
+	// journal is the journal file the cache is synced with, and offset the size of the journal read
+	journal os.FileInfo
+	offset  int64
+}
+
+// NewDiskLaptopStore returns a new DiskLaptopStore
+func NewDiskLaptopStore(laptopFolder string) (*DiskLaptopStore, error) {
+	err := os.MkdirAll(laptopFolder, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create laptop folder: %w", err)
+	}
+
+	lockFile, err := os.OpenFile(filepath.Join(laptopFolder, folderLockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open laptop folder lock: %w", err)
+	}
+
+	// the journal always exists, a missing journal is a replaced one
+	journal, err := os.OpenFile(filepath.Join(laptopFolder, laptopJournalName), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		lockFile.Close()
+		return nil, fmt.Errorf("cannot create laptop journal: %w", err)
+	}
+	journal.Close()
+
+	store := &DiskLaptopStore{
+		laptopFolder: laptopFolder,
+		cache:        NewInMemoryLaptopStore(),
+		lockFile:     lockFile,
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err = store.sync(context.Background())
+	if err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Save saves the laptop to the store
+func (store *DiskLaptopStore) Save(ctx context.Context, laptop *pb.Laptop) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return store.save(laptop)
+}
+
+// SaveBatch saves the laptops to the store, returns the error of each laptop in the same order.
+// The laptops that are not written yet when the context is done get its error.
+func (store *DiskLaptopStore) SaveBatch(ctx context.Context, laptops []*pb.Laptop) []error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	errs := make([]error, len(laptops))
+	for i, laptop := range laptops {
+		if err := ctx.Err(); err != nil {
+			errs[i] = err
+			continue
+		}
+		errs[i] = store.save(laptop)
+	}
+
+	return errs
+}
+
+func (store *DiskLaptopStore) save(laptop *pb.Laptop) error {
+	path, err := store.laptopPath(laptop.Id)
+	if err != nil {
+		return err
+	}
+
+	tmpPath, err := store.writeTempFile(laptop)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	err = store.withFolderLock(func() error {
+		// link fails if the file exists, even if it was created by another server
+		err := os.Link(tmpPath, path)
+		if os.IsExist(err) {
+			return ErrAlreadyExists
+		}
+		if err != nil {
+			return fmt.Errorf("cannot write laptop file: %w", err)
+		}
+
+		err = store.recordChange(laptop.Id)
+		if err != nil {
+			os.Remove(path)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	store.cache.set(laptop)
+	return nil
+}
+
+// Update replaces the saved laptop with the same ID, returns ErrNotFound if there is none
+func (store *DiskLaptopStore) Update(ctx context.Context, laptop *pb.Laptop) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	path, err := store.laptopPath(laptop.Id)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	tmpPath, err := store.writeTempFile(laptop)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	// the folder is locked, so that the laptop cannot be deleted by another server
+	// between the check and the rename
+	err = store.withFolderLock(func() error {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return ErrNotFound
+		}
+
+		// rename replaces the file at once, so other servers never read a partial laptop
+		err := os.Rename(tmpPath, path)
+		if err != nil {
+			return fmt.Errorf("cannot write laptop file: %w", err)
+		}
+
+		return store.recordChange(laptop.Id)
+	})
+	if errors.Is(err, ErrNotFound) {
+		store.cache.unset(laptop.Id)
+	}
+	if err != nil {
+		return err
+	}
+
+	store.cache.set(laptop)
+	return nil
+}
+
+// Delete deletes the laptop by ID, returns ErrNotFound if it doesn't exist
+func (store *DiskLaptopStore) Delete(ctx context.Context, id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	path, err := store.laptopPath(id)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	err = store.withFolderLock(func() error {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("cannot delete laptop file: %w", err)
+		}
+
+		return store.recordChange(id)
+	})
+	if err == nil || errors.Is(err, ErrNotFound) {
+		store.cache.unset(id)
+	}
+
+	return err
+}
+
+// Find finds a laptop by ID
+func (store *DiskLaptopStore) Find(ctx context.Context, id string) (*pb.Laptop, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err := store.sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.cache.get(id), nil
+}
+
+// Search searches for laptops with filter, returns one by one via the found function
+func (store *DiskLaptopStore) Search(ctx context.Context, filter *pb.Filter, found func(laptop *pb.Laptop) error) error {
+	store.mutex.Lock()
+	err := store.sync(ctx)
+	store.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return store.cache.Search(ctx, filter, found)
+}
+
+// withFolderLock calls fn while it holds the lock of the folder, shared by all servers using it.
+// It must be called with the mutex held, since the lock is not exclusive between the goroutines of a server.
+func (store *DiskLaptopStore) withFolderLock(fn func() error) error {
+	err := lockFile(store.lockFile)
+	if err != nil {
+		return fmt.Errorf("cannot lock laptop folder: %w", err)
+	}
+	defer unlockFile(store.lockFile)
+
+	return fn()
+}
+
+// recordChange appends the ID of a changed laptop to the journal, replacing the journal
+// by an empty one first if it is too large. It must be called with the lock of the folder held.
+func (store *DiskLaptopStore) recordChange(id string) error {
+	journalPath := filepath.Join(store.laptopFolder, laptopJournalName)
+
+	// if the cache is synced with the journal, it stays synced after the change
+	before, err := os.Stat(journalPath)
+	synced := err == nil && store.journal != nil && os.SameFile(before, store.journal) && before.Size() == store.offset
+
+	if err == nil && before.Size() >= maxLaptopJournalSize {
+		// the other servers see that the journal is replaced and reload every laptop file
+		tmpPath, err := store.writeEmptyTempFile()
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tmpPath, journalPath)
+		if err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("cannot replace laptop journal: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open laptop journal: %w", err)
+	}
+
+	_, err = file.Write([]byte(id + "\n"))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write laptop journal: %w", err)
+	}
+
+	if synced {
+		after, err := os.Stat(journalPath)
+		if err == nil {
+			store.journal = after
+			store.offset = after.Size()
+		}
+	}
+
+	return nil
+}
+
+// sync updates the cache with the laptops changed by other servers since the journal was last read,
+// or with every laptop file if the journal was replaced. It must be called with the mutex held,
+// and stops with the error of the context once it is done.
+func (store *DiskLaptopStore) sync(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	journalPath := filepath.Join(store.laptopFolder, laptopJournalName)
+	info, err := os.Stat(journalPath)
+	if os.IsNotExist(err) {
+		return store.reload(ctx, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read laptop journal: %w", err)
+	}
+
+	if store.journal == nil || !os.SameFile(info, store.journal) || info.Size() < store.offset {
+		return store.reload(ctx, info)
+	}
+	if info.Size() == store.offset {
+		return nil
+	}
+
+	file, err := os.Open(journalPath)
+	if err != nil {
+		return fmt.Errorf("cannot read laptop journal: %w", err)
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(io.NewSectionReader(file, store.offset, info.Size()-store.offset))
+	if err != nil {
+		return fmt.Errorf("cannot read laptop journal: %w", err)
+	}
+
+	// a line that is being written is read the next time
+	end := bytes.LastIndexByte(data, '\n') + 1
+	for _, id := range strings.Fields(string(data[:end])) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := store.load(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	store.offset += int64(end)
+	return nil
+}
+
+// reload reads every laptop file into the cache, and takes the journal as read up to its size.
+// The journal info must be taken before the folder is read, so that the laptops changed
+// while it is read are loaded again by the next sync.
+func (store *DiskLaptopStore) reload(ctx context.Context, journal os.FileInfo) error {
+	files, err := ioutil.ReadDir(store.laptopFolder)
+	if err != nil {
+		return fmt.Errorf("cannot read laptop folder: %w", err)
+	}
+
+	ids := make(map[string]bool, len(files))
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != laptopFileExt {
+			continue
+		}
+
+		id := strings.TrimSuffix(name, laptopFileExt)
+		ids[id] = true
+
+		err := store.load(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	var removed []string
+	store.cache.mutex.RLock()
+	for id := range store.cache.data {
+		if !ids[id] {
+			removed = append(removed, id)
+		}
+	}
+	store.cache.mutex.RUnlock()
+
+	for _, id := range removed {
+		store.cache.unset(id)
+	}
+
+	// a partial last line of the journal is skipped, its laptop file is already read
+	store.journal = journal
+	store.offset = 0
+	if journal != nil {
+		store.offset = journal.Size()
+	}
+
+	return nil
+}
+
+// load reads the laptop file into the cache, or removes the laptop from the cache if its file doesn't exist
+func (store *DiskLaptopStore) load(id string) error {
+	path, err := store.laptopPath(id)
+	if err != nil {
+		return nil
+	}
+
+	laptop := &pb.Laptop{}
+	err = serializer.ReadProtobufFromBinaryFile(laptop, path)
+	if errors.Is(err, os.ErrNotExist) {
+		store.cache.unset(id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	store.cache.set(laptop)
+	return nil
+}
+
+// writeTempFile writes the laptop to a new temp file in the laptop folder, returns its path
+func (store *DiskLaptopStore) writeTempFile(laptop *pb.Laptop) (string, error) {
+	tmpPath, err := store.writeEmptyTempFile()
+	if err != nil {
+		return "", err
+	}
+
+	err = serializer.WriteProtobufToBinaryFile(laptop, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	return tmpPath, nil
+}
+
+// writeEmptyTempFile creates a new empty temp file in the laptop folder, returns its path
+func (store *DiskLaptopStore) writeEmptyTempFile() (string, error) {
+	tmpFile, err := ioutil.TempFile(store.laptopFolder, ".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("cannot create temp file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+
+	return tmpPath, nil
+}
+
+// laptopPath returns the path of the laptop file, or ErrInvalidLaptopID if the ID is not a file name,
+// so that different IDs never share a file
+func (store *DiskLaptopStore) laptopPath(id string) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", ErrInvalidLaptopID
+	}
+	return filepath.Join(store.laptopFolder, id+laptopFileExt), nil
+}
@@ -0,0 +1,199 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/service"
+)
+
+func TestDiskLaptopStoreShared(t *testing.T) {
+	t.Parallel()
+
+	laptopFolder := t.TempDir()
+
+	store1, err := service.NewDiskLaptopStore(laptopFolder)
+	require.NoError(t, err)
+	store2, err := service.NewDiskLaptopStore(laptopFolder)
+	require.NoError(t, err)
+
+	laptop := sample.NewLaptop()
+	require.NoError(t, store1.Save(context.Background(), laptop))
+
+	// the laptop saved by one store is visible to the other
+	other, err := store2.Find(context.Background(), laptop.Id)
+	require.NoError(t, err)
+	requireSameLaptop(t, laptop, other)
+
+	// both stores reject the same ID
+	require.ErrorIs(t, store1.Save(context.Background(), laptop), service.ErrAlreadyExists)
+	require.ErrorIs(t, store2.Save(context.Background(), laptop), service.ErrAlreadyExists)
+
+	laptop2 := sample.NewLaptop()
+	require.NoError(t, store2.Save(context.Background(), laptop2))
+
+	found := make(map[string]bool)
+	err = store1.Search(context.Background(), &pb.Filter{MaxPriceUsd: 1e6}, func(laptop *pb.Laptop) error {
+		found[laptop.GetId()] = true
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{laptop.Id: true, laptop2.Id: true}, found)
+
+	// a new store loads the existing laptops
+	store3, err := service.NewDiskLaptopStore(laptopFolder)
+	require.NoError(t, err)
+	other, err = store3.Find(context.Background(), laptop2.Id)
+	require.NoError(t, err)
+	requireSameLaptop(t, laptop2, other)
+
+	other, err = store3.Find(context.Background(), sample.NewLaptop().Id)
+	require.NoError(t, err)
+	require.Nil(t, other)
+}
+
+func TestDiskLaptopStoreSaveBatch(t *testing.T) {
+	t.Parallel()
+
+	store, err := service.NewDiskLaptopStore(t.TempDir())
+	require.NoError(t, err)
+
+	laptop1 := sample.NewLaptop()
+	laptop2 := sample.NewLaptop()
+	errs := store.SaveBatch(context.Background(), []*pb.Laptop{laptop1, laptop2, laptop1})
+	require.Len(t, errs, 3)
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	require.ErrorIs(t, errs[2], service.ErrAlreadyExists)
+
+	other, err := store.Find(context.Background(), laptop2.Id)
+	require.NoError(t, err)
+	requireSameLaptop(t, laptop2, other)
+}
+
+func TestDiskLaptopStoreUpdateDelete(t *testing.T) {
+	t.Parallel()
+
+	laptopFolder := t.TempDir()
+
+	store1, err := service.NewDiskLaptopStore(laptopFolder)
+	require.NoError(t, err)
+	store2, err := service.NewDiskLaptopStore(laptopFolder)
+	require.NoError(t, err)
+
+	laptop := sample.NewLaptop()
+	require.NoError(t, store1.Save(context.Background(), laptop))
+	_, err = store2.Find(context.Background(), laptop.Id)
+	require.NoError(t, err)
+
+	// the update of one store is visible to the other, even if it cached the laptop
+	laptop.PriceUsd++
+	laptop.Name = "updated"
+	require.NoError(t, store1.Update(context.Background(), laptop))
+	other, err := store2.Find(context.Background(), laptop.Id)
+	require.NoError(t, err)
+	requireSameLaptop(t, laptop, other)
+
+	require.ErrorIs(t, store1.Update(context.Background(), sample.NewLaptop()), service.ErrNotFound)
+
+	require.NoError(t, store2.Delete(context.Background(), laptop.Id))
+	require.ErrorIs(t, store1.Delete(context.Background(), laptop.Id), service.ErrNotFound)
+
+	err = store1.Search(context.Background(), &pb.Filter{MaxPriceUsd: 1e6}, func(laptop *pb.Laptop) error {
+		t.Errorf("unexpected laptop %s", laptop.Id)
+		return nil
+	})
+	require.NoError(t, err)
+
+	other, err = store1.Find(context.Background(), laptop.Id)
+	require.NoError(t, err)
+	require.Nil(t, other)
+}
+
+func TestDiskLaptopStoreConcurrentChanges(t *testing.T) {
+	t.Parallel()
+
+	laptopFolder := t.TempDir()
+
+	store1, err := service.NewDiskLaptopStore(laptopFolder)
+	require.NoError(t, err)
+	store2, err := service.NewDiskLaptopStore(laptopFolder)
+	require.NoError(t, err)
+
+	laptop := sample.NewLaptop()
+	laptop.Name = "aaaa"
+	require.NoError(t, store1.Save(context.Background(), laptop))
+	_, err = store2.Find(context.Background(), laptop.Id)
+	require.NoError(t, err)
+
+	// a rewrite of the same size at once is seen too
+	laptop.Name = "bbbb"
+	require.NoError(t, store1.Update(context.Background(), laptop))
+	other, err := store2.Find(context.Background(), laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, "bbbb", other.GetName())
+
+	// the laptop deleted by another store is not updated back
+	require.NoError(t, store2.Delete(context.Background(), laptop.Id))
+	require.ErrorIs(t, store1.Update(context.Background(), laptop), service.ErrNotFound)
+
+	other, err = store2.Find(context.Background(), laptop.Id)
+	require.NoError(t, err)
+	require.Nil(t, other)
+}
+
+func TestDiskLaptopStoreInvalidID(t *testing.T) {
+	t.Parallel()
+
+	store, err := service.NewDiskLaptopStore(t.TempDir())
+	require.NoError(t, err)
+
+	// IDs that are not file names are rejected, instead of sharing a file
+	for _, id := range []string{"", "a/x", "b/x", `c\x`, "..", ".hidden"} {
+		laptop := sample.NewLaptop()
+		laptop.Id = id
+		require.ErrorIs(t, store.Save(context.Background(), laptop), service.ErrInvalidLaptopID, id)
+		require.ErrorIs(t, store.Update(context.Background(), laptop), service.ErrNotFound, id)
+		require.ErrorIs(t, store.Delete(context.Background(), id), service.ErrNotFound, id)
+
+		found, err := store.Find(context.Background(), id)
+		require.NoError(t, err)
+		require.Nil(t, found)
+	}
+}
+
+func TestDiskStoresCanceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	laptopStore, err := service.NewDiskLaptopStore(t.TempDir())
+	require.NoError(t, err)
+
+	laptop := sample.NewLaptop()
+	require.ErrorIs(t, laptopStore.Save(ctx, laptop), context.Canceled)
+	errs := laptopStore.SaveBatch(ctx, []*pb.Laptop{laptop})
+	require.ErrorIs(t, errs[0], context.Canceled)
+	err = laptopStore.Search(ctx, &pb.Filter{MaxPriceUsd: 1e6}, func(laptop *pb.Laptop) error { return nil })
+	require.ErrorIs(t, err, context.Canceled)
+
+	found, err := laptopStore.Find(context.Background(), laptop.Id)
+	require.NoError(t, err)
+	require.Nil(t, found)
+
+	imageFolder := t.TempDir()
+	imageStore := newTestImageStore(t, imageFolder)
+	_, _, err = imageStore.Save(ctx, laptop.Id, ".jpg", *bytes.NewBufferString("image"))
+	require.ErrorIs(t, err, context.Canceled)
+
+	// the partial image file is removed, only the lock of the folder is left
+	files, err := filepath.Glob(filepath.Join(imageFolder, "[^.]*"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/runtime/protoiface"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// ErrorDomain is the domain of the ErrorInfo detail of the service errors
+const ErrorDomain = "grpc-example.thewalkers2012.github.com"
+
+// Reasons of the ErrorInfo detail of the service errors.
+// They are stable, so clients can rely on them instead of the messages.
+const (
+	ReasonInvalidArgument          = "INVALID_ARGUMENT"
+	ReasonLaptopNotFound           = "LAPTOP_NOT_FOUND"
+	ReasonLaptopAlreadyExists      = "LAPTOP_ALREADY_EXISTS"
+	ReasonLaptopNotDeleted         = "LAPTOP_NOT_DELETED"
+	ReasonImageTooLarge            = "IMAGE_TOO_LARGE"
+	ReasonImageNotFound            = "IMAGE_NOT_FOUND"
+	ReasonTenantNotFound           = "TENANT_NOT_FOUND"
+	ReasonTenantAlreadyExists      = "TENANT_ALREADY_EXISTS"
+	ReasonTenantsDisabled          = "TENANTS_DISABLED"
+	ReasonTenantMismatch           = "TENANT_MISMATCH"
+	ReasonTokenMissing             = "TOKEN_MISSING"
+	ReasonTokenInvalid             = "TOKEN_INVALID"
+	ReasonPermissionDenied         = "PERMISSION_DENIED"
+	ReasonInvalidCredentials       = "INVALID_CREDENTIALS"
+	ReasonUserNotFound             = "USER_NOT_FOUND"
+	ReasonUserAlreadyExists        = "USER_ALREADY_EXISTS"
+	ReasonAuditLogDisabled         = "AUDIT_LOG_DISABLED"
+	ReasonInvalidCatalogArchive    = "INVALID_CATALOG_ARCHIVE"
+	ReasonIdempotencyKeyReused     = "IDEMPOTENCY_KEY_REUSED"
+	ReasonIdempotencyKeyInProgress = "IDEMPOTENCY_KEY_IN_PROGRESS"
+	ReasonEventsDisabled           = "EVENTS_DISABLED"
+	ReasonEventsClosed             = "EVENTS_CLOSED"
+	ReasonWatcherTooSlow           = "WATCHER_TOO_SLOW"
+	ReasonRequestCanceled          = "REQUEST_CANCELED"
+	ReasonDeadlineExceeded         = "DEADLINE_EXCEEDED"
+	ReasonStreamFailed             = "STREAM_FAILED"
+	ReasonInternal                 = "INTERNAL"
+)
+
+// Resource types of the ResourceInfo detail
+const (
+	ResourceTypeLaptop = "laptop"
+	ResourceTypeImage  = "image"
+	ResourceTypeTenant = "tenant"
+	ResourceTypeUser   = "user"
+)
+
+// retryDelay is the delay of the RetryInfo detail of the errors that can be retried
+const retryDelay = time.Second
+
+// detailedError returns a status error with the details, followed by an ErrorInfo detail of the reason and metadata
+func detailedError(
+	code codes.Code,
+	reason string,
+	metadata map[string]string,
+	message string,
+	details ...protoiface.MessageV1,
+) error {
+	st := status.New(code, message)
+
+	details = append(details, &errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   ErrorDomain,
+		Metadata: metadata,
+	})
+
+	detailed, err := st.WithDetails(details...)
+	if err != nil {
+		return st.Err()
+	}
+
+	return detailed.Err()
+}
+
+// resourceInfo returns a ResourceInfo detail of the resource
+func resourceInfo(resourceType string, name string, description string) *errdetails.ResourceInfo {
+	return &errdetails.ResourceInfo{
+		ResourceType: resourceType,
+		ResourceName: name,
+		Description:  description,
+	}
+}
+
+// retryInfo returns a RetryInfo detail with the delay before the request can be retried
+func retryInfo(delay time.Duration) *errdetails.RetryInfo {
+	return &errdetails.RetryInfo{RetryDelay: durationpb.New(delay)}
+}
+
+// laptopNotFoundError returns a NotFound error of the laptop
+func laptopNotFoundError(laptopID string) error {
+	return detailedError(
+		codes.NotFound,
+		ReasonLaptopNotFound,
+		map[string]string{"laptop_id": laptopID},
+		fmt.Sprintf("laptop %s doesn't exist", laptopID),
+		resourceInfo(ResourceTypeLaptop, laptopID, "laptop doesn't exist"),
+	)
+}
+
+// imageNotFoundError returns a NotFound error of an image that the laptop doesn't have
+func imageNotFoundError(laptopID string, imageID string) error {
+	return detailedError(
+		codes.NotFound,
+		ReasonImageNotFound,
+		map[string]string{"laptop_id": laptopID, "image_id": imageID},
+		fmt.Sprintf("laptop %s has no image %s", laptopID, imageID),
+		resourceInfo(ResourceTypeImage, imageID, "image doesn't exist"),
+	)
+}
+
+// tenantNotFoundError returns a PermissionDenied error of a tenant that doesn't exist
+func tenantNotFoundError(tenantID string) error {
+	return detailedError(
+		codes.PermissionDenied,
+		ReasonTenantNotFound,
+		map[string]string{"tenant_id": tenantID},
+		fmt.Sprintf("tenant %s doesn't exist", tenantID),
+		resourceInfo(ResourceTypeTenant, tenantID, "tenant doesn't exist"),
+	)
+}
+
+// userNotFoundError returns a NotFound error of the user
+func userNotFoundError(username string) error {
+	return detailedError(
+		codes.NotFound,
+		ReasonUserNotFound,
+		map[string]string{"username": username},
+		fmt.Sprintf("user %s doesn't exist", username),
+		resourceInfo(ResourceTypeUser, username, "user doesn't exist"),
+	)
+}
+
+// laptopSaveError returns the error of a laptop that cannot be saved to the store,
+// AlreadyExists if the store has a laptop with the same ID
+func laptopSaveError(ctx context.Context, laptopID string, err error) error {
+	if errors.Is(err, ErrAlreadyExists) {
+		return detailedError(
+			codes.AlreadyExists,
+			ReasonLaptopAlreadyExists,
+			map[string]string{"laptop_id": laptopID},
+			fmt.Sprintf("cannot save laptop to the store: %v", err),
+			resourceInfo(ResourceTypeLaptop, laptopID, "laptop already exists"),
+		)
+	}
+	return storeError(ctx, "cannot save laptop to the store", err)
+}
+
+// storeError returns the error of a failed store operation: Canceled or DeadlineExceeded
+// if the store stopped because the request is done, Internal otherwise
+func storeError(ctx context.Context, message string, err error) error {
+	switch {
+	case errors.Is(err, context.Canceled) || ctx.Err() == context.Canceled:
+		return detailedError(codes.Canceled, ReasonRequestCanceled, nil, message+": request is canceled")
+	case errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded:
+		return detailedError(codes.DeadlineExceeded, ReasonDeadlineExceeded, nil, message+": deadline is exceeded")
+	default:
+		return internalError(message, err)
+	}
+}
+
+// internalError returns an Internal error of an unexpected failure
+func internalError(message string, err error) error {
+	return detailedError(codes.Internal, ReasonInternal, nil, fmt.Sprintf("%s: %v", message, err))
+}
+
+// streamError returns the error of a stream that cannot receive or send a message:
+// Canceled or DeadlineExceeded if the request is done, Unknown otherwise
+func streamError(ctx context.Context, message string, err error) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	return detailedError(codes.Unknown, ReasonStreamFailed, nil, fmt.Sprintf("%s: %v", message, err))
+}
+
+// contextError returns a Canceled or DeadlineExceeded error if the request is done, nil otherwise
+func contextError(ctx context.Context) error {
+	switch ctx.Err() {
+	case context.Canceled:
+		return logError(detailedError(codes.Canceled, ReasonRequestCanceled, nil, "request is canceled"))
+	case context.DeadlineExceeded:
+		return logError(detailedError(codes.DeadlineExceeded, ReasonDeadlineExceeded, nil, "deadline is exceeded"))
+	default:
+		return nil
+	}
+}
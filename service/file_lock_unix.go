@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package service
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile waits for an exclusive lock of the file, shared by all processes that open it
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+}
+
+// unlockFile releases the lock of the file
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,354 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// IdempotencyKeyHeader is the metadata key of the client-chosen idempotency key
+const IdempotencyKeyHeader = "idempotency-key"
+
+// DefaultIdempotencyTTL is how long responses are remembered by default
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// ErrIdempotencyKeyReused is returned when a key is reused with a different request payload
+var ErrIdempotencyKeyReused = errors.New("idempotency key is already used by a different request")
+
+// ErrIdempotencyKeyInProgress is returned when a request with the same key is still being processed
+var ErrIdempotencyKeyInProgress = errors.New("request with the same idempotency key is in progress")
+
+// IdempotencyStore remembers the responses of requests by idempotency key
+type IdempotencyStore interface {
+	// Begin reserves the key for a request with the given payload fingerprint.
+	// It returns the saved response if the same request was already completed.
+	Begin(ctx context.Context, key string, fingerprint []byte) (proto.Message, error)
+	// Complete saves the response of the request that reserved the key
+	Complete(ctx context.Context, key string, response proto.Message) error
+	// Cancel releases the key of a request that failed, so that it can be retried.
+	// The context may be done already, when the request failed because of it.
+	Cancel(ctx context.Context, key string) error
+}
+
+type idempotencyRecord struct {
+	fingerprint []byte
+	response    proto.Message
+	expiresAt   time.Time
+}
+
+// InMemoryIdempotencyStore stores idempotency records in memory until they expire
+type InMemoryIdempotencyStore struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	records   map[string]*idempotencyRecord
+	lastSweep time.Time
+}
+
+// NewInMemoryIdempotencyStore returns a new InMemoryIdempotencyStore
+func NewInMemoryIdempotencyStore(ttl time.Duration) *InMemoryIdempotencyStore {
+	return &InMemoryIdempotencyStore{
+		ttl:       ttl,
+		records:   make(map[string]*idempotencyRecord),
+		lastSweep: time.Now(),
+	}
+}
+
+// Begin reserves the key for a request with the given payload fingerprint
+func (store *InMemoryIdempotencyStore) Begin(ctx context.Context, key string, fingerprint []byte) (proto.Message, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	store.sweep(now)
+
+	record := store.records[key]
+	if record != nil && now.Before(record.expiresAt) {
+		if !bytes.Equal(record.fingerprint, fingerprint) {
+			return nil, ErrIdempotencyKeyReused
+		}
+		if record.response == nil {
+			return nil, ErrIdempotencyKeyInProgress
+		}
+		return proto.Clone(record.response), nil
+	}
+
+	store.records[key] = &idempotencyRecord{
+		fingerprint: fingerprint,
+		expiresAt:   now.Add(store.ttl),
+	}
+
+	return nil, nil
+}
+
+// Complete saves the response of the request that reserved the key
+func (store *InMemoryIdempotencyStore) Complete(ctx context.Context, key string, response proto.Message) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	record := store.records[key]
+	if record == nil {
+		return ErrNotFound
+	}
+
+	record.response = proto.Clone(response)
+	record.expiresAt = time.Now().Add(store.ttl)
+	return nil
+}
+
+// Cancel releases the key of a request that failed
+func (store *InMemoryIdempotencyStore) Cancel(ctx context.Context, key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.records, key)
+	return nil
+}
+
+// sweep removes the expired records at most once per TTL
+func (store *InMemoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(store.lastSweep) < store.ttl {
+		return
+	}
+
+	for key, record := range store.records {
+		if !now.Before(record.expiresAt) {
+			delete(store.records, key)
+		}
+	}
+	store.lastSweep = now
+}
+
+const (
+	// idempotencyJournalName is the file of the idempotency records in the laptop folder, one change per line
+	idempotencyJournalName = ".idempotency"
+	// maxIdempotencyJournalRecords is the number of records of the journal over which it is replaced
+	// by the records that have not expired
+	maxIdempotencyJournalRecords = 10000
+	// idempotencyReservationTTL is how long a key stays reserved by a request that is not completed,
+	// so that the keys of a server that stopped during its requests can be retried on another server
+	idempotencyReservationTTL = 10 * time.Minute
+)
+
+// DiskIdempotencyStore stores idempotency records in a journal of a folder, such as the laptop folder,
+// so that a request retried on another server sharing the folder gets the response of the first one.
+// Every change is appended while the server holds the lock of the folder, after it has read the changes
+// appended by the other servers.
+type DiskIdempotencyStore struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	journal *diskJournal
+	records map[string]*idempotencyRecord
+}
+
+// idempotencyChange is a change of the record of a key in the journal, Removed if the key was released
+type idempotencyChange struct {
+	Key         string    `json:"key"`
+	Fingerprint []byte    `json:"fingerprint,omitempty"`
+	Response    []byte    `json:"response,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at,omitempty"`
+	Removed     bool      `json:"removed,omitempty"`
+}
+
+// NewDiskIdempotencyStore returns a new DiskIdempotencyStore with the records of the journal of the folder
+func NewDiskIdempotencyStore(folder string, ttl time.Duration) (*DiskIdempotencyStore, error) {
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create idempotency folder: %w", err)
+	}
+
+	journal, err := openDiskJournal(folder, idempotencyJournalName)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &DiskIdempotencyStore{
+		ttl:     ttl,
+		journal: journal,
+		records: make(map[string]*idempotencyRecord),
+	}
+
+	err = journal.withLock(store.read)
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Begin reserves the key for a request with the given payload fingerprint
+func (store *DiskIdempotencyStore) Begin(ctx context.Context, key string, fingerprint []byte) (proto.Message, error) {
+	var saved proto.Message
+	err := store.locked(func(now time.Time) error {
+		record := store.records[key]
+		if record != nil && now.Before(record.expiresAt) {
+			if !bytes.Equal(record.fingerprint, fingerprint) {
+				return ErrIdempotencyKeyReused
+			}
+			if record.response == nil {
+				return ErrIdempotencyKeyInProgress
+			}
+			saved = proto.Clone(record.response)
+			return nil
+		}
+
+		reservation := store.ttl
+		if reservation > idempotencyReservationTTL {
+			reservation = idempotencyReservationTTL
+		}
+		return store.append(&idempotencyChange{Key: key, Fingerprint: fingerprint, ExpiresAt: now.Add(reservation)})
+	})
+
+	return saved, err
+}
+
+// Complete saves the response of the request that reserved the key
+func (store *DiskIdempotencyStore) Complete(ctx context.Context, key string, response proto.Message) error {
+	data, err := anypb.New(response)
+	if err != nil {
+		return fmt.Errorf("cannot marshal response: %w", err)
+	}
+	value, err := proto.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("cannot marshal response: %w", err)
+	}
+
+	return store.locked(func(now time.Time) error {
+		record := store.records[key]
+		if record == nil {
+			return ErrNotFound
+		}
+
+		return store.append(&idempotencyChange{
+			Key:         key,
+			Fingerprint: record.fingerprint,
+			Response:    value,
+			ExpiresAt:   now.Add(store.ttl),
+		})
+	})
+}
+
+// Cancel releases the key of a request that failed
+func (store *DiskIdempotencyStore) Cancel(ctx context.Context, key string) error {
+	return store.locked(func(now time.Time) error {
+		if store.records[key] == nil {
+			return nil
+		}
+		return store.append(&idempotencyChange{Key: key, Removed: true})
+	})
+}
+
+// locked calls fn with the lock of the folder held, once the store has read the changes of the journal.
+// The journal is replaced by the records that have not expired once it has maxIdempotencyJournalRecords records.
+func (store *DiskIdempotencyStore) locked(fn func(now time.Time) error) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.journal.withLock(func() error {
+		err := store.read()
+		if err != nil {
+			return err
+		}
+
+		err = fn(time.Now())
+		if err != nil || store.journal.records < maxIdempotencyJournalRecords {
+			return err
+		}
+
+		// the change is in the journal, so the journal is only replaced by the next change
+		err = store.compact(time.Now())
+		if err != nil {
+			log.Printf("cannot compact idempotency journal: %v", err)
+		}
+		return nil
+	})
+}
+
+// append appends the change to the journal and applies it
+func (store *DiskIdempotencyStore) append(change *idempotencyChange) error {
+	err := store.journal.append(change)
+	if err != nil {
+		return fmt.Errorf("cannot write idempotency journal: %w", err)
+	}
+
+	return store.apply(change)
+}
+
+// compact replaces the journal by the records that have not expired
+func (store *DiskIdempotencyStore) compact(now time.Time) error {
+	var changes []interface{}
+	for key, record := range store.records {
+		if !now.Before(record.expiresAt) {
+			delete(store.records, key)
+			continue
+		}
+
+		change := &idempotencyChange{Key: key, Fingerprint: record.fingerprint, ExpiresAt: record.expiresAt}
+		if record.response != nil {
+			data, err := anypb.New(record.response)
+			if err == nil {
+				change.Response, err = proto.Marshal(data)
+			}
+			if err != nil {
+				return fmt.Errorf("cannot marshal response: %w", err)
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	return store.journal.replace(changes...)
+}
+
+// read applies the changes appended to the journal since it was last read, it must be called with the lock held
+func (store *DiskIdempotencyStore) read() error {
+	reset := func() error {
+		store.records = make(map[string]*idempotencyRecord)
+		return nil
+	}
+
+	return store.journal.read(reset, func(data []byte) error {
+		change := &idempotencyChange{}
+		err := json.Unmarshal(data, change)
+		if err != nil {
+			return err
+		}
+
+		return store.apply(change)
+	})
+}
+
+// apply applies a change of the journal to the records
+func (store *DiskIdempotencyStore) apply(change *idempotencyChange) error {
+	if change.Removed {
+		delete(store.records, change.Key)
+		return nil
+	}
+
+	record := &idempotencyRecord{
+		fingerprint: change.Fingerprint,
+		expiresAt:   change.ExpiresAt,
+	}
+
+	if len(change.Response) > 0 {
+		data := &anypb.Any{}
+		err := proto.Unmarshal(change.Response, data)
+		if err == nil {
+			record.response, err = data.UnmarshalNew()
+		}
+		if err != nil {
+			return fmt.Errorf("cannot unmarshal response: %w", err)
+		}
+	}
+
+	store.records[change.Key] = record
+	return nil
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/thewalkers2012/grpc-example/pb"
+)
+
+// DefaultImageCollectInterval is how often the images of the laptops that no longer exist are deleted by default
+const DefaultImageCollectInterval = time.Hour
+
+// DefaultImageRetention is how long the images of a deleted laptop are kept by default,
+// so that restoring the laptop brings them back
+const DefaultImageRetention = 7 * 24 * time.Hour
+
+// CollectImages deletes the images of the laptops that don't exist in the laptop store of the tenant,
+// and returns the number of deleted images. The images of a laptop deleted less than retention ago
+// are kept, since the laptop can still be restored.
+func CollectImages(ctx context.Context, tenant *Tenant, retention time.Duration) (int, error) {
+	images, err := tenant.ImageStore.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("cannot list images: %w", err)
+	}
+
+	counts := make(map[string]int)
+	var laptopIDs []string
+	for _, info := range images {
+		if counts[info.LaptopID] == 0 {
+			laptopIDs = append(laptopIDs, info.LaptopID)
+		}
+		counts[info.LaptopID]++
+	}
+
+	deleted := 0
+	for _, laptopID := range laptopIDs {
+		laptop, err := tenant.LaptopStore.Find(ctx, laptopID)
+		if err != nil {
+			return deleted, fmt.Errorf("cannot find laptop %s: %w", laptopID, err)
+		}
+		if laptop != nil {
+			continue
+		}
+
+		restorable, err := restorableLaptop(ctx, tenant.HistoryStore, laptopID, retention)
+		if err != nil {
+			return deleted, err
+		}
+		if restorable {
+			continue
+		}
+
+		err = tenant.ImageStore.DeleteLaptop(ctx, laptopID)
+		if err != nil {
+			return deleted, fmt.Errorf("cannot delete images of laptop %s: %w", laptopID, err)
+		}
+		deleted += counts[laptopID]
+	}
+
+	return deleted, nil
+}
+
+// restorableLaptop tells whether the laptop was deleted less than retention ago
+func restorableLaptop(ctx context.Context, historyStore LaptopHistoryStore, laptopID string, retention time.Duration) (bool, error) {
+	if historyStore == nil {
+		return false, nil
+	}
+
+	versions, err := historyStore.List(ctx, laptopID)
+	if err != nil {
+		return false, fmt.Errorf("cannot list versions of laptop %s: %w", laptopID, err)
+	}
+	if len(versions) == 0 {
+		return false, nil
+	}
+
+	last := versions[len(versions)-1]
+	return last.GetChange() == pb.LaptopVersion_DELETED && time.Since(last.GetTime().AsTime()) < retention, nil
+}
+
+// RunImageCollector collects the images of the laptops that no longer exist in every tenant
+// at every interval, until the context is done
+func RunImageCollector(ctx context.Context, tenants TenantStore, interval time.Duration, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		list, err := tenants.List(ctx)
+		if err != nil {
+			log.Printf("cannot list tenants to collect images: %v", err)
+			continue
+		}
+
+		for _, tenant := range list {
+			deleted, err := CollectImages(ctx, tenant, retention)
+			if err != nil {
+				log.Printf("cannot collect images of tenant %s: %v", tenant.ID, err)
+			}
+			if deleted > 0 {
+				log.Printf("collected %d images of deleted laptops of tenant %s", deleted, tenant.ID)
+			}
+		}
+	}
+}
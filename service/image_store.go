@@ -2,64 +2,858 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+const (
+	// imageIndexFile is the sidecar file of the image folder with the information of its images
+	imageIndexFile = "index.json"
+	// imageJournalFile is the sidecar file of the changes of the images since the index file was written, one per line
+	imageJournalFile = "index.journal"
+	// maxImageJournalChanges is the number of changes of the journal over which the index file is written again
+	maxImageJournalChanges = 1000
+	// imageQuarantineFolder is the subfolder of the image folder where unknown and corrupted files are moved
+	imageQuarantineFolder = "quarantine"
+)
+
+// ImageStore is an interface to store laptop images.
+// The images of a laptop are ordered in a gallery, the first one is the primary image.
+// Writing an image stops with the error of the context once it is done.
 type ImageStore interface {
-	Save(laptopID string, imageType string, imageData bytes.Buffer) (string, error)
+	// Save saves a new image at the end of the gallery of the laptop and returns its ID.
+	// It tells whether the data was deduplicated, because the store already had the same data.
+	Save(ctx context.Context, laptopID string, imageType string, imageData bytes.Buffer) (string, bool, error)
+	// List returns the information of all images, sorted by laptop ID and order
+	List(ctx context.Context) ([]*ImageInfo, error)
+	// ListLaptop returns the information of the images of a laptop, sorted by order
+	ListLaptop(ctx context.Context, laptopID string) ([]*ImageInfo, error)
+	// Open opens the data of an image
+	Open(ctx context.Context, imageID string) (io.ReadCloser, error)
+	// Restore saves an image with a known ID at the end of the gallery of the laptop,
+	// such as an image from a catalog archive
+	Restore(ctx context.Context, imageID string, laptopID string, imageType string, imageData io.Reader) error
+	// Delete deletes an image of the laptop, the next images move up in the gallery.
+	// It returns ErrNotFound if the laptop has no such image.
+	Delete(ctx context.Context, laptopID string, imageID string) error
+	// DeleteLaptop deletes all images of the laptop
+	DeleteLaptop(ctx context.Context, laptopID string) error
+	// Reorder puts the images first in the gallery of the laptop, in the order of imageIDs.
+	// The other images keep their relative order after them.
+	// It returns ErrNotFound if one of the images is not an image of the laptop.
+	Reorder(ctx context.Context, laptopID string, imageIDs []string) error
 }
 
+// DiskImageStore stores images in a folder, with their information in a sidecar index file of the folder.
+// Every change is appended to a journal, and the index is written again once the journal has
+// maxImageJournalChanges changes, so that a change doesn't cost a write of every image.
+// The index is reconciled with the files of the folder when the store is created.
+//
+// Several servers can share the same folder: a server changes the images while it holds the lock
+// of the folder, after it has applied the changes appended to the journal by the other servers.
+//
+// The data is content-addressed: every image is a record that refers to a blob file named after
+// the SHA-256 of its data, so identical images share a blob. A blob is deleted with its last image.
 type DiskImageStore struct {
 	mutex       sync.RWMutex
 	imageFolder string
 	images      map[string]*ImageInfo
+	// galleries are the image IDs of every laptop, in order
+	galleries map[string][]string
+	// blobs are the number of images of every blob, by checksum
+	blobs  map[string]int
+	report *ImageIndexReport
+	// journal has the changes since the index file was written, seq is the number of the last change applied
+	journal *diskJournal
+	seq     uint64
 }
 
 // ImageInfo contains information of the laptop image
 type ImageInfo struct {
+	ID       string
 	LaptopID string
 	Type     string
-	Path     string
+	// Path is the path of the blob of the image, shared by the images with the same data
+	Path string
+	Size int64
+	// Checksum is the hex-encoded SHA-256 of the image data
+	Checksum   string
+	UploadedAt time.Time
+	// Order is the position of the image in the gallery of the laptop, the primary image is at 0
+	Order int
+}
+
+// imageIndex is the content of the index file, the images are sorted by laptop ID and order
+type imageIndex struct {
+	// Seq is the number of the last change of the journal written to the index
+	Seq    uint64         `json:"seq,omitempty"`
+	Images []*imageRecord `json:"images"`
+}
+
+// Operations of the changes of the journal
+const (
+	imageChangeAdd          = "add"
+	imageChangeDelete       = "delete"
+	imageChangeDeleteLaptop = "delete_laptop"
+	imageChangeReorder      = "reorder"
+)
+
+// imageChange is a change of the images in the journal, numbered after the previous changes
+type imageChange struct {
+	Seq      uint64       `json:"seq"`
+	Op       string       `json:"op"`
+	Image    *imageRecord `json:"image,omitempty"`
+	ImageID  string       `json:"image_id,omitempty"`
+	LaptopID string       `json:"laptop_id,omitempty"`
+	// ImageIDs is the gallery of the laptop after it is reordered
+	ImageIDs []string `json:"image_ids,omitempty"`
 }
 
-func NewDiskImageStore(imageFolder string) *DiskImageStore {
-	return &DiskImageStore{
+// imageRecord is an image of the index file, the path of its blob is relative to the image folder
+type imageRecord struct {
+	ID         string    `json:"id"`
+	LaptopID   string    `json:"laptop_id"`
+	Type       string    `json:"type"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	Checksum   string    `json:"checksum"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// ImageIndexReport is the result of the reconciliation of the image index with the files of the image folder
+type ImageIndexReport struct {
+	// Missing are the IDs of the indexed images whose file doesn't exist, they are removed from the index
+	Missing []string
+	// Corrupted are the IDs of the indexed images whose file doesn't match its size or checksum,
+	// they are removed from the index and their file is quarantined
+	Corrupted []string
+	// Quarantined are the names of the files moved to the quarantine folder: the unknown files and the corrupted blobs
+	Quarantined []string
+}
+
+// Empty tells whether the index matched the folder
+func (report *ImageIndexReport) Empty() bool {
+	return len(report.Missing) == 0 && len(report.Corrupted) == 0 && len(report.Quarantined) == 0
+}
+
+// NewDiskImageStore returns a new DiskImageStore with the images of the index of the folder.
+// The indexed images whose file is missing or corrupted are removed from the index,
+// and the files that are not in the index are moved to the quarantine subfolder.
+// The files of the images saved before the store was content-addressed are renamed to their blob.
+func NewDiskImageStore(imageFolder string) (*DiskImageStore, error) {
+	err := os.MkdirAll(imageFolder, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create image folder: %w", err)
+	}
+
+	journal, err := openDiskJournal(imageFolder, imageJournalFile)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &DiskImageStore{
 		imageFolder: imageFolder,
-		images:      make(map[string]*ImageInfo),
+		journal:     journal,
+	}
+
+	// the index is read with the lock held, so that it is not replaced before the journal is read
+	err = journal.withLock(func() error {
+		err := store.loadIndex()
+		if err == nil {
+			err = store.read()
+		}
+		if err == nil {
+			store.report, err = store.reconcile()
+		}
+		return err
+	})
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+
+	if !store.report.Empty() {
+		log.Printf(
+			"reconciled image folder %s: %d missing, %d corrupted, %d files quarantined",
+			imageFolder, len(store.report.Missing), len(store.report.Corrupted), len(store.report.Quarantined),
+		)
+	}
+
+	return store, nil
+}
+
+// IndexReport returns the result of the reconciliation of the index when the store was created
+func (store *DiskImageStore) IndexReport() *ImageIndexReport {
+	return store.report
+}
+
+// loadIndex reads the images of the index file, if there is one, in place of the images of the store.
+// The changes of the journal are applied by read.
+func (store *DiskImageStore) loadIndex() error {
+	store.images = make(map[string]*ImageInfo)
+	store.galleries = make(map[string][]string)
+	store.blobs = make(map[string]int)
+	store.seq = 0
+
+	data, err := ioutil.ReadFile(filepath.Join(store.imageFolder, imageIndexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot read image index: %w", err)
+	}
+
+	if err == nil {
+		index := &imageIndex{}
+		err = json.Unmarshal(data, index)
+		if err != nil {
+			return fmt.Errorf("cannot parse image index: %w", err)
+		}
+
+		for _, record := range index.Images {
+			store.apply(&imageChange{Op: imageChangeAdd, Image: record})
+		}
+		store.seq = index.Seq
+	}
+
+	return nil
+}
+
+// read applies the changes appended to the journal since it was last read, by this server or others.
+// The index file is read again if the journal was replaced. It must be called with the lock held.
+func (store *DiskImageStore) read() error {
+	return store.journal.read(store.loadIndex, func(record []byte) error {
+		change := &imageChange{}
+		err := json.Unmarshal(record, change)
+		if err != nil {
+			return err
+		}
+
+		// the changes written to the index before the journal was replaced are applied already
+		if change.Seq > store.seq {
+			store.apply(change)
+			store.seq = change.Seq
+		}
+		return nil
+	})
+}
+
+// sync applies the changes appended to the journal by the other servers.
+// It costs a single stat when there is none.
+func (store *DiskImageStore) sync() error {
+	store.mutex.RLock()
+	changed, err := store.journal.changed()
+	store.mutex.RUnlock()
+
+	if err != nil || !changed {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.journal.withLock(store.read)
+}
+
+// locked calls fn with the lock of the folder held, once the store has applied the changes of the journal.
+// The mutex of the store must be held.
+func (store *DiskImageStore) locked(fn func() error) error {
+	return store.journal.withLock(func() error {
+		err := store.read()
+		if err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+// apply applies a change of the journal to the images and the number of images of their blobs,
+// but not to the blob files: only the server that made the change writes or deletes them
+func (store *DiskImageStore) apply(change *imageChange) {
+	switch change.Op {
+	case imageChangeAdd:
+		record := change.Image
+		if record == nil || store.images[record.ID] != nil {
+			return
+		}
+		store.blobs[record.Checksum]++
+		store.images[record.ID] = &ImageInfo{
+			ID:         record.ID,
+			LaptopID:   record.LaptopID,
+			Type:       record.Type,
+			Path:       filepath.Join(store.imageFolder, record.Path),
+			Size:       record.Size,
+			Checksum:   record.Checksum,
+			UploadedAt: record.UploadedAt,
+		}
+		store.galleries[record.LaptopID] = append(store.galleries[record.LaptopID], record.ID)
+	case imageChangeDelete:
+		store.forget(change.ImageID)
+	case imageChangeDeleteLaptop:
+		for _, imageID := range append([]string(nil), store.galleries[change.LaptopID]...) {
+			store.forget(imageID)
+		}
+	case imageChangeReorder:
+		if len(change.ImageIDs) > 0 {
+			store.galleries[change.LaptopID] = change.ImageIDs
+		}
+	}
+}
+
+// reconcile checks the files of the folder against the index, and saves the index if it changed.
+// It must be called with the lock held, so that no other server is adding a blob.
+func (store *DiskImageStore) reconcile() (*ImageIndexReport, error) {
+	indexed := make(map[string][]*ImageInfo)
+	for _, info := range store.images {
+		name := filepath.Base(info.Path)
+		indexed[name] = append(indexed[name], info)
+	}
+
+	entries, err := ioutil.ReadDir(store.imageFolder)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image folder: %w", err)
+	}
+
+	report := &ImageIndexReport{}
+	changed := false
+	found := make(map[string]bool, len(store.images))
+	for _, entry := range entries {
+		name := entry.Name()
+		// the uploads of the servers are moved to their blob with the lock held
+		if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasPrefix(name, imageIndexFile) || name == imageJournalFile ||
+			(strings.HasPrefix(name, "upload-") && strings.HasSuffix(name, ".tmp")) {
+			continue
+		}
+
+		infos := indexed[name]
+		if len(infos) > 0 {
+			size, checksum, err := fileChecksum(filepath.Join(store.imageFolder, name))
+			if err != nil {
+				return nil, err
+			}
+
+			if size == infos[0].Size && checksum == infos[0].Checksum {
+				if name != checksum {
+					err := store.migrate(name, infos)
+					if err != nil {
+						return nil, err
+					}
+					changed = true
+				}
+
+				for _, info := range infos {
+					found[info.ID] = true
+				}
+				continue
+			}
+
+			for _, info := range infos {
+				report.Corrupted = append(report.Corrupted, info.ID)
+			}
+		}
+
+		err := store.quarantine(name)
+		if err != nil {
+			return nil, err
+		}
+		report.Quarantined = append(report.Quarantined, name)
+	}
+
+	for imageID := range store.images {
+		if !found[imageID] {
+			if !contains(report.Corrupted, imageID) {
+				report.Missing = append(report.Missing, imageID)
+			}
+			store.forget(imageID)
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Corrupted)
+
+	if changed || len(report.Missing) > 0 || len(report.Corrupted) > 0 || store.journal.records > 0 {
+		err = store.compact()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// migrate moves the file of images saved before the store was content-addressed to their blob
+func (store *DiskImageStore) migrate(name string, infos []*ImageInfo) error {
+	path := filepath.Join(store.imageFolder, name)
+	blobPath := store.blobPath(infos[0].Checksum)
+
+	var err error
+	if _, statErr := os.Stat(blobPath); statErr == nil {
+		err = os.Remove(path)
+	} else {
+		err = os.Rename(path, blobPath)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot move image file %s to its blob: %w", name, err)
+	}
+
+	for _, info := range infos {
+		info.Path = blobPath
+	}
+	return nil
+}
+
+// blobPath returns the path of the blob of the data with the checksum
+func (store *DiskImageStore) blobPath(checksum string) string {
+	return filepath.Join(store.imageFolder, checksum)
+}
+
+// quarantine moves a file of the image folder to the quarantine subfolder
+func (store *DiskImageStore) quarantine(name string) error {
+	quarantineFolder := filepath.Join(store.imageFolder, imageQuarantineFolder)
+	err := os.MkdirAll(quarantineFolder, 0755)
+	if err != nil {
+		return fmt.Errorf("cannot create quarantine folder: %w", err)
+	}
+
+	err = os.Rename(filepath.Join(store.imageFolder, name), filepath.Join(quarantineFolder, name))
+	if err != nil {
+		return fmt.Errorf("cannot quarantine file %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// saveIndex writes the images to the index file, replacing it at once
+func (store *DiskImageStore) saveIndex() error {
+	index := &imageIndex{Seq: store.seq, Images: []*imageRecord{}}
+	for _, info := range store.list() {
+		index.Images = append(index.Images, newImageRecord(info))
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot marshal image index: %w", err)
+	}
+
+	path := filepath.Join(store.imageFolder, imageIndexFile)
+	err = ioutil.WriteFile(path+".tmp", data, 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("cannot write image index: %w", err)
+	}
+
+	return nil
+}
+
+// newImageRecord returns the record of the image in the index file
+func newImageRecord(info *ImageInfo) *imageRecord {
+	return &imageRecord{
+		ID:         info.ID,
+		LaptopID:   info.LaptopID,
+		Type:       info.Type,
+		Path:       filepath.Base(info.Path),
+		Size:       info.Size,
+		Checksum:   info.Checksum,
+		UploadedAt: info.UploadedAt,
+	}
+}
+
+// compact writes the images to the index file and replaces the journal with an empty one.
+// It must be called with the lock held.
+func (store *DiskImageStore) compact() error {
+	err := store.saveIndex()
+	if err != nil {
+		return err
+	}
+
+	// the changes left in the journal if it cannot be replaced are already in the index, so they are skipped
+	err = store.journal.replace()
+	if err != nil {
+		return fmt.Errorf("cannot empty image journal: %w", err)
+	}
+
+	return nil
+}
+
+// commit appends a change of the images to the journal, then applies it.
+// The index file is written again once the journal has maxImageJournalChanges changes.
+// It must be called with the lock held, after the changes of the journal are applied.
+func (store *DiskImageStore) commit(change *imageChange) error {
+	change.Seq = store.seq + 1
+	err := store.journal.append(change)
+	if err != nil {
+		return fmt.Errorf("cannot write image journal: %w", err)
 	}
+
+	store.apply(change)
+	store.seq = change.Seq
+
+	if store.journal.records >= maxImageJournalChanges {
+		// the change is in the journal, so the index is only written again by the next change
+		err = store.compact()
+		if err != nil {
+			log.Printf("cannot compact image journal: %v", err)
+		}
+	}
+
+	return nil
 }
 
 // Save saves a new laptop image to the store
-func (store *DiskImageStore) Save(laptopID string, imageType string, imageData bytes.Buffer) (string, error) {
+func (store *DiskImageStore) Save(ctx context.Context, laptopID string, imageType string, imageData bytes.Buffer) (string, bool, error) {
 	imageID, err := uuid.NewRandom()
 	if err != nil {
-		return "", fmt.Errorf("cannot generate image id: %w", err)
+		return "", false, fmt.Errorf("cannot generate image id: %w", err)
 	}
 
-	imagePath := fmt.Sprintf("%s/%s%s", store.imageFolder, imageID, imageType)
+	deduplicated, err := store.add(ctx, imageID.String(), laptopID, imageType, &imageData)
+	if err != nil {
+		return "", false, err
+	}
+
+	return imageID.String(), deduplicated, nil
+}
+
+// List returns the information of all images, sorted by laptop ID and order
+func (store *DiskImageStore) List(ctx context.Context) ([]*ImageInfo, error) {
+	err := store.sync()
+	if err != nil {
+		return nil, err
+	}
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.list(), nil
+}
+
+func (store *DiskImageStore) list() []*ImageInfo {
+	laptopIDs := make([]string, 0, len(store.galleries))
+	for laptopID := range store.galleries {
+		laptopIDs = append(laptopIDs, laptopID)
+	}
+	sort.Strings(laptopIDs)
+
+	images := make([]*ImageInfo, 0, len(store.images))
+	for _, laptopID := range laptopIDs {
+		images = append(images, store.gallery(laptopID)...)
+	}
+
+	return images
+}
+
+// ListLaptop returns the information of the images of a laptop, sorted by order
+func (store *DiskImageStore) ListLaptop(ctx context.Context, laptopID string) ([]*ImageInfo, error) {
+	err := store.sync()
+	if err != nil {
+		return nil, err
+	}
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.gallery(laptopID), nil
+}
+
+// gallery returns copies of the images of the laptop, with their order
+func (store *DiskImageStore) gallery(laptopID string) []*ImageInfo {
+	imageIDs := store.galleries[laptopID]
+	images := make([]*ImageInfo, len(imageIDs))
+	for i, imageID := range imageIDs {
+		other := *store.images[imageID]
+		other.Order = i
+		images[i] = &other
+	}
+	return images
+}
 
-	file, err := os.Create(imagePath)
+// Open opens the data of an image
+func (store *DiskImageStore) Open(ctx context.Context, imageID string) (io.ReadCloser, error) {
+	err := store.sync()
 	if err != nil {
-		return "", fmt.Errorf("cannot create image file: %w", err)
+		return nil, err
 	}
 
-	_, err = imageData.WriteTo(file)
+	store.mutex.RLock()
+	info := store.images[imageID]
+	store.mutex.RUnlock()
+
+	if info == nil {
+		return nil, ErrNotFound
+	}
+
+	file, err := os.Open(info.Path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image file: %w", err)
+	}
+
+	return file, nil
+}
+
+// Restore saves an image with a known ID
+func (store *DiskImageStore) Restore(ctx context.Context, imageID string, laptopID string, imageType string, imageData io.Reader) error {
+	_, err := store.add(ctx, imageID, laptopID, imageType, imageData)
+	return err
+}
+
+// add saves an image with its data in a new blob, or in the existing blob of the same data.
+// It tells whether the blob already existed.
+func (store *DiskImageStore) add(ctx context.Context, imageID string, laptopID string, imageType string, imageData io.Reader) (bool, error) {
+	_, err := uuid.Parse(imageID)
+	if err != nil {
+		return false, fmt.Errorf("image ID is not a valid UUID: %w", err)
+	}
+
+	err = store.sync()
+	if err != nil {
+		return false, err
+	}
+
+	store.mutex.RLock()
+	exists := store.images[imageID] != nil
+	store.mutex.RUnlock()
+
+	if exists {
+		return false, ErrAlreadyExists
+	}
+
+	// the data is written to a temporary file, until its checksum tells its blob
+	file, err := ioutil.TempFile(store.imageFolder, "upload-*.tmp")
+	if err != nil {
+		return false, fmt.Errorf("cannot create image file: %w", err)
+	}
+	tmpPath := file.Name()
+	defer os.Remove(tmpPath)
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), &contextReader{ctx: ctx, reader: imageData})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot write image to file: %w", err)
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	blobPath := store.blobPath(checksum)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	deduplicated := false
+	err = store.locked(func() error {
+		if store.images[imageID] != nil {
+			return ErrAlreadyExists
+		}
+
+		deduplicated = store.blobs[checksum] > 0
+		if !deduplicated {
+			err := os.Rename(tmpPath, blobPath)
+			if err != nil {
+				return fmt.Errorf("cannot save image blob: %w", err)
+			}
+		}
+
+		record := &imageRecord{
+			ID:         imageID,
+			LaptopID:   laptopID,
+			Type:       imageType,
+			Path:       filepath.Base(blobPath),
+			Size:       size,
+			Checksum:   checksum,
+			UploadedAt: time.Now().UTC(),
+		}
+		err := store.commit(&imageChange{Op: imageChangeAdd, Image: record})
+		if err != nil && !deduplicated {
+			os.Remove(blobPath)
+		}
+		return err
+	})
 	if err != nil {
-		return "", fmt.Errorf("cannot write image to file: %w", err)
+		return false, err
+	}
+
+	return deduplicated, nil
+}
+
+// Delete deletes an image of the laptop and its file
+func (store *DiskImageStore) Delete(ctx context.Context, laptopID string, imageID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	store.images[imageID.String()] = &ImageInfo{
-		LaptopID: laptopID,
-		Type:     imageType,
-		Path:     imagePath,
+	return store.locked(func() error {
+		info := store.images[imageID]
+		if info == nil || info.LaptopID != laptopID {
+			return ErrNotFound
+		}
+
+		err := store.commit(&imageChange{Op: imageChangeDelete, ImageID: imageID})
+		if err != nil {
+			return err
+		}
+
+		store.removeUnusedBlob(info.Checksum)
+		return nil
+	})
+}
+
+// DeleteLaptop deletes all images of the laptop and their files
+func (store *DiskImageStore) DeleteLaptop(ctx context.Context, laptopID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	return imageID.String(), nil
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.locked(func() error {
+		images := store.gallery(laptopID)
+		if len(images) == 0 {
+			return nil
+		}
+
+		err := store.commit(&imageChange{Op: imageChangeDeleteLaptop, LaptopID: laptopID})
+		if err != nil {
+			return err
+		}
+
+		for _, info := range images {
+			store.removeUnusedBlob(info.Checksum)
+		}
+		return nil
+	})
+}
+
+// Reorder puts the images first in the gallery of the laptop, in the order of imageIDs
+func (store *DiskImageStore) Reorder(ctx context.Context, laptopID string, imageIDs []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.locked(func() error {
+		gallery := store.galleries[laptopID]
+		rest := append([]string(nil), gallery...)
+		for i, imageID := range imageIDs {
+			info := store.images[imageID]
+			if info == nil || info.LaptopID != laptopID {
+				return ErrNotFound
+			}
+			rest = removeString(rest, imageID)
+			if len(rest) != len(gallery)-i-1 {
+				return fmt.Errorf("image %s is listed more than once", imageID)
+			}
+		}
+
+		reordered := make([]string, 0, len(gallery))
+		reordered = append(reordered, imageIDs...)
+		reordered = append(reordered, rest...)
+
+		return store.commit(&imageChange{Op: imageChangeReorder, LaptopID: laptopID, ImageIDs: reordered})
+	})
+}
+
+// forget removes an image from the images, the gallery of its laptop and the images of its blob, but not its file
+func (store *DiskImageStore) forget(imageID string) {
+	info := store.images[imageID]
+	if info == nil {
+		return
+	}
+
+	delete(store.images, imageID)
+	store.blobs[info.Checksum]--
+	if store.blobs[info.Checksum] <= 0 {
+		delete(store.blobs, info.Checksum)
+	}
+
+	gallery := removeString(store.galleries[info.LaptopID], imageID)
+	if len(gallery) == 0 {
+		delete(store.galleries, info.LaptopID)
+		return
+	}
+	store.galleries[info.LaptopID] = gallery
+}
+
+// removeUnusedBlob deletes the blob if no image refers to it anymore. It must be called with the lock held,
+// so that no other server saves an image with the same data meanwhile.
+// A blob that cannot be deleted is only logged: it is quarantined when the store is created again.
+func (store *DiskImageStore) removeUnusedBlob(checksum string) {
+	if store.blobs[checksum] > 0 {
+		return
+	}
+
+	err := os.Remove(store.blobPath(checksum))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("cannot remove image blob: %v", err)
+	}
+}
+
+// fileChecksum returns the size and the hex-encoded SHA-256 of a file
+func fileChecksum(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", fmt.Errorf("cannot open image file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", fmt.Errorf("cannot read image file: %w", err)
+	}
+
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// removeString returns the values without the first occurrence of value
+func removeString(values []string, value string) []string {
+	for i, v := range values {
+		if v == value {
+			return append(values[:i:i], values[i+1:]...)
+		}
+	}
+	return values
+}
+
+// contains tells whether the values include value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// contextReader is a reader that fails with the error of its context once it is done,
+// so that a long copy stops when its request is canceled
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
 }
@@ -0,0 +1,327 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestDiskImageStoreIndex(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	imageFolder := t.TempDir()
+	store := newTestImageStore(t, imageFolder)
+	require.True(t, store.IndexReport().Empty())
+
+	var imageIDs []string
+	for _, data := range []string{"image1", "image2", "image3", "image4"} {
+		imageID, deduplicated, err := store.Save(ctx, "laptop1", ".jpg", *bytes.NewBufferString(data))
+		require.NoError(t, err)
+		require.False(t, deduplicated)
+		imageIDs = append(imageIDs, imageID)
+	}
+	require.NoError(t, store.Reorder(ctx, "laptop1", []string{imageIDs[3]}))
+
+	before, err := store.ListLaptop(ctx, "laptop1")
+	require.NoError(t, err)
+	require.Equal(t, int64(6), before[0].Size)
+	require.Len(t, before[0].Checksum, 64)
+	require.Equal(t, filepath.Join(imageFolder, before[0].Checksum), before[0].Path)
+	require.False(t, before[0].UploadedAt.IsZero())
+
+	// the images are found again after a restart, in the same order
+	store = newTestImageStore(t, imageFolder)
+	require.True(t, store.IndexReport().Empty())
+	after, err := store.ListLaptop(ctx, "laptop1")
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	// a missing file, a corrupted file and an unknown file are reported
+	require.NoError(t, os.Remove(after[1].Path))
+	require.NoError(t, ioutil.WriteFile(after[2].Path, []byte("changed"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(imageFolder, "unknown.jpg"), []byte("unknown"), 0644))
+
+	store = newTestImageStore(t, imageFolder)
+	report := store.IndexReport()
+	require.Equal(t, []string{after[1].ID}, report.Missing)
+	require.Equal(t, []string{after[2].ID}, report.Corrupted)
+	require.ElementsMatch(t, []string{filepath.Base(after[2].Path), "unknown.jpg"}, report.Quarantined)
+	require.FileExists(t, filepath.Join(imageFolder, "quarantine", "unknown.jpg"))
+	require.NoFileExists(t, filepath.Join(imageFolder, "unknown.jpg"))
+
+	images, err := store.ListLaptop(ctx, "laptop1")
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+	require.Equal(t, after[0].ID, images[0].ID)
+	require.Equal(t, after[3].ID, images[1].ID)
+	require.Equal(t, 1, images[1].Order)
+
+	// the reconciled index is saved
+	store = newTestImageStore(t, imageFolder)
+	require.True(t, store.IndexReport().Empty())
+}
+
+func TestDiskImageStoreJournal(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	imageFolder := t.TempDir()
+	store := newTestImageStore(t, imageFolder)
+
+	var imageIDs []string
+	for _, data := range []string{"image1", "image2", "image3"} {
+		imageID, _, err := store.Save(ctx, "laptop1", ".jpg", *bytes.NewBufferString(data))
+		require.NoError(t, err)
+		imageIDs = append(imageIDs, imageID)
+	}
+	_, _, err := store.Save(ctx, "laptop2", ".jpg", *bytes.NewBufferString("image4"))
+	require.NoError(t, err)
+	require.NoError(t, store.Reorder(ctx, "laptop1", []string{imageIDs[2]}))
+	require.NoError(t, store.Delete(ctx, "laptop1", imageIDs[0]))
+	require.NoError(t, store.DeleteLaptop(ctx, "laptop2"))
+
+	// the changes are only appended to the journal
+	require.NoFileExists(t, filepath.Join(imageFolder, "index.json"))
+	before, err := store.List(ctx)
+	require.NoError(t, err)
+
+	// a change that was being written when the server stopped is ignored
+	journal, err := os.OpenFile(filepath.Join(imageFolder, "index.journal"), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = journal.WriteString(`{"seq":8,"op":"del`)
+	require.NoError(t, err)
+	require.NoError(t, journal.Close())
+
+	store = newTestImageStore(t, imageFolder)
+	require.True(t, store.IndexReport().Empty())
+	after, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+	require.Equal(t, imageIDs[2], after[0].ID)
+	require.Equal(t, imageIDs[1], after[1].ID)
+
+	// the journal is written to the index when the store is created
+	require.FileExists(t, filepath.Join(imageFolder, "index.json"))
+	info, err := os.Stat(filepath.Join(imageFolder, "index.journal"))
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+
+	_, _, err = store.Save(ctx, "laptop1", ".jpg", *bytes.NewBufferString("image5"))
+	require.NoError(t, err)
+	store = newTestImageStore(t, imageFolder)
+	images, err := store.ListLaptop(ctx, "laptop1")
+	require.NoError(t, err)
+	require.Len(t, images, 3)
+}
+
+func TestDiskImageStoreShared(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	imageFolder := t.TempDir()
+	store1 := newTestImageStore(t, imageFolder)
+	store2 := newTestImageStore(t, imageFolder)
+
+	imageID1, _, err := store1.Save(ctx, "laptop1", ".jpg", *bytes.NewBufferString("image"))
+	require.NoError(t, err)
+
+	// the blob saved by one server is shared with the images saved by the other
+	imageID2, deduplicated, err := store2.Save(ctx, "laptop2", ".jpg", *bytes.NewBufferString("image"))
+	require.NoError(t, err)
+	require.True(t, deduplicated)
+	require.NoError(t, store1.Delete(ctx, "laptop1", imageID1))
+
+	images, err := store2.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	require.Equal(t, imageID2, images[0].ID)
+	require.FileExists(t, images[0].Path)
+
+	// a third server compacts the journal, the others read the new index before their next change
+	store3 := newTestImageStore(t, imageFolder)
+	require.True(t, store3.IndexReport().Empty())
+	imageID3, _, err := store1.Save(ctx, "laptop1", ".jpg", *bytes.NewBufferString("image3"))
+	require.NoError(t, err)
+	require.NoError(t, store2.Reorder(ctx, "laptop1", []string{imageID3}))
+
+	for _, store := range []*service.DiskImageStore{store1, store2, store3} {
+		images, err := store.List(ctx)
+		require.NoError(t, err)
+		require.Len(t, images, 2)
+		require.Equal(t, imageID3, images[0].ID)
+		require.Equal(t, imageID2, images[1].ID)
+	}
+
+	// no image is lost and no blob is quarantined by a restart
+	store := newTestImageStore(t, imageFolder)
+	require.True(t, store.IndexReport().Empty())
+	images, err = store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+}
+
+func TestDiskImageStoreDeduplication(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	imageFolder := t.TempDir()
+	store := newTestImageStore(t, imageFolder)
+
+	imageID1, deduplicated, err := store.Save(ctx, "laptop1", ".jpg", *bytes.NewBufferString("image"))
+	require.NoError(t, err)
+	require.False(t, deduplicated)
+	imageID2, deduplicated, err := store.Save(ctx, "laptop2", ".jpeg", *bytes.NewBufferString("image"))
+	require.NoError(t, err)
+	require.True(t, deduplicated)
+	imageID3, deduplicated, err := store.Save(ctx, "laptop2", ".jpg", *bytes.NewBufferString("other"))
+	require.NoError(t, err)
+	require.False(t, deduplicated)
+
+	// every laptop has its own image record, sharing the blob of the data
+	images, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, images, 3)
+	require.Equal(t, imageID1, images[0].ID)
+	require.Equal(t, imageID2, images[1].ID)
+	require.Equal(t, ".jpeg", images[1].Type)
+	require.Equal(t, images[0].Path, images[1].Path)
+	require.NotEqual(t, images[0].Path, images[2].Path)
+
+	blobs, err := filepath.Glob(filepath.Join(imageFolder, "[0-9a-f]*"))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{images[0].Path, images[2].Path}, blobs)
+
+	// the references are counted again after a restart
+	store = newTestImageStore(t, imageFolder)
+	require.True(t, store.IndexReport().Empty())
+
+	require.NoError(t, store.Delete(ctx, "laptop1", imageID1))
+	require.FileExists(t, images[0].Path)
+
+	_, deduplicated, err = store.Save(ctx, "laptop3", ".jpg", *bytes.NewBufferString("image"))
+	require.NoError(t, err)
+	require.True(t, deduplicated)
+	require.NoError(t, store.DeleteLaptop(ctx, "laptop3"))
+	require.FileExists(t, images[0].Path)
+
+	require.NoError(t, store.DeleteLaptop(ctx, "laptop2"))
+	require.NoFileExists(t, images[0].Path)
+	require.NoFileExists(t, images[2].Path)
+
+	_, err = store.Open(ctx, imageID3)
+	require.ErrorIs(t, err, service.ErrNotFound)
+}
+
+func TestDiskImageStoreMigration(t *testing.T) {
+	t.Parallel()
+
+	// the index and files of the images saved before the store was content-addressed
+	imageFolder := t.TempDir()
+	index := `{"images": [
+		{"id": "a8a1bd44-5ea8-4e4a-9a53-4ac6d1a6e2a1", "laptop_id": "laptop1", "type": ".jpg", "path": "a8a1bd44-5ea8-4e4a-9a53-4ac6d1a6e2a1.jpg", "size": 5,
+		 "checksum": "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d"},
+		{"id": "b0e5c1f2-2f0d-4a4f-8d8e-0d3f1b8a9c11", "laptop_id": "laptop2", "type": ".jpg", "path": "b0e5c1f2-2f0d-4a4f-8d8e-0d3f1b8a9c11.jpg", "size": 5,
+		 "checksum": "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d"}
+	]}`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(imageFolder, "index.json"), []byte(index), 0644))
+	for _, name := range []string{"a8a1bd44-5ea8-4e4a-9a53-4ac6d1a6e2a1.jpg", "b0e5c1f2-2f0d-4a4f-8d8e-0d3f1b8a9c11.jpg"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(imageFolder, name), []byte("image"), 0644))
+	}
+
+	store := newTestImageStore(t, imageFolder)
+	require.True(t, store.IndexReport().Empty())
+
+	images, err := store.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+
+	blobPath := filepath.Join(imageFolder, "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d")
+	for _, info := range images {
+		require.Equal(t, blobPath, info.Path)
+	}
+
+	files, err := filepath.Glob(filepath.Join(imageFolder, "*.jpg"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	// the index refers to the blob
+	store = newTestImageStore(t, imageFolder)
+	require.True(t, store.IndexReport().Empty())
+}
+
+func TestCollectImages(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	tenant := &service.Tenant{
+		LaptopStore:  service.NewInMemoryLaptopStore(),
+		ImageStore:   newTestImageStore(t, t.TempDir()),
+		HistoryStore: service.NewInMemoryLaptopHistoryStore(),
+	}
+
+	laptop := sample.NewLaptop()
+	require.NoError(t, tenant.LaptopStore.Save(ctx, laptop))
+
+	// a laptop that was just deleted can still be restored with its images
+	deletedLaptop := sample.NewLaptop()
+	_, err := tenant.HistoryStore.Add(ctx, &pb.LaptopVersion{
+		Change: pb.LaptopVersion_DELETED,
+		Laptop: deletedLaptop,
+		Time:   timestamppb.Now(),
+	})
+	require.NoError(t, err)
+
+	_, _, err = tenant.ImageStore.Save(ctx, laptop.Id, ".jpg", *bytes.NewBufferString("image"))
+	require.NoError(t, err)
+	for _, data := range []string{"image", "deleted"} {
+		_, _, err := tenant.ImageStore.Save(ctx, deletedLaptop.Id, ".jpg", *bytes.NewBufferString(data))
+		require.NoError(t, err)
+	}
+	_, _, err = tenant.ImageStore.Save(ctx, "unknown-laptop", ".jpg", *bytes.NewBufferString("unknown"))
+	require.NoError(t, err)
+	deletedImages, err := tenant.ImageStore.ListLaptop(ctx, deletedLaptop.Id)
+	require.NoError(t, err)
+
+	// the images of a laptop without history are collected right away
+	deleted, err := service.CollectImages(ctx, tenant, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+
+	images, err := tenant.ImageStore.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, images, 3)
+
+	deleted, err = service.CollectImages(ctx, tenant, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, deleted)
+
+	images, err = tenant.ImageStore.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	require.Equal(t, laptop.Id, images[0].LaptopID)
+
+	// the data shared with the remaining image is kept
+	require.FileExists(t, images[0].Path)
+	require.NoFileExists(t, deletedImages[1].Path)
+
+	deleted, err = service.CollectImages(ctx, tenant, 0)
+	require.NoError(t, err)
+	require.Zero(t, deleted)
+}
+
+func newTestImageStore(t *testing.T, imageFolder string) *service.DiskImageStore {
+	store, err := service.NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+	return store
+}
@@ -18,6 +18,23 @@ type UserClaims struct {
 	jwt.StandardClaims
 	Username string `json:"username"`
 	Role     string `json:"role"`
+	TenantID string `json:"tenant_id,omitempty"`
+}
+
+// GetUsername returns the username of the claims, or an empty string if the claims are nil
+func (claims *UserClaims) GetUsername() string {
+	if claims == nil {
+		return ""
+	}
+	return claims.Username
+}
+
+// GetRole returns the role of the claims, or an empty string if the claims are nil
+func (claims *UserClaims) GetRole() string {
+	if claims == nil {
+		return ""
+	}
+	return claims.Role
 }
 
 // NewJWTManager returns a new JWTManager
@@ -36,6 +53,7 @@ func (manager *JWTManager) Generate(user *User) (string, error) {
 		},
 		Username: user.Username,
 		Role:     user.Role,
+		TenantID: user.TenantID,
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
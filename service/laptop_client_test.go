@@ -14,11 +14,15 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/thewalkers2012/grpc-example/pb"
 	"github.com/thewalkers2012/grpc-example/sample"
 	"github.com/thewalkers2012/grpc-example/serializer"
 	"github.com/thewalkers2012/grpc-example/service"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func init() {
@@ -45,7 +49,7 @@ func TestClientCreateLaptop(t *testing.T) {
 	assert.Equal(t, expectedID, res.Id)
 
 	// check that the laptop is saved to the store
-	other, err := laptopStore.Find(res.Id)
+	other, err := laptopStore.Find(context.Background(), res.Id)
 	assert.NoError(t, err)
 	assert.NotNil(t, other)
 
@@ -76,6 +80,7 @@ func TestClientSearchLaptop(t *testing.T) {
 			laptop.Cpu.NumberCores = 2
 		case 2:
 			laptop.Cpu.MinGhz = 2.0
+			laptop.Cpu.MaxGhz = 2.0
 		case 3:
 			laptop.Ram = &pb.Memory{Value: 4086, Unit: pb.Memory_MEGABYTE}
 		case 4:
@@ -93,7 +98,7 @@ func TestClientSearchLaptop(t *testing.T) {
 			laptop.Ram = &pb.Memory{Value: 64, Unit: pb.Memory_GIGABYTE}
 			expectedIDs[laptop.Id] = true
 		}
-		err := store.Save(laptop)
+		err := store.Save(context.Background(), laptop)
 		assert.NoError(t, err)
 	}
 
@@ -126,12 +131,13 @@ func TestClientUploadImage(t *testing.T) {
 	t.Parallel()
 
 	testImageFolder := "../tmp"
+	imageFolder := t.TempDir()
 
 	laptopStore := service.NewInMemoryLaptopStore()
-	imageStore := service.NewDiskImageStore(testImageFolder)
+	imageStore := newTestImageStore(t, imageFolder)
 
 	laptop := sample.NewLaptop()
-	err := laptopStore.Save(laptop)
+	err := laptopStore.Save(context.Background(), laptop)
 	assert.NoError(t, err)
 
 	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
@@ -185,10 +191,139 @@ func TestClientUploadImage(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotZero(t, res.GetId())
 	assert.EqualValues(t, res.GetSize(), size)
+	assert.False(t, res.GetDeduplicated())
 
-	saveImagePath := fmt.Sprintf("%s/%s%s", testImageFolder, res.GetId(), imageType)
-	assert.FileExists(t, saveImagePath)
-	assert.NoError(t, os.Remove(saveImagePath))
+	images, err := imageStore.ListLaptop(context.Background(), laptop.GetId())
+	assert.NoError(t, err)
+	assert.Len(t, images, 1)
+	assert.Equal(t, res.GetId(), images[0].ID)
+	assert.Equal(t, imageType, images[0].Type)
+	assert.Equal(t, filepath.Join(imageFolder, images[0].Checksum), images[0].Path)
+	assert.FileExists(t, images[0].Path)
+}
+
+func TestClientUploadImageIdempotency(t *testing.T) {
+	t.Parallel()
+
+	testImageFolder := "../tmp"
+	imageFolder := t.TempDir()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := newTestImageStore(t, imageFolder)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(context.Background(), laptop)
+	assert.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), service.IdempotencyKeyHeader, "upload-1")
+	imagePath := fmt.Sprintf("%s/laptop.jpeg", testImageFolder)
+
+	res1 := uploadTestImage(t, ctx, laptopClient, laptop.GetId(), imagePath)
+	res2 := uploadTestImage(t, ctx, laptopClient, laptop.GetId(), imagePath)
+	assert.Equal(t, res1.GetId(), res2.GetId())
+	assert.Equal(t, res1.GetSize(), res2.GetSize())
+
+	// the replay doesn't save the image again
+	images, err := imageStore.ListLaptop(context.Background(), laptop.GetId())
+	assert.NoError(t, err)
+	assert.Len(t, images, 1)
+	assert.FileExists(t, images[0].Path)
+}
+
+func TestClientImageGallery(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := newTestImageStore(t, imageFolder)
+
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(context.Background(), laptop))
+	other := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(context.Background(), other))
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+	ctx := context.Background()
+
+	// the same image is uploaded every time, so its data is shared
+	var imageIDs []string
+	for i := 0; i < 3; i++ {
+		res := uploadTestImage(t, ctx, laptopClient, laptop.GetId(), "../tmp/laptop.jpeg")
+		require.Equal(t, i > 0, res.GetDeduplicated())
+		imageIDs = append(imageIDs, res.GetId())
+	}
+	otherImage := uploadTestImage(t, ctx, laptopClient, other.GetId(), "../tmp/laptop.jpeg")
+	require.True(t, otherImage.GetDeduplicated())
+
+	requireImages := func(images []*pb.LaptopImage, ids ...string) {
+		require.Len(t, images, len(ids))
+		for i, image := range images {
+			require.Equal(t, ids[i], image.GetId())
+			require.EqualValues(t, i, image.GetOrder())
+			require.Equal(t, ".jpeg", image.GetType())
+			require.NotZero(t, image.GetSize())
+		}
+	}
+
+	found, err := laptopClient.GetLaptop(ctx, &pb.GetLaptopRequest{Id: laptop.GetId()})
+	require.NoError(t, err)
+	requireImages(found.GetLaptop().GetImages(), imageIDs...)
+
+	primary, err := laptopClient.SetPrimaryImage(ctx, &pb.SetPrimaryImageRequest{LaptopId: laptop.GetId(), ImageId: imageIDs[2]})
+	require.NoError(t, err)
+	requireImages(primary.GetImages(), imageIDs[2], imageIDs[0], imageIDs[1])
+
+	reordered, err := laptopClient.ReorderImages(ctx, &pb.ReorderImagesRequest{
+		LaptopId: laptop.GetId(),
+		ImageIds: []string{imageIDs[1], imageIDs[0]},
+	})
+	require.NoError(t, err)
+	requireImages(reordered.GetImages(), imageIDs[1], imageIDs[0], imageIDs[2])
+
+	_, err = laptopClient.ReorderImages(ctx, &pb.ReorderImagesRequest{
+		LaptopId: laptop.GetId(),
+		ImageIds: []string{imageIDs[0], imageIDs[0]},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the image of another laptop is not part of the gallery
+	_, err = laptopClient.SetPrimaryImage(ctx, &pb.SetPrimaryImageRequest{LaptopId: laptop.GetId(), ImageId: otherImage.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = laptopClient.DeleteImage(ctx, &pb.DeleteImageRequest{LaptopId: laptop.GetId(), ImageId: otherImage.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	deleted, err := laptopClient.DeleteImage(ctx, &pb.DeleteImageRequest{LaptopId: laptop.GetId(), ImageId: imageIDs[1]})
+	require.NoError(t, err)
+	requireImages(deleted.GetImages(), imageIDs[0], imageIDs[2])
+
+	// the images of a deleted laptop are kept until they are collected, so restoring it brings them back
+	_, err = laptopClient.DeleteLaptop(ctx, &pb.DeleteLaptopRequest{Id: laptop.GetId()})
+	require.NoError(t, err)
+
+	restored, err := laptopClient.RestoreLaptop(ctx, &pb.RestoreLaptopRequest{Id: laptop.GetId()})
+	require.NoError(t, err)
+	requireImages(restored.GetLaptop().GetImages(), imageIDs[0], imageIDs[2])
+
+	// the images of a collected laptop are deleted, but not the images of other laptops
+	_, err = laptopClient.DeleteLaptop(ctx, &pb.DeleteLaptopRequest{Id: laptop.GetId()})
+	require.NoError(t, err)
+	_, err = service.CollectImages(ctx, &service.Tenant{LaptopStore: laptopStore, ImageStore: imageStore}, 0)
+	require.NoError(t, err)
+
+	images, err := imageStore.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	require.Equal(t, other.GetId(), images[0].LaptopID)
+	require.FileExists(t, images[0].Path)
+
+	// the data is deleted with its last image
+	_, err = laptopClient.DeleteImage(ctx, &pb.DeleteImageRequest{LaptopId: other.GetId(), ImageId: otherImage.GetId()})
+	require.NoError(t, err)
+	require.NoFileExists(t, images[0].Path)
 }
 
 func TestClientRateLaptop(t *testing.T) {
@@ -198,7 +333,7 @@ func TestClientRateLaptop(t *testing.T) {
 	ratingStore := service.NewInMemoryRatingStore()
 
 	laptop := sample.NewLaptop()
-	err := laptopStore.Save(laptop)
+	err := laptopStore.Save(context.Background(), laptop)
 	assert.NoError(t, err)
 
 	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
@@ -238,22 +373,417 @@ func TestClientRateLaptop(t *testing.T) {
 	}
 }
 
+func TestClientBulkCreateLaptops(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	existing := sample.NewLaptop()
+	err := laptopStore.Save(context.Background(), existing)
+	assert.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	stream, err := laptopClient.BulkCreateLaptops(context.Background())
+	assert.NoError(t, err)
+
+	// more laptops than a batch, with an invalid and a duplicate one
+	n := 250
+	laptops := make([]*pb.Laptop, n)
+	for i := range laptops {
+		laptops[i] = sample.NewLaptop()
+	}
+	laptops[10].Id = "invalid-uuid"
+	laptops[120] = existing
+	laptops[200].Id = ""
+
+	for _, laptop := range laptops {
+		err := stream.Send(&pb.BulkCreateLaptopsRequest{Laptop: laptop})
+		assert.NoError(t, err)
+	}
+
+	res, err := stream.CloseAndRecv()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(n-2), res.GetCreatedCount())
+	assert.Equal(t, uint32(2), res.GetFailedCount())
+	assert.Len(t, res.GetResults(), n)
+
+	for i, result := range res.GetResults() {
+		assert.Equal(t, uint32(i), result.GetIndex())
+
+		switch i {
+		case 10:
+			assert.Equal(t, uint32(codes.InvalidArgument), result.GetCode())
+		case 120:
+			assert.Equal(t, uint32(codes.AlreadyExists), result.GetCode())
+		default:
+			assert.Equal(t, uint32(codes.OK), result.GetCode())
+			assert.NotEmpty(t, result.GetId())
+
+			found, err := laptopStore.Find(context.Background(), result.GetId())
+			assert.NoError(t, err)
+			assert.NotNil(t, found)
+		}
+	}
+}
+
+func TestClientWatchLaptops(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	ratingStore := service.NewInMemoryRatingStore()
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	existing := sample.NewLaptop()
+	existing.PriceUsd = 1000
+	require.NoError(t, laptopStore.Save(context.Background(), existing))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	filter := &pb.Filter{MaxPriceUsd: 2000}
+	stream, err := laptopClient.WatchLaptops(ctx, &pb.WatchLaptopsRequest{Filter: filter, InitialSnapshot: true})
+	require.NoError(t, err)
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, existing.Id, res.GetSnapshotLaptop().GetId())
+
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.True(t, res.GetSnapshotComplete())
+
+	matching := sample.NewLaptop()
+	matching.PriceUsd = 1500
+	_, err = laptopClient.CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: matching})
+	require.NoError(t, err)
+
+	expensive := sample.NewLaptop()
+	expensive.PriceUsd = 3000
+	_, err = laptopClient.CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: expensive})
+	require.NoError(t, err)
+
+	// the update is watched because the laptop matched the filter before it
+	existing.PriceUsd = 2500
+	_, err = laptopClient.UpdateLaptop(ctx, &pb.UpdateLaptopRequest{Laptop: existing})
+	require.NoError(t, err)
+
+	rateStream, err := laptopClient.RateLaptop(ctx)
+	require.NoError(t, err)
+	require.NoError(t, rateStream.Send(&pb.RateLaptopRequest{LaptopId: matching.Id, Score: 8}))
+	_, err = rateStream.Recv()
+	require.NoError(t, err)
+	require.NoError(t, rateStream.CloseSend())
+
+	_, err = laptopClient.DeleteLaptop(ctx, &pb.DeleteLaptopRequest{Id: matching.Id})
+	require.NoError(t, err)
+
+	expected := []struct {
+		eventType pb.LaptopEvent_Type
+		laptopID  string
+	}{
+		{pb.LaptopEvent_CREATED, matching.Id},
+		{pb.LaptopEvent_UPDATED, existing.Id},
+		{pb.LaptopEvent_RATED, matching.Id},
+		{pb.LaptopEvent_DELETED, matching.Id},
+	}
+	for _, want := range expected {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		event := res.GetEvent()
+		require.Equal(t, want.eventType, event.GetType())
+		require.Equal(t, want.laptopID, event.GetLaptopId())
+		require.NotNil(t, event.GetTime())
+
+		switch event.GetType() {
+		case pb.LaptopEvent_UPDATED:
+			require.Equal(t, 1000.0, event.GetPreviousLaptop().GetPriceUsd())
+			require.Equal(t, 2500.0, event.GetLaptop().GetPriceUsd())
+		case pb.LaptopEvent_RATED:
+			require.EqualValues(t, 1, event.GetRatedCount())
+			require.Equal(t, 8.0, event.GetAverageScore())
+		}
+	}
+
+	_, err = laptopClient.DeleteLaptop(ctx, &pb.DeleteLaptopRequest{Id: matching.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = laptopClient.UpdateLaptop(ctx, &pb.UpdateLaptopRequest{Laptop: sample.NewLaptop()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestClientTimeout(t *testing.T) {
+	t.Parallel()
+
+	// the server reports the code of every request, to check that it stops when the client gives up
+	serverCodes := make(chan codes.Code, 1)
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(func(
+			ctx context.Context,
+			req interface{},
+			info *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler,
+		) (interface{}, error) {
+			res, err := handler(ctx, req)
+			serverCodes <- status.Code(err)
+			return res, err
+		}),
+		grpc.StreamInterceptor(func(
+			srv interface{},
+			stream grpc.ServerStream,
+			info *grpc.StreamServerInfo,
+			handler grpc.StreamHandler,
+		) error {
+			err := handler(srv, stream)
+			serverCodes <- status.Code(err)
+			return err
+		}),
+	)
+	laptopServer := service.NewLaptopService(
+		blockingLaptopStore{service.NewInMemoryLaptopStore()},
+		newTestImageStore(t, t.TempDir()),
+		service.NewInMemoryRatingStore(),
+		service.WithHistoryStore(blockingHistoryStore{service.NewInMemoryLaptopHistoryStore()}),
+	)
+	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	laptopClient := newTestLaptopClient(t, listener.Addr().String())
+	laptop := sample.NewLaptop()
+
+	testCases := []struct {
+		name string
+		call func(ctx context.Context) error
+	}{
+		{
+			name: "CreateLaptop",
+			call: func(ctx context.Context) error {
+				_, err := laptopClient.CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: laptop})
+				return err
+			},
+		},
+		{
+			name: "BulkCreateLaptops",
+			call: func(ctx context.Context) error {
+				stream, err := laptopClient.BulkCreateLaptops(ctx)
+				if err != nil {
+					return err
+				}
+				if err := stream.Send(&pb.BulkCreateLaptopsRequest{Laptop: sample.NewLaptop()}); err != nil {
+					return err
+				}
+				_, err = stream.CloseAndRecv()
+				return err
+			},
+		},
+		{
+			name: "UpdateLaptop",
+			call: func(ctx context.Context) error {
+				_, err := laptopClient.UpdateLaptop(ctx, &pb.UpdateLaptopRequest{Laptop: laptop})
+				return err
+			},
+		},
+		{
+			name: "DeleteLaptop",
+			call: func(ctx context.Context) error {
+				_, err := laptopClient.DeleteLaptop(ctx, &pb.DeleteLaptopRequest{Id: laptop.Id})
+				return err
+			},
+		},
+		{
+			name: "RestoreLaptop",
+			call: func(ctx context.Context) error {
+				_, err := laptopClient.RestoreLaptop(ctx, &pb.RestoreLaptopRequest{Id: laptop.Id})
+				return err
+			},
+		},
+		{
+			name: "GetLaptopHistory",
+			call: func(ctx context.Context) error {
+				_, err := laptopClient.GetLaptopHistory(ctx, &pb.GetLaptopHistoryRequest{Id: laptop.Id})
+				return err
+			},
+		},
+		{
+			name: "GetLaptop",
+			call: func(ctx context.Context) error {
+				_, err := laptopClient.GetLaptop(ctx, &pb.GetLaptopRequest{Id: laptop.Id})
+				return err
+			},
+		},
+		{
+			name: "SearchLaptop",
+			call: func(ctx context.Context) error {
+				stream, err := laptopClient.SearchLaptop(ctx, &pb.SearchLaptopRequest{Filter: &pb.Filter{MaxPriceUsd: 5000}})
+				if err != nil {
+					return err
+				}
+				_, err = stream.Recv()
+				return err
+			},
+		},
+		{
+			name: "SearchFacets",
+			call: func(ctx context.Context) error {
+				_, err := laptopClient.SearchFacets(ctx, &pb.SearchFacetsRequest{})
+				return err
+			},
+		},
+		{
+			name: "WatchLaptops",
+			call: func(ctx context.Context) error {
+				stream, err := laptopClient.WatchLaptops(ctx, &pb.WatchLaptopsRequest{InitialSnapshot: true})
+				if err != nil {
+					return err
+				}
+				_, err = stream.Recv()
+				return err
+			},
+		},
+		{
+			name: "UploadImage",
+			call: func(ctx context.Context) error {
+				stream, err := laptopClient.UploadImage(ctx)
+				if err != nil {
+					return err
+				}
+				info := &pb.ImageInfo{LaptopId: laptop.Id, ImageTypes: ".jpg"}
+				if err := stream.Send(&pb.UploadmageRequest{Data: &pb.UploadmageRequest_Info{Info: info}}); err != nil {
+					return err
+				}
+				_, err = stream.CloseAndRecv()
+				return err
+			},
+		},
+		{
+			name: "DeleteImage",
+			call: func(ctx context.Context) error {
+				_, err := laptopClient.DeleteImage(ctx, &pb.DeleteImageRequest{LaptopId: laptop.Id, ImageId: "image"})
+				return err
+			},
+		},
+		{
+			name: "SetPrimaryImage",
+			call: func(ctx context.Context) error {
+				_, err := laptopClient.SetPrimaryImage(ctx, &pb.SetPrimaryImageRequest{LaptopId: laptop.Id, ImageId: "image"})
+				return err
+			},
+		},
+		{
+			name: "ReorderImages",
+			call: func(ctx context.Context) error {
+				_, err := laptopClient.ReorderImages(ctx, &pb.ReorderImagesRequest{LaptopId: laptop.Id, ImageIds: []string{"image"}})
+				return err
+			},
+		},
+		{
+			name: "RateLaptop",
+			call: func(ctx context.Context) error {
+				stream, err := laptopClient.RateLaptop(ctx)
+				if err != nil {
+					return err
+				}
+				if err := stream.Send(&pb.RateLaptopRequest{LaptopId: laptop.Id, Score: 8}); err != nil {
+					return err
+				}
+				_, err = stream.Recv()
+				return err
+			},
+		},
+	}
+
+	// the subtests share the channel of the server codes, so they don't run in parallel
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			err := tc.call(ctx)
+			require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+			// the server sees its own deadline, or the client canceling the request if it gives up first
+			select {
+			case code := <-serverCodes:
+				require.Contains(t, []codes.Code{codes.DeadlineExceeded, codes.Canceled}, code)
+			case <-time.After(time.Second):
+				require.FailNow(t, "the server doesn't stop the request after its deadline")
+			}
+		})
+	}
+}
+
+// blockingLaptopStore is a laptop store so slow that every call only returns once its context is done
+type blockingLaptopStore struct {
+	service.LaptopStore
+}
+
+func (store blockingLaptopStore) Save(ctx context.Context, laptop *pb.Laptop) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (store blockingLaptopStore) SaveBatch(ctx context.Context, laptops []*pb.Laptop) []error {
+	<-ctx.Done()
+	errs := make([]error, len(laptops))
+	for i := range errs {
+		errs[i] = ctx.Err()
+	}
+	return errs
+}
+
+func (store blockingLaptopStore) Update(ctx context.Context, laptop *pb.Laptop) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (store blockingLaptopStore) Delete(ctx context.Context, id string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (store blockingLaptopStore) Find(ctx context.Context, id string) (*pb.Laptop, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (store blockingLaptopStore) Search(ctx context.Context, filter *pb.Filter, found func(laptop *pb.Laptop) error) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// blockingHistoryStore is a history store so slow that every call only returns once its context is done
+type blockingHistoryStore struct {
+	service.LaptopHistoryStore
+}
+
+func (store blockingHistoryStore) Add(ctx context.Context, version *pb.LaptopVersion) (uint32, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func (store blockingHistoryStore) List(ctx context.Context, laptopID string) ([]*pb.LaptopVersion, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
 func startTestLaptopServer(
 	t *testing.T,
 	laptopStore service.LaptopStore,
 	imageStore service.ImageStore,
 	ratingStore service.RatingStore,
+	options ...service.LaptopServerOption,
 ) string {
-	laptopServer := service.NewLaptopService(laptopStore, imageStore, ratingStore)
+	laptopServer := service.NewLaptopService(laptopStore, imageStore, ratingStore, options...)
 
 	grpcServer := grpc.NewServer()
 	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
 
-	val := 8000 + rand.Intn(100)
-	address := fmt.Sprintf("127.0.0.1:%d", val)
-	log.Println("address", address)
-
-	listener, err := net.Listen("tcp", address) // random available port
+	listener, err := net.Listen("tcp", "127.0.0.1:0") // random available port
 	assert.NoError(t, err)
 
 	go grpcServer.Serve(listener) // non block
@@ -261,6 +791,47 @@ func startTestLaptopServer(
 	return listener.Addr().String()
 }
 
+func uploadTestImage(
+	t *testing.T,
+	ctx context.Context,
+	laptopClient pb.LaptopServiceClient,
+	laptopID string,
+	imagePath string,
+) *pb.UploadImageResponse {
+	data, err := os.ReadFile(imagePath)
+	assert.NoError(t, err)
+
+	stream, err := laptopClient.UploadImage(ctx)
+	assert.NoError(t, err)
+
+	err = stream.Send(&pb.UploadmageRequest{
+		Data: &pb.UploadmageRequest_Info{
+			Info: &pb.ImageInfo{
+				LaptopId:   laptopID,
+				ImageTypes: filepath.Ext(imagePath),
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	for len(data) > 0 {
+		n := 1024
+		if n > len(data) {
+			n = len(data)
+		}
+
+		err = stream.Send(&pb.UploadmageRequest{
+			Data: &pb.UploadmageRequest_ChunkData{ChunkData: data[:n]},
+		})
+		assert.NoError(t, err)
+		data = data[n:]
+	}
+
+	res, err := stream.CloseAndRecv()
+	assert.NoError(t, err)
+	return res
+}
+
 func newTestLaptopClient(t *testing.T, serverAddress string) pb.LaptopServiceClient {
 	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
 	assert.NoError(t, err)
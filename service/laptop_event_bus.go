@@ -0,0 +1,108 @@
+package service
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/thewalkers2012/grpc-example/pb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultEventBufferSize is the number of events buffered for every subscriber by default
+const DefaultEventBufferSize = 256
+
+// ErrSlowSubscriber is the error of a subscription closed because it didn't receive its events fast enough
+var ErrSlowSubscriber = errors.New("subscriber is too slow to receive events")
+
+// LaptopEventBus broadcasts laptop events to its subscribers.
+// Publishing never waits for a subscriber: a subscriber whose buffer is full is disconnected.
+type LaptopEventBus struct {
+	mutex       sync.Mutex
+	bufferSize  int
+	subscribers map[*LaptopEventSubscription]bool
+}
+
+// NewLaptopEventBus returns a new event bus that buffers bufferSize events for every subscriber
+func NewLaptopEventBus(bufferSize int) *LaptopEventBus {
+	if bufferSize <= 0 {
+		bufferSize = DefaultEventBufferSize
+	}
+
+	return &LaptopEventBus{
+		bufferSize:  bufferSize,
+		subscribers: make(map[*LaptopEventSubscription]bool),
+	}
+}
+
+// Subscribe returns a subscription to the events published from now on
+func (bus *LaptopEventBus) Subscribe() *LaptopEventSubscription {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	subscription := &LaptopEventSubscription{
+		bus:    bus,
+		events: make(chan *pb.LaptopEvent, bus.bufferSize),
+	}
+	bus.subscribers[subscription] = true
+
+	return subscription
+}
+
+// Publish sends the event to every subscriber, setting its time if it has none.
+// The event is shared by the subscribers, so it must not be changed afterwards.
+func (bus *LaptopEventBus) Publish(event *pb.LaptopEvent) {
+	if event.Time == nil {
+		event.Time = timestamppb.Now()
+	}
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	for subscription := range bus.subscribers {
+		select {
+		case subscription.events <- event:
+		default:
+			bus.unsubscribe(subscription, ErrSlowSubscriber)
+		}
+	}
+}
+
+func (bus *LaptopEventBus) unsubscribe(subscription *LaptopEventSubscription, err error) {
+	if !bus.subscribers[subscription] {
+		return
+	}
+
+	delete(bus.subscribers, subscription)
+	subscription.err = err
+	close(subscription.events)
+}
+
+// LaptopEventSubscription receives the events of a LaptopEventBus
+type LaptopEventSubscription struct {
+	bus    *LaptopEventBus
+	events chan *pb.LaptopEvent
+	// err is set before events is closed
+	err error
+}
+
+// Events returns the channel of the events, it is closed when the subscription ends
+func (subscription *LaptopEventSubscription) Events() <-chan *pb.LaptopEvent {
+	return subscription.events
+}
+
+// Err returns why the subscription ended once the events channel is closed,
+// ErrSlowSubscriber if the subscriber was disconnected, nil if it was closed
+func (subscription *LaptopEventSubscription) Err() error {
+	subscription.bus.mutex.Lock()
+	defer subscription.bus.mutex.Unlock()
+
+	return subscription.err
+}
+
+// Close ends the subscription, it is safe to call Close more than once
+func (subscription *LaptopEventSubscription) Close() {
+	subscription.bus.mutex.Lock()
+	defer subscription.bus.mutex.Unlock()
+
+	subscription.bus.unsubscribe(subscription, nil)
+}
@@ -0,0 +1,43 @@
+package service_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/service"
+)
+
+func TestLaptopEventBus(t *testing.T) {
+	t.Parallel()
+
+	bus := service.NewLaptopEventBus(2)
+	fast := bus.Subscribe()
+	defer fast.Close()
+	slow := bus.Subscribe()
+	defer slow.Close()
+
+	for i := 0; i < 3; i++ {
+		bus.Publish(&pb.LaptopEvent{Type: pb.LaptopEvent_CREATED})
+		if i < 2 {
+			event := <-fast.Events()
+			require.NotNil(t, event.GetTime())
+		}
+	}
+
+	// the slow subscriber gets its buffered events, then it is disconnected
+	for i := 0; i < 2; i++ {
+		_, ok := <-slow.Events()
+		require.True(t, ok)
+	}
+	_, ok := <-slow.Events()
+	require.False(t, ok)
+	require.ErrorIs(t, slow.Err(), service.ErrSlowSubscriber)
+
+	// the other subscriber is not affected
+	<-fast.Events()
+	fast.Close()
+	_, ok = <-fast.Events()
+	require.False(t, ok)
+	require.NoError(t, fast.Err())
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/thewalkers2012/grpc-example/pb"
+)
+
+// default boundaries of the facet buckets
+var (
+	DefaultPriceBoundariesUSD = []float64{1000, 1500, 2000, 2500, 3000}
+	DefaultRAMBoundariesGB    = []uint64{8, 16, 32, 64}
+)
+
+var gigabyte = &pb.Memory{Value: 1, Unit: pb.Memory_GIGABYTE}
+
+// FacetBuckets are the ascending boundaries of the range facets
+type FacetBuckets struct {
+	PriceUSD []float64
+	RAMGB    []uint64
+}
+
+// ComputeFacets counts the laptops of the store that match the filter by brand, CPU brand,
+// RAM bucket, price bucket, screen panel and release year
+func ComputeFacets(
+	ctx context.Context,
+	store LaptopStore,
+	filter *pb.Filter,
+	buckets FacetBuckets,
+) (*pb.SearchFacetsResponse, error) {
+	brands := make(map[string]uint32)
+	cpuBrands := make(map[string]uint32)
+	panels := make(map[string]uint32)
+	years := make(map[string]uint32)
+	priceCounts := make([]uint32, len(buckets.PriceUSD)+1)
+	ramCounts := make([]uint32, len(buckets.RAMGB)+1)
+
+	ramBoundaries := make([]float64, len(buckets.RAMGB))
+	for i, gb := range buckets.RAMGB {
+		ramBoundaries[i] = float64(gb)
+	}
+
+	res := &pb.SearchFacetsResponse{}
+	err := store.Search(ctx, filter, func(laptop *pb.Laptop) error {
+		res.TotalCount++
+		brands[laptop.GetBrand()]++
+		cpuBrands[laptop.GetCpu().GetBrand()]++
+		panels[laptop.GetScreen().GetPanel().String()]++
+		years[strconv.Itoa(int(laptop.GetReleaseYear()))]++
+		priceCounts[bucketIndex(buckets.PriceUSD, laptop.GetPriceUsd())]++
+		ramCounts[bucketIndex(ramBoundaries, float64(toBit(laptop.GetRam()))/float64(toBit(gigabyte)))]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res.Brands = valueFacet(brands)
+	res.CpuBrands = valueFacet(cpuBrands)
+	res.ScreenPanels = valueFacet(panels)
+	res.ReleaseYears = valueFacet(years)
+	res.PriceBuckets = bucketFacet(buckets.PriceUSD, priceCounts)
+	res.RamBuckets = bucketFacet(ramBoundaries, ramCounts)
+
+	return res, nil
+}
+
+// ValidateFacetBuckets adds the violations of bucket boundaries that are not positive and ascending
+func ValidateFacetBuckets(violations *FieldViolations, buckets FacetBuckets) {
+	for i, boundary := range buckets.PriceUSD {
+		if boundary <= 0 || (i > 0 && boundary <= buckets.PriceUSD[i-1]) {
+			violations.Add(fmt.Sprintf("price_boundaries_usd[%d]", i), "must be positive and greater than the previous boundary")
+		}
+	}
+	for i, boundary := range buckets.RAMGB {
+		if boundary == 0 || (i > 0 && boundary <= buckets.RAMGB[i-1]) {
+			violations.Add(fmt.Sprintf("ram_boundaries_gb[%d]", i), "must be positive and greater than the previous boundary")
+		}
+	}
+}
+
+// bucketIndex returns the index of the bucket of the value, the buckets being split at the boundaries
+func bucketIndex(boundaries []float64, value float64) int {
+	return sort.Search(len(boundaries), func(i int) bool {
+		return boundaries[i] > value
+	})
+}
+
+// valueFacet returns the counts by value, the most frequent first
+func valueFacet(counts map[string]uint32) []*pb.FacetValue {
+	values := make([]*pb.FacetValue, 0, len(counts))
+	for value, count := range counts {
+		values = append(values, &pb.FacetValue{Value: value, Count: count})
+	}
+
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Count != values[j].Count {
+			return values[i].Count > values[j].Count
+		}
+		return values[i].Value < values[j].Value
+	})
+
+	return values
+}
+
+// bucketFacet returns the counts of every bucket, including the empty ones
+func bucketFacet(boundaries []float64, counts []uint32) []*pb.FacetValue {
+	values := make([]*pb.FacetValue, len(counts))
+	for i, count := range counts {
+		value := &pb.FacetValue{Count: count}
+		if i > 0 {
+			value.Min = boundaries[i-1]
+		}
+		if i < len(boundaries) {
+			value.Max = boundaries[i]
+			value.Value = fmt.Sprintf("%g-%g", value.Min, value.Max)
+		} else {
+			value.Value = fmt.Sprintf("%g+", value.Min)
+		}
+		values[i] = value
+	}
+
+	return values
+}
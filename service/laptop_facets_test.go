@@ -0,0 +1,83 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServerSearchFacets(t *testing.T) {
+	t.Parallel()
+
+	newLaptop := func(brand string, cpuBrand string, ramGB uint64, price float64, panel pb.Screen_Panel, year uint32) *pb.Laptop {
+		laptop := sample.NewLaptop()
+		laptop.Brand = brand
+		laptop.Cpu.Brand = cpuBrand
+		laptop.Ram = &pb.Memory{Value: ramGB, Unit: pb.Memory_GIGABYTE}
+		laptop.PriceUsd = price
+		laptop.Screen.Panel = panel
+		laptop.ReleaseYear = year
+		return laptop
+	}
+
+	store := service.NewInMemoryLaptopStore()
+	laptops := []*pb.Laptop{
+		newLaptop("Dell", "Intel", 8, 900, pb.Screen_IPS, 2018),
+		newLaptop("Dell", "AMD", 16, 1500, pb.Screen_OLED, 2019),
+		newLaptop("Apple", "Intel", 16, 2400, pb.Screen_IPS, 2019),
+		newLaptop("Lenovo", "Intel", 64, 3500, pb.Screen_IPS, 2019),
+	}
+	for _, laptop := range laptops {
+		require.NoError(t, store.Save(context.Background(), laptop))
+	}
+
+	server := service.NewLaptopService(store, nil, nil)
+
+	res, err := server.SearchFacets(context.Background(), &pb.SearchFacetsRequest{})
+	require.NoError(t, err)
+	require.EqualValues(t, 4, res.GetTotalCount())
+	require.Equal(t, []string{"Dell:2", "Apple:1", "Lenovo:1"}, facetCounts(res.GetBrands()))
+	require.Equal(t, []string{"Intel:3", "AMD:1"}, facetCounts(res.GetCpuBrands()))
+	require.Equal(t, []string{"IPS:3", "OLED:1"}, facetCounts(res.GetScreenPanels()))
+	require.Equal(t, []string{"2019:3", "2018:1"}, facetCounts(res.GetReleaseYears()))
+	require.Equal(t,
+		[]string{"0-8:0", "8-16:1", "16-32:2", "32-64:0", "64+:1"},
+		facetCounts(res.GetRamBuckets()),
+	)
+	require.Equal(t,
+		[]string{"0-1000:1", "1000-1500:0", "1500-2000:1", "2000-2500:1", "2500-3000:0", "3000+:1"},
+		facetCounts(res.GetPriceBuckets()),
+	)
+	require.Equal(t, 3000.0, res.GetPriceBuckets()[5].GetMin())
+	require.Equal(t, 0.0, res.GetPriceBuckets()[5].GetMax())
+
+	// the facets follow the filter, with the buckets of the request
+	res, err = server.SearchFacets(context.Background(), &pb.SearchFacetsRequest{
+		Filter:             &pb.Filter{MaxPriceUsd: 2500, MinRam: &pb.Memory{Value: 16, Unit: pb.Memory_GIGABYTE}},
+		PriceBoundariesUsd: []float64{2000},
+		RamBoundariesGb:    []uint64{32},
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, res.GetTotalCount())
+	require.Equal(t, []string{"AMD:1", "Intel:1"}, facetCounts(res.GetCpuBrands()))
+	require.Equal(t, []string{"0-2000:1", "2000+:1"}, facetCounts(res.GetPriceBuckets()))
+	require.Equal(t, []string{"0-32:2", "32+:0"}, facetCounts(res.GetRamBuckets()))
+
+	_, err = server.SearchFacets(context.Background(), &pb.SearchFacetsRequest{PriceBoundariesUsd: []float64{2000, 1000}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func facetCounts(values []*pb.FacetValue) []string {
+	counts := make([]string, len(values))
+	for i, value := range values {
+		counts[i] = value.GetValue() + ":" + fmt.Sprint(value.GetCount())
+	}
+	return counts
+}
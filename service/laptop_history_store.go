@@ -0,0 +1,280 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/thewalkers2012/grpc-example/pb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// LaptopHistoryStore is an interface to store the versions of the laptops
+type LaptopHistoryStore interface {
+	// Add appends a version of a laptop, numbered after its previous versions, and returns its number
+	Add(ctx context.Context, version *pb.LaptopVersion) (uint32, error)
+	// List returns the versions of a laptop from the oldest to the newest
+	List(ctx context.Context, laptopID string) ([]*pb.LaptopVersion, error)
+}
+
+// InMemoryLaptopHistoryStore stores the versions of the laptops in memory
+type InMemoryLaptopHistoryStore struct {
+	mutex    sync.RWMutex
+	versions map[string][]*pb.LaptopVersion
+}
+
+// NewInMemoryLaptopHistoryStore returns a new InMemoryLaptopHistoryStore
+func NewInMemoryLaptopHistoryStore() *InMemoryLaptopHistoryStore {
+	return &InMemoryLaptopHistoryStore{
+		versions: make(map[string][]*pb.LaptopVersion),
+	}
+}
+
+// Add appends a version of a laptop and returns its number
+func (store *InMemoryLaptopHistoryStore) Add(ctx context.Context, version *pb.LaptopVersion) (uint32, error) {
+	laptopID := version.GetLaptop().GetId()
+	if laptopID == "" {
+		return 0, fmt.Errorf("version has no laptop ID")
+	}
+
+	other := proto.Clone(version).(*pb.LaptopVersion)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	other.Version = uint32(len(store.versions[laptopID]) + 1)
+	store.versions[laptopID] = append(store.versions[laptopID], other)
+	return other.Version, nil
+}
+
+// List returns the versions of a laptop from the oldest to the newest
+func (store *InMemoryLaptopHistoryStore) List(ctx context.Context, laptopID string) ([]*pb.LaptopVersion, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	versions := make([]*pb.LaptopVersion, len(store.versions[laptopID]))
+	for i, version := range store.versions[laptopID] {
+		versions[i] = proto.Clone(version).(*pb.LaptopVersion)
+	}
+
+	return versions, nil
+}
+
+// laptopHistoryJournalName is the file of the versions of the laptops in the laptop folder, one per line
+const laptopHistoryJournalName = ".history"
+
+// DiskLaptopHistoryStore stores the versions of the laptops in a journal of the laptop folder,
+// so that the history and the deleted laptops survive a restart and are shared by the servers of the folder.
+// A version is numbered and appended while the server holds the lock of the folder, after it has read
+// the versions appended by the other servers.
+type DiskLaptopHistoryStore struct {
+	mutex    sync.Mutex
+	journal  *diskJournal
+	versions map[string][]*pb.LaptopVersion
+}
+
+// NewDiskLaptopHistoryStore returns a new DiskLaptopHistoryStore with the versions of the journal of the folder
+func NewDiskLaptopHistoryStore(laptopFolder string) (*DiskLaptopHistoryStore, error) {
+	err := os.MkdirAll(laptopFolder, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create laptop folder: %w", err)
+	}
+
+	journal, err := openDiskJournal(laptopFolder, laptopHistoryJournalName)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &DiskLaptopHistoryStore{
+		journal:  journal,
+		versions: make(map[string][]*pb.LaptopVersion),
+	}
+
+	err = journal.withLock(store.read)
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Add appends a version of a laptop and returns its number
+func (store *DiskLaptopHistoryStore) Add(ctx context.Context, version *pb.LaptopVersion) (uint32, error) {
+	laptopID := version.GetLaptop().GetId()
+	if laptopID == "" {
+		return 0, fmt.Errorf("version has no laptop ID")
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	other := proto.Clone(version).(*pb.LaptopVersion)
+	err := store.journal.withLock(func() error {
+		err := store.read()
+		if err != nil {
+			return err
+		}
+
+		other.Version = uint32(len(store.versions[laptopID]) + 1)
+		data, err := protojson.Marshal(other)
+		if err != nil {
+			return fmt.Errorf("cannot marshal laptop version: %w", err)
+		}
+
+		return store.journal.append(json.RawMessage(data))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	store.versions[laptopID] = append(store.versions[laptopID], other)
+	return other.Version, nil
+}
+
+// List returns the versions of a laptop from the oldest to the newest
+func (store *DiskLaptopHistoryStore) List(ctx context.Context, laptopID string) ([]*pb.LaptopVersion, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	changed, err := store.journal.changed()
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		err := store.journal.withLock(store.read)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	versions := make([]*pb.LaptopVersion, len(store.versions[laptopID]))
+	for i, version := range store.versions[laptopID] {
+		versions[i] = proto.Clone(version).(*pb.LaptopVersion)
+	}
+
+	return versions, nil
+}
+
+// read adds the versions appended to the journal since it was last read, it must be called with the lock held
+func (store *DiskLaptopHistoryStore) read() error {
+	reset := func() error {
+		store.versions = make(map[string][]*pb.LaptopVersion)
+		return nil
+	}
+
+	return store.journal.read(reset, func(record []byte) error {
+		version := &pb.LaptopVersion{}
+		err := protojson.Unmarshal(record, version)
+		if err != nil {
+			return err
+		}
+
+		laptopID := version.GetLaptop().GetId()
+		store.versions[laptopID] = append(store.versions[laptopID], version)
+		return nil
+	})
+}
+
+// laptopAsOf returns the laptop of the last version at the time, or nil if it didn't exist then
+func laptopAsOf(versions []*pb.LaptopVersion, asOf time.Time) *pb.Laptop {
+	var last *pb.LaptopVersion
+	for _, version := range versions {
+		if version.GetTime().AsTime().After(asOf) {
+			break
+		}
+		last = version
+	}
+
+	if last == nil || last.GetChange() == pb.LaptopVersion_DELETED {
+		return nil
+	}
+	return last.GetLaptop()
+}
+
+// diffLaptops returns the fields that differ between the laptops, sorted by path.
+// The update time is not compared, it is the time of the version.
+func diffLaptops(old *pb.Laptop, new *pb.Laptop) ([]*pb.FieldDiff, error) {
+	oldFields, err := jsonFields(old)
+	if err != nil {
+		return nil, err
+	}
+
+	newFields, err := jsonFields(new)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(oldFields, "updated_at")
+	delete(newFields, "updated_at")
+	return diffJSONFields("", oldFields, newFields), nil
+}
+
+// jsonFields returns the compact JSON values of the fields of the message by field name
+func jsonFields(message proto.Message) (map[string]json.RawMessage, error) {
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal message to JSON: %w", err)
+	}
+
+	compact := &bytes.Buffer{}
+	err = json.Compact(compact, data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compact JSON: %w", err)
+	}
+
+	fields := make(map[string]json.RawMessage)
+	err = json.Unmarshal(compact.Bytes(), &fields)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal JSON fields: %w", err)
+	}
+
+	return fields, nil
+}
+
+// diffJSONFields compares the fields of two JSON objects, and the fields of the objects they both have
+func diffJSONFields(prefix string, old map[string]json.RawMessage, new map[string]json.RawMessage) []*pb.FieldDiff {
+	names := make([]string, 0, len(old)+len(new))
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range new {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var diffs []*pb.FieldDiff
+	for _, name := range names {
+		oldValue, newValue := old[name], new[name]
+		if bytes.Equal(oldValue, newValue) {
+			continue
+		}
+
+		var oldObject, newObject map[string]json.RawMessage
+		if json.Unmarshal(oldValue, &oldObject) == nil && json.Unmarshal(newValue, &newObject) == nil &&
+			oldObject != nil && newObject != nil {
+			diffs = append(diffs, diffJSONFields(prefix+name+".", oldObject, newObject)...)
+			continue
+		}
+
+		diffs = append(diffs, &pb.FieldDiff{
+			Field:    prefix + name,
+			OldValue: string(oldValue),
+			NewValue: string(newValue),
+		})
+	}
+
+	return diffs
+}
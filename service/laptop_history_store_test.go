@@ -0,0 +1,163 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestClientLaptopHistory(t *testing.T) {
+	t.Parallel()
+
+	tenants := service.NewInMemoryTenantStore(service.NewTenantFactory(t.TempDir(), ""))
+	defaultTenant, err := tenants.Create(context.Background(), service.DefaultTenant)
+	require.NoError(t, err)
+
+	admin, err := service.NewUser("admin1", "secret", "admin")
+	require.NoError(t, err)
+	require.NoError(t, defaultTenant.UserStore.Save(context.Background(), admin))
+
+	conn, err := grpc.Dial(startTestTenantServer(t, tenants, defaultTenant), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	login, err := pb.NewAuthServiceClient(conn).Login(context.Background(), &pb.LoginRequest{Username: "admin1", Password: "secret"})
+	require.NoError(t, err)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", login.GetAccessToken())
+	laptopClient := pb.NewLaptopServiceClient(conn)
+
+	laptop := sample.NewLaptop()
+	laptop.PriceUsd = 1500
+	_, err = laptopClient.CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+
+	_, err = laptopClient.RestoreLaptop(ctx, &pb.RestoreLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	updated := proto.Clone(laptop).(*pb.Laptop)
+	updated.PriceUsd = 1200
+	updated.Cpu.MaxGhz = updated.Cpu.MinGhz
+	_, err = laptopClient.UpdateLaptop(ctx, &pb.UpdateLaptopRequest{Laptop: updated})
+	require.NoError(t, err)
+
+	_, err = laptopClient.DeleteLaptop(ctx, &pb.DeleteLaptopRequest{Id: laptop.Id})
+	require.NoError(t, err)
+
+	_, err = laptopClient.GetLaptop(ctx, &pb.GetLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	restored, err := laptopClient.RestoreLaptop(ctx, &pb.RestoreLaptopRequest{Id: laptop.Id})
+	require.NoError(t, err)
+	require.Equal(t, 1200.0, restored.GetLaptop().GetPriceUsd())
+
+	found, err := laptopClient.GetLaptop(ctx, &pb.GetLaptopRequest{Id: laptop.Id})
+	require.NoError(t, err)
+	require.Equal(t, 1200.0, found.GetLaptop().GetPriceUsd())
+
+	history, err := laptopClient.GetLaptopHistory(ctx, &pb.GetLaptopHistoryRequest{Id: laptop.Id})
+	require.NoError(t, err)
+
+	versions := history.GetVersions()
+	require.Len(t, versions, 4)
+	changes := []pb.LaptopVersion_Change{
+		pb.LaptopVersion_CREATED,
+		pb.LaptopVersion_UPDATED,
+		pb.LaptopVersion_DELETED,
+		pb.LaptopVersion_RESTORED,
+	}
+	for i, version := range versions {
+		require.EqualValues(t, i+1, version.GetVersion())
+		require.Equal(t, changes[i], version.GetChange())
+		require.Equal(t, "admin1", version.GetActor())
+		require.NotNil(t, version.GetTime())
+	}
+
+	require.Empty(t, versions[0].GetDiffs())
+	require.Empty(t, versions[2].GetDiffs())
+
+	diffs := map[string]*pb.FieldDiff{}
+	for _, diff := range versions[1].GetDiffs() {
+		diffs[diff.GetField()] = diff
+	}
+	require.Len(t, diffs, 2)
+	require.Equal(t, "1500", diffs["price_usd"].GetOldValue())
+	require.Equal(t, "1200", diffs["price_usd"].GetNewValue())
+	require.Contains(t, diffs, "cpu.max_ghz")
+
+	// the laptop as of the time of a version
+	asOf, err := laptopClient.GetLaptop(ctx, &pb.GetLaptopRequest{Id: laptop.Id, AsOf: versions[0].GetTime()})
+	require.NoError(t, err)
+	require.Equal(t, 1500.0, asOf.GetLaptop().GetPriceUsd())
+
+	// past versions are only read by admins, as the history
+	_, err = laptopClient.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: laptop.Id, AsOf: versions[0].GetTime()})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = laptopClient.GetLaptop(ctx, &pb.GetLaptopRequest{Id: laptop.Id, AsOf: versions[2].GetTime()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	before := timestamppb.New(versions[0].GetTime().AsTime().Add(-1))
+	_, err = laptopClient.GetLaptop(ctx, &pb.GetLaptopRequest{Id: laptop.Id, AsOf: before})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = laptopClient.GetLaptopHistory(ctx, &pb.GetLaptopHistoryRequest{Id: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestDiskLaptopHistoryStoreShared(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	laptopFolder := t.TempDir()
+	store1, err := service.NewDiskLaptopHistoryStore(laptopFolder)
+	require.NoError(t, err)
+	store2, err := service.NewDiskLaptopHistoryStore(laptopFolder)
+	require.NoError(t, err)
+
+	laptop := sample.NewLaptop()
+	changes := []pb.LaptopVersion_Change{pb.LaptopVersion_CREATED, pb.LaptopVersion_UPDATED, pb.LaptopVersion_DELETED}
+	for i, change := range changes {
+		// the servers number the versions one after the other
+		store := []*service.DiskLaptopHistoryStore{store1, store2}[i%2]
+		number, err := store.Add(ctx, &pb.LaptopVersion{Change: change, Laptop: laptop, Time: timestamppb.Now()})
+		require.NoError(t, err)
+		require.EqualValues(t, i+1, number)
+	}
+
+	versions, err := store2.List(ctx, laptop.Id)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+
+	// the deleted laptop can still be restored with its images after a restart
+	store3, err := service.NewDiskLaptopHistoryStore(laptopFolder)
+	require.NoError(t, err)
+	restarted, err := store3.List(ctx, laptop.Id)
+	require.NoError(t, err)
+	require.Len(t, restarted, 3)
+	for i, version := range restarted {
+		require.True(t, proto.Equal(versions[i], version))
+	}
+
+	tenant := &service.Tenant{
+		LaptopStore:  service.NewInMemoryLaptopStore(),
+		ImageStore:   newTestImageStore(t, t.TempDir()),
+		HistoryStore: store3,
+	}
+	_, _, err = tenant.ImageStore.Save(ctx, laptop.Id, ".jpg", *bytes.NewBufferString("image"))
+	require.NoError(t, err)
+	deleted, err := service.CollectImages(ctx, tenant, time.Hour)
+	require.NoError(t, err)
+	require.Zero(t, deleted)
+}
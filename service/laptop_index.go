@@ -0,0 +1,169 @@
+package service
+
+import (
+	"sort"
+
+	"github.com/thewalkers2012/grpc-example/pb"
+)
+
+// laptopIndexBucketSize is the number of entries of an index bucket, a bucket is split when it is twice as large
+const laptopIndexBucketSize = 256
+
+// laptopIndex keeps the IDs of the laptops sorted by one of their values, to find value ranges without a full scan.
+// The entries are split into sorted buckets, so adding or removing a laptop only moves the entries of one bucket.
+type laptopIndex struct {
+	value   func(laptop *pb.Laptop) float64
+	buckets [][]laptopIndexEntry
+}
+
+type laptopIndexEntry struct {
+	value float64
+	id    string
+}
+
+func (entry laptopIndexEntry) less(other laptopIndexEntry) bool {
+	return entry.value < other.value || (entry.value == other.value && entry.id < other.id)
+}
+
+// laptopIndexPosition is the position of an entry in an index
+type laptopIndexPosition struct {
+	bucket int
+	offset int
+}
+
+// laptopIndexRange is the range of entries of an index between two positions
+type laptopIndexRange struct {
+	index *laptopIndex
+	from  laptopIndexPosition
+	to    laptopIndexPosition
+}
+
+func newLaptopIndex(value func(laptop *pb.Laptop) float64) *laptopIndex {
+	return &laptopIndex{value: value}
+}
+
+// add adds the laptop to the index
+func (index *laptopIndex) add(laptop *pb.Laptop) {
+	entry := laptopIndexEntry{value: index.value(laptop), id: laptop.GetId()}
+	if len(index.buckets) == 0 {
+		index.buckets = [][]laptopIndexEntry{{entry}}
+		return
+	}
+
+	position := index.search(func(other laptopIndexEntry) bool { return !other.less(entry) })
+	if position.bucket == len(index.buckets) {
+		position.bucket--
+		position.offset = len(index.buckets[position.bucket])
+	}
+
+	bucket := append(index.buckets[position.bucket], laptopIndexEntry{})
+	copy(bucket[position.offset+1:], bucket[position.offset:])
+	bucket[position.offset] = entry
+	index.buckets[position.bucket] = bucket
+
+	if len(bucket) >= 2*laptopIndexBucketSize {
+		half := len(bucket) / 2
+		right := append([]laptopIndexEntry(nil), bucket[half:]...)
+
+		index.buckets = append(index.buckets, nil)
+		copy(index.buckets[position.bucket+2:], index.buckets[position.bucket+1:])
+		index.buckets[position.bucket] = bucket[:half]
+		index.buckets[position.bucket+1] = right
+	}
+}
+
+// remove removes the laptop from the index, it must be the same laptop that was added
+func (index *laptopIndex) remove(laptop *pb.Laptop) {
+	entry := laptopIndexEntry{value: index.value(laptop), id: laptop.GetId()}
+
+	position := index.search(func(other laptopIndexEntry) bool { return !other.less(entry) })
+	if position.bucket == len(index.buckets) || index.buckets[position.bucket][position.offset] != entry {
+		return
+	}
+
+	bucket := index.buckets[position.bucket]
+	bucket = append(bucket[:position.offset], bucket[position.offset+1:]...)
+	if len(bucket) == 0 {
+		index.buckets = append(index.buckets[:position.bucket], index.buckets[position.bucket+1:]...)
+		return
+	}
+	index.buckets[position.bucket] = bucket
+}
+
+// search returns the position of the first entry for which after returns true,
+// after must be false for a prefix of the entries and true for the rest
+func (index *laptopIndex) search(after func(entry laptopIndexEntry) bool) laptopIndexPosition {
+	b := sort.Search(len(index.buckets), func(i int) bool {
+		bucket := index.buckets[i]
+		return after(bucket[len(bucket)-1])
+	})
+	if b == len(index.buckets) {
+		return laptopIndexPosition{bucket: b}
+	}
+
+	bucket := index.buckets[b]
+	offset := sort.Search(len(bucket), func(i int) bool {
+		return after(bucket[i])
+	})
+	return laptopIndexPosition{bucket: b, offset: offset}
+}
+
+func (index *laptopIndex) end() laptopIndexPosition {
+	return laptopIndexPosition{bucket: len(index.buckets)}
+}
+
+// atMost returns the range of entries with a value less than or equal to max
+func (index *laptopIndex) atMost(max float64) laptopIndexRange {
+	to := index.search(func(entry laptopIndexEntry) bool { return entry.value > max })
+	return laptopIndexRange{index: index, to: to}
+}
+
+// atLeast returns the range of entries with a value greater than or equal to min
+func (index *laptopIndex) atLeast(min float64) laptopIndexRange {
+	from := index.search(func(entry laptopIndexEntry) bool { return entry.value >= min })
+	return laptopIndexRange{index: index, from: from, to: index.end()}
+}
+
+// len returns the number of entries in the range
+func (r laptopIndexRange) len() int {
+	n := 0
+	for b := r.from.bucket; b < r.to.bucket; b++ {
+		n += len(r.index.buckets[b])
+	}
+	return n - r.from.offset + r.to.offset
+}
+
+// each calls fn with the ID of every entry in the range, in order
+func (r laptopIndexRange) each(fn func(id string)) {
+	for b := r.from.bucket; b <= r.to.bucket && b < len(r.index.buckets); b++ {
+		bucket := r.index.buckets[b]
+		if b == r.to.bucket {
+			bucket = bucket[:r.to.offset]
+		}
+		if b == r.from.bucket {
+			bucket = bucket[r.from.offset:]
+		}
+
+		for _, entry := range bucket {
+			fn(entry.id)
+		}
+	}
+}
+
+func laptopPriceUSD(laptop *pb.Laptop) float64 {
+	return laptop.GetPriceUsd()
+}
+
+func laptopCPUCores(laptop *pb.Laptop) float64 {
+	return float64(laptop.GetCpu().GetNumberCores())
+}
+
+func laptopCPUGhz(laptop *pb.Laptop) float64 {
+	return laptop.GetCpu().GetMaxGhz()
+}
+
+// laptopRAM returns the RAM in bits. The conversion to float64 may round large values,
+// but it keeps their order, so ranges of the index never miss a laptop.
+func laptopRAM(laptop *pb.Laptop) float64 {
+	return float64(toBit(laptop.GetRam()))
+}
@@ -3,74 +3,174 @@ package service
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/thewalkers2012/grpc-example/pb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const maxImageSize = 1 << 20
 
+// bulkCreateBatchSize is the number of laptops saved to the store at once by BulkCreateLaptops
+const bulkCreateBatchSize = 100
+
 // LaptopService is the service that provides laptop services
 type LaptopServer struct {
-	laptopStore LaptopStore
-	imageStore  ImageStore
-	ratingStore RatingStore
+	laptopStore      LaptopStore
+	imageStore       ImageStore
+	ratingStore      RatingStore
+	historyStore     LaptopHistoryStore
+	idempotencyStore IdempotencyStore
+	eventBus         *LaptopEventBus
+	facetBuckets     FacetBuckets
+	exchangeRates    ExchangeRateProvider
+	tenants          TenantStore
 	pb.UnimplementedLaptopServiceServer
 }
 
+// LaptopServerOption configures optional dependencies of a LaptopServer
+type LaptopServerOption func(server *LaptopServer)
+
+// WithIdempotencyStore sets the store that remembers responses by idempotency key
+func WithIdempotencyStore(store IdempotencyStore) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.idempotencyStore = store
+	}
+}
+
+// WithHistoryStore sets the store of the laptop versions
+func WithHistoryStore(store LaptopHistoryStore) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.historyStore = store
+	}
+}
+
+// WithEventBus sets the bus the laptop events are published to and watched from
+func WithEventBus(bus *LaptopEventBus) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.eventBus = bus
+	}
+}
+
+// WithFacetBuckets sets the default bucket boundaries of SearchFacets
+func WithFacetBuckets(buckets FacetBuckets) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.facetBuckets = buckets
+	}
+}
+
+// WithExchangeRates sets the exchange rates of the supported currencies, only USD is supported by default
+func WithExchangeRates(rates ExchangeRateProvider) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.exchangeRates = rates
+	}
+}
+
+// WithTenants makes the server use the stores of the tenant of each request,
+// instead of the stores it was created with
+func WithTenants(tenants TenantStore) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.tenants = tenants
+	}
+}
+
 // NewLaptopService returns a new laptopServer
-func NewLaptopService(laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore) *LaptopServer {
-	return &LaptopServer{
-		laptopStore: laptopStore,
-		imageStore:  imageStore,
-		ratingStore: ratingStore,
+func NewLaptopService(
+	laptopStore LaptopStore,
+	imageStore ImageStore,
+	ratingStore RatingStore,
+	options ...LaptopServerOption,
+) *LaptopServer {
+	server := &LaptopServer{
+		laptopStore:      laptopStore,
+		imageStore:       imageStore,
+		ratingStore:      ratingStore,
+		historyStore:     NewInMemoryLaptopHistoryStore(),
+		idempotencyStore: NewInMemoryIdempotencyStore(DefaultIdempotencyTTL),
+		eventBus:         NewLaptopEventBus(DefaultEventBufferSize),
+		facetBuckets: FacetBuckets{
+			PriceUSD: DefaultPriceBoundariesUSD,
+			RAMGB:    DefaultRAMBoundariesGB,
+		},
+		exchangeRates: StaticExchangeRates{},
+	}
+
+	for _, option := range options {
+		option(server)
 	}
+
+	return server
+}
+
+// tenant returns the stores of the tenant of the request
+func (s *LaptopServer) tenant(ctx context.Context) (*Tenant, error) {
+	return findTenant(ctx, s.tenants, &Tenant{
+		ID:           DefaultTenant,
+		LaptopStore:  s.laptopStore,
+		ImageStore:   s.imageStore,
+		RatingStore:  s.ratingStore,
+		HistoryStore: s.historyStore,
+		EventBus:     s.eventBus,
+	})
 }
 
+// CreateLaptop is a unary RPC to create a new laptop
 func (s *LaptopServer) CreateLaptop(ctx context.Context, req *pb.CreateLaptopRequest) (*pb.CreateLaptopResponse, error) {
+	res, err := s.idempotent(ctx, "CreateLaptop", fingerprint(req), func() (proto.Message, error) {
+		res, err := s.createLaptop(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(*pb.CreateLaptopResponse), nil
+}
+
+func (s *LaptopServer) createLaptop(ctx context.Context, req *pb.CreateLaptopRequest) (*pb.CreateLaptopResponse, error) {
 	laptop := req.GetLaptop()
 	log.Printf("receive a create-laptop request with id: %s", laptop.Id)
 
-	if len(laptop.Id) > 0 {
-		// check if it's a valid UUID
-		_, err := uuid.Parse(laptop.Id)
-		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, "laptop ID is not a valid UUID: %v", err)
-		}
-	} else {
-		id, err := uuid.NewRandom()
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "cannot generate a new laptop ID: %v", err)
-		}
-		laptop.Id = id.String()
+	err := prepareLaptop(laptop)
+	if err == nil {
+		err = s.convertPrice(laptop)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	// some heavy processing
 	// time.Sleep(6 * time.Second)
 
-	if ctx.Err() == context.Canceled {
-		log.Printf("request is canceled")
-		return nil, status.Error(codes.Canceled, "request is canceled")
+	if err := contextError(ctx); err != nil {
+		return nil, err
 	}
 
-	if ctx.Err() == context.DeadlineExceeded {
-		log.Printf("deadline is exceeded")
-		return nil, status.Error(codes.DeadlineExceeded, "deadline is exceeded")
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	// save the laptop to in-memory store
-	err := s.laptopStore.Save(laptop)
+	err = tenant.saveLaptop(ctx, laptop)
 	if err != nil {
-		code := codes.Internal
-		if errors.Is(err, ErrAlreadyExists) {
-			code = codes.AlreadyExists
-		}
-		return nil, status.Errorf(code, "cannot save laptop to the store: %v", err)
+		return nil, laptopSaveError(ctx, laptop.Id, err)
 	}
 
 	log.Printf("save laptop with id: %s", laptop.Id)
@@ -82,18 +182,562 @@ func (s *LaptopServer) CreateLaptop(ctx context.Context, req *pb.CreateLaptopReq
 	return res, nil
 }
 
+// prepareLaptop validates the laptop of a create request and assigns it a new ID if it has none
+func prepareLaptop(laptop *pb.Laptop) error {
+	var violations FieldViolations
+	ValidateLaptop(&violations, "laptop", laptop)
+	if err := violations.Err(); err != nil {
+		return err
+	}
+
+	// the images are uploaded separately
+	laptop.Images = nil
+
+	if len(laptop.Id) == 0 {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return internalError("cannot generate a new laptop ID", err)
+		}
+		laptop.Id = id.String()
+	}
+
+	return nil
+}
+
+// convertPrice sets the USD price of the laptop from its price, if it has one
+func (s *LaptopServer) convertPrice(laptop *pb.Laptop) error {
+	if laptop.GetPrice() == nil {
+		return nil
+	}
+
+	priceUSD, err := toUSD(s.exchangeRates, laptop.GetPrice())
+	if err != nil {
+		return s.currencyError("laptop.price.currency_code", err)
+	}
+
+	laptop.PriceUsd = math.Round(priceUSD*100) / 100
+	return nil
+}
+
+// usdFilter returns the filter with its max price in USD, combined with its max USD price
+func (s *LaptopServer) usdFilter(field string, filter *pb.Filter) (*pb.Filter, error) {
+	if filter.GetMaxPrice() == nil {
+		return filter, nil
+	}
+
+	var violations FieldViolations
+	validateMoney(&violations, fieldPath(field, "max_price"), filter.GetMaxPrice())
+	if err := violations.Err(); err != nil {
+		return nil, err
+	}
+
+	maxPriceUSD, err := toUSD(s.exchangeRates, filter.GetMaxPrice())
+	if err != nil {
+		return nil, s.currencyError(fieldPath(field, "max_price.currency_code"), err)
+	}
+
+	filter = proto.Clone(filter).(*pb.Filter)
+	if filter.MaxPriceUsd == 0 || maxPriceUSD < filter.MaxPriceUsd {
+		filter.MaxPriceUsd = maxPriceUSD
+	}
+
+	return filter, nil
+}
+
+// currencyError returns the error of a currency field with no exchange rate
+func (s *LaptopServer) currencyError(field string, err error) error {
+	if errors.Is(err, ErrUnsupportedCurrency) {
+		var violations FieldViolations
+		violations.Add(field, "is not a supported currency")
+		return violations.Err()
+	}
+	return internalError("cannot get exchange rate", err)
+}
+
+// BulkCreateLaptops is a client-streaming RPC to create many laptops.
+// Invalid laptops don't stop the import: every laptop gets its own result.
+func (s *LaptopServer) BulkCreateLaptops(stream pb.LaptopService_BulkCreateLaptopsServer) error {
+	tenant, err := s.tenant(stream.Context())
+	if err != nil {
+		return logError(err)
+	}
+
+	res := &pb.BulkCreateLaptopsResponse{}
+	batch := make([]*pb.Laptop, 0, bulkCreateBatchSize)
+	batchResults := make([]*pb.BulkCreateLaptopResult, 0, bulkCreateBatchSize)
+
+	saveBatch := func() {
+		errs := tenant.saveLaptops(stream.Context(), batch)
+		for i, err := range errs {
+			if err != nil {
+				setBulkCreateError(batchResults[i], laptopSaveError(stream.Context(), batch[i].Id, err))
+			}
+		}
+
+		batch = batch[:0]
+		batchResults = batchResults[:0]
+	}
+
+	for index := uint32(0); ; index++ {
+		err := contextError(stream.Context())
+		if err != nil {
+			return err
+		}
+
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return logError(streamError(stream.Context(), "cannot receive stream request", err))
+		}
+
+		laptop := req.GetLaptop()
+		result := &pb.BulkCreateLaptopResult{Index: index}
+		res.Results = append(res.Results, result)
+
+		err = prepareLaptop(laptop)
+		if err == nil {
+			err = s.convertPrice(laptop)
+		}
+		if err != nil {
+			setBulkCreateError(result, err)
+			continue
+		}
+
+		result.Id = laptop.GetId()
+		batch = append(batch, laptop)
+		batchResults = append(batchResults, result)
+		if len(batch) == bulkCreateBatchSize {
+			saveBatch()
+		}
+	}
+
+	if len(batch) > 0 {
+		saveBatch()
+	}
+
+	// the request may be done while the last batch is saved
+	if err := contextError(stream.Context()); err != nil {
+		return err
+	}
+
+	for _, result := range res.Results {
+		if result.GetCode() == uint32(codes.OK) {
+			res.CreatedCount++
+		} else {
+			res.FailedCount++
+		}
+	}
+
+	log.Printf("bulk created %d laptops, %d failed", res.CreatedCount, res.FailedCount)
+
+	err = stream.SendAndClose(res)
+	if err != nil {
+		return logError(streamError(stream.Context(), "cannot send response", err))
+	}
+
+	return nil
+}
+
+func setBulkCreateError(result *pb.BulkCreateLaptopResult, err error) {
+	st := status.Convert(err)
+	result.Code = uint32(st.Code())
+	result.Message = st.Message()
+}
+
+// UpdateLaptop is a unary RPC to replace a laptop
+func (s *LaptopServer) UpdateLaptop(ctx context.Context, req *pb.UpdateLaptopRequest) (*pb.UpdateLaptopResponse, error) {
+	laptop := req.GetLaptop()
+	log.Printf("receive an update-laptop request with id: %s", laptop.GetId())
+
+	var violations FieldViolations
+	ValidateLaptop(&violations, "laptop", laptop)
+	if laptop != nil && laptop.GetId() == "" {
+		violations.Add("laptop.id", "is required")
+	}
+	if err := violations.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.convertPrice(laptop); err != nil {
+		return nil, err
+	}
+
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := tenant.LaptopStore.Find(ctx, laptop.Id)
+	if err != nil {
+		return nil, storeError(ctx, "cannot find laptop", err)
+	}
+	if previous == nil {
+		return nil, laptopNotFoundError(laptop.Id)
+	}
+
+	laptop.UpdatedAt = timestamppb.Now()
+	laptop.Images = nil
+	err = tenant.LaptopStore.Update(ctx, laptop)
+	if errors.Is(err, ErrNotFound) {
+		return nil, laptopNotFoundError(laptop.Id)
+	}
+	if err != nil {
+		return nil, storeError(ctx, "cannot update laptop in the store", err)
+	}
+
+	log.Printf("updated laptop with id: %s", laptop.Id)
+	tenant.recordVersion(ctx, pb.LaptopVersion_UPDATED, laptop, laptop.UpdatedAt)
+
+	if err := tenant.withImages(ctx, laptop); err != nil {
+		return nil, storeError(ctx, "cannot list laptop images", err)
+	}
+	tenant.publish(&pb.LaptopEvent{
+		Type:           pb.LaptopEvent_UPDATED,
+		LaptopId:       laptop.Id,
+		Laptop:         laptop,
+		PreviousLaptop: previous,
+	})
+
+	return &pb.UpdateLaptopResponse{Laptop: laptop}, nil
+}
+
+// DeleteLaptop is a unary RPC to delete a laptop by ID
+func (s *LaptopServer) DeleteLaptop(ctx context.Context, req *pb.DeleteLaptopRequest) (*pb.DeleteLaptopResponse, error) {
+	laptopID := req.GetId()
+	log.Printf("receive a delete-laptop request with id: %s", laptopID)
+
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	laptop, err := tenant.LaptopStore.Find(ctx, laptopID)
+	if err != nil {
+		return nil, storeError(ctx, "cannot find laptop", err)
+	}
+	if laptop == nil {
+		return nil, laptopNotFoundError(laptopID)
+	}
+
+	err = tenant.LaptopStore.Delete(ctx, laptopID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, laptopNotFoundError(laptopID)
+	}
+	if err != nil {
+		return nil, storeError(ctx, "cannot delete laptop from the store", err)
+	}
+
+	log.Printf("deleted laptop with id: %s", laptopID)
+	tenant.recordVersion(ctx, pb.LaptopVersion_DELETED, laptop, timestamppb.Now())
+
+	// the images are kept so that restoring the laptop brings them back,
+	// the image collector deletes them once the laptop cannot be restored anymore
+	tenant.publish(&pb.LaptopEvent{Type: pb.LaptopEvent_DELETED, LaptopId: laptopID, Laptop: laptop})
+
+	return &pb.DeleteLaptopResponse{}, nil
+}
+
+// RestoreLaptop is a unary RPC to restore a deleted laptop as it was before it was deleted,
+// with the images it had unless they have been collected since
+func (s *LaptopServer) RestoreLaptop(ctx context.Context, req *pb.RestoreLaptopRequest) (*pb.RestoreLaptopResponse, error) {
+	laptopID := req.GetId()
+	log.Printf("receive a restore-laptop request with id: %s", laptopID)
+
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := tenant.HistoryStore.List(ctx, laptopID)
+	if err != nil {
+		return nil, storeError(ctx, "cannot list laptop versions", err)
+	}
+	if len(versions) == 0 {
+		return nil, laptopNotFoundError(laptopID)
+	}
+
+	last := versions[len(versions)-1]
+	if last.GetChange() != pb.LaptopVersion_DELETED {
+		return nil, detailedError(
+			codes.FailedPrecondition,
+			ReasonLaptopNotDeleted,
+			map[string]string{"laptop_id": laptopID},
+			fmt.Sprintf("laptop %s is not deleted", laptopID),
+			resourceInfo(ResourceTypeLaptop, laptopID, "laptop is not deleted"),
+		)
+	}
+
+	laptop := last.GetLaptop()
+	laptop.UpdatedAt = timestamppb.Now()
+	err = tenant.LaptopStore.Save(ctx, laptop)
+	if err != nil {
+		return nil, laptopSaveError(ctx, laptop.Id, err)
+	}
+
+	log.Printf("restored laptop with id: %s", laptopID)
+	tenant.recordVersion(ctx, pb.LaptopVersion_RESTORED, laptop, laptop.UpdatedAt)
+
+	if err := tenant.withImages(ctx, laptop); err != nil {
+		return nil, storeError(ctx, "cannot list laptop images", err)
+	}
+	tenant.publish(&pb.LaptopEvent{Type: pb.LaptopEvent_CREATED, LaptopId: laptopID, Laptop: laptop})
+
+	return &pb.RestoreLaptopResponse{Laptop: laptop}, nil
+}
+
+// GetLaptopHistory is a unary RPC to get the versions of a laptop,
+// with the fields changed by every version
+func (s *LaptopServer) GetLaptopHistory(ctx context.Context, req *pb.GetLaptopHistoryRequest) (*pb.GetLaptopHistoryResponse, error) {
+	laptopID := req.GetId()
+	log.Printf("receive a get-laptop-history request with id: %s", laptopID)
+
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := tenant.HistoryStore.List(ctx, laptopID)
+	if err != nil {
+		return nil, storeError(ctx, "cannot list laptop versions", err)
+	}
+
+	if len(versions) == 0 {
+		// laptops saved before their history was recorded have none
+		laptop, err := tenant.LaptopStore.Find(ctx, laptopID)
+		if err != nil {
+			return nil, storeError(ctx, "cannot find laptop", err)
+		}
+		if laptop == nil {
+			return nil, laptopNotFoundError(laptopID)
+		}
+	}
+
+	for i := 1; i < len(versions); i++ {
+		diffs, err := diffLaptops(versions[i-1].GetLaptop(), versions[i].GetLaptop())
+		if err != nil {
+			return nil, internalError("cannot compare laptop versions", err)
+		}
+		versions[i].Diffs = diffs
+	}
+
+	return &pb.GetLaptopHistoryResponse{Versions: versions}, nil
+}
+
+// recordVersion adds a version of the laptop to the history of the tenant, made by the user of the request.
+// The change is already saved, so a failure is only logged.
+func (tenant *Tenant) recordVersion(
+	ctx context.Context,
+	change pb.LaptopVersion_Change,
+	laptop *pb.Laptop,
+	at *timestamppb.Timestamp,
+) {
+	if tenant.HistoryStore == nil {
+		return
+	}
+
+	actor := ""
+	if claims := ClaimsFromContext(ctx); claims != nil {
+		actor = claims.Username
+	}
+
+	_, err := tenant.HistoryStore.Add(ctx, &pb.LaptopVersion{
+		Change: change,
+		Laptop: laptop,
+		Actor:  actor,
+		Time:   at,
+	})
+	if err != nil {
+		log.Printf("cannot record version of laptop %s: %v", laptop.GetId(), err)
+	}
+}
+
+// WatchLaptops is a server-streaming RPC to receive the events of the laptops that match a filter.
+// The initial snapshot may include laptops that are also reported by the first live events.
+// A watcher that doesn't receive its events fast enough is disconnected with ResourceExhausted.
+func (s *LaptopServer) WatchLaptops(req *pb.WatchLaptopsRequest, stream pb.LaptopService_WatchLaptopsServer) error {
+	filter, err := s.usdFilter("filter", req.GetFilter())
+	if err != nil {
+		return err
+	}
+	log.Printf("receive a watch-laptops request with filter: %v", filter)
+
+	tenant, err := s.tenant(stream.Context())
+	if err != nil {
+		return logError(err)
+	}
+
+	if tenant.EventBus == nil {
+		return logError(detailedError(codes.Unimplemented, ReasonEventsDisabled, nil, "laptop events are not enabled"))
+	}
+
+	// subscribe before the snapshot, so no event is lost in between
+	subscription := tenant.EventBus.Subscribe()
+	defer subscription.Close()
+
+	if req.GetInitialSnapshot() {
+		err := sendSnapshot(tenant, filter, stream)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			log.Printf("stop watching laptops: %v", stream.Context().Err())
+			return contextError(stream.Context())
+
+		case event, ok := <-subscription.Events():
+			if !ok {
+				if errors.Is(subscription.Err(), ErrSlowSubscriber) {
+					return logError(detailedError(
+						codes.ResourceExhausted,
+						ReasonWatcherTooSlow,
+						nil,
+						fmt.Sprintf("watcher is disconnected: %v", ErrSlowSubscriber),
+						retryInfo(retryDelay),
+					))
+				}
+				return logError(detailedError(codes.Unavailable, ReasonEventsClosed, nil, "laptop events are closed", retryInfo(retryDelay)))
+			}
+
+			if !isWatched(filter, event) {
+				continue
+			}
+
+			err := stream.Send(&pb.WatchLaptopsResponse{Data: &pb.WatchLaptopsResponse_Event{Event: event}})
+			if err != nil {
+				return logError(streamError(stream.Context(), "cannot send event", err))
+			}
+		}
+	}
+}
+
+// sendSnapshot sends the laptops of the tenant that match the filter, then the end of the snapshot
+func sendSnapshot(tenant *Tenant, filter *pb.Filter, stream pb.LaptopService_WatchLaptopsServer) error {
+	if filter == nil {
+		filter = &pb.Filter{MaxPriceUsd: math.MaxFloat64}
+	}
+
+	err := tenant.LaptopStore.Search(stream.Context(), filter, func(laptop *pb.Laptop) error {
+		if err := tenant.withImages(stream.Context(), laptop); err != nil {
+			return err
+		}
+		return stream.Send(&pb.WatchLaptopsResponse{Data: &pb.WatchLaptopsResponse_SnapshotLaptop{SnapshotLaptop: laptop}})
+	})
+	if err == nil {
+		err = stream.Send(&pb.WatchLaptopsResponse{Data: &pb.WatchLaptopsResponse_SnapshotComplete{SnapshotComplete: true}})
+	}
+	if err != nil {
+		return logError(storeError(stream.Context(), "cannot send snapshot", err))
+	}
+
+	return nil
+}
+
+// isWatched tells whether the event concerns a laptop that matches the filter, before or after the event.
+// Every event is watched without a filter.
+func isWatched(filter *pb.Filter, event *pb.LaptopEvent) bool {
+	if filter == nil {
+		return true
+	}
+	if event.GetLaptop() != nil && isQualified(filter, event.GetLaptop()) {
+		return true
+	}
+	return event.GetPreviousLaptop() != nil && isQualified(filter, event.GetPreviousLaptop())
+}
+
+// saveLaptop saves a new laptop to the store of the tenant, and records and publishes its creation
+func (tenant *Tenant) saveLaptop(ctx context.Context, laptop *pb.Laptop) error {
+	err := tenant.LaptopStore.Save(ctx, laptop)
+	if err != nil {
+		return err
+	}
+
+	tenant.created(ctx, laptop)
+	return nil
+}
+
+// saveLaptops saves new laptops to the store of the tenant, and records and publishes the creation
+// of those that are saved. It returns the error of every laptop, like SaveBatch.
+func (tenant *Tenant) saveLaptops(ctx context.Context, laptops []*pb.Laptop) []error {
+	errs := tenant.LaptopStore.SaveBatch(ctx, laptops)
+	for i, err := range errs {
+		if err == nil {
+			tenant.created(ctx, laptops[i])
+		}
+	}
+
+	return errs
+}
+
+// created records the first version of a new laptop and publishes its creation
+func (tenant *Tenant) created(ctx context.Context, laptop *pb.Laptop) {
+	tenant.recordVersion(ctx, pb.LaptopVersion_CREATED, laptop, timestamppb.Now())
+	tenant.publish(&pb.LaptopEvent{Type: pb.LaptopEvent_CREATED, LaptopId: laptop.Id, Laptop: laptop})
+}
+
+// publish sends the event to the laptop watchers of the tenant
+func (tenant *Tenant) publish(event *pb.LaptopEvent) {
+	if tenant.EventBus != nil {
+		tenant.EventBus.Publish(event)
+	}
+}
+
 // SearchLaptop is a server-streaming RPC to search for laptops
 func (s *LaptopServer) SearchLaptop(req *pb.SearchLaptopRequest, stream pb.LaptopService_SearchLaptopServer) error {
-	filter := req.GetFilter()
+	filter, err := s.usdFilter("filter", req.GetFilter())
+	if err != nil {
+		return err
+	}
 	log.Printf("receive a search-laptop request with filter: %v", filter)
 
-	err := s.laptopStore.Search(
+	currency := req.GetCurrencyCode()
+	if currency != "" {
+		if _, err := s.exchangeRates.USDRate(currency); err != nil {
+			return s.currencyError("currency_code", err)
+		}
+	}
+
+	tenant, err := s.tenant(stream.Context())
+	if err != nil {
+		return logError(err)
+	}
+
+	err = tenant.LaptopStore.Search(
 		stream.Context(),
 		filter,
 		func(laptop *pb.Laptop) error {
+			if err := tenant.withImages(stream.Context(), laptop); err != nil {
+				return err
+			}
+
 			res := &pb.SearchLaptopResponse{
 				Laptop: laptop,
 			}
+
+			if currency != "" {
+				price, err := ConvertMoney(s.exchangeRates, laptopPrice(laptop), currency)
+				if err != nil {
+					return err
+				}
+				res.ConvertedPrice = price
+			}
+
 			err := stream.Send(res)
 
 			if err != nil {
@@ -106,29 +750,154 @@ func (s *LaptopServer) SearchLaptop(req *pb.SearchLaptopRequest, stream pb.Lapto
 	)
 
 	if err != nil {
-		return status.Errorf(codes.Internal, "unexpected error: %v", err)
+		return logError(storeError(stream.Context(), "cannot search laptops", err))
 	}
 
 	return nil
 }
 
+// laptopPrice returns the price of the laptop, in USD if it only has a USD price
+func laptopPrice(laptop *pb.Laptop) *pb.Money {
+	if laptop.GetPrice() != nil {
+		return laptop.GetPrice()
+	}
+	return NewMoney(USD, laptop.GetPriceUsd())
+}
+
+// SearchFacets is a unary RPC to count the laptops that match a filter by brand, CPU brand,
+// RAM bucket, price bucket, screen panel and release year. A request without a filter counts every laptop.
+func (s *LaptopServer) SearchFacets(ctx context.Context, req *pb.SearchFacetsRequest) (*pb.SearchFacetsResponse, error) {
+	filter := req.GetFilter()
+	log.Printf("receive a search-facets request with filter: %v", filter)
+
+	buckets := s.facetBuckets
+	if len(req.GetPriceBoundariesUsd()) > 0 {
+		buckets.PriceUSD = req.GetPriceBoundariesUsd()
+	}
+	if len(req.GetRamBoundariesGb()) > 0 {
+		buckets.RAMGB = req.GetRamBoundariesGb()
+	}
+
+	var violations FieldViolations
+	ValidateFacetBuckets(&violations, buckets)
+	if err := violations.Err(); err != nil {
+		return nil, err
+	}
+
+	if filter == nil {
+		filter = &pb.Filter{MaxPriceUsd: math.MaxFloat64}
+	}
+	filter, err := s.usdFilter("filter", filter)
+	if err != nil {
+		return nil, err
+	}
+
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := ComputeFacets(ctx, tenant.LaptopStore, filter, buckets)
+	if err != nil {
+		return nil, logError(storeError(ctx, "cannot compute facets", err))
+	}
+
+	return res, nil
+}
+
+// GetLaptop is a unary RPC to get a laptop by ID
+func (s *LaptopServer) GetLaptop(ctx context.Context, req *pb.GetLaptopRequest) (*pb.GetLaptopResponse, error) {
+	laptopID := req.GetId()
+	log.Printf("receive a get-laptop request with id: %s", laptopID)
+
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetAsOf() != nil {
+		return getLaptopAsOf(ctx, tenant, laptopID, req.GetAsOf())
+	}
+
+	laptop, err := tenant.LaptopStore.Find(ctx, laptopID)
+	if err != nil {
+		return nil, storeError(ctx, "cannot find laptop", err)
+	}
+
+	if laptop == nil {
+		return nil, laptopNotFoundError(laptopID)
+	}
+
+	if err := tenant.withImages(ctx, laptop); err != nil {
+		return nil, storeError(ctx, "cannot list laptop images", err)
+	}
+
+	res := &pb.GetLaptopResponse{
+		Laptop: laptop,
+	}
+
+	return res, nil
+}
+
+// getLaptopAsOf returns the version of the laptop at the time.
+// Only admins can read past versions, as they do with the history of the laptop.
+func getLaptopAsOf(ctx context.Context, tenant *Tenant, laptopID string, asOf *timestamppb.Timestamp) (*pb.GetLaptopResponse, error) {
+	if claims := ClaimsFromContext(ctx); claims == nil || claims.Role != RoleAdmin {
+		return nil, detailedError(
+			codes.PermissionDenied,
+			ReasonPermissionDenied,
+			map[string]string{"laptop_id": laptopID, "field": "as_of", "role": claims.GetRole()},
+			"no permission to get past versions of a laptop",
+		)
+	}
+
+	if err := asOf.CheckValid(); err != nil {
+		var violations FieldViolations
+		violations.Add("as_of", err.Error())
+		return nil, violations.Err()
+	}
+
+	versions, err := tenant.HistoryStore.List(ctx, laptopID)
+	if err != nil {
+		return nil, storeError(ctx, "cannot list laptop versions", err)
+	}
+
+	laptop := laptopAsOf(versions, asOf.AsTime())
+	if laptop == nil {
+		return nil, detailedError(
+			codes.NotFound,
+			ReasonLaptopNotFound,
+			map[string]string{"laptop_id": laptopID, "as_of": asOf.AsTime().Format(time.RFC3339)},
+			fmt.Sprintf("laptop %s doesn't exist at %s", laptopID, asOf.AsTime().Format(time.RFC3339)),
+			resourceInfo(ResourceTypeLaptop, laptopID, "laptop doesn't exist at this time"),
+		)
+	}
+
+	return &pb.GetLaptopResponse{Laptop: laptop}, nil
+}
+
 func (s *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) error {
 	req, err := stream.Recv()
 	if err != nil {
-		return logError(status.Errorf(codes.Unknown, "cannot receive image info"))
+		return logError(streamError(stream.Context(), "cannot receive image info", err))
 	}
 
 	laptopID := req.GetInfo().GetLaptopId()
 	imageType := req.GetInfo().GetImageTypes()
 	log.Printf("receive an unload-image request for laptop %s with image type %s", laptopID, imageType)
 
-	laptop, err := s.laptopStore.Find(laptopID)
+	tenant, err := s.tenant(stream.Context())
 	if err != nil {
-		return logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+		return logError(err)
+	}
+
+	laptop, err := tenant.LaptopStore.Find(stream.Context(), laptopID)
+	if err != nil {
+		return logError(storeError(stream.Context(), "cannot find laptop", err))
 	}
 
 	if laptop == nil {
-		return logError(status.Errorf(codes.AlreadyExists, "laptop %s doesn't exist", laptopID))
+		return logError(laptopNotFoundError(laptopID))
 	}
 
 	imageData := bytes.Buffer{}
@@ -149,7 +918,7 @@ func (s *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) er
 		}
 
 		if err != nil {
-			return logError(status.Errorf(codes.Unknown, "cannot receive chunk data: %v", err))
+			return logError(streamError(stream.Context(), "cannot receive chunk data", err))
 		}
 
 		chunk := req.GetChunkData()
@@ -159,7 +928,16 @@ func (s *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) er
 
 		imageSize += size
 		if imageSize > maxImageSize {
-			return logError(status.Errorf(codes.InvalidArgument, "image is too large: %d > %d", imageSize, maxImageSize))
+			return logError(detailedError(
+				codes.InvalidArgument,
+				ReasonImageTooLarge,
+				map[string]string{"max_size": fmt.Sprint(maxImageSize)},
+				fmt.Sprintf("image is too large: %d > %d", imageSize, maxImageSize),
+				&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+					Field:       "chunk_data",
+					Description: fmt.Sprintf("image must not be larger than %d bytes", maxImageSize),
+				}}},
+			))
 		}
 
 		// write slow
@@ -167,30 +945,242 @@ func (s *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) er
 
 		_, err = imageData.Write(chunk)
 		if err != nil {
-			return logError(status.Errorf(codes.Internal, "cannot write chunk data: %v", err))
+			return logError(internalError("cannot write chunk data", err))
 		}
 	}
 
-	imageID, err := s.imageStore.Save(laptopID, imageType, imageData)
+	imageFingerprint := fingerprint(req.GetInfo())
+	imageFingerprint = append(imageFingerprint, fingerprintBytes(imageData.Bytes())...)
+
+	res, err := s.idempotent(stream.Context(), "UploadImage", imageFingerprint, func() (proto.Message, error) {
+		imageID, deduplicated, err := tenant.ImageStore.Save(stream.Context(), laptopID, imageType, imageData)
+		if err != nil {
+			return nil, storeError(stream.Context(), "cannot save image to the store", err)
+		}
+		_, err = tenant.galleryChanged(stream.Context(), laptop, &pb.LaptopEvent{Type: pb.LaptopEvent_IMAGE_ADDED, ImageId: imageID})
+		if err != nil {
+			// the image is saved, so a failure to publish its event is only logged
+			log.Print(err)
+		}
+
+		res := &pb.UploadImageResponse{
+			Id:           imageID,
+			Size:         uint32(imageSize),
+			Deduplicated: deduplicated,
+		}
+		return res, nil
+	})
 	if err != nil {
-		return logError(status.Errorf(codes.Internal, "cannot save image to the store: %v", err))
+		return logError(err)
 	}
 
-	res := &pb.UploadImageResponse{
-		Id:   imageID,
-		Size: uint32(imageSize),
+	err = stream.SendAndClose(res.(*pb.UploadImageResponse))
+	if err != nil {
+		return logError(streamError(stream.Context(), "cannot send response", err))
 	}
 
-	err = stream.SendAndClose(res)
+	log.Printf(
+		"saved image with id: %s, size %d, deduplicated %t",
+		res.(*pb.UploadImageResponse).GetId(), imageSize, res.(*pb.UploadImageResponse).GetDeduplicated(),
+	)
+	return nil
+}
+
+// DeleteImage is a unary RPC to delete an image of a laptop
+func (s *LaptopServer) DeleteImage(ctx context.Context, req *pb.DeleteImageRequest) (*pb.DeleteImageResponse, error) {
+	laptopID := req.GetLaptopId()
+	imageID := req.GetImageId()
+	log.Printf("receive a delete-image request for laptop %s with image id: %s", laptopID, imageID)
+
+	var violations FieldViolations
+	if imageID == "" {
+		violations.Add("image_id", "is required")
+	}
+	if err := violations.Err(); err != nil {
+		return nil, err
+	}
+
+	tenant, laptop, err := s.galleryLaptop(ctx, laptopID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tenant.ImageStore.Delete(ctx, laptopID, imageID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, imageNotFoundError(laptopID, imageID)
+	}
+	if err != nil {
+		return nil, storeError(ctx, "cannot delete image from the store", err)
+	}
+
+	log.Printf("deleted image with id: %s", imageID)
+	images, err := tenant.galleryChanged(ctx, laptop, &pb.LaptopEvent{Type: pb.LaptopEvent_IMAGE_DELETED, ImageId: imageID})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.DeleteImageResponse{Images: images}, nil
+}
+
+// SetPrimaryImage is a unary RPC to move an image of a laptop to the front of its gallery
+func (s *LaptopServer) SetPrimaryImage(ctx context.Context, req *pb.SetPrimaryImageRequest) (*pb.SetPrimaryImageResponse, error) {
+	laptopID := req.GetLaptopId()
+	imageID := req.GetImageId()
+	log.Printf("receive a set-primary-image request for laptop %s with image id: %s", laptopID, imageID)
+
+	var violations FieldViolations
+	if imageID == "" {
+		violations.Add("image_id", "is required")
+	}
+	if err := violations.Err(); err != nil {
+		return nil, err
+	}
+
+	images, err := s.reorderImages(ctx, laptopID, []string{imageID})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.SetPrimaryImageResponse{Images: images}, nil
+}
+
+// ReorderImages is a unary RPC to put images of a laptop first in its gallery, in the order of the request
+func (s *LaptopServer) ReorderImages(ctx context.Context, req *pb.ReorderImagesRequest) (*pb.ReorderImagesResponse, error) {
+	laptopID := req.GetLaptopId()
+	imageIDs := req.GetImageIds()
+	log.Printf("receive a reorder-images request for laptop %s with image ids: %v", laptopID, imageIDs)
+
+	var violations FieldViolations
+	if len(imageIDs) == 0 {
+		violations.Add("image_ids", "is required")
+	}
+	listed := make(map[string]bool, len(imageIDs))
+	for i, imageID := range imageIDs {
+		field := fmt.Sprintf("image_ids[%d]", i)
+		switch {
+		case imageID == "":
+			violations.Add(field, "is required")
+		case listed[imageID]:
+			violations.Add(field, "is listed more than once")
+		}
+		listed[imageID] = true
+	}
+	if err := violations.Err(); err != nil {
+		return nil, err
+	}
+
+	images, err := s.reorderImages(ctx, laptopID, imageIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ReorderImagesResponse{Images: images}, nil
+}
+
+// reorderImages puts the images first in the gallery of the laptop and returns the images after the change
+func (s *LaptopServer) reorderImages(ctx context.Context, laptopID string, imageIDs []string) ([]*pb.LaptopImage, error) {
+	tenant, laptop, err := s.galleryLaptop(ctx, laptopID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tenant.ImageStore.Reorder(ctx, laptopID, imageIDs)
+	if errors.Is(err, ErrNotFound) {
+		// find the image to report, another request may delete it in the meantime
+		images, listErr := tenant.ImageStore.ListLaptop(ctx, laptopID)
+		if listErr != nil {
+			return nil, storeError(ctx, "cannot list laptop images", listErr)
+		}
+		return nil, imageNotFoundError(laptopID, missingImage(imageIDs, images))
+	}
+	if err != nil {
+		return nil, storeError(ctx, "cannot reorder images in the store", err)
+	}
+
+	log.Printf("reordered images of laptop with id: %s", laptopID)
+	return tenant.galleryChanged(ctx, laptop, &pb.LaptopEvent{Type: pb.LaptopEvent_IMAGES_REORDERED})
+}
+
+// missingImage returns the first image ID that is not one of the images
+func missingImage(imageIDs []string, images []*ImageInfo) string {
+	found := make(map[string]bool, len(images))
+	for _, info := range images {
+		found[info.ID] = true
+	}
+
+	for _, imageID := range imageIDs {
+		if !found[imageID] {
+			return imageID
+		}
+	}
+	return imageIDs[0]
+}
+
+// galleryLaptop returns the tenant of the request and its laptop whose gallery is changed
+func (s *LaptopServer) galleryLaptop(ctx context.Context, laptopID string) (*Tenant, *pb.Laptop, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	tenant, err := s.tenant(ctx)
 	if err != nil {
-		return logError(status.Errorf(codes.Unknown, "cannot send response: %v", err))
+		return nil, nil, err
 	}
 
-	log.Printf("saved image with id: %s, size %d", imageID, imageSize)
+	laptop, err := tenant.LaptopStore.Find(ctx, laptopID)
+	if err != nil {
+		return nil, nil, storeError(ctx, "cannot find laptop", err)
+	}
+	if laptop == nil {
+		return nil, nil, laptopNotFoundError(laptopID)
+	}
+
+	return tenant, laptop, nil
+}
+
+// galleryChanged publishes the event of a change of the gallery of the laptop, with the laptop and its images,
+// and returns the images
+func (tenant *Tenant) galleryChanged(ctx context.Context, laptop *pb.Laptop, event *pb.LaptopEvent) ([]*pb.LaptopImage, error) {
+	if err := tenant.withImages(ctx, laptop); err != nil {
+		return nil, storeError(ctx, "cannot list laptop images", err)
+	}
+
+	event.LaptopId = laptop.GetId()
+	event.Laptop = laptop
+	tenant.publish(event)
+
+	return laptop.GetImages(), nil
+}
+
+// withImages sets the images of the laptop from the image store of the tenant
+func (tenant *Tenant) withImages(ctx context.Context, laptop *pb.Laptop) error {
+	if tenant.ImageStore == nil {
+		return nil
+	}
+
+	images, err := tenant.ImageStore.ListLaptop(ctx, laptop.GetId())
+	if err != nil {
+		return err
+	}
+
+	laptop.Images = nil
+	for _, info := range images {
+		laptop.Images = append(laptop.Images, &pb.LaptopImage{
+			Id:    info.ID,
+			Type:  info.Type,
+			Size:  uint64(info.Size),
+			Order: uint32(info.Order),
+		})
+	}
 	return nil
 }
 
 func (server *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer) error {
+	tenant, err := server.tenant(stream.Context())
+	if err != nil {
+		return logError(err)
+	}
+
 	for {
 		err := contextError(stream.Context())
 		if err != nil {
@@ -204,7 +1194,7 @@ func (server *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer)
 		}
 
 		if err != nil {
-			return logError(status.Errorf(codes.Unknown, "cannot receive stream request: %v", err))
+			return logError(streamError(stream.Context(), "cannot receive stream request", err))
 		}
 
 		laptopID := req.GetLaptopId()
@@ -212,17 +1202,17 @@ func (server *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer)
 
 		log.Printf("received a rate-laptop request: id = %s, score = %2f", laptopID, score)
 
-		found, err := server.laptopStore.Find(laptopID)
+		found, err := tenant.LaptopStore.Find(stream.Context(), laptopID)
 		if err != nil {
-			return logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+			return logError(storeError(stream.Context(), "cannot find laptop", err))
 		}
 		if found == nil {
-			return logError(status.Errorf(codes.NotFound, "laptopID %s is not found", laptopID))
+			return logError(laptopNotFoundError(laptopID))
 		}
 
-		rating, err := server.ratingStore.Add(laptopID, score)
+		rating, err := tenant.RatingStore.Add(stream.Context(), laptopID, score)
 		if err != nil {
-			return logError(status.Errorf(codes.Internal, "cannot add rating to the store: %v", err))
+			return logError(storeError(stream.Context(), "cannot add rating to the store", err))
 		}
 
 		res := &pb.RateLaptopResponse{
@@ -230,25 +1220,107 @@ func (server *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer)
 			RatedCount:   rating.Count,
 			AverageScore: rating.Sum / float64(rating.Count),
 		}
+		tenant.publish(&pb.LaptopEvent{
+			Type:         pb.LaptopEvent_RATED,
+			LaptopId:     laptopID,
+			Laptop:       found,
+			RatedCount:   res.RatedCount,
+			AverageScore: res.AverageScore,
+		})
 
 		err = stream.Send(res)
 		if err != nil {
-			return logError(status.Errorf(codes.Unknown, "cannot send stream response: %v", err))
+			return logError(streamError(stream.Context(), "cannot send stream response", err))
 		}
 	}
 
 	return nil
 }
 
-func contextError(ctx context.Context) error {
-	switch ctx.Err() {
-	case context.Canceled:
-		return logError(status.Errorf(codes.Canceled, "request canceled"))
-	case context.Canceled:
-		return logError(status.Errorf(codes.DeadlineExceeded, "deadline is exceeded"))
-	default:
+// idempotent runs the request at most once per idempotency key of the user.
+// A replay of the request gets the response of the first one, and reusing
+// the key for a request with a different payload is rejected.
+// Requests without an idempotency key are always run.
+func (s *LaptopServer) idempotent(
+	ctx context.Context,
+	method string,
+	fingerprint []byte,
+	run func() (proto.Message, error),
+) (proto.Message, error) {
+	key := idempotencyKey(ctx, method)
+	if key == "" || s.idempotencyStore == nil {
+		return run()
+	}
+
+	saved, err := s.idempotencyStore.Begin(ctx, key, fingerprint)
+	switch {
+	case errors.Is(err, ErrIdempotencyKeyReused):
+		return nil, detailedError(
+			codes.InvalidArgument,
+			ReasonIdempotencyKeyReused,
+			nil,
+			err.Error(),
+			&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+				Field:       IdempotencyKeyHeader,
+				Description: "is already used by a request with a different payload",
+			}}},
+		)
+	case errors.Is(err, ErrIdempotencyKeyInProgress):
+		return nil, detailedError(codes.Aborted, ReasonIdempotencyKeyInProgress, nil, err.Error(), retryInfo(retryDelay))
+	case err != nil:
+		return nil, storeError(ctx, "cannot check idempotency key", err)
+	}
+
+	if saved != nil {
+		log.Printf("replay the %s response for idempotency key", method)
+		return saved, nil
+	}
+
+	res, err := run()
+	if err != nil {
+		if cancelErr := s.idempotencyStore.Cancel(ctx, key); cancelErr != nil {
+			log.Printf("cannot release idempotency key: %v", cancelErr)
+		}
+		return nil, err
+	}
+
+	err = s.idempotencyStore.Complete(ctx, key, res)
+	if err != nil {
+		log.Printf("cannot save response of idempotency key: %v", err)
+	}
+
+	return res, nil
+}
+
+// idempotencyKey returns the store key of the request idempotency key,
+// scoped by tenant, user and method, or an empty string if the request has none
+func idempotencyKey(ctx context.Context, method string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(IdempotencyKeyHeader)
+	if len(values) == 0 || values[0] == "" {
+		return ""
+	}
+
+	username := ""
+	if claims := ClaimsFromContext(ctx); claims != nil {
+		username = claims.Username
+	}
+
+	return strings.Join([]string{TenantFromContext(ctx), username, method, values[0]}, "\x00")
+}
+
+// fingerprint returns a hash of the message payload
+func fingerprint(message proto.Message) []byte {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(message)
+	if err != nil {
 		return nil
 	}
+	return fingerprintBytes(data)
+}
+
+func fingerprintBytes(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
 }
 
 func logError(err error) error {
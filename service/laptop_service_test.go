@@ -4,13 +4,16 @@ import (
 	"context"
 	"log"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/thewalkers2012/grpc-example/pb"
 	"github.com/thewalkers2012/grpc-example/sample"
 	"github.com/thewalkers2012/grpc-example/service"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestServerCreateLaptop(t *testing.T) {
@@ -24,7 +27,7 @@ func TestServerCreateLaptop(t *testing.T) {
 
 	laptopDuplicateID := sample.NewLaptop()
 	storeDuplicateID := service.NewInMemoryLaptopStore()
-	err := storeDuplicateID.Save(laptopDuplicateID)
+	err := storeDuplicateID.Save(context.Background(), laptopDuplicateID)
 	assert.Nil(t, err)
 
 	testCases := []struct {
@@ -88,3 +91,161 @@ func TestServerCreateLaptop(t *testing.T) {
 		})
 	}
 }
+
+func TestServerGetLaptop(t *testing.T) {
+	t.Parallel()
+
+	laptop := sample.NewLaptop()
+	store := service.NewInMemoryLaptopStore()
+	err := store.Save(context.Background(), laptop)
+	assert.NoError(t, err)
+
+	server := service.NewLaptopService(store, nil, nil)
+
+	res, err := server.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: laptop.Id})
+	assert.NoError(t, err)
+	requireSameLaptop(t, laptop, res.GetLaptop())
+
+	res, err = server.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: sample.NewLaptop().Id})
+	assert.Nil(t, res)
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.NotFound, st.Code())
+}
+
+func TestServerContextError(t *testing.T) {
+	t.Parallel()
+
+	laptop := sample.NewLaptop()
+	store := service.NewInMemoryLaptopStore()
+	assert.NoError(t, store.Save(context.Background(), laptop))
+	server := service.NewLaptopService(store, nil, nil)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := server.DeleteLaptop(canceled, &pb.DeleteLaptopRequest{Id: laptop.Id})
+	assert.Equal(t, codes.Canceled, status.Code(err))
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = server.DeleteLaptop(expired, &pb.DeleteLaptopRequest{Id: laptop.Id})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	found, err := store.Find(context.Background(), laptop.Id)
+	assert.NoError(t, err)
+	assert.NotNil(t, found)
+}
+
+func TestServerCreateLaptopIdempotency(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryLaptopStore()
+	server := service.NewLaptopService(store, nil, nil,
+		service.WithIdempotencyStore(service.NewInMemoryIdempotencyStore(time.Minute)))
+
+	withKey := func(key string) context.Context {
+		md := metadata.Pairs(service.IdempotencyKeyHeader, key)
+		return metadata.NewIncomingContext(context.Background(), md)
+	}
+
+	newRequest := func(laptop *pb.Laptop) *pb.CreateLaptopRequest {
+		return &pb.CreateLaptopRequest{Laptop: proto.Clone(laptop).(*pb.Laptop)}
+	}
+
+	// the server assigns the ID, so only the key can dedupe the replay
+	laptop := sample.NewLaptop()
+	laptop.Id = ""
+
+	res1, err := server.CreateLaptop(withKey("key-1"), newRequest(laptop))
+	assert.NoError(t, err)
+	res2, err := server.CreateLaptop(withKey("key-1"), newRequest(laptop))
+	assert.NoError(t, err)
+	assert.Equal(t, res1.Id, res2.Id)
+
+	// a new key creates a new laptop
+	res3, err := server.CreateLaptop(withKey("key-2"), newRequest(laptop))
+	assert.NoError(t, err)
+	assert.NotEqual(t, res1.Id, res3.Id)
+
+	// the same key with a different payload is rejected
+	other := sample.NewLaptop()
+	other.Id = ""
+	_, err = server.CreateLaptop(withKey("key-1"), newRequest(other))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// a failed request doesn't use up the key
+	invalid := sample.NewLaptop()
+	invalid.Id = "invalid-uuid"
+	_, err = server.CreateLaptop(withKey("key-3"), newRequest(invalid))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	invalid.Id = ""
+	_, err = server.CreateLaptop(withKey("key-3"), newRequest(invalid))
+	assert.NoError(t, err)
+}
+
+func TestIdempotencyStoreExpiry(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryIdempotencyStore(10 * time.Millisecond)
+	res := &pb.CreateLaptopResponse{Id: "laptop-id"}
+
+	saved, err := store.Begin(context.Background(), "key", []byte("payload"))
+	assert.NoError(t, err)
+	assert.Nil(t, saved)
+
+	_, err = store.Begin(context.Background(), "key", []byte("payload"))
+	assert.ErrorIs(t, err, service.ErrIdempotencyKeyInProgress)
+
+	assert.NoError(t, store.Complete(context.Background(), "key", res))
+
+	saved, err = store.Begin(context.Background(), "key", []byte("payload"))
+	assert.NoError(t, err)
+	assert.True(t, proto.Equal(res, saved))
+
+	time.Sleep(20 * time.Millisecond)
+
+	saved, err = store.Begin(context.Background(), "key", []byte("another payload"))
+	assert.NoError(t, err)
+	assert.Nil(t, saved)
+}
+
+func TestDiskIdempotencyStoreShared(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	folder := t.TempDir()
+	store1, err := service.NewDiskIdempotencyStore(folder, time.Minute)
+	assert.NoError(t, err)
+	store2, err := service.NewDiskIdempotencyStore(folder, time.Minute)
+	assert.NoError(t, err)
+	res := &pb.CreateLaptopResponse{Id: "laptop-id"}
+
+	// a request retried on another server waits for the first one, then gets its response
+	saved, err := store1.Begin(ctx, "key", []byte("payload"))
+	assert.NoError(t, err)
+	assert.Nil(t, saved)
+	_, err = store2.Begin(ctx, "key", []byte("payload"))
+	assert.ErrorIs(t, err, service.ErrIdempotencyKeyInProgress)
+
+	assert.NoError(t, store1.Complete(ctx, "key", res))
+	saved, err = store2.Begin(ctx, "key", []byte("payload"))
+	assert.NoError(t, err)
+	assert.True(t, proto.Equal(res, saved))
+	_, err = store2.Begin(ctx, "key", []byte("another payload"))
+	assert.ErrorIs(t, err, service.ErrIdempotencyKeyReused)
+
+	// a key released by a failed request can be used on another server
+	_, err = store2.Begin(ctx, "other-key", []byte("payload"))
+	assert.NoError(t, err)
+	assert.NoError(t, store2.Cancel(ctx, "other-key"))
+	saved, err = store1.Begin(ctx, "other-key", []byte("payload"))
+	assert.NoError(t, err)
+	assert.Nil(t, saved)
+
+	// the responses are found again after a restart
+	store3, err := service.NewDiskIdempotencyStore(folder, time.Minute)
+	assert.NoError(t, err)
+	saved, err = store3.Begin(ctx, "key", []byte("payload"))
+	assert.NoError(t, err)
+	assert.True(t, proto.Equal(res, saved))
+}
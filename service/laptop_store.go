@@ -5,28 +5,47 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"sync"
 
-	"github.com/jinzhu/copier"
 	"github.com/thewalkers2012/grpc-example/pb"
+	"google.golang.org/protobuf/proto"
 )
 
+// ErrAlreadyExists is returned when a record with the same ID already exists in the store
 var ErrAlreadyExists = errors.New("record already exists")
 
-// LaptopStore is an interface to store laptop
+// ErrNotFound is returned when a record doesn't exist in the store
+var ErrNotFound = errors.New("record not found")
+
+// LaptopStore is an interface to store laptop.
+// Long operations stop with the error of the context once it is done.
 type LaptopStore interface {
 	// Save saves the laptop to the store
-	Save(laptop *pb.Laptop) error
+	Save(ctx context.Context, laptop *pb.Laptop) error
+	// SaveBatch saves the laptops to the store, returns the error of each laptop in the same order
+	SaveBatch(ctx context.Context, laptops []*pb.Laptop) []error
+	// Update replaces the saved laptop with the same ID, returns ErrNotFound if there is none
+	Update(ctx context.Context, laptop *pb.Laptop) error
+	// Delete deletes the laptop by ID, returns ErrNotFound if it doesn't exist
+	Delete(ctx context.Context, id string) error
 	// Find finds a laptop by ID
-	Find(id string) (*pb.Laptop, error)
-	//
+	Find(ctx context.Context, id string) (*pb.Laptop, error)
+	// Search calls found with every laptop that matches the filter
 	Search(ctx context.Context, filter *pb.Filter, found func(laptop *pb.Laptop) error) error
 }
 
-// InMemoryLaptopStore stores laptop in memory
+// InMemoryLaptopStore stores laptop in memory.
+// Saved laptops are never changed in place, so they can be read after the lock is released.
 type InMemoryLaptopStore struct {
 	mutex sync.RWMutex
 	data  map[string]*pb.Laptop
+	// indexes of the filter values, to search without scanning every laptop
+	priceIndex *laptopIndex
+	coresIndex *laptopIndex
+	ghzIndex   *laptopIndex
+	ramIndex   *laptopIndex
+	textIndex  *laptopTextIndex
 }
 
 // type DBLaptopStore struct {
@@ -35,69 +54,227 @@ type InMemoryLaptopStore struct {
 // NewInMemoryLaptopStore returns a new InMemoryLaptopStore
 func NewInMemoryLaptopStore() *InMemoryLaptopStore {
 	return &InMemoryLaptopStore{
-		data: make(map[string]*pb.Laptop),
+		data:       make(map[string]*pb.Laptop),
+		priceIndex: newLaptopIndex(laptopPriceUSD),
+		coresIndex: newLaptopIndex(laptopCPUCores),
+		ghzIndex:   newLaptopIndex(laptopCPUGhz),
+		ramIndex:   newLaptopIndex(laptopRAM),
+		textIndex:  newLaptopTextIndex(),
 	}
 }
 
 // Save saves the laptop to the store
-func (store *InMemoryLaptopStore) Save(laptop *pb.Laptop) error {
+func (store *InMemoryLaptopStore) Save(ctx context.Context, laptop *pb.Laptop) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.save(laptop)
+}
+
+// SaveBatch saves the laptops to the store, returns the error of each laptop in the same order
+func (store *InMemoryLaptopStore) SaveBatch(ctx context.Context, laptops []*pb.Laptop) []error {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
+	errs := make([]error, len(laptops))
+	for i, laptop := range laptops {
+		errs[i] = store.save(laptop)
+	}
+
+	return errs
+}
+
+func (store *InMemoryLaptopStore) save(laptop *pb.Laptop) error {
 	if store.data[laptop.Id] != nil {
 		return ErrAlreadyExists
 	}
 
-	// deep copy
-	other, err := deepCopy(laptop)
-	if err != nil {
-		return err
+	store.put(laptop)
+	return nil
+}
+
+// Update replaces the saved laptop with the same ID, returns ErrNotFound if there is none
+func (store *InMemoryLaptopStore) Update(ctx context.Context, laptop *pb.Laptop) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.data[laptop.Id] == nil {
+		return ErrNotFound
 	}
 
-	store.data[other.Id] = other
+	store.put(laptop)
+	return nil
+}
+
+// Delete deletes the laptop by ID, returns ErrNotFound if it doesn't exist
+func (store *InMemoryLaptopStore) Delete(ctx context.Context, id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.remove(id)
+}
+
+// remove deletes the laptop by ID, returns ErrNotFound if it doesn't exist
+func (store *InMemoryLaptopStore) remove(id string) error {
+	laptop := store.data[id]
+	if laptop == nil {
+		return ErrNotFound
+	}
+
+	store.unindex(laptop)
+	delete(store.data, id)
 	return nil
 }
 
+// unset deletes the laptop by ID whether or not it exists
+func (store *InMemoryLaptopStore) unset(id string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.remove(id)
+}
+
+// set saves a copy of the laptop whether or not it exists
+func (store *InMemoryLaptopStore) set(laptop *pb.Laptop) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.put(laptop)
+}
+
+// put saves a copy of the laptop, replacing the laptop with the same ID
+func (store *InMemoryLaptopStore) put(laptop *pb.Laptop) {
+	other := cloneLaptop(laptop)
+	if previous := store.data[other.Id]; previous != nil {
+		store.unindex(previous)
+	}
+	store.data[other.Id] = other
+	store.index(other)
+}
+
+func (store *InMemoryLaptopStore) index(laptop *pb.Laptop) {
+	store.priceIndex.add(laptop)
+	store.coresIndex.add(laptop)
+	store.ghzIndex.add(laptop)
+	store.ramIndex.add(laptop)
+	store.textIndex.add(laptop)
+}
+
+func (store *InMemoryLaptopStore) unindex(laptop *pb.Laptop) {
+	store.priceIndex.remove(laptop)
+	store.coresIndex.remove(laptop)
+	store.ghzIndex.remove(laptop)
+	store.ramIndex.remove(laptop)
+	store.textIndex.remove(laptop)
+}
+
 // Find finds a laptop by ID
-func (store *InMemoryLaptopStore) Find(id string) (*pb.Laptop, error) {
+func (store *InMemoryLaptopStore) Find(ctx context.Context, id string) (*pb.Laptop, error) {
+	return store.get(id), nil
+}
+
+// get returns a copy of the laptop, or nil if it doesn't exist
+func (store *InMemoryLaptopStore) get(id string) *pb.Laptop {
 	store.mutex.RLock()
 	defer store.mutex.RUnlock()
 
 	laptop := store.data[id]
 	if laptop == nil {
-		return nil, nil
+		return nil
 	}
 
-	return deepCopy(laptop)
+	return cloneLaptop(laptop)
 }
 
+// Search searches for laptops with filter, returns one by one via the found function.
+// The store is not locked while found is called.
 func (store *InMemoryLaptopStore) Search(ctx context.Context, filter *pb.Filter, found func(laptop *pb.Laptop) error) error {
+	for _, laptop := range store.match(filter) {
+		if err := ctx.Err(); err != nil {
+			log.Print("context is cancelled")
+			return fmt.Errorf("search is stopped: %w", err)
+		}
+
+		err := found(cloneLaptop(laptop))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// match returns the saved laptops that match the filter, the most relevant first if it has a query.
+// Only the laptops in the smallest range of the indexes are checked.
+func (store *InMemoryLaptopStore) match(filter *pb.Filter) []*pb.Laptop {
 	store.mutex.RLock()
 	defer store.mutex.RUnlock()
 
-	for _, laptop := range store.data {
-		// heavy processing
-		// time.Sleep(time.Second)
-		// log.Print("checking laptop id:", laptop.GetId())
+	if len(tokenize(filter.GetQuery())) > 0 {
+		return store.matchText(filter)
+	}
+
+	candidates := store.priceIndex.atMost(filter.GetMaxPriceUsd())
+	ranges := []laptopIndexRange{
+		store.coresIndex.atLeast(float64(filter.GetMinCpuCores())),
+		store.ghzIndex.atLeast(filter.GetMinCpuGhz()),
+		store.ramIndex.atLeast(float64(toBit(filter.GetMinRam()))),
+	}
+	size := candidates.len()
+	for _, r := range ranges {
+		if n := r.len(); n < size {
+			candidates, size = r, n
+		}
+	}
 
-		if ctx.Err() == context.Canceled || ctx.Err() == context.DeadlineExceeded {
-			log.Print("context is cancled")
-			return errors.New("context is cancelled")
+	matches := make([]*pb.Laptop, 0, size)
+	candidates.each(func(id string) {
+		laptop := store.data[id]
+		if isQualified(filter, laptop) {
+			matches = append(matches, laptop)
 		}
+	})
+
+	sortLaptops(matches, filter.GetSortOrder())
+	return matches
+}
 
+// matchText returns the saved laptops that match the filter with a query, the most relevant first
+func (store *InMemoryLaptopStore) matchText(filter *pb.Filter) []*pb.Laptop {
+	scores := store.textIndex.search(filter.GetQuery())
+
+	matches := make([]*pb.Laptop, 0, len(scores))
+	for id := range scores {
+		laptop := store.data[id]
 		if isQualified(filter, laptop) {
-			other, err := deepCopy(laptop)
-			if err != nil {
-				return err
-			}
-			err = found(other)
-			if err != nil {
-				return err
-			}
+			matches = append(matches, laptop)
 		}
 	}
 
-	return nil
+	sort.Slice(matches, func(i, j int) bool {
+		score1, score2 := scores[matches[i].Id], scores[matches[j].Id]
+		if score1 != score2 {
+			return score1 > score2
+		}
+		return matches[i].Id < matches[j].Id
+	})
+
+	sortLaptops(matches, filter.GetSortOrder())
+	return matches
+}
+
+// sortLaptops sorts the laptops in the order of the filter, laptops with the same price keep their order
+func sortLaptops(laptops []*pb.Laptop, order pb.Filter_SortOrder) {
+	switch order {
+	case pb.Filter_PRICE_ASCENDING:
+		sort.SliceStable(laptops, func(i, j int) bool {
+			return laptops[i].GetPriceUsd() < laptops[j].GetPriceUsd()
+		})
+	case pb.Filter_PRICE_DESCENDING:
+		sort.SliceStable(laptops, func(i, j int) bool {
+			return laptops[i].GetPriceUsd() > laptops[j].GetPriceUsd()
+		})
+	}
 }
 
 func isQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
@@ -113,6 +290,9 @@ func isQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
 	if toBit(laptop.GetRam()) < toBit(filter.GetMinRam()) {
 		return false
 	}
+	if filter.GetQuery() != "" && !matchesQuery(filter.GetQuery(), laptop) {
+		return false
+	}
 	return true
 }
 
@@ -137,12 +317,7 @@ func toBit(memory *pb.Memory) uint64 {
 	}
 }
 
-func deepCopy(laptop *pb.Laptop) (*pb.Laptop, error) {
-	other := &pb.Laptop{}
-	err := copier.Copy(other, laptop)
-	if err != nil {
-		return nil, fmt.Errorf("cannot copy laptop data: %v", err)
-	}
-
-	return other, nil
+// cloneLaptop returns a deep copy of the laptop, so the stored laptops are never shared with callers
+func cloneLaptop(laptop *pb.Laptop) *pb.Laptop {
+	return proto.Clone(laptop).(*pb.Laptop)
 }
@@ -0,0 +1,298 @@
+package service_test
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestInMemoryLaptopStoreCopies(t *testing.T) {
+	t.Parallel()
+
+	kg := sample.NewLaptop()
+	kg.Weight = &pb.Laptop_WeightKg{WeightKg: 1.4}
+
+	lb := sample.NewLaptop()
+	lb.Weight = &pb.Laptop_WeightLg{WeightLg: 3.1}
+	lb.Gpus = append(lb.Gpus, sample.NewGPU(), sample.NewGPU())
+	lb.UpdatedAt = timestamppb.New(time.Date(2021, 11, 20, 8, 30, 0, 123, time.UTC))
+
+	empty := &pb.Laptop{Id: sample.NewLaptop().Id}
+
+	for _, laptop := range []*pb.Laptop{kg, lb, empty} {
+		store := service.NewInMemoryLaptopStore()
+		require.NoError(t, store.Save(context.Background(), laptop))
+
+		// oneof, repeated, nested and timestamp fields survive the round trip
+		found, err := store.Find(context.Background(), laptop.Id)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(laptop, found), "got %v", found)
+
+		var searched *pb.Laptop
+		err = store.Search(context.Background(), &pb.Filter{MaxPriceUsd: 1e6}, func(other *pb.Laptop) error {
+			searched = other
+			return nil
+		})
+		require.NoError(t, err)
+		require.True(t, proto.Equal(laptop, searched))
+
+		// changing the saved or the returned laptops doesn't change the stored one
+		original := proto.Clone(laptop)
+		laptop.Name = "changed"
+		if laptop.Cpu != nil {
+			laptop.Cpu.NumberCores++
+			found.Gpus[0].Name = "changed"
+			searched.Storage = nil
+		}
+
+		found, err = store.Find(context.Background(), laptop.Id)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(original, found))
+	}
+}
+
+func TestInMemoryLaptopStoreSearchIndexes(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryLaptopStore()
+	laptops := make(map[string]*pb.Laptop)
+	for i := 0; i < 500; i++ {
+		laptop := sample.NewLaptop()
+		require.NoError(t, store.Save(context.Background(), laptop))
+		laptops[laptop.Id] = laptop
+	}
+
+	// updated and deleted laptops are re-indexed
+	i := 0
+	for id, laptop := range laptops {
+		switch i % 3 {
+		case 0:
+			laptop.PriceUsd = float64(rand.Intn(3000))
+			laptop.Cpu.MaxGhz += 1
+			require.NoError(t, store.Update(context.Background(), laptop))
+		case 1:
+			require.NoError(t, store.Delete(context.Background(), id))
+			delete(laptops, id)
+		}
+		i++
+	}
+
+	filters := []*pb.Filter{
+		{MaxPriceUsd: 2000},
+		{MaxPriceUsd: 3000, MinCpuCores: 4},
+		{MaxPriceUsd: 3000, MinCpuGhz: 3.5},
+		{MaxPriceUsd: 3000, MinRam: &pb.Memory{Value: 32, Unit: pb.Memory_GIGABYTE}},
+		{MaxPriceUsd: 2500, MinCpuCores: 6, MinCpuGhz: 3.0, MinRam: &pb.Memory{Value: 8192, Unit: pb.Memory_MEGABYTE}},
+		{MaxPriceUsd: 0},
+	}
+
+	for _, filter := range filters {
+		var expected []string
+		for id, laptop := range laptops {
+			if isExpectedMatch(filter, laptop) {
+				expected = append(expected, id)
+			}
+		}
+
+		var found []string
+		err := store.Search(context.Background(), filter, func(laptop *pb.Laptop) error {
+			found = append(found, laptop.Id)
+			return nil
+		})
+		require.NoError(t, err)
+
+		sort.Strings(expected)
+		sort.Strings(found)
+		require.Equal(t, expected, found, "filter %v", filter)
+	}
+}
+
+func TestInMemoryLaptopStoreTextSearch(t *testing.T) {
+	t.Parallel()
+
+	newLaptop := func(brand string, name string, cpu string, gpu string) *pb.Laptop {
+		laptop := sample.NewLaptop()
+		laptop.Brand = brand
+		laptop.Name = name
+		laptop.Cpu.Name = cpu
+		laptop.Gpus[0].Name = gpu
+		laptop.PriceUsd = 2000
+		return laptop
+	}
+
+	thinkpad := newLaptop("Lenovo", "Thinkpad X1", "Core i7-9750H", "RTX 2060")
+	thinkpadAMD := newLaptop("Lenovo", "Thinkpad P53", "Ryzen 7 PRO 2700U", "RX 580")
+	xps := newLaptop("Dell", "XPS", "Core i7-9750H", "GTX 1660-Ti")
+	rtxBook := newLaptop("Acme", "Rtxbook", "Core i7-9750H", "GTX 1070")
+
+	store := service.NewInMemoryLaptopStore()
+	for _, laptop := range []*pb.Laptop{thinkpad, thinkpadAMD, xps, rtxBook} {
+		require.NoError(t, store.Save(context.Background(), laptop))
+	}
+
+	search := func(filter *pb.Filter) []string {
+		var ids []string
+		err := store.Search(context.Background(), filter, func(laptop *pb.Laptop) error {
+			ids = append(ids, laptop.Id)
+			return nil
+		})
+		require.NoError(t, err)
+		return ids
+	}
+
+	require.Equal(t, []string{thinkpad.Id}, search(&pb.Filter{MaxPriceUsd: 3000, Query: "thinkpad i7 rtx"}))
+	require.Equal(t, []string{thinkpad.Id}, search(&pb.Filter{MaxPriceUsd: 3000, Query: "THINK I7"}))
+	require.ElementsMatch(t, []string{thinkpad.Id, thinkpadAMD.Id}, search(&pb.Filter{MaxPriceUsd: 3000, Query: "lenovo"}))
+	require.Empty(t, search(&pb.Filter{MaxPriceUsd: 3000, Query: "thinkpad gtx"}))
+	require.Empty(t, search(&pb.Filter{MaxPriceUsd: 1000, Query: "thinkpad"}))
+
+	// a match in the name ranks above a match in the GPU, and a longer part of a word ranks above a shorter one
+	require.Equal(t, []string{rtxBook.Id, thinkpad.Id}, search(&pb.Filter{MaxPriceUsd: 3000, Query: "rtx"}))
+	require.Equal(t, []string{thinkpad.Id, xps.Id}, search(&pb.Filter{MaxPriceUsd: 3000, Query: "x"}))
+
+	// an explicit sort order replaces the relevance, which still orders the laptops with the same price
+	xps.PriceUsd = 1500
+	require.NoError(t, store.Update(context.Background(), xps))
+	require.Equal(t, []string{xps.Id, thinkpad.Id}, search(&pb.Filter{
+		MaxPriceUsd: 3000,
+		Query:       "x",
+		SortOrder:   pb.Filter_PRICE_ASCENDING,
+	}))
+	require.Equal(t, []string{rtxBook.Id, thinkpad.Id}, search(&pb.Filter{
+		MaxPriceUsd: 3000,
+		Query:       "rtx",
+		SortOrder:   pb.Filter_PRICE_DESCENDING,
+	}))
+
+	// the index follows the updates and deletes
+	thinkpad.Name = "Ideapad"
+	require.NoError(t, store.Update(context.Background(), thinkpad))
+	require.Equal(t, []string{thinkpadAMD.Id}, search(&pb.Filter{MaxPriceUsd: 3000, Query: "thinkpad"}))
+	require.Equal(t, []string{thinkpad.Id}, search(&pb.Filter{MaxPriceUsd: 3000, Query: "idea"}))
+
+	require.NoError(t, store.Delete(context.Background(), thinkpadAMD.Id))
+	require.Empty(t, search(&pb.Filter{MaxPriceUsd: 3000, Query: "thinkpad"}))
+	require.Empty(t, search(&pb.Filter{MaxPriceUsd: 3000, Query: "ryzen"}))
+}
+
+func TestInMemoryLaptopStoreSearchDoesNotBlockWriters(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryLaptopStore()
+	require.NoError(t, store.Save(context.Background(), sample.NewLaptop()))
+
+	err := store.Search(context.Background(), &pb.Filter{MaxPriceUsd: 1e6}, func(laptop *pb.Laptop) error {
+		// a writer would deadlock here if the store was still locked
+		return store.Save(context.Background(), sample.NewLaptop())
+	})
+	require.NoError(t, err)
+}
+
+// isExpectedMatch is a plain implementation of the search filter
+func isExpectedMatch(filter *pb.Filter, laptop *pb.Laptop) bool {
+	ramBits := func(memory *pb.Memory) uint64 {
+		shifts := map[pb.Memory_Unit]uint{
+			pb.Memory_BIT:      0,
+			pb.Memory_BYTE:     3,
+			pb.Memory_KILOBYTE: 13,
+			pb.Memory_MEGABYTE: 23,
+			pb.Memory_GIGABYTE: 33,
+			pb.Memory_TERABYTE: 43,
+		}
+		shift, ok := shifts[memory.GetUnit()]
+		if !ok {
+			return 0
+		}
+		return memory.GetValue() << shift
+	}
+
+	return laptop.GetPriceUsd() <= filter.GetMaxPriceUsd() &&
+		laptop.GetCpu().GetNumberCores() >= filter.GetMinCpuCores() &&
+		laptop.GetCpu().GetMaxGhz() >= filter.GetMinCpuGhz() &&
+		ramBits(laptop.GetRam()) >= ramBits(filter.GetMinRam())
+}
+
+const benchmarkLaptopCount = 100000
+
+func newBenchmarkLaptopStore(b *testing.B) *service.InMemoryLaptopStore {
+	b.Helper()
+
+	store := service.NewInMemoryLaptopStore()
+	for i := 0; i < benchmarkLaptopCount; i++ {
+		if err := store.Save(context.Background(), sample.NewLaptop()); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return store
+}
+
+func BenchmarkInMemoryLaptopStoreSearch(b *testing.B) {
+	store := newBenchmarkLaptopStore(b)
+
+	benchmarks := []struct {
+		name   string
+		filter *pb.Filter
+	}{
+		{"selective_price", &pb.Filter{MaxPriceUsd: 1600}},
+		{"selective_cores", &pb.Filter{MaxPriceUsd: 1e6, MinCpuCores: 8}},
+		{"selective_ram", &pb.Filter{MaxPriceUsd: 1e6, MinRam: &pb.Memory{Value: 64, Unit: pb.Memory_GIGABYTE}}},
+		{"broad", &pb.Filter{MaxPriceUsd: 1e6}},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				err := store.Search(context.Background(), bm.filter, func(laptop *pb.Laptop) error {
+					return nil
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkInMemoryLaptopStoreSave(b *testing.B) {
+	store := newBenchmarkLaptopStore(b)
+
+	laptops := make([]*pb.Laptop, b.N)
+	for i := range laptops {
+		laptops[i] = sample.NewLaptop()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := store.Save(context.Background(), laptops[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInMemoryLaptopStoreFind(b *testing.B) {
+	store := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	if err := store.Save(context.Background(), laptop); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.Find(context.Background(), laptop.Id); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/thewalkers2012/grpc-example/pb"
+)
+
+// weights of the laptop text fields in the relevance of a search
+const (
+	brandTextWeight = 3
+	nameTextWeight  = 3
+	cpuTextWeight   = 2
+	gpuTextWeight   = 1
+)
+
+// laptopTextIndex is an inverted index of the words of the laptop brand, name, CPU name and GPU names
+type laptopTextIndex struct {
+	// postings are the weights of every word in the laptops that contain it, by laptop ID
+	postings map[string]map[string]float64
+	// words are the indexed words in order, to find the words with a prefix
+	words []string
+}
+
+func newLaptopTextIndex() *laptopTextIndex {
+	return &laptopTextIndex{
+		postings: make(map[string]map[string]float64),
+	}
+}
+
+// add adds the words of the laptop to the index
+func (index *laptopTextIndex) add(laptop *pb.Laptop) {
+	for word, weight := range laptopWords(laptop) {
+		posting := index.postings[word]
+		if posting == nil {
+			posting = make(map[string]float64)
+			index.postings[word] = posting
+
+			i := sort.SearchStrings(index.words, word)
+			index.words = append(index.words, "")
+			copy(index.words[i+1:], index.words[i:])
+			index.words[i] = word
+		}
+		posting[laptop.GetId()] = weight
+	}
+}
+
+// remove removes the words of the laptop from the index, it must be the same laptop that was added
+func (index *laptopTextIndex) remove(laptop *pb.Laptop) {
+	for word := range laptopWords(laptop) {
+		posting := index.postings[word]
+		delete(posting, laptop.GetId())
+		if len(posting) > 0 {
+			continue
+		}
+
+		delete(index.postings, word)
+		i := sort.SearchStrings(index.words, word)
+		if i < len(index.words) && index.words[i] == word {
+			index.words = append(index.words[:i], index.words[i+1:]...)
+		}
+	}
+}
+
+// search returns the relevance of the laptops that contain a word starting with every term of the query, by ID
+func (index *laptopTextIndex) search(query string) map[string]float64 {
+	var scores map[string]float64
+
+	for _, term := range tokenize(query) {
+		// the best match of the term in every laptop
+		termScores := make(map[string]float64)
+		for i := sort.SearchStrings(index.words, term); i < len(index.words); i++ {
+			word := index.words[i]
+			if !strings.HasPrefix(word, term) {
+				break
+			}
+
+			for id, weight := range index.postings[word] {
+				if scores != nil && scores[id] == 0 {
+					continue
+				}
+				if score := termScore(term, word, weight); score > termScores[id] {
+					termScores[id] = score
+				}
+			}
+		}
+
+		if scores == nil {
+			scores = termScores
+		} else {
+			for id := range scores {
+				if termScores[id] == 0 {
+					delete(scores, id)
+				} else {
+					scores[id] += termScores[id]
+				}
+			}
+		}
+
+		if len(scores) == 0 {
+			break
+		}
+	}
+
+	return scores
+}
+
+// matchesQuery tells whether every term of the query is a prefix of a word of the laptop
+func matchesQuery(query string, laptop *pb.Laptop) bool {
+	words := laptopWords(laptop)
+
+	for _, term := range tokenize(query) {
+		found := false
+		for word := range words {
+			if strings.HasPrefix(word, term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// termScore is the relevance of a term matching a word with the weight of its field,
+// a full word scores more than a prefix of it
+func termScore(term string, word string, weight float64) float64 {
+	return weight * float64(len(term)) / float64(len(word))
+}
+
+// laptopWords returns the words of the laptop text fields with the weight of the most relevant field they are in
+func laptopWords(laptop *pb.Laptop) map[string]float64 {
+	words := make(map[string]float64)
+	addWords := func(text string, weight float64) {
+		for _, word := range tokenize(text) {
+			if weight > words[word] {
+				words[word] = weight
+			}
+		}
+	}
+
+	addWords(laptop.GetBrand(), brandTextWeight)
+	addWords(laptop.GetName(), nameTextWeight)
+	addWords(laptop.GetCpu().GetName(), cpuTextWeight)
+	for _, gpu := range laptop.GetGpus() {
+		addWords(gpu.GetName(), gpuTextWeight)
+	}
+
+	return words
+}
+
+// tokenize splits the text into lowercase words of letters and digits
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
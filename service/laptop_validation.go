@@ -0,0 +1,199 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+)
+
+// FieldViolations collects the invalid fields of a request message
+type FieldViolations []*errdetails.BadRequest_FieldViolation
+
+// Add adds a violation of the field at path
+func (violations *FieldViolations) Add(path string, description string) {
+	*violations = append(*violations, &errdetails.BadRequest_FieldViolation{
+		Field:       path,
+		Description: description,
+	})
+}
+
+// Err returns an InvalidArgument error with an ErrorInfo detail and a BadRequest detail listing every violation,
+// or nil if there are none. The message lists the violations too, for clients that don't read details.
+func (violations FieldViolations) Err() error {
+	if len(violations) == 0 {
+		return nil
+	}
+
+	descriptions := make([]string, len(violations))
+	for i, violation := range violations {
+		descriptions[i] = fmt.Sprintf("%s: %s", violation.GetField(), violation.GetDescription())
+	}
+
+	return detailedError(
+		codes.InvalidArgument,
+		ReasonInvalidArgument,
+		nil,
+		"invalid request: "+strings.Join(descriptions, "; "),
+		&errdetails.BadRequest{FieldViolations: violations},
+	)
+}
+
+// ValidateLaptop adds the violations of the laptop and its nested messages, with paths under field.
+// An empty ID is valid, since the server assigns one.
+func ValidateLaptop(violations *FieldViolations, field string, laptop *pb.Laptop) {
+	if laptop == nil {
+		violations.Add(field, "is required")
+		return
+	}
+
+	if laptop.GetId() != "" {
+		if _, err := uuid.Parse(laptop.GetId()); err != nil {
+			violations.Add(fieldPath(field, "id"), "must be a valid UUID")
+		}
+	}
+
+	validateCPU(violations, fieldPath(field, "cpu"), laptop.GetCpu())
+	validateMemory(violations, fieldPath(field, "ram"), laptop.GetRam())
+
+	for i, gpu := range laptop.GetGpus() {
+		validateGPU(violations, fmt.Sprintf("%s[%d]", fieldPath(field, "gpus"), i), gpu)
+	}
+
+	for i, storage := range laptop.GetStorage() {
+		validateStorage(violations, fmt.Sprintf("%s[%d]", fieldPath(field, "storage"), i), storage)
+	}
+
+	if laptop.GetScreen() != nil {
+		validateScreen(violations, fieldPath(field, "screen"), laptop.GetScreen())
+	}
+
+	if laptop.GetKeyboard() != nil {
+		if _, ok := pb.Keyboard_Layout_name[int32(laptop.GetKeyboard().GetLayout())]; !ok {
+			violations.Add(fieldPath(field, "keyboard.layout"), "is not a known layout")
+		}
+	}
+
+	switch weight := laptop.GetWeight().(type) {
+	case *pb.Laptop_WeightKg:
+		if weight.WeightKg <= 0 {
+			violations.Add(fieldPath(field, "weight_kg"), "must be positive")
+		}
+	case *pb.Laptop_WeightLg:
+		if weight.WeightLg <= 0 {
+			violations.Add(fieldPath(field, "weight_lg"), "must be positive")
+		}
+	}
+
+	if laptop.GetPriceUsd() < 0 {
+		violations.Add(fieldPath(field, "price_usd"), "must not be negative")
+	}
+
+	if laptop.GetPrice() != nil {
+		validateMoney(violations, fieldPath(field, "price"), laptop.GetPrice())
+	}
+}
+
+func validateMoney(violations *FieldViolations, field string, money *pb.Money) {
+	if !isCurrencyCode(money.GetCurrencyCode()) {
+		violations.Add(fieldPath(field, "currency_code"), "must be an ISO 4217 currency code")
+	}
+	if money.GetMinorUnits() < 0 {
+		violations.Add(fieldPath(field, "minor_units"), "must not be negative")
+	}
+}
+
+func validateCPU(violations *FieldViolations, field string, cpu *pb.CPU) {
+	if cpu == nil {
+		violations.Add(field, "is required")
+		return
+	}
+
+	if cpu.GetNumberCores() == 0 {
+		violations.Add(fieldPath(field, "number_cores"), "must be positive")
+	}
+	if cpu.GetNumberThreads() < cpu.GetNumberCores() {
+		violations.Add(fieldPath(field, "number_threads"), "must not be less than number_cores")
+	}
+
+	validateFrequency(violations, field, cpu.GetMinGhz(), cpu.GetMaxGhz())
+}
+
+func validateGPU(violations *FieldViolations, field string, gpu *pb.GPU) {
+	if gpu == nil {
+		violations.Add(field, "is required")
+		return
+	}
+
+	validateFrequency(violations, field, gpu.GetMinGhz(), gpu.GetMaxGhz())
+
+	if gpu.GetMomory() != nil {
+		validateMemory(violations, fieldPath(field, "momory"), gpu.GetMomory())
+	}
+}
+
+func validateFrequency(violations *FieldViolations, field string, minGhz float64, maxGhz float64) {
+	if minGhz <= 0 {
+		violations.Add(fieldPath(field, "min_ghz"), "must be positive")
+	}
+	if maxGhz < minGhz {
+		violations.Add(fieldPath(field, "max_ghz"), "must not be less than min_ghz")
+	}
+}
+
+func validateMemory(violations *FieldViolations, field string, memory *pb.Memory) {
+	if memory == nil {
+		violations.Add(field, "is required")
+		return
+	}
+
+	if memory.GetValue() == 0 {
+		violations.Add(fieldPath(field, "value"), "must be positive")
+	}
+	if _, ok := pb.Memory_Unit_name[int32(memory.GetUnit())]; !ok || memory.GetUnit() == pb.Memory_UNKNOWN {
+		violations.Add(fieldPath(field, "unit"), "must be a known unit")
+	}
+}
+
+func validateStorage(violations *FieldViolations, field string, storage *pb.Storage) {
+	if storage == nil {
+		violations.Add(field, "is required")
+		return
+	}
+
+	if _, ok := pb.Storage_Driver_name[int32(storage.GetDriver())]; !ok {
+		violations.Add(fieldPath(field, "driver"), "is not a known driver")
+	}
+
+	validateMemory(violations, fieldPath(field, "memory"), storage.GetMemory())
+}
+
+func validateScreen(violations *FieldViolations, field string, screen *pb.Screen) {
+	if screen.GetSizeInch() <= 0 {
+		violations.Add(fieldPath(field, "size_inch"), "must be positive")
+	}
+
+	if resolution := screen.GetResolution(); resolution != nil {
+		if resolution.GetWidth() == 0 {
+			violations.Add(fieldPath(field, "resolution.width"), "must be positive")
+		}
+		if resolution.GetHeight() == 0 {
+			violations.Add(fieldPath(field, "resolution.height"), "must be positive")
+		}
+	}
+
+	if _, ok := pb.Screen_Panel_name[int32(screen.GetPanel())]; !ok {
+		violations.Add(fieldPath(field, "panel"), "is not a known panel")
+	}
+}
+
+// fieldPath joins the path of a message field with the name of one of its fields
+func fieldPath(field string, name string) string {
+	if field == "" {
+		return name
+	}
+	return field + "." + name
+}
@@ -0,0 +1,145 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateLaptop(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		modify func(laptop *pb.Laptop)
+		fields []string
+	}{
+		{
+			name:   "valid",
+			modify: func(laptop *pb.Laptop) {},
+		},
+		{
+			name:   "valid_no_id",
+			modify: func(laptop *pb.Laptop) { laptop.Id = "" },
+		},
+		{
+			name:   "invalid_id",
+			modify: func(laptop *pb.Laptop) { laptop.Id = "invalid-uuid" },
+			fields: []string{"laptop.id"},
+		},
+		{
+			name:   "nil_cpu",
+			modify: func(laptop *pb.Laptop) { laptop.Cpu = nil },
+			fields: []string{"laptop.cpu"},
+		},
+		{
+			name:   "negative_price",
+			modify: func(laptop *pb.Laptop) { laptop.PriceUsd = -1 },
+			fields: []string{"laptop.price_usd"},
+		},
+		{
+			name:   "zero_ram",
+			modify: func(laptop *pb.Laptop) { laptop.Ram.Value = 0 },
+			fields: []string{"laptop.ram.value"},
+		},
+		{
+			name: "max_ghz_less_than_min_ghz",
+			modify: func(laptop *pb.Laptop) {
+				laptop.Cpu.MinGhz = 3.0
+				laptop.Cpu.MaxGhz = 2.5
+			},
+			fields: []string{"laptop.cpu.max_ghz"},
+		},
+		{
+			name: "threads_less_than_cores",
+			modify: func(laptop *pb.Laptop) {
+				laptop.Cpu.NumberCores = 8
+				laptop.Cpu.NumberThreads = 4
+			},
+			fields: []string{"laptop.cpu.number_threads"},
+		},
+		{
+			name:   "unknown_memory_unit",
+			modify: func(laptop *pb.Laptop) { laptop.Storage[1].Memory.Unit = pb.Memory_UNKNOWN },
+			fields: []string{"laptop.storage[1].memory.unit"},
+		},
+		{
+			name: "every_problem_is_listed",
+			modify: func(laptop *pb.Laptop) {
+				laptop.Ram = nil
+				laptop.PriceUsd = -1
+				laptop.Gpus[0].MinGhz = 0
+				laptop.Weight = &pb.Laptop_WeightKg{WeightKg: -2}
+			},
+			fields: []string{"laptop.ram", "laptop.gpus[0].min_ghz", "laptop.weight_kg", "laptop.price_usd"},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			laptop := sample.NewLaptop()
+			tc.modify(laptop)
+
+			var violations service.FieldViolations
+			service.ValidateLaptop(&violations, "laptop", laptop)
+
+			fields := make([]string, len(violations))
+			for i, violation := range violations {
+				fields[i] = violation.GetField()
+			}
+			require.ElementsMatch(t, tc.fields, fields)
+
+			if len(tc.fields) == 0 {
+				require.NoError(t, violations.Err())
+			}
+		})
+	}
+
+	var violations service.FieldViolations
+	service.ValidateLaptop(&violations, "laptop", nil)
+	require.Len(t, violations, 1)
+	require.Equal(t, "laptop", violations[0].GetField())
+}
+
+func TestServerCreateLaptopValidation(t *testing.T) {
+	t.Parallel()
+
+	laptop := sample.NewLaptop()
+	laptop.Cpu.NumberThreads = 0
+	laptop.Ram.Unit = pb.Memory_UNKNOWN
+
+	store := service.NewInMemoryLaptopStore()
+	server := service.NewLaptopService(store, nil, nil)
+
+	_, err := server.CreateLaptop(context.Background(), &pb.CreateLaptopRequest{Laptop: laptop})
+	st := status.Convert(err)
+	require.Equal(t, codes.InvalidArgument, st.Code())
+
+	require.Len(t, st.Details(), 2)
+	badRequest, ok := st.Details()[0].(*errdetails.BadRequest)
+	require.True(t, ok)
+	errorInfo, ok := st.Details()[1].(*errdetails.ErrorInfo)
+	require.True(t, ok)
+	require.Equal(t, service.ReasonInvalidArgument, errorInfo.GetReason())
+
+	fields := make([]string, len(badRequest.GetFieldViolations()))
+	for i, violation := range badRequest.GetFieldViolations() {
+		fields[i] = violation.GetField()
+	}
+	require.ElementsMatch(t, []string{"laptop.cpu.number_threads", "laptop.ram.unit"}, fields)
+
+	found, err := store.Find(context.Background(), laptop.Id)
+	require.NoError(t, err)
+	require.Nil(t, found)
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sync"
+
+	"github.com/thewalkers2012/grpc-example/pb"
+)
+
+// USD is the currency of the prices compared by the stores
+const USD = "USD"
+
+// ErrUnsupportedCurrency is returned when there is no exchange rate for a currency
+var ErrUnsupportedCurrency = errors.New("unsupported currency")
+
+// currencyDigits are the numbers of minor unit digits of the currencies that don't have 2
+var currencyDigits = map[string]int{
+	"BHD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"VND": 0,
+}
+
+// ExchangeRateProvider gives the exchange rates of the supported currencies
+type ExchangeRateProvider interface {
+	// USDRate returns the amount of the currency worth one USD, or ErrUnsupportedCurrency
+	USDRate(currency string) (float64, error)
+}
+
+// StaticExchangeRates are fixed exchange rates: the amount of every currency worth one USD.
+// USD is always supported.
+type StaticExchangeRates map[string]float64
+
+// USDRate returns the amount of the currency worth one USD, or ErrUnsupportedCurrency
+func (rates StaticExchangeRates) USDRate(currency string) (float64, error) {
+	if currency == USD {
+		return 1, nil
+	}
+
+	rate, ok := rates[currency]
+	if !ok || rate <= 0 {
+		return 0, fmt.Errorf("%w: %q", ErrUnsupportedCurrency, currency)
+	}
+	return rate, nil
+}
+
+// FileExchangeRates are the exchange rates of a JSON file, reloaded by Reload:
+//
+//	{"rates": {"EUR": 0.88, "VND": 22700}}
+type FileExchangeRates struct {
+	path  string
+	mutex sync.RWMutex
+	rates StaticExchangeRates
+}
+
+// NewFileExchangeRates returns the exchange rates loaded from the file at path
+func NewFileExchangeRates(path string) (*FileExchangeRates, error) {
+	provider := &FileExchangeRates{path: path}
+
+	err := provider.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+// Reload reads the file again. The previous rates are kept if it is invalid.
+func (provider *FileExchangeRates) Reload() error {
+	data, err := ioutil.ReadFile(provider.path)
+	if err != nil {
+		return fmt.Errorf("cannot read exchange rate file: %w", err)
+	}
+
+	file := struct {
+		Rates map[string]float64 `json:"rates"`
+	}{}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return fmt.Errorf("cannot parse exchange rate file: %w", err)
+	}
+
+	for currency, rate := range file.Rates {
+		if !isCurrencyCode(currency) || rate <= 0 || math.IsInf(rate, 0) {
+			return fmt.Errorf("invalid exchange rate %v for currency %q", rate, currency)
+		}
+	}
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	provider.rates = file.Rates
+	return nil
+}
+
+// USDRate returns the amount of the currency worth one USD, or ErrUnsupportedCurrency
+func (provider *FileExchangeRates) USDRate(currency string) (float64, error) {
+	provider.mutex.RLock()
+	defer provider.mutex.RUnlock()
+
+	return provider.rates.USDRate(currency)
+}
+
+// NewMoney returns the amount of the currency as money, rounded to the minor unit
+func NewMoney(currency string, amount float64) *pb.Money {
+	return &pb.Money{
+		CurrencyCode: currency,
+		MinorUnits:   int64(math.Round(amount * minorUnitsPerUnit(currency))),
+	}
+}
+
+// MoneyAmount returns the amount of the money in units of its currency
+func MoneyAmount(money *pb.Money) float64 {
+	return float64(money.GetMinorUnits()) / minorUnitsPerUnit(money.GetCurrencyCode())
+}
+
+// ConvertMoney converts the money to the currency with the exchange rates
+func ConvertMoney(rates ExchangeRateProvider, money *pb.Money, currency string) (*pb.Money, error) {
+	if money.GetCurrencyCode() == currency {
+		return &pb.Money{CurrencyCode: currency, MinorUnits: money.GetMinorUnits()}, nil
+	}
+
+	amount, err := toUSD(rates, money)
+	if err != nil {
+		return nil, err
+	}
+
+	rate, err := rates.USDRate(currency)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMoney(currency, amount*rate), nil
+}
+
+// toUSD returns the amount of the money in USD
+func toUSD(rates ExchangeRateProvider, money *pb.Money) (float64, error) {
+	rate, err := rates.USDRate(money.GetCurrencyCode())
+	if err != nil {
+		return 0, err
+	}
+
+	return MoneyAmount(money) / rate, nil
+}
+
+func minorUnitsPerUnit(currency string) float64 {
+	digits, ok := currencyDigits[currency]
+	if !ok {
+		digits = 2
+	}
+	return math.Pow10(digits)
+}
+
+// isCurrencyCode tells whether the code looks like an ISO 4217 code
+func isCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
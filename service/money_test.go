@@ -0,0 +1,149 @@
+package service_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestConvertMoney(t *testing.T) {
+	t.Parallel()
+
+	rates := service.StaticExchangeRates{"EUR": 0.8, "VND": 23000}
+
+	testCases := []struct {
+		name     string
+		money    *pb.Money
+		currency string
+		expected *pb.Money
+	}{
+		{"usd_to_eur", &pb.Money{CurrencyCode: "USD", MinorUnits: 150000}, "EUR", &pb.Money{CurrencyCode: "EUR", MinorUnits: 120000}},
+		{"eur_to_usd", &pb.Money{CurrencyCode: "EUR", MinorUnits: 120000}, "USD", &pb.Money{CurrencyCode: "USD", MinorUnits: 150000}},
+		{"eur_to_vnd_without_minor_units", &pb.Money{CurrencyCode: "EUR", MinorUnits: 1}, "VND", &pb.Money{CurrencyCode: "VND", MinorUnits: 288}},
+		{"same_currency", &pb.Money{CurrencyCode: "VND", MinorUnits: 42}, "VND", &pb.Money{CurrencyCode: "VND", MinorUnits: 42}},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			converted, err := service.ConvertMoney(rates, tc.money, tc.currency)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected.GetCurrencyCode(), converted.GetCurrencyCode())
+			require.Equal(t, tc.expected.GetMinorUnits(), converted.GetMinorUnits())
+		})
+	}
+
+	_, err := service.ConvertMoney(rates, &pb.Money{CurrencyCode: "GBP", MinorUnits: 100}, "USD")
+	require.ErrorIs(t, err, service.ErrUnsupportedCurrency)
+}
+
+func TestFileExchangeRatesReload(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "rates.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"rates": {"EUR": 0.8}}`), 0644))
+
+	rates, err := service.NewFileExchangeRates(path)
+	require.NoError(t, err)
+
+	rate, err := rates.USDRate("EUR")
+	require.NoError(t, err)
+	require.Equal(t, 0.8, rate)
+	_, err = rates.USDRate("VND")
+	require.ErrorIs(t, err, service.ErrUnsupportedCurrency)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"rates": {"EUR": 0.9, "VND": 23000}}`), 0644))
+	require.NoError(t, rates.Reload())
+	rate, err = rates.USDRate("VND")
+	require.NoError(t, err)
+	require.Equal(t, 23000.0, rate)
+
+	// an invalid file keeps the previous rates
+	require.NoError(t, os.WriteFile(path, []byte(`{"rates": {"EUR": -1}}`), 0644))
+	require.Error(t, rates.Reload())
+	rate, err = rates.USDRate("EUR")
+	require.NoError(t, err)
+	require.Equal(t, 0.9, rate)
+}
+
+func TestClientSearchLaptopInCurrency(t *testing.T) {
+	t.Parallel()
+
+	rates := service.StaticExchangeRates{"EUR": 0.8}
+	serverAddress := startTestLaptopServer(t, service.NewInMemoryLaptopStore(), nil, nil, service.WithExchangeRates(rates))
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	// 1200 EUR is 1500 USD
+	inEUR := sample.NewLaptop()
+	inEUR.Price = &pb.Money{CurrencyCode: "EUR", MinorUnits: 120000}
+	inUSD := sample.NewLaptop()
+	inUSD.PriceUsd = 1000
+	for _, laptop := range []*pb.Laptop{inEUR, inUSD} {
+		_, err := laptopClient.CreateLaptop(context.Background(), &pb.CreateLaptopRequest{Laptop: laptop})
+		require.NoError(t, err)
+	}
+
+	res, err := laptopClient.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: inEUR.Id})
+	require.NoError(t, err)
+	require.Equal(t, 1500.0, res.GetLaptop().GetPriceUsd())
+
+	search := func(req *pb.SearchLaptopRequest) []*pb.SearchLaptopResponse {
+		stream, err := laptopClient.SearchLaptop(context.Background(), req)
+		require.NoError(t, err)
+
+		var responses []*pb.SearchLaptopResponse
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				return responses
+			}
+			require.NoError(t, err)
+			responses = append(responses, res)
+		}
+	}
+
+	responses := search(&pb.SearchLaptopRequest{
+		Filter: &pb.Filter{
+			MaxPrice:  &pb.Money{CurrencyCode: "EUR", MinorUnits: 120000},
+			SortOrder: pb.Filter_PRICE_DESCENDING,
+		},
+		CurrencyCode: "EUR",
+	})
+	require.Len(t, responses, 2)
+	require.Equal(t, inEUR.Id, responses[0].GetLaptop().GetId())
+	require.Equal(t, "EUR", responses[0].GetConvertedPrice().GetCurrencyCode())
+	require.EqualValues(t, 120000, responses[0].GetConvertedPrice().GetMinorUnits())
+	require.Equal(t, inUSD.Id, responses[1].GetLaptop().GetId())
+	require.EqualValues(t, 80000, responses[1].GetConvertedPrice().GetMinorUnits())
+
+	responses = search(&pb.SearchLaptopRequest{
+		Filter: &pb.Filter{MaxPrice: &pb.Money{CurrencyCode: "EUR", MinorUnits: 100000}},
+	})
+	require.Len(t, responses, 1)
+	require.Equal(t, inUSD.Id, responses[0].GetLaptop().GetId())
+	require.Nil(t, responses[0].GetConvertedPrice())
+
+	stream, err := laptopClient.SearchLaptop(context.Background(), &pb.SearchLaptopRequest{
+		Filter: &pb.Filter{MaxPrice: &pb.Money{CurrencyCode: "GBP", MinorUnits: 100000}},
+	})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	st := status.Convert(err)
+	require.Equal(t, codes.InvalidArgument, st.Code())
+	require.Len(t, st.Details(), 2)
+	badRequest := st.Details()[0].(*errdetails.BadRequest)
+	require.Equal(t, "filter.max_price.currency_code", badRequest.GetFieldViolations()[0].GetField())
+}
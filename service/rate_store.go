@@ -1,12 +1,21 @@
 package service
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
 	"sync"
 )
 
 // RatingStore is an interface to store laptop ratings
 type RatingStore interface {
-	Add(laptopID string, store float64) (*Rating, error)
+	Add(ctx context.Context, laptopID string, store float64) (*Rating, error)
+	// List returns the ratings of all laptops by laptop ID
+	List(ctx context.Context) (map[string]*Rating, error)
+	// Set replaces the rating of a laptop, such as with a rating from a catalog archive
+	Set(ctx context.Context, laptopID string, rating *Rating) error
 }
 
 // Rating contains the rating information of a laptop
@@ -28,7 +37,7 @@ func NewInMemoryRatingStore() *InMemoryRatingStore {
 }
 
 // Add adds a new laptop score to the store and returns its rating
-func (store *InMemoryRatingStore) Add(laptopID string, score float64) (*Rating, error) {
+func (store *InMemoryRatingStore) Add(ctx context.Context, laptopID string, score float64) (*Rating, error) {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
@@ -46,3 +55,193 @@ func (store *InMemoryRatingStore) Add(laptopID string, score float64) (*Rating,
 	store.rating[laptopID] = rating
 	return rating, nil
 }
+
+// List returns the ratings of all laptops by laptop ID
+func (store *InMemoryRatingStore) List(ctx context.Context) (map[string]*Rating, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	ratings := make(map[string]*Rating, len(store.rating))
+	for laptopID, rating := range store.rating {
+		other := *rating
+		ratings[laptopID] = &other
+	}
+
+	return ratings, nil
+}
+
+// Set replaces the rating of a laptop
+func (store *InMemoryRatingStore) Set(ctx context.Context, laptopID string, rating *Rating) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	other := *rating
+	store.rating[laptopID] = &other
+	return nil
+}
+
+const (
+	// ratingJournalName is the file of the scores and ratings of the laptops in the laptop folder, one per line
+	ratingJournalName = ".ratings"
+	// maxRatingJournalRecords is the number of records of the journal over which it is replaced by the ratings
+	maxRatingJournalRecords = 10000
+)
+
+// DiskRatingStore stores laptop ratings in a journal of the laptop folder, so that they survive a restart
+// and are shared by the servers using the folder. Every score is appended while the server holds the lock
+// of the folder, after it has read the scores appended by the other servers.
+type DiskRatingStore struct {
+	mutex   sync.Mutex
+	journal *diskJournal
+	rating  map[string]*Rating
+}
+
+// ratingRecord is a score of a laptop in the journal, or its rating if Set is true
+type ratingRecord struct {
+	LaptopID string  `json:"laptop_id"`
+	Score    float64 `json:"score,omitempty"`
+	Set      bool    `json:"set,omitempty"`
+	Count    uint32  `json:"count,omitempty"`
+	Sum      float64 `json:"sum,omitempty"`
+}
+
+// NewDiskRatingStore returns a new DiskRatingStore with the ratings of the journal of the folder
+func NewDiskRatingStore(laptopFolder string) (*DiskRatingStore, error) {
+	err := os.MkdirAll(laptopFolder, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create laptop folder: %w", err)
+	}
+
+	journal, err := openDiskJournal(laptopFolder, ratingJournalName)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &DiskRatingStore{
+		journal: journal,
+		rating:  make(map[string]*Rating),
+	}
+
+	err = journal.withLock(store.read)
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Add adds a new laptop score to the store and returns its rating
+func (store *DiskRatingStore) Add(ctx context.Context, laptopID string, score float64) (*Rating, error) {
+	return store.write(ctx, &ratingRecord{LaptopID: laptopID, Score: score})
+}
+
+// List returns the ratings of all laptops by laptop ID
+func (store *DiskRatingStore) List(ctx context.Context) (map[string]*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	changed, err := store.journal.changed()
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		err := store.journal.withLock(store.read)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ratings := make(map[string]*Rating, len(store.rating))
+	for laptopID, rating := range store.rating {
+		other := *rating
+		ratings[laptopID] = &other
+	}
+
+	return ratings, nil
+}
+
+// Set replaces the rating of a laptop
+func (store *DiskRatingStore) Set(ctx context.Context, laptopID string, rating *Rating) error {
+	_, err := store.write(ctx, &ratingRecord{LaptopID: laptopID, Set: true, Count: rating.Count, Sum: rating.Sum})
+	return err
+}
+
+// write appends the record to the journal, applies it and returns the rating of its laptop.
+// The journal is replaced by the ratings once it has maxRatingJournalRecords records.
+func (store *DiskRatingStore) write(ctx context.Context, record *ratingRecord) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	err := store.journal.withLock(func() error {
+		err := store.read()
+		if err != nil {
+			return err
+		}
+
+		err = store.journal.append(record)
+		if err != nil {
+			return fmt.Errorf("cannot write rating journal: %w", err)
+		}
+		store.apply(record)
+
+		if store.journal.records >= maxRatingJournalRecords {
+			records := make([]interface{}, 0, len(store.rating))
+			for laptopID, rating := range store.rating {
+				records = append(records, &ratingRecord{LaptopID: laptopID, Set: true, Count: rating.Count, Sum: rating.Sum})
+			}
+
+			// the score is in the journal, so the journal is only replaced by the next score
+			err := store.journal.replace(records...)
+			if err != nil {
+				log.Printf("cannot compact rating journal: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rating := *store.rating[record.LaptopID]
+	return &rating, nil
+}
+
+// read applies the records appended to the journal since it was last read, it must be called with the lock held
+func (store *DiskRatingStore) read() error {
+	reset := func() error {
+		store.rating = make(map[string]*Rating)
+		return nil
+	}
+
+	return store.journal.read(reset, func(data []byte) error {
+		record := &ratingRecord{}
+		err := json.Unmarshal(data, record)
+		if err != nil {
+			return err
+		}
+
+		store.apply(record)
+		return nil
+	})
+}
+
+// apply adds the score of the record to the rating of its laptop, or replaces the rating
+func (store *DiskRatingStore) apply(record *ratingRecord) {
+	if record.Set {
+		store.rating[record.LaptopID] = &Rating{Count: record.Count, Sum: record.Sum}
+		return
+	}
+
+	rating := store.rating[record.LaptopID]
+	if rating == nil {
+		rating = &Rating{}
+		store.rating[record.LaptopID] = rating
+	}
+	rating.Count++
+	rating.Sum += record.Score
+}
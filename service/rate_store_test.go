@@ -0,0 +1,42 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/service"
+)
+
+func TestDiskRatingStoreShared(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	laptopFolder := t.TempDir()
+	store1, err := service.NewDiskRatingStore(laptopFolder)
+	require.NoError(t, err)
+	store2, err := service.NewDiskRatingStore(laptopFolder)
+	require.NoError(t, err)
+
+	// the scores of both servers add up
+	_, err = store1.Add(ctx, "laptop1", 5)
+	require.NoError(t, err)
+	rating, err := store2.Add(ctx, "laptop1", 3)
+	require.NoError(t, err)
+	require.Equal(t, &service.Rating{Count: 2, Sum: 8}, rating)
+
+	require.NoError(t, store2.Set(ctx, "laptop2", &service.Rating{Count: 4, Sum: 10}))
+	ratings, err := store1.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[string]*service.Rating{
+		"laptop1": {Count: 2, Sum: 8},
+		"laptop2": {Count: 4, Sum: 10},
+	}, ratings)
+
+	// the ratings are found again after a restart
+	store3, err := service.NewDiskRatingStore(laptopFolder)
+	require.NoError(t, err)
+	restarted, err := store3.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ratings, restarted)
+}
@@ -0,0 +1,407 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// DefaultTenant is the tenant of the requests and tokens that don't have a tenant ID.
+// Its admins manage the other tenants.
+const DefaultTenant = "default"
+
+// ErrInvalidTenantID is returned when a tenant ID cannot be used
+var ErrInvalidTenantID = errors.New("tenant ID must be 1 to 63 lowercase letters, digits or dashes, starting with a letter or digit")
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Tenant holds the stores of a tenant. The data of a tenant is never visible to the other tenants.
+type Tenant struct {
+	ID           string
+	LaptopStore  LaptopStore
+	ImageStore   ImageStore
+	RatingStore  RatingStore
+	UserStore    UserStore
+	HistoryStore LaptopHistoryStore
+	EventBus     *LaptopEventBus
+}
+
+// TenantFactory creates the stores of a new tenant
+type TenantFactory func(tenantID string) (*Tenant, error)
+
+// TenantStore is an interface to store tenants
+type TenantStore interface {
+	// Create creates a new tenant with empty stores, and saves the users to its user store.
+	// The tenant is not created if one of the users cannot be saved.
+	Create(ctx context.Context, tenantID string, users ...*User) (*Tenant, error)
+	// Find finds a tenant by ID, it returns nil if the tenant doesn't exist
+	Find(ctx context.Context, tenantID string) (*Tenant, error)
+	// List returns all tenants sorted by ID
+	List(ctx context.Context) ([]*Tenant, error)
+}
+
+// InMemoryTenantStore stores tenants in memory
+type InMemoryTenantStore struct {
+	mutex     sync.RWMutex
+	tenants   map[string]*Tenant
+	newTenant TenantFactory
+}
+
+// NewInMemoryTenantStore returns a new tenant store that creates the stores of new tenants with newTenant
+func NewInMemoryTenantStore(newTenant TenantFactory) *InMemoryTenantStore {
+	return &InMemoryTenantStore{
+		tenants:   make(map[string]*Tenant),
+		newTenant: newTenant,
+	}
+}
+
+// Create creates a new tenant with empty stores and its users
+func (store *InMemoryTenantStore) Create(ctx context.Context, tenantID string, users ...*User) (*Tenant, error) {
+	if !tenantIDPattern.MatchString(tenantID) {
+		return nil, ErrInvalidTenantID
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.tenants[tenantID] != nil {
+		return nil, ErrAlreadyExists
+	}
+
+	tenant, err := store.newTenant(tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create stores of tenant %s: %w", tenantID, err)
+	}
+
+	err = saveTenantUsers(ctx, tenant, users)
+	if err != nil {
+		return nil, err
+	}
+
+	store.tenants[tenantID] = tenant
+	return tenant, nil
+}
+
+// Find finds a tenant by ID
+func (store *InMemoryTenantStore) Find(ctx context.Context, tenantID string) (*Tenant, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.tenants[tenantID], nil
+}
+
+// List returns all tenants sorted by ID
+func (store *InMemoryTenantStore) List(ctx context.Context) ([]*Tenant, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	tenants := make([]*Tenant, 0, len(store.tenants))
+	for _, tenant := range store.tenants {
+		tenants = append(tenants, tenant)
+	}
+
+	sort.Slice(tenants, func(i, j int) bool {
+		return tenants[i].ID < tenants[j].ID
+	})
+
+	return tenants, nil
+}
+
+// tenantCreatingName is the file of the folder of a tenant while the tenant is created.
+// A folder that still has it was left by a server that failed to create the tenant, it is not a tenant.
+const tenantCreatingName = ".creating"
+
+// DiskTenantStore stores tenants as the subfolders of a folder, such as the laptop folder,
+// so that the tenants survive a restart and are shared by the servers using the folder.
+// A tenant is created while the server holds the lock of the folder, and the tenants created
+// by the other servers are loaded when they are first found.
+type DiskTenantStore struct {
+	mutex     sync.RWMutex
+	folder    string
+	lockFile  *os.File
+	tenants   map[string]*Tenant
+	newTenant TenantFactory
+}
+
+// NewDiskTenantStore returns a new tenant store with the tenants of the folder,
+// that creates the stores of the tenants with newTenant
+func NewDiskTenantStore(folder string, newTenant TenantFactory) (*DiskTenantStore, error) {
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create tenant folder: %w", err)
+	}
+
+	lockFile, err := os.OpenFile(filepath.Join(folder, folderLockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open tenant folder lock: %w", err)
+	}
+
+	store := &DiskTenantStore{
+		folder:    folder,
+		lockFile:  lockFile,
+		tenants:   make(map[string]*Tenant),
+		newTenant: newTenant,
+	}
+
+	_, err = store.List(context.Background())
+	if err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Create creates a new tenant with empty stores and its users.
+// If the tenant cannot be created, its folder is removed.
+func (store *DiskTenantStore) Create(ctx context.Context, tenantID string, users ...*User) (*Tenant, error) {
+	if !tenantIDPattern.MatchString(tenantID) {
+		return nil, ErrInvalidTenantID
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.tenants[tenantID] != nil {
+		return nil, ErrAlreadyExists
+	}
+
+	var tenant *Tenant
+	err := store.withFolderLock(func() error {
+		tenantFolder := filepath.Join(store.folder, tenantID)
+		if store.exists(tenantID) {
+			return ErrAlreadyExists
+		}
+
+		// the folder of a tenant that failed to be created is replaced
+		err := os.RemoveAll(tenantFolder)
+		if err == nil {
+			err = os.Mkdir(tenantFolder, 0755)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(tenantFolder, tenantCreatingName), nil, 0644)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot create folder of tenant %s: %w", tenantID, err)
+		}
+
+		tenant, err = store.newTenant(tenantID)
+		if err != nil {
+			err = fmt.Errorf("cannot create stores of tenant %s: %w", tenantID, err)
+		}
+		if err == nil {
+			err = saveTenantUsers(ctx, tenant, users)
+		}
+		if err == nil {
+			err = os.Remove(filepath.Join(tenantFolder, tenantCreatingName))
+		}
+		if err != nil {
+			os.RemoveAll(tenantFolder)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	store.tenants[tenantID] = tenant
+	return tenant, nil
+}
+
+// Find finds a tenant by ID, the tenants created by other servers are loaded from the folder
+func (store *DiskTenantStore) Find(ctx context.Context, tenantID string) (*Tenant, error) {
+	store.mutex.RLock()
+	tenant := store.tenants[tenantID]
+	store.mutex.RUnlock()
+
+	if tenant != nil || !tenantIDPattern.MatchString(tenantID) {
+		return tenant, nil
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err := store.withFolderLock(func() error {
+		return store.load(tenantID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return store.tenants[tenantID], nil
+}
+
+// List returns all tenants sorted by ID
+func (store *DiskTenantStore) List(ctx context.Context) ([]*Tenant, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err := store.withFolderLock(func() error {
+		entries, err := ioutil.ReadDir(store.folder)
+		if err != nil {
+			return fmt.Errorf("cannot read tenant folder: %w", err)
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() && tenantIDPattern.MatchString(entry.Name()) {
+				err := store.load(entry.Name())
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := make([]*Tenant, 0, len(store.tenants))
+	for _, tenant := range store.tenants {
+		tenants = append(tenants, tenant)
+	}
+
+	sort.Slice(tenants, func(i, j int) bool {
+		return tenants[i].ID < tenants[j].ID
+	})
+
+	return tenants, nil
+}
+
+// load creates the stores of the tenant if its folder exists and the tenant is not loaded yet.
+// It must be called with the lock of the folder held.
+func (store *DiskTenantStore) load(tenantID string) error {
+	if store.tenants[tenantID] != nil || !store.exists(tenantID) {
+		return nil
+	}
+
+	tenant, err := store.newTenant(tenantID)
+	if err != nil {
+		return fmt.Errorf("cannot create stores of tenant %s: %w", tenantID, err)
+	}
+
+	store.tenants[tenantID] = tenant
+	return nil
+}
+
+// exists tells whether the folder of the tenant exists and is not being created
+func (store *DiskTenantStore) exists(tenantID string) bool {
+	tenantFolder := filepath.Join(store.folder, tenantID)
+	if info, err := os.Stat(tenantFolder); err != nil || !info.IsDir() {
+		return false
+	}
+
+	_, err := os.Stat(filepath.Join(tenantFolder, tenantCreatingName))
+	return os.IsNotExist(err)
+}
+
+// withFolderLock calls fn while it holds the lock of the folder, shared by all servers using it
+func (store *DiskTenantStore) withFolderLock(fn func() error) error {
+	err := lockFile(store.lockFile)
+	if err != nil {
+		return fmt.Errorf("cannot lock tenant folder: %w", err)
+	}
+	defer unlockFile(store.lockFile)
+
+	return fn()
+}
+
+// saveTenantUsers saves the users of a new tenant to its user store
+func saveTenantUsers(ctx context.Context, tenant *Tenant, users []*User) error {
+	for _, user := range users {
+		err := tenant.UserStore.Save(ctx, user)
+		if err != nil {
+			return fmt.Errorf("cannot save user %s of tenant %s: %w", user.Username, tenant.ID, err)
+		}
+	}
+	return nil
+}
+
+// NewTenantFactory returns a factory that keeps the images of a tenant in imageFolder/<tenant>,
+// and its laptops, their history and ratings and its users in laptopFolder/<tenant>, or in memory if laptopFolder is empty.
+// With a laptop folder, the tenants are stored by NewDiskTenantStore(laptopFolder, factory).
+func NewTenantFactory(imageFolder string, laptopFolder string) TenantFactory {
+	return func(tenantID string) (*Tenant, error) {
+		imageStore, err := NewDiskImageStore(filepath.Join(imageFolder, tenantID))
+		if err != nil {
+			return nil, err
+		}
+
+		var laptopStore LaptopStore = NewInMemoryLaptopStore()
+		var historyStore LaptopHistoryStore = NewInMemoryLaptopHistoryStore()
+		var userStore UserStore = NewInMemoryUserStore()
+		var ratingStore RatingStore = NewInMemoryRatingStore()
+		if laptopFolder != "" {
+			laptopStore, err = NewDiskLaptopStore(filepath.Join(laptopFolder, tenantID))
+			if err != nil {
+				return nil, err
+			}
+
+			historyStore, err = NewDiskLaptopHistoryStore(filepath.Join(laptopFolder, tenantID))
+			if err != nil {
+				return nil, err
+			}
+
+			userStore, err = NewDiskUserStore(filepath.Join(laptopFolder, tenantID))
+			if err != nil {
+				return nil, err
+			}
+
+			ratingStore, err = NewDiskRatingStore(filepath.Join(laptopFolder, tenantID))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		tenant := &Tenant{
+			ID:           tenantID,
+			LaptopStore:  laptopStore,
+			ImageStore:   imageStore,
+			RatingStore:  ratingStore,
+			UserStore:    userStore,
+			HistoryStore: historyStore,
+			EventBus:     NewLaptopEventBus(DefaultEventBufferSize),
+		}
+		return tenant, nil
+	}
+}
+
+// TenantFromContext returns the tenant ID of the authorized user, or DefaultTenant
+func TenantFromContext(ctx context.Context) string {
+	return tenantOf(ClaimsFromContext(ctx))
+}
+
+// tenantOf returns the tenant ID of the claims, or DefaultTenant
+func tenantOf(claims *UserClaims) string {
+	if claims == nil || claims.TenantID == "" {
+		return DefaultTenant
+	}
+	return claims.TenantID
+}
+
+// findTenant returns the tenant of the request, or fallback if the server doesn't have a tenant store
+func findTenant(ctx context.Context, tenants TenantStore, fallback *Tenant) (*Tenant, error) {
+	if tenants == nil {
+		return fallback, nil
+	}
+
+	tenantID := TenantFromContext(ctx)
+	tenant, err := tenants.Find(ctx, tenantID)
+	if err != nil {
+		return nil, storeError(ctx, "cannot find tenant", err)
+	}
+
+	if tenant == nil {
+		return nil, tenantNotFoundError(tenantID)
+	}
+
+	return tenant, nil
+}
@@ -0,0 +1,448 @@
+package service_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thewalkers2012/grpc-example/client"
+	"github.com/thewalkers2012/grpc-example/pb"
+	"github.com/thewalkers2012/grpc-example/sample"
+	"github.com/thewalkers2012/grpc-example/service"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestInMemoryTenantStore(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	store := service.NewInMemoryTenantStore(service.NewTenantFactory(imageFolder, ""))
+
+	acme, err := store.Create(context.Background(), "acme")
+	require.NoError(t, err)
+	require.Equal(t, "acme", acme.ID)
+	require.DirExists(t, filepath.Join(imageFolder, "acme"))
+
+	_, err = store.Create(context.Background(), "acme")
+	require.ErrorIs(t, err, service.ErrAlreadyExists)
+
+	for _, tenantID := range []string{"", "Acme", "../acme", "-acme"} {
+		_, err = store.Create(context.Background(), tenantID)
+		require.ErrorIs(t, err, service.ErrInvalidTenantID, tenantID)
+	}
+
+	_, err = store.Create(context.Background(), "globex")
+	require.NoError(t, err)
+
+	found, err := store.Find(context.Background(), "acme")
+	require.NoError(t, err)
+	require.Same(t, acme, found)
+
+	found, err = store.Find(context.Background(), "initech")
+	require.NoError(t, err)
+	require.Nil(t, found)
+
+	tenants, err := store.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, tenants, 2)
+	require.Equal(t, "acme", tenants[0].ID)
+	require.Equal(t, "globex", tenants[1].ID)
+
+	// the stores of the tenants are separate
+	laptop := sample.NewLaptop()
+	require.NoError(t, acme.LaptopStore.Save(context.Background(), laptop))
+	other, err := tenants[1].LaptopStore.Find(context.Background(), laptop.Id)
+	require.NoError(t, err)
+	require.Nil(t, other)
+}
+
+func TestInMemoryTenantStoreCreateUsers(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	newTenant := service.NewTenantFactory(t.TempDir(), "")
+	failing := true
+	store := service.NewInMemoryTenantStore(func(tenantID string) (*service.Tenant, error) {
+		tenant, err := newTenant(tenantID)
+		if err == nil && failing {
+			tenant.UserStore = failingUserStore{tenant.UserStore}
+		}
+		return tenant, err
+	})
+
+	admin, err := service.NewUser("admin1", "secret", service.RoleAdmin)
+	require.NoError(t, err)
+
+	// the tenant is not created without its admin
+	_, err = store.Create(ctx, "acme", admin)
+	require.ErrorIs(t, err, errUserStoreFailed)
+	found, err := store.Find(ctx, "acme")
+	require.NoError(t, err)
+	require.Nil(t, found)
+
+	failing = false
+	acme, err := store.Create(ctx, "acme", admin)
+	require.NoError(t, err)
+	user, err := acme.UserStore.Find(ctx, "admin1")
+	require.NoError(t, err)
+	require.Equal(t, service.RoleAdmin, user.Role)
+}
+
+func TestDiskTenantStoreShared(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	imageFolder := t.TempDir()
+	laptopFolder := t.TempDir()
+	newTenant := service.NewTenantFactory(imageFolder, laptopFolder)
+	store1, err := service.NewDiskTenantStore(laptopFolder, newTenant)
+	require.NoError(t, err)
+	store2, err := service.NewDiskTenantStore(laptopFolder, newTenant)
+	require.NoError(t, err)
+
+	admin, err := service.NewUser("admin1", "secret", service.RoleAdmin)
+	require.NoError(t, err)
+	_, err = store1.Create(ctx, "acme", admin)
+	require.NoError(t, err)
+	_, err = store2.Create(ctx, "acme", admin)
+	require.ErrorIs(t, err, service.ErrAlreadyExists)
+
+	// the tenant and its users created by one server are found by the other
+	acme, err := store2.Find(ctx, "acme")
+	require.NoError(t, err)
+	require.NotNil(t, acme)
+	user, err := acme.UserStore.Find(ctx, "admin1")
+	require.NoError(t, err)
+	require.NotNil(t, user)
+
+	user.Role = service.RoleUser
+	require.NoError(t, acme.UserStore.Update(ctx, user))
+	found, err := store1.Find(ctx, "acme")
+	require.NoError(t, err)
+	user, err = found.UserStore.Find(ctx, "admin1")
+	require.NoError(t, err)
+	require.Equal(t, service.RoleUser, user.Role)
+
+	// a tenant that failed to be created is not loaded, and can be created again
+	require.NoError(t, os.MkdirAll(filepath.Join(laptopFolder, "globex"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(laptopFolder, "globex", ".creating"), nil, 0644))
+	store3, err := service.NewDiskTenantStore(laptopFolder, newTenant)
+	require.NoError(t, err)
+	tenants, err := store3.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, tenants, 1)
+	require.Equal(t, "acme", tenants[0].ID)
+
+	users, err := tenants[0].UserStore.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	require.Equal(t, service.RoleUser, users[0].Role)
+
+	_, err = store3.Create(ctx, "globex")
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(laptopFolder, "globex", ".creating"))
+
+	// the folder of a tenant whose admin cannot be saved is removed
+	store4, err := service.NewDiskTenantStore(laptopFolder, func(tenantID string) (*service.Tenant, error) {
+		tenant, err := newTenant(tenantID)
+		if err == nil {
+			tenant.UserStore = failingUserStore{tenant.UserStore}
+		}
+		return tenant, err
+	})
+	require.NoError(t, err)
+	_, err = store4.Create(ctx, "initech", admin)
+	require.ErrorIs(t, err, errUserStoreFailed)
+	require.NoDirExists(t, filepath.Join(laptopFolder, "initech"))
+	found, err = store1.Find(ctx, "initech")
+	require.NoError(t, err)
+	require.Nil(t, found)
+}
+
+var errUserStoreFailed = errors.New("user store failed")
+
+// failingUserStore is a user store that cannot save users
+type failingUserStore struct {
+	service.UserStore
+}
+
+func (store failingUserStore) Save(ctx context.Context, user *service.User) error {
+	return errUserStoreFailed
+}
+
+func TestClientTenantIsolation(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	tenants := service.NewInMemoryTenantStore(service.NewTenantFactory(imageFolder, ""))
+	defaultTenant, err := tenants.Create(context.Background(), service.DefaultTenant)
+	require.NoError(t, err)
+
+	admin, err := service.NewUser("admin1", "secret", "admin")
+	require.NoError(t, err)
+	require.NoError(t, defaultTenant.UserStore.Save(context.Background(), admin))
+
+	serverAddress := startTestTenantServer(t, tenants, defaultTenant)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	authClient := pb.NewAuthServiceClient(conn)
+	laptopClient := pb.NewLaptopServiceClient(conn)
+	ctx := context.Background()
+
+	login := func(tenantID string, username string) context.Context {
+		res, err := authClient.Login(ctx, &pb.LoginRequest{TenantId: tenantID, Username: username, Password: "secret"})
+		require.NoError(t, err)
+		return metadata.AppendToOutgoingContext(ctx, "authorization", res.GetAccessToken())
+	}
+
+	defaultAdmin := login("", "admin1")
+	created, err := authClient.CreateTenant(defaultAdmin, &pb.CreateTenantRequest{
+		TenantId:      "acme",
+		AdminUsername: "admin1",
+		AdminPassword: "secret",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "acme", created.GetAdmin().GetTenantId())
+
+	_, err = authClient.CreateTenant(defaultAdmin, &pb.CreateTenantRequest{TenantId: "Acme!", AdminUsername: "a", AdminPassword: "b"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the admin of acme is not the admin of the default tenant, although they have the same username
+	acmeAdmin := login("acme", "admin1")
+	_, err = authClient.ListTenants(acmeAdmin, &pb.ListTenantsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	users, err := authClient.ListUsers(acmeAdmin, &pb.ListUsersRequest{})
+	require.NoError(t, err)
+	require.Len(t, users.GetUsers(), 1)
+	require.Equal(t, "acme", users.GetUsers()[0].GetTenantId())
+
+	laptop := sample.NewLaptop()
+	_, err = laptopClient.CreateLaptop(acmeAdmin, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+
+	_, err = laptopClient.GetLaptop(acmeAdmin, &pb.GetLaptopRequest{Id: laptop.Id})
+	require.NoError(t, err)
+
+	// the laptop is not visible from the default tenant, with or without a token
+	_, err = laptopClient.GetLaptop(defaultAdmin, &pb.GetLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = laptopClient.GetLaptop(ctx, &pb.GetLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	require.Zero(t, searchCount(t, laptopClient, ctx))
+	require.Equal(t, 1, searchCount(t, laptopClient, acmeAdmin))
+
+	// asking for another tenant than the one of the token is denied
+	crossTenant := metadata.AppendToOutgoingContext(defaultAdmin, service.TenantHeader, "acme")
+	_, err = laptopClient.GetLaptop(crossTenant, &pb.GetLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	anonymous := metadata.AppendToOutgoingContext(ctx, service.TenantHeader, "acme")
+	_, err = laptopClient.GetLaptop(anonymous, &pb.GetLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// the images of a tenant are in its own folder
+	stream, err := laptopClient.UploadImage(acmeAdmin)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.UploadmageRequest{
+		Data: &pb.UploadmageRequest_Info{Info: &pb.ImageInfo{LaptopId: laptop.Id, ImageTypes: ".jpg"}},
+	}))
+	require.NoError(t, stream.Send(&pb.UploadmageRequest{Data: &pb.UploadmageRequest_ChunkData{ChunkData: []byte("image")}}))
+	image, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	require.NotEmpty(t, image.GetId())
+	checksum := sha256.Sum256([]byte("image"))
+	require.FileExists(t, filepath.Join(imageFolder, "acme", hex.EncodeToString(checksum[:])))
+
+	entries, err := filepath.Glob(filepath.Join(imageFolder, service.DefaultTenant, "[^.]*"))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestClientExpiredTokenOnPublicMethod(t *testing.T) {
+	t.Parallel()
+
+	tenants := service.NewInMemoryTenantStore(service.NewTenantFactory(t.TempDir(), ""))
+	defaultTenant, err := tenants.Create(context.Background(), service.DefaultTenant)
+	require.NoError(t, err)
+	require.NoError(t, defaultTenant.LaptopStore.Save(context.Background(), sample.NewLaptop()))
+
+	admin, err := service.NewUser("admin1", "secret", "admin")
+	require.NoError(t, err)
+
+	// signed with the secret of the server, but expired
+	accessToken, err := service.NewJWTManager("secret", -time.Minute).Generate(admin)
+	require.NoError(t, err)
+
+	serverAddress := startTestTenantServer(t, tenants, defaultTenant)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	laptopClient := pb.NewLaptopServiceClient(conn)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", accessToken)
+
+	// a public method is called anonymously
+	require.Equal(t, 1, searchCount(t, laptopClient, ctx))
+
+	// a restricted method still needs a valid token
+	_, err = laptopClient.CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestClientAuthErrorReasons(t *testing.T) {
+	t.Parallel()
+
+	tenants := service.NewInMemoryTenantStore(service.NewTenantFactory(t.TempDir(), ""))
+	defaultTenant, err := tenants.Create(context.Background(), service.DefaultTenant)
+	require.NoError(t, err)
+	acme, err := tenants.Create(context.Background(), "acme")
+	require.NoError(t, err)
+
+	for _, tenant := range []*service.Tenant{defaultTenant, acme} {
+		admin, err := service.NewUser("admin1", "secret", "admin")
+		require.NoError(t, err)
+		require.NoError(t, tenant.UserStore.Save(context.Background(), admin))
+	}
+
+	serverAddress := startTestTenantServer(t, tenants, defaultTenant)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// a wrong password and an unknown tenant fail the same way
+	for _, tenantID := range []string{"acme", "initech"} {
+		_, err = client.NewTenantAuthClient(conn, tenantID, "admin1", "wrong").Login(context.Background())
+		var clientErr *client.Error
+		require.ErrorAs(t, err, &clientErr)
+		require.Equal(t, codes.NotFound, status.Code(err))
+		require.Equal(t, service.ReasonInvalidCredentials, clientErr.Reason)
+	}
+
+	authClient := pb.NewAuthServiceClient(conn)
+	accessToken, err := client.NewTenantAuthClient(conn, "acme", "admin1", "secret").Login(context.Background())
+	require.NoError(t, err)
+	acmeAdmin := metadata.AppendToOutgoingContext(context.Background(), "authorization", accessToken)
+
+	_, err = authClient.ListTenants(acmeAdmin, &pb.ListTenantsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Equal(t, service.ReasonPermissionDenied, errorReason(err))
+
+	_, err = authClient.UpdateUserRole(acmeAdmin, &pb.UpdateUserRoleRequest{Username: "admin2", Role: "user"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	require.Equal(t, service.ReasonUserNotFound, errorReason(err))
+
+	_, err = authClient.CreateUser(acmeAdmin, &pb.CreateUserRequest{Username: "admin1", Password: "secret", Role: "admin"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	require.Equal(t, service.ReasonUserAlreadyExists, errorReason(err))
+
+	_, err = authClient.CreateUser(acmeAdmin, &pb.CreateUserRequest{Username: "user1", Role: "user"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Equal(t, service.ReasonInvalidArgument, errorReason(err))
+
+	// the tenant of the token doesn't exist on a server with other tenants
+	otherTenants := service.NewInMemoryTenantStore(service.NewTenantFactory(t.TempDir(), ""))
+	_, err = startTestAuthServer(t, otherTenants).RefreshToken(acmeAdmin, &pb.RefreshTokenRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Equal(t, service.ReasonTenantNotFound, errorReason(err))
+
+	// the user of the token doesn't exist anymore
+	_, err = otherTenants.Create(context.Background(), "acme")
+	require.NoError(t, err)
+	_, err = startTestAuthServer(t, otherTenants).RefreshToken(acmeAdmin, &pb.RefreshTokenRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.Equal(t, service.ReasonTokenInvalid, errorReason(err))
+}
+
+// startTestAuthServer starts an auth server of the tenants, with the secret of startTestTenantServer
+func startTestAuthServer(t *testing.T, tenants service.TenantStore) pb.AuthServiceClient {
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(service.NewAuthInterceptor(jwtManager, nil).Unary()))
+	pb.RegisterAuthServiceServer(grpcServer, service.NewAuthServer(nil, jwtManager, service.WithAuthTenants(tenants)))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewAuthServiceClient(conn)
+}
+
+// errorReason returns the reason of the ErrorInfo detail of the error
+func errorReason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if errorInfo, ok := detail.(*errdetails.ErrorInfo); ok {
+			return errorInfo.GetReason()
+		}
+	}
+	return ""
+}
+
+func searchCount(t *testing.T, laptopClient pb.LaptopServiceClient, ctx context.Context) int {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	stream, err := laptopClient.SearchLaptop(ctx, &pb.SearchLaptopRequest{Filter: &pb.Filter{MaxPriceUsd: 1e9}})
+	require.NoError(t, err)
+
+	count := 0
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			return count
+		}
+		require.NoError(t, err)
+		count++
+	}
+}
+
+func startTestTenantServer(t *testing.T, tenants service.TenantStore, defaultTenant *service.Tenant) string {
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	interceptor := service.NewAuthInterceptor(jwtManager, map[string][]string{
+		"/pb.AuthService/ListUsers":           {"admin"},
+		"/pb.AuthService/CreateTenant":        {"admin"},
+		"/pb.AuthService/ListTenants":         {"admin"},
+		"/pb.LaptopService/CreateLaptop":      {"admin"},
+		"/pb.LaptopService/UploadImage":       {"admin"},
+		"/pb.LaptopService/BulkCreateLaptops": {"admin"},
+	})
+
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()),
+	)
+	pb.RegisterAuthServiceServer(grpcServer, service.NewAuthServer(
+		defaultTenant.UserStore, jwtManager, service.WithAuthTenants(tenants),
+	))
+	pb.RegisterLaptopServiceServer(grpcServer, service.NewLaptopService(
+		defaultTenant.LaptopStore, defaultTenant.ImageStore, defaultTenant.RatingStore, service.WithTenants(tenants),
+	))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	return listener.Addr().String()
+}
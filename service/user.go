@@ -1,16 +1,33 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Roles of the users
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// ErrInvalidRole is returned when a role is not one of the known roles
+var ErrInvalidRole = errors.New(`role must be "admin" or "user"`)
+
+// isValidRole tells whether the role is one of the known roles
+func isValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleUser
+}
+
 // User contains user's information
 type User struct {
 	Username       string
 	HashedPassword string
 	Role           string
+	// TenantID is the tenant of the user, an empty ID is the default tenant
+	TenantID string
 }
 
 // NewUser returns a new User
@@ -41,5 +58,6 @@ func (user *User) Clone() *User {
 		Username:       user.Username,
 		HashedPassword: user.HashedPassword,
 		Role:           user.Role,
+		TenantID:       user.TenantID,
 	}
 }
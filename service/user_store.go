@@ -1,13 +1,24 @@
 package service
 
-import "sync"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
 
 // UserStore is an interface to store users
 type UserStore interface {
 	// Save saves a user to the store
-	Save(user *User) error
+	Save(ctx context.Context, user *User) error
+	// Update replaces an existing user in the store
+	Update(ctx context.Context, user *User) error
 	// Find finds a user by username
-	Find(username string) (*User, error)
+	Find(ctx context.Context, username string) (*User, error)
+	// List returns all users sorted by username
+	List(ctx context.Context) ([]*User, error)
 }
 
 // InMemoryUserStore stores user in memory
@@ -23,7 +34,7 @@ func NewInMemoryUserStore() *InMemoryUserStore {
 }
 
 // Save saves a user to the store
-func (store *InMemoryUserStore) Save(user *User) error {
+func (store *InMemoryUserStore) Save(ctx context.Context, user *User) error {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
@@ -35,11 +46,160 @@ func (store *InMemoryUserStore) Save(user *User) error {
 	return nil
 }
 
+// Update replaces an existing user in the store
+func (store *InMemoryUserStore) Update(ctx context.Context, user *User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.users[user.Username] == nil {
+		return ErrNotFound
+	}
+
+	store.users[user.Username] = user.Clone()
+	return nil
+}
+
 // Find finds a user by username
-func (store *InMemoryUserStore) Find(username string) (*User, error) {
+func (store *InMemoryUserStore) Find(ctx context.Context, username string) (*User, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	user := store.users[username]
+	if user == nil {
+		return nil, nil
+	}
+
+	return user.Clone(), nil
+}
+
+// List returns all users sorted by username
+func (store *InMemoryUserStore) List(ctx context.Context) ([]*User, error) {
 	store.mutex.RLock()
 	defer store.mutex.RUnlock()
 
+	users := make([]*User, 0, len(store.users))
+	for _, user := range store.users {
+		users = append(users, user.Clone())
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	return users, nil
+}
+
+// userJournalName is the file of the users in the folder of a tenant, one saved or updated user per line
+const userJournalName = ".users"
+
+// DiskUserStore stores users in a journal of a folder, so that they survive a restart
+// and are shared by the servers using the folder. Every saved or updated user is appended
+// while the server holds the lock of the folder, after it has read the users appended by the others.
+type DiskUserStore struct {
+	mutex   sync.Mutex
+	journal *diskJournal
+	users   map[string]*User
+}
+
+// userRecord is a user in the journal
+type userRecord struct {
+	Username       string `json:"username"`
+	HashedPassword string `json:"hashed_password"`
+	Role           string `json:"role"`
+	TenantID       string `json:"tenant_id,omitempty"`
+}
+
+// NewDiskUserStore returns a new DiskUserStore with the users of the journal of the folder
+func NewDiskUserStore(folder string) (*DiskUserStore, error) {
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create user folder: %w", err)
+	}
+
+	journal, err := openDiskJournal(folder, userJournalName)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &DiskUserStore{
+		journal: journal,
+		users:   make(map[string]*User),
+	}
+
+	err = journal.withLock(store.read)
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Save saves a user to the store
+func (store *DiskUserStore) Save(ctx context.Context, user *User) error {
+	return store.write(ctx, user, func(exists bool) error {
+		if exists {
+			return ErrAlreadyExists
+		}
+		return nil
+	})
+}
+
+// Update replaces an existing user in the store
+func (store *DiskUserStore) Update(ctx context.Context, user *User) error {
+	return store.write(ctx, user, func(exists bool) error {
+		if !exists {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+// write appends the user to the journal if check accepts whether the user exists
+func (store *DiskUserStore) write(ctx context.Context, user *User, check func(exists bool) error) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return store.journal.withLock(func() error {
+		err := store.read()
+		if err != nil {
+			return err
+		}
+
+		err = check(store.users[user.Username] != nil)
+		if err != nil {
+			return err
+		}
+
+		err = store.journal.append(&userRecord{
+			Username:       user.Username,
+			HashedPassword: user.HashedPassword,
+			Role:           user.Role,
+			TenantID:       user.TenantID,
+		})
+		if err != nil {
+			return fmt.Errorf("cannot write user journal: %w", err)
+		}
+
+		store.users[user.Username] = user.Clone()
+		return nil
+	})
+}
+
+// Find finds a user by username
+func (store *DiskUserStore) Find(ctx context.Context, username string) (*User, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err := store.sync()
+	if err != nil {
+		return nil, err
+	}
+
 	user := store.users[username]
 	if user == nil {
 		return nil, nil
@@ -47,3 +207,59 @@ func (store *InMemoryUserStore) Find(username string) (*User, error) {
 
 	return user.Clone(), nil
 }
+
+// List returns all users sorted by username
+func (store *DiskUserStore) List(ctx context.Context) ([]*User, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err := store.sync()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]*User, 0, len(store.users))
+	for _, user := range store.users {
+		users = append(users, user.Clone())
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	return users, nil
+}
+
+// sync reads the users appended by the other servers, it costs a single stat when there is none
+func (store *DiskUserStore) sync() error {
+	changed, err := store.journal.changed()
+	if err != nil || !changed {
+		return err
+	}
+
+	return store.journal.withLock(store.read)
+}
+
+// read reads the users appended to the journal since it was last read, it must be called with the lock held
+func (store *DiskUserStore) read() error {
+	reset := func() error {
+		store.users = make(map[string]*User)
+		return nil
+	}
+
+	return store.journal.read(reset, func(data []byte) error {
+		record := &userRecord{}
+		err := json.Unmarshal(data, record)
+		if err != nil {
+			return err
+		}
+
+		store.users[record.Username] = &User{
+			Username:       record.Username,
+			HashedPassword: record.HashedPassword,
+			Role:           record.Role,
+			TenantID:       record.TenantID,
+		}
+		return nil
+	})
+}